@@ -1,19 +1,66 @@
 package core
 
-type Row struct {
-	Id       int
-	Username [32]byte
-	Email    [256]byte
-}
+import "toydb-go/sql"
 
 type StatementType int
 
 const (
 	STATEMENT_INSERT StatementType = iota + 1
 	STATEMENT_SELECT
+	STATEMENT_CREATE_TABLE
+	STATEMENT_UPDATE
+	STATEMENT_DELETE
+	STATEMENT_BEGIN
+	STATEMENT_COMMIT
+	STATEMENT_ROLLBACK
+	STATEMENT_CREATE_INDEX
+	// PREPARE文とDEALLOCATE文。準備するときにセッションに登録・削除するので、実行することはない
+	STATEMENT_PREPARE
+	STATEMENT_DEALLOCATE
+)
+
+// EXPLAIN文の種類
+type ExplainKind int
+
+const (
+	// 演算子の木を表示する
+	EXPLAIN_QUERY_PLAN ExplainKind = iota + 1
+	// ステートメントを実行して、演算子ごとの統計と一緒に演算子の木を表示する
+	EXPLAIN_ANALYZE
 )
 
 type Statement struct {
-	Type        StatementType
-	RowToInsert Row // insert only
+	Type StatementType
+	// EXPLAIN文の場合は、その種類。Typeは説明するステートメントの種類になる
+	Explain ExplainKind
+	// 対象のテーブル名。チュートリアル形式（insert 1 name email、select）の場合は空
+	TableName string
+	// insert only: テーブルのカラムの順番に並べた値
+	Values []Value
+	// insert only: 同じキーの行がある場合は置き換える
+	Upsert bool
+	// select, update, delete only: WHERE句の条件。省略した場合はnil
+	Where sql.Expr
+	// select only: 結果のカラムの式。*はテーブルのカラムに展開する
+	Columns []sql.Expr
+	// select only: 結果のカラム名。別名があれば別名、なければ式を文字列に戻したもの
+	ColumnNames []string
+	// select only: GROUP BY句
+	GroupBy []sql.Expr
+	// select only: HAVING句の条件。省略した場合はnil
+	Having sql.Expr
+	// select only: ORDER BY句。別名と位置（ORDER BY 2）は、結果のカラムの式に置き換える
+	OrderBy []sql.OrderingTerm
+	// select only: 返す行数の上限。負の場合は制限しない
+	Limit int64
+	// select only: 読み飛ばす行数
+	Offset int64
+	// update only: SET句
+	Set []sql.Assignment
+	// update only: SET句のカラムの、テーブルでのインデックス
+	SetColumns []int
+	// create table only
+	CreateTable *sql.CreateTableStmt
+	// create index only
+	CreateIndex *sql.CreateIndexStmt
 }
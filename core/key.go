@@ -0,0 +1,145 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// 値を、バイト列の大小（bytes.Compare）がCompareの順番と一致するキーにエンコードする。
+//
+//	キー = 種類(1バイト) + 中身
+//
+// 中身は、NULLは空。数値は、float64の順番を保つ8バイトの後ろに、REALは0x00、INTEGERは0x01とint64の順番を保つ8バイトを続ける。
+// float64にすると同じになる大きな整数も、整数の順番に並ぶ。
+// TEXTとBLOBは、0x00を0x00 0xFFにエスケープしたバイト列の後ろに、終わりを表す0x00 0x00を続ける。
+// 短い方が先に並び、キーの後ろに別のバイト列をつなげても順番は変わらない
+
+// Key Value Type
+const (
+	KEY_NULL byte = iota + 1
+	KEY_NUMBER
+	KEY_TEXT
+	KEY_BLOB
+)
+
+// 数値のキーで、float64の8バイトの後ろにつける印
+const (
+	KEY_REAL_MARKER    byte = 0x00
+	KEY_INTEGER_MARKER byte = 0x01
+)
+
+// 数値のキーのうち、float64の8バイトまでの長さ
+const KEY_NUMBER_PREFIX_SIZE = 1 + 8
+
+var ErrMalformedKey = errors.New("malformed key")
+
+// 値をキーにエンコードして、bufの後ろに追加する
+func AppendKey(buf []byte, value Value) []byte {
+	switch value.Type {
+	case VALUE_INTEGER:
+		buf = appendNumberPrefix(buf, float64(value.Integer))
+		buf = append(buf, KEY_INTEGER_MARKER)
+		return binary.BigEndian.AppendUint64(buf, uint64(value.Integer)^(1<<63))
+	case VALUE_REAL:
+		buf = appendNumberPrefix(buf, value.Real)
+		return append(buf, KEY_REAL_MARKER)
+	case VALUE_TEXT:
+		return appendKeyBytes(append(buf, KEY_TEXT), []byte(value.Text))
+	case VALUE_BLOB:
+		return appendKeyBytes(append(buf, KEY_BLOB), value.Blob)
+	default:
+		return append(buf, KEY_NULL)
+	}
+}
+
+// 数値のキーの、種類とfloat64の8バイトを追加する。
+// 負の数は全てのビットを反転し、0以上の数は符号ビットを立てると、符号なし整数の順番がfloat64の順番になる
+func appendNumberPrefix(buf []byte, v float64) []byte {
+	if v == 0 {
+		// -0と0を同じキーにする
+		v = 0
+	}
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(append(buf, KEY_NUMBER), bits)
+}
+
+// TEXTとBLOBの中身を、エスケープして追加する
+func appendKeyBytes(buf []byte, b []byte) []byte {
+	for {
+		i := bytes.IndexByte(b, 0x00)
+		if i < 0 {
+			break
+		}
+		buf = append(buf, b[:i]...)
+		buf = append(buf, 0x00, 0xFF)
+		b = b[i+1:]
+	}
+	buf = append(buf, b...)
+	return append(buf, 0x00, 0x00)
+}
+
+// キーの先頭の値をデコードして、値と残りのバイト列を返す
+func DecodeKey(key []byte) (Value, []byte, error) {
+	if len(key) == 0 {
+		return Value{}, nil, ErrMalformedKey
+	}
+
+	switch key[0] {
+	case KEY_NULL:
+		return NullValue(), key[1:], nil
+	case KEY_NUMBER:
+		if len(key) < KEY_NUMBER_PREFIX_SIZE+1 {
+			return Value{}, nil, ErrMalformedKey
+		}
+		switch key[KEY_NUMBER_PREFIX_SIZE] {
+		case KEY_REAL_MARKER:
+			bits := binary.BigEndian.Uint64(key[1:])
+			if bits&(1<<63) != 0 {
+				bits &^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			return RealValue(math.Float64frombits(bits)), key[KEY_NUMBER_PREFIX_SIZE+1:], nil
+		case KEY_INTEGER_MARKER:
+			rest := key[KEY_NUMBER_PREFIX_SIZE+1:]
+			if len(rest) < 8 {
+				return Value{}, nil, ErrMalformedKey
+			}
+			return IntegerValue(int64(binary.BigEndian.Uint64(rest) ^ (1 << 63))), rest[8:], nil
+		default:
+			return Value{}, nil, ErrMalformedKey
+		}
+	case KEY_TEXT, KEY_BLOB:
+		var b []byte
+		rest := key[1:]
+		for {
+			i := bytes.IndexByte(rest, 0x00)
+			if i < 0 || i+1 >= len(rest) {
+				return Value{}, nil, ErrMalformedKey
+			}
+			b = append(b, rest[:i]...)
+			escape := rest[i+1]
+			rest = rest[i+2:]
+			if escape == 0x00 {
+				break
+			}
+			if escape != 0xFF {
+				return Value{}, nil, ErrMalformedKey
+			}
+			b = append(b, 0x00)
+		}
+		if key[0] == KEY_TEXT {
+			return TextValue(string(b)), rest, nil
+		}
+		return BlobValue(append([]byte{}, b...)), rest, nil
+	default:
+		return Value{}, nil, ErrMalformedKey
+	}
+}
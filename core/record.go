@@ -0,0 +1,103 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// 値の並びを、バイト列（レコード）にエンコードする。
+//
+//	レコード = 値の数(uvarint) + 値 * 値の数
+//	値 = 型(1バイト) + 中身
+//
+// 中身は、INTEGERはzigzag形式のvarint、REALは8バイト、TEXTとBLOBは長さ(uvarint) + バイト列、NULLは空。
+
+// Record Value Type
+const (
+	RECORD_NULL byte = iota
+	RECORD_INTEGER
+	RECORD_REAL
+	RECORD_TEXT
+	RECORD_BLOB
+)
+
+var ErrMalformedRecord = errors.New("malformed record")
+
+// 値の並びをレコードにエンコードして、bufの後ろに追加する
+func AppendRecord(buf []byte, values []Value) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(values)))
+
+	for _, value := range values {
+		switch value.Type {
+		case VALUE_INTEGER:
+			buf = append(buf, RECORD_INTEGER)
+			buf = binary.AppendVarint(buf, value.Integer)
+		case VALUE_REAL:
+			buf = append(buf, RECORD_REAL)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(value.Real))
+		case VALUE_TEXT:
+			buf = append(buf, RECORD_TEXT)
+			buf = binary.AppendUvarint(buf, uint64(len(value.Text)))
+			buf = append(buf, value.Text...)
+		case VALUE_BLOB:
+			buf = append(buf, RECORD_BLOB)
+			buf = binary.AppendUvarint(buf, uint64(len(value.Blob)))
+			buf = append(buf, value.Blob...)
+		default:
+			buf = append(buf, RECORD_NULL)
+		}
+	}
+	return buf
+}
+
+// レコードをデコードする
+func DecodeRecord(record []byte) ([]Value, error) {
+	numValues, n := binary.Uvarint(record)
+	if n <= 0 || numValues > uint64(len(record)) {
+		return nil, ErrMalformedRecord
+	}
+	record = record[n:]
+
+	values := make([]Value, 0, numValues)
+	for i := uint64(0); i < numValues; i++ {
+		if len(record) == 0 {
+			return nil, ErrMalformedRecord
+		}
+		valueType := record[0]
+		record = record[1:]
+
+		switch valueType {
+		case RECORD_NULL:
+			values = append(values, NullValue())
+		case RECORD_INTEGER:
+			v, n := binary.Varint(record)
+			if n <= 0 {
+				return nil, ErrMalformedRecord
+			}
+			values = append(values, IntegerValue(v))
+			record = record[n:]
+		case RECORD_REAL:
+			if len(record) < 8 {
+				return nil, ErrMalformedRecord
+			}
+			values = append(values, RealValue(math.Float64frombits(binary.LittleEndian.Uint64(record))))
+			record = record[8:]
+		case RECORD_TEXT, RECORD_BLOB:
+			length, n := binary.Uvarint(record)
+			if n <= 0 || uint64(len(record)-n) < length {
+				return nil, ErrMalformedRecord
+			}
+			bytes := record[n : n+int(length)]
+			if valueType == RECORD_TEXT {
+				values = append(values, TextValue(string(bytes)))
+			} else {
+				values = append(values, BlobValue(append([]byte{}, bytes...)))
+			}
+			record = record[n+int(length):]
+		default:
+			return nil, ErrMalformedRecord
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+type ValueType int
+
+const (
+	// ゼロ値はNULLにする
+	VALUE_NULL ValueType = iota
+	VALUE_INTEGER
+	VALUE_REAL
+	VALUE_TEXT
+	VALUE_BLOB
+)
+
+// 行に含まれる1つの値。Typeに対応するフィールドだけを使う
+type Value struct {
+	Type    ValueType
+	Integer int64
+	Real    float64
+	Text    string
+	Blob    []byte
+}
+
+func NullValue() Value {
+	return Value{Type: VALUE_NULL}
+}
+
+func IntegerValue(v int64) Value {
+	return Value{Type: VALUE_INTEGER, Integer: v}
+}
+
+func RealValue(v float64) Value {
+	return Value{Type: VALUE_REAL, Real: v}
+}
+
+func TextValue(v string) Value {
+	return Value{Type: VALUE_TEXT, Text: v}
+}
+
+func BlobValue(v []byte) Value {
+	return Value{Type: VALUE_BLOB, Blob: v}
+}
+
+func (v Value) IsNull() bool {
+	return v.Type == VALUE_NULL
+}
+
+// 表示用の文字列を返す
+func (v Value) String() string {
+	switch v.Type {
+	case VALUE_INTEGER:
+		return strconv.FormatInt(v.Integer, 10)
+	case VALUE_REAL:
+		s := strconv.FormatFloat(v.Real, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEIN") {
+			// 整数と区別できるように、小数点をつける
+			s += ".0"
+		}
+		return s
+	case VALUE_TEXT:
+		return v.Text
+	case VALUE_BLOB:
+		return "x'" + hex.EncodeToString(v.Blob) + "'"
+	default:
+		return "NULL"
+	}
+}
+
+// 型の名前を返す
+func (t ValueType) String() string {
+	switch t {
+	case VALUE_INTEGER:
+		return "INTEGER"
+	case VALUE_REAL:
+		return "REAL"
+	case VALUE_TEXT:
+		return "TEXT"
+	case VALUE_BLOB:
+		return "BLOB"
+	default:
+		return "NULL"
+	}
+}
+
+// 型ごとの並び順。NULL < 数値 < TEXT < BLOB
+func typeOrder(t ValueType) int {
+	switch t {
+	case VALUE_NULL:
+		return 0
+	case VALUE_INTEGER, VALUE_REAL:
+		return 1
+	case VALUE_TEXT:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// 数値をfloat64で返す
+func (v Value) float() float64 {
+	if v.Type == VALUE_INTEGER {
+		return float64(v.Integer)
+	}
+	return v.Real
+}
+
+// 2つの値を比較する。a < bなら負、a == bなら0、a > bなら正を返す。
+// 型が違う場合は、NULL < 数値 < TEXT < BLOBの順に並べる
+func Compare(a Value, b Value) int {
+	if oa, ob := typeOrder(a.Type), typeOrder(b.Type); oa != ob {
+		return oa - ob
+	}
+
+	switch a.Type {
+	case VALUE_NULL:
+		return 0
+	case VALUE_INTEGER, VALUE_REAL:
+		if a.Type == VALUE_INTEGER && b.Type == VALUE_INTEGER {
+			switch {
+			case a.Integer < b.Integer:
+				return -1
+			case a.Integer > b.Integer:
+				return 1
+			default:
+				return 0
+			}
+		}
+		fa, fb := a.float(), b.float()
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		default:
+			return 0
+		}
+	case VALUE_TEXT:
+		return strings.Compare(a.Text, b.Text)
+	default:
+		return bytes.Compare(a.Blob, b.Blob)
+	}
+}
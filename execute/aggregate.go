@@ -0,0 +1,352 @@
+package execute
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"toydb-go/core"
+	"toydb-go/sql"
+	db "toydb-go/table"
+)
+
+// 集約関数
+var aggregateFunctions = map[string]bool{
+	"COUNT": true,
+	"SUM":   true,
+	"AVG":   true,
+	"MIN":   true,
+	"MAX":   true,
+}
+
+var ErrIntegerOverflow = errors.New("integer overflow")
+
+// 関数名と引数の数を確認する。関数は集約関数だけ使える
+func checkFunction(call *sql.FuncCall) error {
+	if !aggregateFunctions[call.Name] {
+		return fmt.Errorf("no such function: %s", call.Name)
+	}
+	// COUNT(*) 以外は、引数を1つとる
+	if call.Star && call.Name != "COUNT" || !call.Star && len(call.Args) != 1 {
+		return fmt.Errorf("wrong number of arguments to function %s()", call.Name)
+	}
+	return nil
+}
+
+// 式が集約関数を含むならtrue
+func ContainsAggregate(expr sql.Expr) bool {
+	found := false
+	walkFuncCalls(expr, func(call *sql.FuncCall) { found = true })
+	return found
+}
+
+// 式に含まれる関数呼び出しを、外側から順番にfnに渡す。関数の引数の中は見ない
+func walkFuncCalls(expr sql.Expr, fn func(call *sql.FuncCall)) {
+	switch expr := expr.(type) {
+	case *sql.FuncCall:
+		fn(expr)
+	case *sql.UnaryExpr:
+		walkFuncCalls(expr.X, fn)
+	case *sql.BinaryExpr:
+		walkFuncCalls(expr.X, fn)
+		walkFuncCalls(expr.Y, fn)
+	case *sql.InExpr:
+		walkFuncCalls(expr.X, fn)
+		for _, item := range expr.List {
+			walkFuncCalls(item, fn)
+		}
+	case *sql.BetweenExpr:
+		walkFuncCalls(expr.X, fn)
+		walkFuncCalls(expr.Low, fn)
+		walkFuncCalls(expr.High, fn)
+	case *sql.IsNullExpr:
+		walkFuncCalls(expr.X, fn)
+	}
+}
+
+// 集約するSELECT文ならtrue。GROUP BY句かHAVING句があるか、結果やORDER BY句に集約関数がある
+func isAggregateQuery(statement core.Statement) bool {
+	if len(statement.GroupBy) > 0 || statement.Having != nil {
+		return true
+	}
+	for _, expr := range statement.Columns {
+		if ContainsAggregate(expr) {
+			return true
+		}
+	}
+	for _, term := range statement.OrderBy {
+		if ContainsAggregate(term.Expr) {
+			return true
+		}
+	}
+	return false
+}
+
+// 1つの集約関数の途中の状態
+type aggregateState struct {
+	call *sql.FuncCall
+	// NULLでない値の数（COUNT(*)の場合は行数）
+	count int64
+	// SUM / AVGの合計。整数だけの間はsumInteger、小数が出たらsumRealで計算する
+	sumInteger int64
+	sumReal    float64
+	isReal     bool
+	// MIN / MAXの値
+	value core.Value
+}
+
+// 行を1つ集約する
+func (s *aggregateState) step(row rowContext) error {
+	if s.call.Star {
+		s.count++
+		return nil
+	}
+	v, err := eval(s.call.Args[0], row)
+	if err != nil || v.IsNull() {
+		return err
+	}
+	s.count++
+
+	switch s.call.Name {
+	case "SUM", "AVG":
+		switch v.Type {
+		case core.VALUE_INTEGER:
+			if !s.isReal {
+				sum := s.sumInteger + v.Integer
+				if (sum > s.sumInteger) != (v.Integer > 0) {
+					return fmt.Errorf("%w in %s()", ErrIntegerOverflow, s.call.Name)
+				}
+				s.sumInteger = sum
+			}
+			s.sumReal += float64(v.Integer)
+		case core.VALUE_REAL:
+			s.isReal = true
+			s.sumReal += v.Real
+		default:
+			return fmt.Errorf("%w: %s(%s)", ErrTypeMismatch, s.call.Name, v.Type)
+		}
+	case "MIN":
+		if s.count == 1 || core.Compare(v, s.value) < 0 {
+			s.value = v
+		}
+	case "MAX":
+		if s.count == 1 || core.Compare(v, s.value) > 0 {
+			s.value = v
+		}
+	}
+	return nil
+}
+
+// 集約した結果を返す。COUNT以外は、NULLでない値がなければNULLになる
+func (s *aggregateState) result() core.Value {
+	if s.call.Name == "COUNT" {
+		return core.IntegerValue(s.count)
+	}
+	if s.count == 0 {
+		return core.NullValue()
+	}
+	switch s.call.Name {
+	case "SUM":
+		if s.isReal {
+			return core.RealValue(s.sumReal)
+		}
+		return core.IntegerValue(s.sumInteger)
+	case "AVG":
+		return core.RealValue(s.sumReal / float64(s.count))
+	default:
+		return s.value
+	}
+}
+
+// GROUP BYの1つのグループ
+type group struct {
+	// グループの最初の行。集約関数の外にあるカラムは、この行の値になる
+	row    []core.Value
+	states []*aggregateState
+}
+
+// グループを見分けるキー。1と1.0は同じグループにする
+func groupKey(values []core.Value) string {
+	normalized := make([]core.Value, len(values))
+	for i, v := range values {
+		if v.Type == core.VALUE_REAL && v.Real == math.Trunc(v.Real) && math.Abs(v.Real) < 1<<63 {
+			v = core.IntegerValue(int64(v.Real))
+		}
+		normalized[i] = v
+	}
+	return string(core.AppendRecord(nil, normalized))
+}
+
+// COUNT(*) だけを求めるSELECT文ならtrue。行をデコードせずに、B-treeのセルの数から答えられる
+func isCountStar(statement core.Statement) bool {
+	if statement.Where != nil || len(statement.GroupBy) > 0 || statement.Having != nil || len(statement.OrderBy) > 0 || len(statement.Columns) != 1 {
+		return false
+	}
+	call, ok := statement.Columns[0].(*sql.FuncCall)
+	return ok && call.Name == "COUNT" && call.Star
+}
+
+// 集約するSELECT文の、グループごとの行を返す演算子を作る。HAVING句の条件を満たさないグループは除く
+func aggregateOperator(statement core.Statement, table *db.Table) operator {
+	if isCountStar(statement) {
+		return &countRows{table: table, call: statement.Columns[0].(*sql.FuncCall)}
+	}
+
+	var calls []*sql.FuncCall
+	collect := func(call *sql.FuncCall) { calls = append(calls, call) }
+	for _, expr := range statement.Columns {
+		walkFuncCalls(expr, collect)
+	}
+	walkFuncCalls(statement.Having, collect)
+	for _, term := range statement.OrderBy {
+		walkFuncCalls(term.Expr, collect)
+	}
+
+	var op operator = &aggregate{
+		child:   scanOperator(table, statement.Where, false),
+		schema:  table.Schema(),
+		groupBy: statement.GroupBy,
+		calls:   calls,
+	}
+	if statement.Having != nil {
+		op = &filter{child: op, cond: statement.Having}
+	}
+	return op
+}
+
+// 集約関数を計算する演算子。Openで子の行を全て読み、ハッシュでグループに分けて集約する。
+// Nextはグループごとに、グループの最初の行と集約関数の値を返す
+type aggregate struct {
+	child   operator
+	schema  *db.Schema
+	groupBy []sql.Expr
+	// 結果、HAVING句、ORDER BY句に含まれる集約関数
+	calls []*sql.FuncCall
+	// 最初に現れた順に並べたグループと、次に返すグループの位置
+	groups []*group
+	pos    int
+}
+
+func (op *aggregate) newGroup(row []core.Value) *group {
+	g := &group{row: row}
+	for _, call := range op.calls {
+		g.states = append(g.states, &aggregateState{call: call})
+	}
+	return g
+}
+
+func (op *aggregate) Open() error {
+	op.groups, op.pos = nil, 0
+	if err := op.child.Open(); err != nil {
+		return err
+	}
+
+	groups := map[string]*group{}
+	for {
+		row, err := op.child.Next()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			break
+		}
+		keys, err := evalList(op.groupBy, *row)
+		if err != nil {
+			return err
+		}
+		g, ok := groups[groupKey(keys)]
+		if !ok {
+			g = op.newGroup(row.values)
+			groups[groupKey(keys)] = g
+			op.groups = append(op.groups, g)
+		}
+		for _, state := range g.states {
+			if err := state.step(*row); err != nil {
+				return err
+			}
+		}
+	}
+	// GROUP BY句がなければ、行がなくても1つのグループになる
+	if len(op.groupBy) == 0 && len(op.groups) == 0 {
+		op.groups = append(op.groups, op.newGroup(make([]core.Value, len(op.schema.Columns))))
+	}
+	return nil
+}
+
+func (op *aggregate) Next() (*rowContext, error) {
+	if op.pos >= len(op.groups) {
+		return nil, nil
+	}
+	g := op.groups[op.pos]
+	op.pos++
+
+	aggregates := map[*sql.FuncCall]core.Value{}
+	for _, state := range g.states {
+		aggregates[state.call] = state.result()
+	}
+	return &rowContext{schema: op.schema, values: g.row, aggregates: aggregates}, nil
+}
+
+func (op *aggregate) Close() {
+	op.groups = nil
+	op.child.Close()
+}
+
+func (op *aggregate) explain() string {
+	text := "AGGREGATE"
+	// 結果とHAVING句に同じ集約関数を書いた場合も、1つだけ表示する
+	var calls []sql.Expr
+	seen := map[string]bool{}
+	for _, call := range op.calls {
+		if name := sql.FormatExpr(call); !seen[name] {
+			seen[name] = true
+			calls = append(calls, call)
+		}
+	}
+	if len(calls) > 0 {
+		text += " " + formatExprList(calls)
+	}
+	if len(op.groupBy) > 0 {
+		text += " GROUP BY " + formatExprList(op.groupBy)
+	}
+	return text
+}
+
+func (op *aggregate) children() []*operator {
+	return []*operator{&op.child}
+}
+
+// COUNT(*) だけを求める演算子。行をデコードせずに、B-treeのセルの数から答える
+type countRows struct {
+	table *db.Table
+	call  *sql.FuncCall
+	done  bool
+}
+
+func (op *countRows) Open() error {
+	op.done = false
+	return nil
+}
+
+func (op *countRows) Next() (*rowContext, error) {
+	if op.done {
+		return nil, nil
+	}
+	op.done = true
+	schema := op.table.Schema()
+	count := core.IntegerValue(int64(op.table.CountRows()))
+	return &rowContext{
+		schema:     schema,
+		values:     make([]core.Value, len(schema.Columns)),
+		aggregates: map[*sql.FuncCall]core.Value{op.call: count},
+	}, nil
+}
+
+func (op *countRows) Close() {}
+
+func (op *countRows) explain() string {
+	return fmt.Sprintf("COUNT %s: sum of leaf cell counts from TableFind", op.table.Schema().Name)
+}
+
+func (op *countRows) children() []*operator {
+	return nil
+}
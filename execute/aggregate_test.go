@@ -0,0 +1,54 @@
+package execute
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"toydb-go/core"
+	"toydb-go/sql"
+)
+
+func TestAggregateState(t *testing.T) {
+	schema := testSchema(t)
+	call := func(name string) *sql.FuncCall {
+		return &sql.FuncCall{Name: name, Args: []sql.Expr{&sql.ColumnRef{Name: "score"}}}
+	}
+	scores := []core.Value{core.IntegerValue(3), core.NullValue(), core.RealValue(1.5), core.IntegerValue(-2)}
+
+	tests := []struct {
+		call     *sql.FuncCall
+		expected string
+	}{
+		{&sql.FuncCall{Name: "COUNT", Star: true}, "4"},
+		{call("COUNT"), "3"},
+		{call("SUM"), "2.5"},
+		{call("AVG"), "0.8333333333333334"},
+		{call("MIN"), "-2"},
+		{call("MAX"), "3"},
+	}
+	for _, test := range tests {
+		state := &aggregateState{call: test.call}
+		for _, score := range scores {
+			row := rowContext{schema: schema, values: []core.Value{core.IntegerValue(1), core.TextValue("a"), score}}
+			if err := state.step(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if actual := state.result().String(); actual != test.expected {
+			t.Errorf("%s: expected %s, but got %s", test.call.Name, test.expected, actual)
+		}
+	}
+
+	// 整数の合計があふれたらエラーにする
+	state := &aggregateState{call: call("SUM")}
+	for _, score := range []int64{math.MaxInt64, 1} {
+		err := state.step(rowContext{schema: schema, values: []core.Value{core.IntegerValue(1), core.TextValue("a"), core.IntegerValue(score)}})
+		if score == 1 && !errors.Is(err, ErrIntegerOverflow) {
+			t.Errorf("expected an overflow, but got %v", err)
+		}
+	}
+
+	if groupKey([]core.Value{core.IntegerValue(1)}) != groupKey([]core.Value{core.RealValue(1.0)}) {
+		t.Errorf("expected 1 and 1.0 to be in the same group")
+	}
+}
@@ -1,9 +1,12 @@
 package execute
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"strings"
 	"toydb-go/core"
+	"toydb-go/persistence"
+	"toydb-go/sql"
 	db "toydb-go/table"
 )
 
@@ -14,87 +17,530 @@ type MetaCommandResult int
 const (
 	META_COMMAND_SUCCESS MetaCommandResult = iota + 1
 	META_COMMAND_UNRECOGNIZED_COMMAND
+	// .exitを受け取った。データベースを閉じて終了するのは呼び出し側
+	META_COMMAND_EXIT
 )
 
 const (
 	EXECUTE_SUCCESS ExecuteResult = iota + 1
 	EXECUTE_TABLE_FULL
 	EXECUTE_DUPLICATE_KEY
+	EXECUTE_COMMIT_FAILED
+	EXECUTE_ROW_TOO_LARGE
+	EXECUTE_SCHEMA_TOO_LONG
+	EXECUTE_CORRUPT
+	EXECUTE_UNIQUE_VIOLATION
+	// 式の評価などに失敗した。詳細はエラーで返す
+	EXECUTE_ERROR
 )
 
+// ステートメントの結果を受け取る
+type Output interface {
+	// SELECT文の結果の行。エラーを返すと、読み込みを止めてEXECUTE_ERRORを返す
+	Row(values []core.Value) error
+	// INSERT文、UPDATE文、DELETE文で書き込んだ行数
+	RowsAffected(n int)
+}
+
 // メタコマンドを実行する
-func ExecMetaCommand(command string, table *db.Table) MetaCommandResult {
+func ExecMetaCommand(command string, database *db.Database) MetaCommandResult {
+	args := strings.Fields(command)
 	if command == ".exit" {
-		db.DbClose(table)
-		os.Exit(0)
-		return META_COMMAND_SUCCESS
-	} else if command == ".btree" {
+		return META_COMMAND_EXIT
+	} else if len(args) <= 2 && args[0] == ".btree" {
+		// テーブル名を省略した場合は、チュートリアル形式のテーブルを表示する
+		name := db.DEFAULT_TABLE_NAME
+		if len(args) == 2 {
+			name = args[1]
+		}
+		// インデックスの名前なら、インデックスのB-treeを表示する
+		if index, ok := database.GetIndex(name); ok {
+			fmt.Println("Tree:")
+			db.PrintIndexTree(index)
+			return META_COMMAND_SUCCESS
+		}
+		table, found := database.GetTable(name)
+		if !found {
+			fmt.Printf("Error: no such table: %s.\n", name)
+			return META_COMMAND_SUCCESS
+		}
 		fmt.Println("Tree:")
-		db.PrintTree(table, 0, 0)
+		db.PrintTree(table, table.RootPageNum(), 0)
+		return META_COMMAND_SUCCESS
+	} else if command == ".tables" {
+		for _, table := range database.Tables() {
+			fmt.Println(table.Schema().Name)
+		}
+		return META_COMMAND_SUCCESS
+	} else if command == ".schema" {
+		for _, table := range database.Tables() {
+			fmt.Printf("%s;\n", table.Schema().SQL())
+			for _, index := range table.Indexes() {
+				fmt.Printf("%s;\n", index.SQL())
+			}
+		}
+		return META_COMMAND_SUCCESS
+	} else if command == ".check" {
+		violations := database.CheckIntegrity()
+		if len(violations) == 0 {
+			fmt.Println("ok")
+		}
+		for _, violation := range violations {
+			fmt.Println(violation)
+		}
+		return META_COMMAND_SUCCESS
+	} else if command == ".dbinfo" {
+		info := database.FileInfo()
+		fmt.Printf("format version: %d\n", info.FormatVersion)
+		fmt.Printf("page size: %d\n", info.PageSize)
+		fmt.Printf("page count: %d\n", info.PageCount)
+		fmt.Printf("free pages: %d\n", info.FreePages)
+		fmt.Printf("change counter: %d\n", info.ChangeCounter)
+		fmt.Printf("schema cookie: %d\n", info.SchemaCookie)
 		return META_COMMAND_SUCCESS
 	} else {
 		return META_COMMAND_UNRECOGNIZED_COMMAND
 	}
 }
 
-func bytesToString(bytes []byte) string {
-	var validBytes []byte
-	for _, b := range bytes {
-		if b == 0 {
-			break
+// ステートメントの対象のテーブルを返す。
+// チュートリアル形式の場合はusersテーブルを使い、createがtrueならテーブルがなければ作る
+func getTable(statement core.Statement, database *db.Database, create bool) (*db.Table, bool, error) {
+	if statement.TableName != "" {
+		table, found := database.GetTable(statement.TableName)
+		return table, found, nil
+	}
+
+	table, found := database.GetTable(db.DEFAULT_TABLE_NAME)
+	if found || !create {
+		return table, found, nil
+	}
+	table, err := database.CreateTable(db.DefaultTableStmt())
+	return table, err == nil, err
+}
+
+// 書き込むステートメントの対象のテーブルを返す。準備した後にテーブルがなくなった場合は、エラーを返す
+func getWriteTable(statement core.Statement, database *db.Database, create bool) (*db.Table, ExecuteResult, error) {
+	table, found, err := getTable(statement, database, create)
+	if err != nil {
+		if errors.Is(err, db.ErrSchemaTooLong) {
+			return nil, EXECUTE_SCHEMA_TOO_LONG, err
 		}
-		validBytes = append(validBytes, b)
+		return nil, resultFor(err), err
 	}
-	return string(validBytes)
+	if !found {
+		name := statement.TableName
+		if name == "" {
+			name = db.DEFAULT_TABLE_NAME
+		}
+		return nil, EXECUTE_ERROR, fmt.Errorf("no such table: %s", name)
+	}
+	return table, EXECUTE_SUCCESS, nil
 }
 
-func printRow(row *db.Row) {
-	fmt.Printf("(%d, %s, %s)\n", row.Id, bytesToString(row.Username[:]), bytesToString(row.Email[:]))
+// drainのfnが返すと、エラーにせずに読み込みを止める
+var errStopScan = errors.New("stop scan")
+
+// WHERE句の条件を満たす行を読む演算子を作る。descがtrueの場合は、キーの大きい順に読む。
+// 主キーの範囲が決まる場合は、範囲の端から読む。
+// 主キーの範囲が決まらず、インデックスで値の範囲が決まる場合は、インデックスの値の順番に読む（usesIndex）
+func scanOperator(table *db.Table, where sql.Expr, desc bool) operator {
+	keys := primaryKeyRange(where, table.Schema())
+	var scan operator = &tableScan{table: table, keys: keys, desc: desc}
+	if keys.isFull() {
+		if r := indexRangeFor(where, table); r != nil {
+			scan = &indexScan{table: table, r: r}
+		}
+	}
+	if where == nil {
+		return scan
+	}
+	return &filter{child: scan, cond: where}
+}
+
+// 式のリストを、行について評価する
+func evalList(exprs []sql.Expr, row rowContext) ([]core.Value, error) {
+	values := make([]core.Value, len(exprs))
+	for i, expr := range exprs {
+		v, err := eval(expr, row)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// B-treeの順番（主キーの順番）で読めばORDER BY句の順番になる場合はtrueと、降順かどうかを返す。
+// 主キーは重複しないので、ORDER BY句の最初の項目が主キーなら、残りの項目は順番に影響しない
+func primaryKeyOrder(orderBy []sql.OrderingTerm, schema *db.Schema) (bool, bool) {
+	if len(orderBy) == 0 {
+		return true, false
+	}
+	if isPrimaryKey(orderBy[0].Expr, schema) {
+		return true, orderBy[0].Desc
+	}
+	return false, false
+}
+
+// SELECT文の結果の行を返す演算子を作る。
+// 行を読む演算子の上に、集約、結果のカラムの評価、ソート、LIMIT句の演算子を重ねる
+func selectOperator(statement core.Statement, table *db.Table) operator {
+	orderBy := statement.OrderBy
+	var op operator
+	if isAggregateQuery(statement) {
+		op = aggregateOperator(statement, table)
+	} else {
+		// 主キーの順番なら、B-treeの順番に読んで、ソートしない。インデックスで読む場合は、主キーの順番にならない
+		ok, desc := primaryKeyOrder(orderBy, table.Schema())
+		if ok && !usesIndex(statement.Where, table) {
+			orderBy = nil
+		} else {
+			desc = false
+		}
+		op = scanOperator(table, statement.Where, desc)
+	}
+
+	if len(orderBy) == 0 {
+		op = &project{child: op, exprs: statement.Columns}
+	} else {
+		// 結果のカラムの後ろにソートキーを並べて評価し、ソートしてからソートキーを除く
+		exprs := append([]sql.Expr{}, statement.Columns...)
+		for _, term := range orderBy {
+			exprs = append(exprs, term.Expr)
+		}
+		op = &sortOperator{child: &project{child: op, exprs: exprs}, numColumns: len(statement.Columns), orderBy: orderBy}
+	}
+
+	if statement.Limit >= 0 || statement.Offset > 0 {
+		op = &limit{child: op, offset: statement.Offset, limit: statement.Limit}
+	}
+	return op
 }
 
 // SELECT文を実行する
-func executeSelect(statement core.Statement, table *db.Table) ExecuteResult {
-	cursor := db.TableStart(table)
+func executeSelect(statement core.Statement, database *db.Database, output Output) (ExecuteResult, error) {
+	table, found, _ := getTable(statement, database, false)
+	if !found {
+		// チュートリアル形式のテーブルをまだ作っていない
+		return EXECUTE_SUCCESS, nil
+	}
 
-	for !cursor.EndOfTable {
-		row := table.GetRowByCursor(cursor.PageNum, cursor.CellNum)
-		printRow(&row)
-		db.CursorAdvance(cursor)
+	err := drain(selectOperator(statement, table), func(row *rowContext) error {
+		return output.Row(row.values)
+	})
+	if err != nil {
+		return resultFor(err), err
 	}
+	return EXECUTE_SUCCESS, nil
+}
 
-	return EXECUTE_SUCCESS
+// SELECT文の結果の行を、1行ずつ読むクエリ。Nextを呼ぶたびに演算子を進めるので、結果の行をメモリに集めない。
+// 開いている間にテーブルを書き換えると、演算子のカーソルが壊れるので、書き込む前にCloseする
+type Query struct {
+	op operator
 }
 
-// INSERT文を実行する
-func executeInsert(statement core.Statement, table *db.Table) ExecuteResult {
-	rowToInsert := &statement.RowToInsert
-	insertResult := table.InsertRow(&db.Row{
-		Id:       rowToInsert.Id,
-		Username: rowToInsert.Username,
-		Email:    rowToInsert.Email,
+// SELECT文の演算子を開いて、結果の行を1行ずつ読むクエリを返す
+func OpenQuery(statement core.Statement, database *db.Database) (*Query, error) {
+	table, found, _ := getTable(statement, database, false)
+	if !found {
+		// チュートリアル形式のテーブルをまだ作っていない
+		return &Query{}, nil
+	}
+
+	op := selectOperator(statement, table)
+	if err := op.Open(); err != nil {
+		op.Close()
+		return nil, err
+	}
+	return &Query{op: op}, nil
+}
+
+// 次の行を返す。行がなくなったらnilを返す。返した行は、次にNextを呼ぶまで使える
+func (q *Query) Next() ([]core.Value, error) {
+	if q.op == nil {
+		return nil, nil
+	}
+	row, err := q.op.Next()
+	if err != nil || row == nil {
+		return nil, err
+	}
+	return row.values, nil
+}
+
+// 演算子を閉じる
+func (q *Query) Close() {
+	if q.op != nil {
+		q.op.Close()
+		q.op = nil
+	}
+}
+
+// ステートメントがデータベースを書き換えない場合はtrueを返す。EXPLAIN文は、ステートメントを実行しない
+func IsReadOnly(statement core.Statement) bool {
+	if statement.Explain != 0 {
+		return true
+	}
+	switch statement.Type {
+	case core.STATEMENT_SELECT, core.STATEMENT_PREPARE, core.STATEMENT_DEALLOCATE:
+		return true
+	default:
+		return false
+	}
+}
+
+// 更新する行
+type rowUpdate struct {
+	oldKey uint32
+	values []core.Value
+}
+
+// UPDATE文を実行する。
+// 先に更新する行を全て集めてから書き込むので、更新した行をもう一度更新することはない
+func executeUpdate(statement core.Statement, database *db.Database, output Output) (ExecuteResult, error) {
+	table, result, err := getWriteTable(statement, database, false)
+	if result != EXECUTE_SUCCESS {
+		return result, err
+	}
+	schema := table.Schema()
+
+	var updates []rowUpdate
+	err = drain(scanOperator(table, statement.Where, false), func(row *rowContext) error {
+		values := append([]core.Value{}, row.values...)
+		for i, assignment := range statement.Set {
+			v, err := eval(assignment.Value, *row)
+			if err != nil {
+				return err
+			}
+			values[statement.SetColumns[i]] = v
+		}
+		if schema.PrimaryKey >= 0 && values[schema.PrimaryKey].IsNull() {
+			return fmt.Errorf("%w: %s.%s", db.ErrNotNull, schema.Name, schema.Columns[schema.PrimaryKey].Name)
+		}
+		if err := schema.CheckRow(values); err != nil {
+			return err
+		}
+		updates = append(updates, rowUpdate{oldKey: row.key, values: values})
+		return nil
+	})
+	if err != nil {
+		return resultFor(err), err
+	}
+
+	// 主キーが変わる行は、全て削除してから挿入し直す。書き込む前に、キーが重複しないか確認する
+	newKey := func(update rowUpdate) uint32 {
+		if schema.PrimaryKey < 0 {
+			return update.oldKey
+		}
+		return uint32(update.values[schema.PrimaryKey].Integer)
+	}
+	moved := map[uint32]bool{}
+	for _, update := range updates {
+		if newKey(update) != update.oldKey {
+			moved[update.oldKey] = true
+		}
+	}
+	seen := map[uint32]bool{}
+	for _, update := range updates {
+		key := newKey(update)
+		if seen[key] || (key != update.oldKey && !moved[key] && table.ContainsKey(key)) {
+			return EXECUTE_DUPLICATE_KEY, nil
+		}
+		seen[key] = true
+	}
+
+	for _, update := range updates {
+		if newKey(update) != update.oldKey {
+			if _, err := table.DeleteRow(update.oldKey); err != nil {
+				return EXECUTE_CORRUPT, err
+			}
+		}
+	}
+	for _, update := range updates {
+		var insertResult db.InsertResult
+		if newKey(update) == update.oldKey {
+			insertResult = table.UpdateRow(update.oldKey, update.values)
+		} else {
+			insertResult = table.InsertRow(update.values)
+		}
+		if insertResult == db.INSERT_UNIQUE_VIOLATION {
+			return EXECUTE_UNIQUE_VIOLATION, nil
+		}
+		if insertResult != db.INSERT_SUCCESS {
+			return EXECUTE_ERROR, fmt.Errorf("could not write row %d", newKey(update))
+		}
+	}
+
+	output.RowsAffected(len(updates))
+	return EXECUTE_SUCCESS, nil
+}
+
+// DELETE文を実行する
+func executeDelete(statement core.Statement, database *db.Database, output Output) (ExecuteResult, error) {
+	table, result, err := getWriteTable(statement, database, false)
+	if result != EXECUTE_SUCCESS {
+		return result, err
+	}
+
+	// 削除する行のキーを全て集めてから削除する。読みながら削除すると、B-treeとインデックスが変わる
+	var keys []uint32
+	err = drain(scanOperator(table, statement.Where, false), func(row *rowContext) error {
+		keys = append(keys, row.key)
+		return nil
 	})
+	if err != nil {
+		return resultFor(err), err
+	}
+	for _, key := range keys {
+		if _, err := table.DeleteRow(key); err != nil {
+			return EXECUTE_CORRUPT, err
+		}
+	}
+	output.RowsAffected(len(keys))
+	return EXECUTE_SUCCESS, nil
+}
+
+// INSERT文を実行する
+func executeInsert(statement core.Statement, database *db.Database, output Output) (ExecuteResult, error) {
+	table, result, err := getWriteTable(statement, database, true)
+	if result != EXECUTE_SUCCESS {
+		return result, err
+	}
+
+	var insertResult db.InsertResult
+	if statement.Upsert {
+		insertResult = table.UpsertRow(statement.Values)
+	} else {
+		insertResult = table.InsertRow(statement.Values)
+	}
 
 	switch insertResult {
 	case db.INSERT_SUCCESS:
-		return EXECUTE_SUCCESS
+		output.RowsAffected(1)
+		return EXECUTE_SUCCESS, nil
 	case db.INSERT_DUPLICATE_KEY:
-		return EXECUTE_DUPLICATE_KEY
+		return EXECUTE_DUPLICATE_KEY, nil
 	case db.INSERT_TABLE_FULL:
-		return EXECUTE_TABLE_FULL
+		return EXECUTE_TABLE_FULL, nil
+	case db.INSERT_ROW_TOO_LARGE:
+		return EXECUTE_ROW_TOO_LARGE, nil
+	case db.INSERT_UNIQUE_VIOLATION:
+		return EXECUTE_UNIQUE_VIOLATION, nil
+	case db.INSERT_CORRUPT:
+		return EXECUTE_CORRUPT, fmt.Errorf("%w: table %s", persistence.ErrCorrupt, table.Schema().Name)
 	default:
-		// ここを通らないことをアサーションしたい、panicでいいのかな
-		return EXECUTE_SUCCESS
+		return EXECUTE_ERROR, fmt.Errorf("could not insert into %s (result %d)", table.Schema().Name, insertResult)
 	}
 }
 
-// SQLステートメントを実行する
-func ExecuteStatement(statement core.Statement, table *db.Table) ExecuteResult {
+// CREATE TABLE文を実行する。定義が長すぎてカタログに入らない場合は、EXECUTE_SCHEMA_TOO_LONGを返す
+func executeCreateTable(statement core.Statement, database *db.Database) (ExecuteResult, error) {
+	if _, found := database.GetTable(statement.CreateTable.Name); found && statement.CreateTable.IfNotExists {
+		return EXECUTE_SUCCESS, nil
+	}
+	_, err := database.CreateTable(statement.CreateTable)
+	switch {
+	case err == nil:
+		return EXECUTE_SUCCESS, nil
+	case errors.Is(err, db.ErrSchemaTooLong):
+		return EXECUTE_SCHEMA_TOO_LONG, err
+	default:
+		return resultFor(err), err
+	}
+}
+
+// CREATE INDEX文を実行する。UNIQUEインデックスで値が重複していたら、EXECUTE_UNIQUE_VIOLATIONを返す
+func executeCreateIndex(statement core.Statement, database *db.Database) (ExecuteResult, error) {
+	if _, found := database.GetIndex(statement.CreateIndex.Name); found && statement.CreateIndex.IfNotExists {
+		return EXECUTE_SUCCESS, nil
+	}
+	_, err := database.CreateIndex(statement.CreateIndex)
+	switch {
+	case err == nil:
+		return EXECUTE_SUCCESS, nil
+	case errors.Is(err, db.ErrUniqueViolation):
+		return EXECUTE_UNIQUE_VIOLATION, err
+	case errors.Is(err, db.ErrRowTooLarge):
+		return EXECUTE_ROW_TOO_LARGE, err
+	case errors.Is(err, db.ErrSchemaTooLong):
+		return EXECUTE_SCHEMA_TOO_LONG, err
+	case errors.Is(err, persistence.ErrCorrupt):
+		return EXECUTE_CORRUPT, err
+	default:
+		return EXECUTE_ERROR, err
+	}
+}
+
+// SQLステートメントを実行して、結果をoutputに渡す。EXECUTE_ERRORの場合は、エラーの詳細も返す
+func ExecuteStatement(statement core.Statement, database *db.Database, output Output) (ExecuteResult, error) {
+	if statement.Explain != 0 {
+		return executeExplain(statement, database, output)
+	}
+
 	switch statement.Type {
-	case core.STATEMENT_INSERT:
-		return executeInsert(statement, table)
 	case core.STATEMENT_SELECT:
-		return executeSelect(statement, table)
+		return executeSelect(statement, database, output)
+	case core.STATEMENT_PREPARE, core.STATEMENT_DEALLOCATE:
+		return EXECUTE_SUCCESS, nil
+	case core.STATEMENT_BEGIN:
+		if err := database.Begin(); err != nil {
+			return EXECUTE_ERROR, err
+		}
+		return EXECUTE_SUCCESS, nil
+	case core.STATEMENT_COMMIT:
+		if !database.InTransaction() {
+			return EXECUTE_ERROR, errors.New("cannot commit - no transaction is active")
+		}
+		if err := database.Commit(); err != nil {
+			return EXECUTE_COMMIT_FAILED, err
+		}
+		return EXECUTE_SUCCESS, nil
+	case core.STATEMENT_ROLLBACK:
+		if !database.InTransaction() {
+			return EXECUTE_ERROR, errors.New("cannot rollback - no transaction is active")
+		}
+		if err := database.Rollback(); err != nil {
+			return EXECUTE_ERROR, err
+		}
+		return EXECUTE_SUCCESS, nil
+	}
+
+	// 書き込むステートメントは、失敗したら始める前の状態に戻す。途中まで書き込んだ変更は残らない
+	if err := database.BeginStatement(); err != nil {
+		return EXECUTE_ERROR, err
+	}
+	result, err := executeWrite(statement, database, output)
+	if result != EXECUTE_SUCCESS {
+		if rollbackErr := database.RollbackStatement(); rollbackErr != nil {
+			return EXECUTE_ERROR, rollbackErr
+		}
+		return result, err
+	}
+
+	// トランザクションの外では、ステートメントごとにコミットする
+	if !database.InTransaction() {
+		if err := database.Commit(); err != nil {
+			return EXECUTE_COMMIT_FAILED, err
+		}
+	}
+	return EXECUTE_SUCCESS, nil
+}
+
+// 書き込むステートメントを実行する
+func executeWrite(statement core.Statement, database *db.Database, output Output) (ExecuteResult, error) {
+	switch statement.Type {
+	case core.STATEMENT_INSERT:
+		return executeInsert(statement, database, output)
+	case core.STATEMENT_CREATE_TABLE:
+		return executeCreateTable(statement, database)
+	case core.STATEMENT_CREATE_INDEX:
+		return executeCreateIndex(statement, database)
+	case core.STATEMENT_UPDATE:
+		return executeUpdate(statement, database, output)
+	case core.STATEMENT_DELETE:
+		return executeDelete(statement, database, output)
 	default:
-		return EXECUTE_SUCCESS
+		return EXECUTE_SUCCESS, nil
 	}
 }
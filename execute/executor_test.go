@@ -0,0 +1,82 @@
+package execute
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"toydb-go/core"
+	db "toydb-go/table"
+)
+
+// 定義が長すぎる以外の理由でテーブルを作れなかった場合は、エラーをそのまま返す
+func TestCreateTableError(t *testing.T) {
+	session := openTestSession(t)
+
+	var statement core.Statement
+	if result, err := session.PrepareStatement("create table t (id integer primary key)", nil, &statement); result != PREPARE_SUCCESS {
+		t.Fatal(err)
+	}
+	var output rowCollector
+	if result, err := ExecuteStatement(statement, session.database, &output); result != EXECUTE_SUCCESS {
+		t.Fatalf("could not create the table (result %d): %v", result, err)
+	}
+	// 準備した後に同じ名前のテーブルができた
+	result, err := ExecuteStatement(statement, session.database, &output)
+	if result != EXECUTE_ERROR || !errors.Is(err, db.ErrTableExists) {
+		t.Errorf("expected EXECUTE_ERROR with ErrTableExists, but got %d: %v", result, err)
+	}
+}
+
+// 準備した後にテーブルがなくなった場合は、テーブルを読まずにエラーを返す
+func TestWriteToMissingTable(t *testing.T) {
+	session := openTestSession(t)
+	if err := session.database.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	runStatement(t, session, "create table t (id integer primary key, name text)")
+
+	var statements []core.Statement
+	for _, text := range []string{
+		"insert into t values (1, 'a')",
+		"update t set name = 'b'",
+		"delete from t where id = 1",
+	} {
+		var statement core.Statement
+		if result, err := session.PrepareStatement(text, nil, &statement); result != PREPARE_SUCCESS {
+			t.Fatal(err)
+		}
+		statements = append(statements, statement)
+	}
+	if err := session.database.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, statement := range statements {
+		var output rowCollector
+		result, err := ExecuteStatement(statement, session.database, &output)
+		if result != EXECUTE_ERROR || err == nil || err.Error() != "no such table: t" {
+			t.Errorf("expected EXECUTE_ERROR with no such table, but got %d: %v", result, err)
+		}
+	}
+}
+
+// 主キーのないテーブルでも、UPDATE文は行を追加せずに、同じキーの行を書き換える
+func TestUpdateTableWithoutPrimaryKey(t *testing.T) {
+	session := openTestSession(t)
+	runStatement(t, session, "create table u (a text, b integer)")
+	runStatement(t, session, "create index u_b on u (b)")
+	runStatement(t, session, "insert into u values ('x', 1)")
+	runStatement(t, session, "insert into u values ('y', 2)")
+	runStatement(t, session, "update u set b = b + 1")
+
+	expected := [][]core.Value{
+		{core.TextValue("x"), core.IntegerValue(2)},
+		{core.TextValue("y"), core.IntegerValue(3)},
+	}
+	if rows := runStatement(t, session, "select a, b from u"); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %v, but got %v", expected, rows)
+	}
+	if rows := runStatement(t, session, "select a from u where b = 3"); len(rows) != 1 || rows[0][0].Text != "y" {
+		t.Errorf("unexpected rows from the index: %v", rows)
+	}
+}
@@ -0,0 +1,125 @@
+package execute
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"toydb-go/core"
+	db "toydb-go/table"
+)
+
+// EXPLAIN ANALYZEで、演算子の実行時の統計を数える演算子。
+// ページ数と時間は、子の演算子の分も含めて、Open、Next、Closeの間に増えた分を数える
+type analyzed struct {
+	operator
+	database *db.Database
+	// 返した行数
+	rows int64
+	// ページャからページを読んだ回数と、かかった時間。子の演算子の分も含む（親の値は、子の値の合計以上になる）
+	pages   uint64
+	elapsed time.Duration
+}
+
+// 演算子の木の全ての演算子を、統計を数える演算子で包む
+func analyze(op operator, database *db.Database) *analyzed {
+	for _, child := range op.children() {
+		*child = analyze(*child, database)
+	}
+	return &analyzed{operator: op, database: database}
+}
+
+// 計測を始めて、計測を終える関数を返す
+func (op *analyzed) measure() func() {
+	start, pages := time.Now(), op.database.PageReads()
+	return func() {
+		op.elapsed += time.Since(start)
+		op.pages += op.database.PageReads() - pages
+	}
+}
+
+func (op *analyzed) Open() error {
+	defer op.measure()()
+	return op.operator.Open()
+}
+
+func (op *analyzed) Next() (*rowContext, error) {
+	defer op.measure()()
+	row, err := op.operator.Next()
+	if row != nil {
+		op.rows++
+	}
+	return row, err
+}
+
+func (op *analyzed) Close() {
+	defer op.measure()()
+	op.operator.Close()
+}
+
+// rows=はこの演算子が返した行数。pages=とtime=は子の演算子の分も含む
+func (op *analyzed) explain() string {
+	return fmt.Sprintf("%s (rows=%d pages=%d time=%s)", op.operator.explain(), op.rows, op.pages, op.elapsed)
+}
+
+// 演算子の木を、子を字下げして1行ずつfnに渡す
+func explainTree(op operator, depth int, fn func(line string) error) error {
+	if err := fn(strings.Repeat("  ", depth) + op.explain()); err != nil {
+		return err
+	}
+	for _, child := range op.children() {
+		if err := explainTree(*child, depth+1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EXPLAIN文を実行する。ステートメントを実行する演算子の木を、1行ずつoutputに渡す。
+// UPDATE文とDELETE文は、書き込む行を読む演算子の木を表示する。
+// EXPLAIN ANALYZEの場合は、先にSELECT文を実行して、結果の行を捨てる
+func executeExplain(statement core.Statement, database *db.Database, output Output) (ExecuteResult, error) {
+	table, found, _ := getTable(statement, database, false)
+	if !found {
+		// チュートリアル形式のテーブルをまだ作っていない
+		return EXECUTE_SUCCESS, nil
+	}
+
+	// ANALYZEはUPDATE文とDELETE文の書き込みを実行しないので、統計が実際と違う。パーサと同じように拒否する
+	if statement.Explain == core.EXPLAIN_ANALYZE && statement.Type != core.STATEMENT_SELECT {
+		return EXECUTE_ERROR, errors.New("EXPLAIN ANALYZE supports only SELECT")
+	}
+
+	var op operator
+	var lines []string
+	switch statement.Type {
+	case core.STATEMENT_SELECT:
+		op = selectOperator(statement, table)
+	case core.STATEMENT_UPDATE:
+		op = scanOperator(table, statement.Where, false)
+		lines = append(lines, "UPDATE "+table.Schema().Name)
+	case core.STATEMENT_DELETE:
+		op = scanOperator(table, statement.Where, false)
+		lines = append(lines, "DELETE FROM "+table.Schema().Name)
+	default:
+		return EXECUTE_ERROR, errors.New("cannot explain this statement")
+	}
+
+	if statement.Explain == core.EXPLAIN_ANALYZE {
+		op = analyze(op, database)
+		if err := drain(op, func(row *rowContext) error { return nil }); err != nil {
+			return resultFor(err), err
+		}
+	}
+	explainTree(op, len(lines), func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+
+	for _, line := range lines {
+		if err := output.Row([]core.Value{core.TextValue(line)}); err != nil {
+			return EXECUTE_ERROR, err
+		}
+	}
+	return EXECUTE_SUCCESS, nil
+}
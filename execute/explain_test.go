@@ -0,0 +1,118 @@
+package execute
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"toydb-go/core"
+)
+
+// EXPLAIN文を実行して、結果の行を返す
+func explainLines(t *testing.T, session *Session, text string, params ...Param) []string {
+	t.Helper()
+	var lines []string
+	for _, row := range runStatement(t, session, text, params...) {
+		lines = append(lines, row[0].Text)
+	}
+	return lines
+}
+
+func TestExplain(t *testing.T) {
+	session := openTestSession(t)
+	runStatement(t, session, "create index by_name on users(name)")
+
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{"explain select name from users", []string{
+			"PROJECT name",
+			"  SCAN users: full leaf scan from TableStart",
+		}},
+		{"explain select * from users where id >= 10 order by id desc limit 3", []string{
+			"LIMIT 3",
+			"  PROJECT id, name, score",
+			"    FILTER id >= 10",
+			"      SEARCH users USING PRIMARY KEY (id >= 10): seek backward via TableFindLast",
+		}},
+		{"explain select name from users where name = 'bob' order by score", []string{
+			"SORT BY score",
+			"  PROJECT name, score",
+			"    FILTER name = 'bob'",
+			"      SEARCH users USING INDEX by_name (name = 'bob'): seek via IndexSeek",
+		}},
+		{"explain select name, count(*) from users group by name having count(*) > 1", []string{
+			"PROJECT name, COUNT(*)",
+			"  FILTER COUNT(*) > 1",
+			"    AGGREGATE COUNT(*) GROUP BY name",
+			"      SCAN users: full leaf scan from TableStart",
+		}},
+		{"explain delete from users where id = 5", []string{
+			"DELETE FROM users",
+			"  FILTER id = 5",
+			"    SEARCH users USING PRIMARY KEY (id = 5): seek via TableFind",
+		}},
+	}
+	for _, test := range tests {
+		if lines := explainLines(t, session, test.text); !reflect.DeepEqual(lines, test.expected) {
+			t.Errorf("%s: expected %q, but got %q", test.text, test.expected, lines)
+		}
+	}
+
+	// パラメータの値で、アクセスパスが決まる
+	lines := explainLines(t, session, "explain update users set score = 0 where id between ? and ?", Param{Ordinal: 1, Value: core.IntegerValue(2)}, Param{Ordinal: 2, Value: core.IntegerValue(4)})
+	if expected := "    SEARCH users USING PRIMARY KEY (id >= 2 AND id <= 4): seek via TableFind"; lines[len(lines)-1] != expected {
+		t.Errorf("expected %q, but got %q", expected, lines)
+	}
+}
+
+func TestExplainAnalyze(t *testing.T) {
+	session := openTestSession(t)
+	for i := 1; i <= 20; i++ {
+		runStatement(t, session, "insert into users values (?, 'user', ?)", Param{Ordinal: 1, Value: core.IntegerValue(int64(i))}, Param{Ordinal: 2, Value: core.IntegerValue(int64(i % 4))})
+	}
+
+	lines := explainLines(t, session, "explain analyze select id from users where score = 1 limit 3")
+	pattern := regexp.MustCompile(`^ *(.+) \(rows=(\d+) pages=(\d+) time=.+\)$`)
+	expected := []struct {
+		operator string
+		rows     int
+	}{
+		{"LIMIT 3", 3},
+		{"PROJECT id", 3},
+		{"FILTER score = 1", 3},
+		// LIMIT句の行数を返したら止めるので、9行目までしか読まない
+		{"SCAN users: full leaf scan from TableStart", 9},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("unexpected plan: %q", lines)
+	}
+	for i, line := range lines {
+		match := pattern.FindStringSubmatch(line)
+		if match == nil {
+			t.Fatalf("unexpected line: %q", line)
+		}
+		rows, _ := strconv.Atoi(match[2])
+		pages, _ := strconv.Atoi(match[3])
+		if match[1] != expected[i].operator || rows != expected[i].rows || pages == 0 {
+			t.Errorf("expected %s with %d rows, but got %q", expected[i].operator, expected[i].rows, line)
+		}
+	}
+
+	// パーサを通さずに作ったステートメントでも、書き込むステートメントのANALYZEは拒否する
+	for _, text := range []string{"update users set name = 'x'", "delete from users"} {
+		var statement core.Statement
+		if result, err := session.PrepareStatement(text, nil, &statement); result != PREPARE_SUCCESS {
+			t.Fatal(err)
+		}
+		statement.Explain = core.EXPLAIN_ANALYZE
+		var output rowCollector
+		if result, err := ExecuteStatement(statement, session.database, &output); result != EXECUTE_ERROR || err == nil {
+			t.Errorf("%s: expected EXECUTE_ERROR, but got %d (%v)", text, result, err)
+		}
+	}
+	if rows := runStatement(t, session, "select count(*) from users where name = 'user'"); rows[0][0].Integer != 20 {
+		t.Errorf("expected the rows to be unchanged, but got %v", rows)
+	}
+}
@@ -0,0 +1,372 @@
+package execute
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"toydb-go/core"
+	"toydb-go/sql"
+	db "toydb-go/table"
+)
+
+// 式を評価するときの行。schemaがnilの場合は、カラムを参照できない
+type rowContext struct {
+	schema *db.Schema
+	values []core.Value
+	// テーブルから読んだ行のキー
+	key uint32
+	// GROUP BYのグループごとに計算した集約関数の値
+	aggregates map[*sql.FuncCall]core.Value
+}
+
+// 式の型エラー。カラムの型エラーと同じものにして、どちらもerrors.Isで判定できるようにする
+var ErrTypeMismatch = db.ErrTypeMismatch
+
+// 比較やANDの結果を表す値
+func boolValue(b bool) core.Value {
+	if b {
+		return core.IntegerValue(1)
+	}
+	return core.IntegerValue(0)
+}
+
+// 値を真偽値として扱う。NULLと0はfalseになる
+func isTrue(v core.Value) bool {
+	switch v.Type {
+	case core.VALUE_INTEGER:
+		return v.Integer != 0
+	case core.VALUE_REAL:
+		return v.Real != 0
+	case core.VALUE_TEXT:
+		f, err := strconv.ParseFloat(v.Text, 64)
+		return err == nil && f != 0
+	default:
+		return false
+	}
+}
+
+// 式に含まれるカラムが、テーブルに存在するか確認する
+func CheckColumns(expr sql.Expr, schema *db.Schema) error {
+	switch expr := expr.(type) {
+	case *sql.ColumnRef:
+		if schema == nil || schema.ColumnIndex(expr.Name) < 0 {
+			return fmt.Errorf("no such column: %s", expr.Name)
+		}
+		return nil
+	case *sql.UnaryExpr:
+		return CheckColumns(expr.X, schema)
+	case *sql.BinaryExpr:
+		if err := CheckColumns(expr.X, schema); err != nil {
+			return err
+		}
+		return CheckColumns(expr.Y, schema)
+	case *sql.InExpr:
+		if err := CheckColumns(expr.X, schema); err != nil {
+			return err
+		}
+		for _, item := range expr.List {
+			if err := CheckColumns(item, schema); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *sql.BetweenExpr:
+		for _, x := range []sql.Expr{expr.X, expr.Low, expr.High} {
+			if err := CheckColumns(x, schema); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *sql.IsNullExpr:
+		return CheckColumns(expr.X, schema)
+	case *sql.FuncCall:
+		if err := checkFunction(expr); err != nil {
+			return err
+		}
+		for _, arg := range expr.Args {
+			if ContainsAggregate(arg) {
+				return fmt.Errorf("misuse of aggregate function %s()", expr.Name)
+			}
+			if err := CheckColumns(arg, schema); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// カラムを含まない式を評価する
+func EvalConstant(expr sql.Expr) (core.Value, error) {
+	return eval(expr, rowContext{})
+}
+
+// 式を評価する
+func eval(expr sql.Expr, row rowContext) (core.Value, error) {
+	switch expr := expr.(type) {
+	case *sql.Literal:
+		return evalLiteral(expr)
+	case *sql.ColumnRef:
+		index := -1
+		if row.schema != nil {
+			index = row.schema.ColumnIndex(expr.Name)
+		}
+		if index < 0 {
+			return core.Value{}, fmt.Errorf("no such column: %s", expr.Name)
+		}
+		return row.values[index], nil
+	case *sql.UnaryExpr:
+		return evalUnary(expr, row)
+	case *sql.BinaryExpr:
+		return evalBinary(expr, row)
+	case *sql.InExpr:
+		return evalIn(expr, row)
+	case *sql.BetweenExpr:
+		return evalBetween(expr, row)
+	case *sql.IsNullExpr:
+		x, err := eval(expr.X, row)
+		if err != nil {
+			return core.Value{}, err
+		}
+		return boolValue(x.IsNull() != expr.Not), nil
+	case *sql.FuncCall:
+		// 集約関数の値は、グループごとに先に計算しておく
+		if v, ok := row.aggregates[expr]; ok {
+			return v, nil
+		}
+		return core.Value{}, fmt.Errorf("misuse of aggregate function %s()", expr.Name)
+	default:
+		return core.Value{}, fmt.Errorf("unsupported expression %T", expr)
+	}
+}
+
+func evalLiteral(literal *sql.Literal) (core.Value, error) {
+	switch literal.Kind {
+	case sql.LITERAL_INTEGER:
+		v, err := strconv.ParseInt(literal.Value, 10, 64)
+		if err != nil {
+			return core.Value{}, fmt.Errorf("integer out of range: %s", literal.Value)
+		}
+		return core.IntegerValue(v), nil
+	case sql.LITERAL_FLOAT:
+		v, err := strconv.ParseFloat(literal.Value, 64)
+		if err != nil {
+			return core.Value{}, fmt.Errorf("invalid number: %s", literal.Value)
+		}
+		return core.RealValue(v), nil
+	case sql.LITERAL_STRING:
+		return core.TextValue(literal.Value), nil
+	case sql.LITERAL_BLOB:
+		v, err := hex.DecodeString(literal.Value)
+		if err != nil {
+			return core.Value{}, err
+		}
+		return core.BlobValue(v), nil
+	default:
+		return core.NullValue(), nil
+	}
+}
+
+func evalUnary(expr *sql.UnaryExpr, row rowContext) (core.Value, error) {
+	x, err := eval(expr.X, row)
+	if err != nil || x.IsNull() {
+		return x, err
+	}
+
+	switch expr.Op {
+	case "NOT":
+		return boolValue(!isTrue(x)), nil
+	case "+":
+		return x, nil
+	default:
+		switch x.Type {
+		case core.VALUE_INTEGER:
+			return core.IntegerValue(-x.Integer), nil
+		case core.VALUE_REAL:
+			return core.RealValue(-x.Real), nil
+		default:
+			return core.Value{}, fmt.Errorf("%w: cannot negate %s", ErrTypeMismatch, x.Type)
+		}
+	}
+}
+
+func evalBinary(expr *sql.BinaryExpr, row rowContext) (core.Value, error) {
+	x, err := eval(expr.X, row)
+	if err != nil {
+		return core.Value{}, err
+	}
+
+	// AND / ORは3値論理。左辺だけで結果が決まる場合は、右辺を評価しない
+	switch expr.Op {
+	case "AND":
+		if !x.IsNull() && !isTrue(x) {
+			return boolValue(false), nil
+		}
+		y, err := eval(expr.Y, row)
+		if err != nil {
+			return core.Value{}, err
+		}
+		if !y.IsNull() && !isTrue(y) {
+			return boolValue(false), nil
+		}
+		if x.IsNull() || y.IsNull() {
+			return core.NullValue(), nil
+		}
+		return boolValue(true), nil
+	case "OR":
+		if isTrue(x) {
+			return boolValue(true), nil
+		}
+		y, err := eval(expr.Y, row)
+		if err != nil {
+			return core.Value{}, err
+		}
+		if isTrue(y) {
+			return boolValue(true), nil
+		}
+		if x.IsNull() || y.IsNull() {
+			return core.NullValue(), nil
+		}
+		return boolValue(false), nil
+	}
+
+	y, err := eval(expr.Y, row)
+	if err != nil {
+		return core.Value{}, err
+	}
+	if x.IsNull() || y.IsNull() {
+		return core.NullValue(), nil
+	}
+
+	switch expr.Op {
+	case "=":
+		return boolValue(core.Compare(x, y) == 0), nil
+	case "!=":
+		return boolValue(core.Compare(x, y) != 0), nil
+	case "<":
+		return boolValue(core.Compare(x, y) < 0), nil
+	case "<=":
+		return boolValue(core.Compare(x, y) <= 0), nil
+	case ">":
+		return boolValue(core.Compare(x, y) > 0), nil
+	case ">=":
+		return boolValue(core.Compare(x, y) >= 0), nil
+	case "||":
+		return core.TextValue(x.String() + y.String()), nil
+	default:
+		return evalArithmetic(expr.Op, x, y)
+	}
+}
+
+// 四則演算と剰余。どちらも整数なら整数、どちらかが小数なら小数で計算する。0で割るとNULLになる
+func evalArithmetic(op string, x core.Value, y core.Value) (core.Value, error) {
+	isNumber := func(v core.Value) bool { return v.Type == core.VALUE_INTEGER || v.Type == core.VALUE_REAL }
+	if !isNumber(x) || !isNumber(y) {
+		return core.Value{}, fmt.Errorf("%w: %s %s %s", ErrTypeMismatch, x.Type, op, y.Type)
+	}
+
+	if x.Type == core.VALUE_INTEGER && y.Type == core.VALUE_INTEGER {
+		a, b := x.Integer, y.Integer
+		switch op {
+		case "+":
+			return core.IntegerValue(a + b), nil
+		case "-":
+			return core.IntegerValue(a - b), nil
+		case "*":
+			return core.IntegerValue(a * b), nil
+		case "/":
+			if b == 0 {
+				return core.NullValue(), nil
+			}
+			return core.IntegerValue(a / b), nil
+		case "%":
+			if b == 0 {
+				return core.NullValue(), nil
+			}
+			return core.IntegerValue(a % b), nil
+		}
+	}
+
+	a, b := toFloat(x), toFloat(y)
+	switch op {
+	case "+":
+		return core.RealValue(a + b), nil
+	case "-":
+		return core.RealValue(a - b), nil
+	case "*":
+		return core.RealValue(a * b), nil
+	case "/":
+		if b == 0 {
+			return core.NullValue(), nil
+		}
+		return core.RealValue(a / b), nil
+	case "%":
+		if b == 0 {
+			return core.NullValue(), nil
+		}
+		return core.RealValue(math.Mod(a, b)), nil
+	default:
+		return core.Value{}, fmt.Errorf("unknown operator %s", op)
+	}
+}
+
+func toFloat(v core.Value) float64 {
+	if v.Type == core.VALUE_INTEGER {
+		return float64(v.Integer)
+	}
+	return v.Real
+}
+
+// x IN (list)。一致するものがなく、リストにNULLがある場合はNULLになる
+func evalIn(expr *sql.InExpr, row rowContext) (core.Value, error) {
+	x, err := eval(expr.X, row)
+	if err != nil || x.IsNull() {
+		return core.NullValue(), err
+	}
+
+	hasNull := false
+	for _, item := range expr.List {
+		v, err := eval(item, row)
+		if err != nil {
+			return core.Value{}, err
+		}
+		if v.IsNull() {
+			hasNull = true
+			continue
+		}
+		if core.Compare(x, v) == 0 {
+			return boolValue(!expr.Not), nil
+		}
+	}
+	if hasNull {
+		return core.NullValue(), nil
+	}
+	return boolValue(expr.Not), nil
+}
+
+// x BETWEEN low AND high は、x >= low AND x <= high と同じ
+func evalBetween(expr *sql.BetweenExpr, row rowContext) (core.Value, error) {
+	v, err := eval(&sql.BinaryExpr{
+		Op: "AND",
+		X:  &sql.BinaryExpr{Op: ">=", X: expr.X, Y: expr.Low},
+		Y:  &sql.BinaryExpr{Op: "<=", X: expr.X, Y: expr.High},
+	}, row)
+	if err != nil || v.IsNull() || !expr.Not {
+		return v, err
+	}
+	return boolValue(!isTrue(v)), nil
+}
+
+// WHERE句の条件を満たすか確認する。条件がない場合は全ての行が満たす
+func matches(where sql.Expr, row rowContext) (bool, error) {
+	if where == nil {
+		return true, nil
+	}
+	v, err := eval(where, row)
+	if err != nil {
+		return false, err
+	}
+	return isTrue(v), nil
+}
@@ -0,0 +1,96 @@
+package execute
+
+import (
+	"testing"
+	"toydb-go/core"
+	"toydb-go/sql"
+	db "toydb-go/table"
+)
+
+func parseWhere(t *testing.T, where string) sql.Expr {
+	stmt, err := sql.Parse("select * from t where " + where)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stmt.(*sql.SelectStmt).Where
+}
+
+func testSchema(t *testing.T) *db.Schema {
+	stmt, err := sql.Parse("create table t (id integer primary key, name text, score real)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := db.NewSchema(stmt.(*sql.CreateTableStmt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+func TestEval(t *testing.T) {
+	schema := testSchema(t)
+	row := rowContext{schema: schema, values: []core.Value{core.IntegerValue(3), core.TextValue("bob"), core.NullValue()}}
+
+	tests := []struct {
+		where    string
+		expected string
+	}{
+		{"id * 2 + 1", "7"},
+		{"id / 2", "1"},
+		{"id / 2.0", "1.5"},
+		{"id % 0", "NULL"},
+		{"name || '!'", "bob!"},
+		{"id = 3 and name = 'bob'", "1"},
+		{"id <> 3 or name < 'c'", "1"},
+		{"score > 1", "NULL"},
+		{"score > 1 and id = 4", "0"},
+		{"score > 1 or id = 3", "1"},
+		{"not (id between 1 and 2)", "1"},
+		{"id not between 1 and 5", "0"},
+		{"id in (1, 2, 3)", "1"},
+		{"id in (1, NULL)", "NULL"},
+		{"name not in ('alice')", "1"},
+		{"score is null and name is not null", "1"},
+		{"-id < 0", "1"},
+	}
+	for _, test := range tests {
+		v, err := eval(parseWhere(t, test.where), row)
+		if err != nil {
+			t.Errorf("%s: %v", test.where, err)
+			continue
+		}
+		if v.String() != test.expected {
+			t.Errorf("%s: expected %s, but got %s", test.where, test.expected, v.String())
+		}
+	}
+
+	if _, err := eval(parseWhere(t, "name + 1"), row); err == nil {
+		t.Error("expected a type error")
+	}
+	if err := CheckColumns(parseWhere(t, "unknown = 1"), schema); err == nil {
+		t.Error("expected an error for an unknown column")
+	}
+}
+
+func TestPrimaryKeyRange(t *testing.T) {
+	schema := testSchema(t)
+
+	tests := []struct {
+		where    string
+		expected keyRange
+	}{
+		{"name = 'x'", fullKeyRange},
+		{"id = 5", keyRange{5, 5}},
+		{"id > 5 and 10 >= id", keyRange{6, 10}},
+		{"id >= 2.5 and id < 7.5", keyRange{3, 7}},
+		{"id between 3 and 4 and name = 'x'", keyRange{3, 4}},
+		{"id = 1 or id = 2", fullKeyRange},
+		{"id < 0", keyRange{0, -1}},
+		{"id = 1.5", keyRange{1, 0}},
+	}
+	for _, test := range tests {
+		if r := primaryKeyRange(parseWhere(t, test.where), schema); r != test.expected {
+			t.Errorf("%s: expected %+v, but got %+v", test.where, test.expected, r)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package execute
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"toydb-go/core"
+	"toydb-go/sql"
+	db "toydb-go/table"
+)
+
+// 主キーが取りうる範囲 [low, high]。low > highの場合は、条件を満たす行がない
+type keyRange struct {
+	low  int64
+	high int64
+}
+
+// 全てのキーを含む範囲
+var fullKeyRange = keyRange{low: 0, high: math.MaxUint32}
+
+func (r keyRange) isFull() bool {
+	return r == fullKeyRange
+}
+
+func (r keyRange) isEmpty() bool {
+	return r.low > r.high
+}
+
+// EXPLAINで表示する、主キーのカラムの条件
+func (r keyRange) describe(column string) string {
+	if r.low == r.high {
+		return fmt.Sprintf("%s = %d", column, r.low)
+	}
+	var conds []string
+	if r.low > fullKeyRange.low {
+		conds = append(conds, fmt.Sprintf("%s >= %d", column, r.low))
+	}
+	if r.high < fullKeyRange.high {
+		conds = append(conds, fmt.Sprintf("%s <= %d", column, r.high))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// ANDでつながった条件に分解する
+func conjuncts(expr sql.Expr) []sql.Expr {
+	if binary, ok := expr.(*sql.BinaryExpr); ok && binary.Op == "AND" {
+		return append(conjuncts(binary.X), conjuncts(binary.Y)...)
+	}
+	if expr == nil {
+		return nil
+	}
+	return []sql.Expr{expr}
+}
+
+// 主キーのカラムならtrue
+func isPrimaryKey(expr sql.Expr, schema *db.Schema) bool {
+	column, ok := expr.(*sql.ColumnRef)
+	return ok && schema.PrimaryKey >= 0 && schema.ColumnIndex(column.Name) == schema.PrimaryKey
+}
+
+// カラムを含まない式で、値がNULLでなければ、その値を返す
+func constantValue(expr sql.Expr) (core.Value, bool) {
+	if CheckColumns(expr, nil) != nil {
+		return core.Value{}, false
+	}
+	v, err := EvalConstant(expr)
+	if err != nil || v.IsNull() {
+		return core.Value{}, false
+	}
+	return v, true
+}
+
+// カラムを含まない数値の式なら、その値を返す
+func numericConstant(expr sql.Expr) (float64, bool) {
+	v, ok := constantValue(expr)
+	if !ok {
+		return 0, false
+	}
+	switch v.Type {
+	case core.VALUE_INTEGER:
+		return float64(v.Integer), true
+	case core.VALUE_REAL:
+		return v.Real, true
+	default:
+		return 0, false
+	}
+}
+
+// 比較の向きを逆にする（1 < id を id > 1 にする）
+var flippedOperators = map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// 主キー op 値 の条件で、範囲を狭める
+func (r *keyRange) restrict(op string, v float64) {
+	switch op {
+	case "=":
+		if v != math.Trunc(v) {
+			// 整数のキーと一致することはない
+			r.low, r.high = 1, 0
+			return
+		}
+		r.restrict(">=", v)
+		r.restrict("<=", v)
+	case ">":
+		r.restrict(">=", math.Floor(v)+1)
+	case ">=":
+		if low := math.Ceil(v); low > float64(r.low) {
+			r.low = int64(math.Min(low, math.MaxUint32+1))
+		}
+	case "<":
+		r.restrict("<=", math.Ceil(v)-1)
+	case "<=":
+		if high := math.Floor(v); high < float64(r.high) {
+			r.high = int64(math.Max(high, -1))
+		}
+	}
+}
+
+// WHERE句から、主キーが取りうる範囲を求める。
+// ANDでつながった条件のうち、主キーと定数を比較するものだけを使う。それ以外の条件は、行ごとに評価して確認する
+func primaryKeyRange(where sql.Expr, schema *db.Schema) keyRange {
+	r := fullKeyRange
+
+	for _, cond := range conjuncts(where) {
+		switch cond := cond.(type) {
+		case *sql.BinaryExpr:
+			op, ok := flippedOperators[cond.Op]
+			if !ok {
+				continue
+			}
+			if isPrimaryKey(cond.X, schema) {
+				if v, ok := numericConstant(cond.Y); ok {
+					r.restrict(cond.Op, v)
+				}
+			} else if isPrimaryKey(cond.Y, schema) {
+				if v, ok := numericConstant(cond.X); ok {
+					r.restrict(op, v)
+				}
+			}
+		case *sql.BetweenExpr:
+			if cond.Not || !isPrimaryKey(cond.X, schema) {
+				continue
+			}
+			if v, ok := numericConstant(cond.Low); ok {
+				r.restrict(">=", v)
+			}
+			if v, ok := numericConstant(cond.High); ok {
+				r.restrict("<=", v)
+			}
+		}
+	}
+	return r
+}
+
+// インデックスで読む値の範囲。lowかhighがnilの場合は、その側を制限しない
+type indexRange struct {
+	index *db.Index
+	low   *db.IndexBound
+	high  *db.IndexBound
+}
+
+// EXPLAINで表示する、インデックスのカラムの条件
+func (r *indexRange) describe(column string) string {
+	if r.isEqual() {
+		return column + " = " + sql.FormatExpr(valueLiteral(r.low.Value))
+	}
+	var conds []string
+	if r.low != nil {
+		op := ">"
+		if r.low.Inclusive {
+			op = ">="
+		}
+		conds = append(conds, column+" "+op+" "+sql.FormatExpr(valueLiteral(r.low.Value)))
+	}
+	if r.high != nil {
+		op := "<"
+		if r.high.Inclusive {
+			op = "<="
+		}
+		conds = append(conds, column+" "+op+" "+sql.FormatExpr(valueLiteral(r.high.Value)))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// 値が1つに決まる範囲ならtrue
+func (r *indexRange) isEqual() bool {
+	return r.low != nil && r.high != nil && r.low.Inclusive && r.high.Inclusive && core.Compare(r.low.Value, r.high.Value) == 0
+}
+
+// インデックスのカラム op 値 の条件で、範囲を狭める
+func (r *indexRange) restrict(op string, v core.Value) {
+	bound := &db.IndexBound{Value: v, Inclusive: op == ">=" || op == "<="}
+	switch op {
+	case "=":
+		r.restrict(">=", v)
+		r.restrict("<=", v)
+	case ">", ">=":
+		if r.low == nil {
+			r.low = bound
+		} else if c := core.Compare(v, r.low.Value); c > 0 || (c == 0 && !bound.Inclusive) {
+			r.low = bound
+		}
+	case "<", "<=":
+		if r.high == nil {
+			r.high = bound
+		} else if c := core.Compare(v, r.high.Value); c < 0 || (c == 0 && !bound.Inclusive) {
+			r.high = bound
+		}
+	}
+}
+
+// WHERE句から、インデックスで読む範囲を決める。使えるインデックスがなければnilを返す。
+// 値が1つに決まるインデックスを優先し、なければ範囲が決まる最初のインデックスを使う
+func indexRangeFor(where sql.Expr, table *db.Table) *indexRange {
+	schema := table.Schema()
+	var best *indexRange
+	for _, index := range table.Indexes() {
+		isIndexed := func(expr sql.Expr) bool {
+			column, ok := expr.(*sql.ColumnRef)
+			return ok && schema.ColumnIndex(column.Name) == index.Column()
+		}
+
+		r := &indexRange{index: index}
+		for _, cond := range conjuncts(where) {
+			switch cond := cond.(type) {
+			case *sql.BinaryExpr:
+				op, ok := flippedOperators[cond.Op]
+				if !ok {
+					continue
+				}
+				if isIndexed(cond.X) {
+					if v, ok := constantValue(cond.Y); ok {
+						r.restrict(cond.Op, v)
+					}
+				} else if isIndexed(cond.Y) {
+					if v, ok := constantValue(cond.X); ok {
+						r.restrict(op, v)
+					}
+				}
+			case *sql.BetweenExpr:
+				if cond.Not || !isIndexed(cond.X) {
+					continue
+				}
+				if v, ok := constantValue(cond.Low); ok {
+					r.restrict(">=", v)
+				}
+				if v, ok := constantValue(cond.High); ok {
+					r.restrict("<=", v)
+				}
+			}
+		}
+
+		if r.low == nil && r.high == nil {
+			continue
+		}
+		if r.isEqual() {
+			return r
+		}
+		if best == nil {
+			best = r
+		}
+	}
+	return best
+}
+
+// WHERE句の行を、インデックスで探すならtrue。主キーの範囲が決まる場合は、主キーで探す
+func usesIndex(where sql.Expr, table *db.Table) bool {
+	return primaryKeyRange(where, table.Schema()).isFull() && indexRangeFor(where, table) != nil
+}
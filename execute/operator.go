@@ -0,0 +1,387 @@
+package execute
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"toydb-go/core"
+	"toydb-go/persistence"
+	"toydb-go/sql"
+	db "toydb-go/table"
+)
+
+// 行を1つずつ返す演算子。演算子は子の演算子から行を取り出して処理し、木にして組み合わせる。
+// Openで読み始め、Nextがnilを返すまで行を取り出し、最後にCloseする。
+// Openがエラーを返した場合もCloseを呼ぶので、Closeは途中まで開いた状態でも後始末できるようにする
+type operator interface {
+	Open() error
+	// 次の行を返す。行がなくなったらnilを返す
+	Next() (*rowContext, error)
+	Close()
+	// EXPLAINで表示する、演算子の1行の説明
+	explain() string
+	// 子の演算子のフィールド。EXPLAIN ANALYZEでは、子を統計を数える演算子に置き換える
+	children() []*operator
+}
+
+// 演算子の全ての行をfnに渡す。fnがerrStopScanを返すと、エラーにせずに止める
+func drain(op operator, fn func(row *rowContext) error) error {
+	defer op.Close()
+	if err := op.Open(); err != nil {
+		return err
+	}
+	for {
+		row, err := op.Next()
+		if err != nil || row == nil {
+			return err
+		}
+		if err := fn(row); err == errStopScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// 演算子のエラーを、ステートメントの結果にする。
+// B-treeやレコードが壊れていた場合はEXECUTE_CORRUPT、式の評価などに失敗した場合はEXECUTE_ERRORになる
+func resultFor(err error) ExecuteResult {
+	if errors.Is(err, persistence.ErrCorrupt) {
+		return EXECUTE_CORRUPT
+	}
+	return EXECUTE_ERROR
+}
+
+// テーブルの行を読めなかったエラー
+func corruptRowError(table *db.Table, err error) error {
+	return fmt.Errorf("%w: table %s: %s", persistence.ErrCorrupt, table.Schema().Name, err.Error())
+}
+
+// テーブルのB-treeを、主キーの範囲だけキーの順番に読む演算子。
+// 範囲の下限からはTableSeek、降順の場合は上限からTableFindLastで読み始め、範囲がなければTableStartから全て読む
+type tableScan struct {
+	table *db.Table
+	keys  keyRange
+	// キーの大きい順に読むならtrue
+	desc   bool
+	cursor *db.Cursor
+}
+
+func (op *tableScan) Open() error {
+	switch {
+	case op.keys.isEmpty():
+		op.cursor = nil
+	case op.desc:
+		op.cursor = db.TableFindLast(op.table, uint32(op.keys.high))
+	case op.keys.isFull():
+		op.cursor = db.TableStart(op.table)
+	default:
+		op.cursor = db.TableSeek(op.table, uint32(op.keys.low))
+	}
+	return nil
+}
+
+func (op *tableScan) Next() (*rowContext, error) {
+	if op.cursor == nil || op.cursor.EndOfTable {
+		return nil, nil
+	}
+	key := db.CursorKey(op.cursor)
+	if int64(key) < op.keys.low || int64(key) > op.keys.high {
+		op.cursor.EndOfTable = true
+		return nil, nil
+	}
+	row, err := op.table.GetRowByCursor(op.cursor.PageNum, op.cursor.CellNum)
+	if err != nil {
+		return nil, corruptRowError(op.table, err)
+	}
+
+	if op.desc {
+		db.CursorRetreat(op.cursor)
+	} else {
+		db.CursorAdvance(op.cursor)
+	}
+	return &rowContext{schema: op.table.Schema(), values: row, key: key}, nil
+}
+
+func (op *tableScan) Close() {
+	op.cursor = nil
+}
+
+func (op *tableScan) explain() string {
+	schema := op.table.Schema()
+	switch {
+	case op.keys.isEmpty():
+		return fmt.Sprintf("SEARCH %s USING PRIMARY KEY: empty range, no rows read", schema.Name)
+	case op.keys.isFull() && op.desc:
+		return fmt.Sprintf("SCAN %s: full leaf scan backward from TableFindLast", schema.Name)
+	case op.keys.isFull():
+		return fmt.Sprintf("SCAN %s: full leaf scan from TableStart", schema.Name)
+	}
+
+	keys := op.keys.describe(schema.Columns[schema.PrimaryKey].Name)
+	if op.desc {
+		return fmt.Sprintf("SEARCH %s USING PRIMARY KEY (%s): seek backward via TableFindLast", schema.Name, keys)
+	}
+	return fmt.Sprintf("SEARCH %s USING PRIMARY KEY (%s): seek via TableFind", schema.Name, keys)
+}
+
+func (op *tableScan) children() []*operator {
+	return nil
+}
+
+// インデックスの値の範囲のエントリから行を読む演算子。行はインデックスの値の順番になる
+type indexScan struct {
+	table *db.Table
+	r     *indexRange
+	it    *db.IndexIterator
+}
+
+func (op *indexScan) Open() error {
+	it, err := op.r.index.Iterate(op.r.low, op.r.high)
+	if err != nil {
+		return err
+	}
+	op.it = it
+	return nil
+}
+
+func (op *indexScan) Next() (*rowContext, error) {
+	key, ok, err := op.it.Next()
+	if err != nil || !ok {
+		return nil, err
+	}
+	row, found, err := op.table.GetRow(key)
+	if err != nil {
+		return nil, corruptRowError(op.table, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: index %s refers to missing row %d", persistence.ErrCorrupt, op.r.index.Name(), key)
+	}
+	return &rowContext{schema: op.table.Schema(), values: row, key: key}, nil
+}
+
+func (op *indexScan) Close() {
+	op.it = nil
+}
+
+func (op *indexScan) explain() string {
+	schema := op.table.Schema()
+	column := schema.Columns[op.r.index.Column()].Name
+	return fmt.Sprintf("SEARCH %s USING INDEX %s (%s): seek via IndexSeek",
+		schema.Name, op.r.index.Name(), op.r.describe(column))
+}
+
+func (op *indexScan) children() []*operator {
+	return nil
+}
+
+// 条件を満たす行だけを返す演算子。WHERE句とHAVING句に使う
+type filter struct {
+	child operator
+	cond  sql.Expr
+}
+
+func (op *filter) Open() error {
+	return op.child.Open()
+}
+
+func (op *filter) Next() (*rowContext, error) {
+	for {
+		row, err := op.child.Next()
+		if err != nil || row == nil {
+			return nil, err
+		}
+		ok, err := matches(op.cond, *row)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return row, nil
+		}
+	}
+}
+
+func (op *filter) Close() {
+	op.child.Close()
+}
+
+func (op *filter) explain() string {
+	return "FILTER " + sql.FormatExpr(op.cond)
+}
+
+func (op *filter) children() []*operator {
+	return []*operator{&op.child}
+}
+
+// 行について式のリストを評価して、その値を行として返す演算子。返す行はカラムを参照できない
+type project struct {
+	child operator
+	exprs []sql.Expr
+}
+
+func (op *project) Open() error {
+	return op.child.Open()
+}
+
+func (op *project) Next() (*rowContext, error) {
+	row, err := op.child.Next()
+	if err != nil || row == nil {
+		return nil, err
+	}
+	values, err := evalList(op.exprs, *row)
+	if err != nil {
+		return nil, err
+	}
+	return &rowContext{values: values}, nil
+}
+
+func (op *project) Close() {
+	op.child.Close()
+}
+
+func (op *project) explain() string {
+	return "PROJECT " + formatExprList(op.exprs)
+}
+
+func (op *project) children() []*operator {
+	return []*operator{&op.child}
+}
+
+// 式のリストを、カンマで区切った文字列にする
+func formatExprList(exprs []sql.Expr) string {
+	texts := make([]string, len(exprs))
+	for i, expr := range exprs {
+		texts[i] = sql.FormatExpr(expr)
+	}
+	return strings.Join(texts, ", ")
+}
+
+// OFFSET句の行を読み飛ばし、LIMIT句の行数を返したら止める演算子。limitが負なら制限しない
+type limit struct {
+	child  operator
+	offset int64
+	limit  int64
+	// まだ返せる行数と、まだ読み飛ばす行数
+	remaining int64
+	skip      int64
+}
+
+func (op *limit) Open() error {
+	op.remaining, op.skip = op.limit, op.offset
+	if op.limit == 0 {
+		// 行を返さないので、子を開かない
+		return nil
+	}
+	return op.child.Open()
+}
+
+func (op *limit) Next() (*rowContext, error) {
+	for op.remaining != 0 {
+		row, err := op.child.Next()
+		if err != nil || row == nil {
+			return nil, err
+		}
+		if op.skip > 0 {
+			op.skip--
+			continue
+		}
+		if op.remaining > 0 {
+			op.remaining--
+		}
+		return row, nil
+	}
+	return nil, nil
+}
+
+func (op *limit) Close() {
+	op.child.Close()
+}
+
+func (op *limit) explain() string {
+	if op.limit < 0 {
+		return fmt.Sprintf("OFFSET %d", op.offset)
+	}
+	if op.offset == 0 {
+		return fmt.Sprintf("LIMIT %d", op.limit)
+	}
+	return fmt.Sprintf("LIMIT %d OFFSET %d", op.limit, op.offset)
+}
+
+func (op *limit) children() []*operator {
+	return []*operator{&op.child}
+}
+
+// 左の行ごとに右の演算子を開き直して、条件を満たす行の組を返す演算子（ネステッドループ結合）。
+// 結合した行は、左の行のカラムの後ろに右の行のカラムを並べたもの。condがnilなら全ての組を返す
+type nestedLoopJoin struct {
+	left  operator
+	right operator
+	cond  sql.Expr
+	// 結合した行のスキーマ
+	schema *db.Schema
+	// 右の行と組み合わせている左の行。nilなら次の左の行を読む
+	leftRow *rowContext
+}
+
+// 2つのテーブルのカラムを並べたスキーマを返す。同じ名前のカラムは、左のテーブルのカラムを参照する
+func joinSchema(left *db.Schema, right *db.Schema) *db.Schema {
+	columns := append(append([]db.Column{}, left.Columns...), right.Columns...)
+	return &db.Schema{Name: left.Name + ", " + right.Name, Columns: columns, PrimaryKey: -1}
+}
+
+func (op *nestedLoopJoin) Open() error {
+	op.leftRow = nil
+	return op.left.Open()
+}
+
+func (op *nestedLoopJoin) Next() (*rowContext, error) {
+	for {
+		if op.leftRow == nil {
+			row, err := op.left.Next()
+			if err != nil || row == nil {
+				return nil, err
+			}
+			op.leftRow = row
+			op.right.Close()
+			if err := op.right.Open(); err != nil {
+				return nil, err
+			}
+		}
+
+		rightRow, err := op.right.Next()
+		if err != nil {
+			return nil, err
+		}
+		if rightRow == nil {
+			op.leftRow = nil
+			continue
+		}
+		values := make([]core.Value, 0, len(op.leftRow.values)+len(rightRow.values))
+		values = append(append(values, op.leftRow.values...), rightRow.values...)
+		row := &rowContext{schema: op.schema, values: values}
+		ok, err := matches(op.cond, *row)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return row, nil
+		}
+	}
+}
+
+func (op *nestedLoopJoin) Close() {
+	op.leftRow = nil
+	op.left.Close()
+	op.right.Close()
+}
+
+func (op *nestedLoopJoin) explain() string {
+	if op.cond == nil {
+		return "NESTED LOOP JOIN"
+	}
+	return "NESTED LOOP JOIN ON " + sql.FormatExpr(op.cond)
+}
+
+func (op *nestedLoopJoin) children() []*operator {
+	return []*operator{&op.left, &op.right}
+}
@@ -0,0 +1,180 @@
+package execute
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"toydb-go/core"
+	"toydb-go/sql"
+	db "toydb-go/table"
+)
+
+// 決まった行を返す演算子。Nextを呼んだ回数を数える
+type valuesOperator struct {
+	rows   [][]core.Value
+	pos    int
+	nexts  int
+	closed bool
+}
+
+func (op *valuesOperator) Open() error {
+	op.pos, op.closed = 0, false
+	return nil
+}
+
+func (op *valuesOperator) Next() (*rowContext, error) {
+	op.nexts++
+	if op.pos >= len(op.rows) {
+		return nil, nil
+	}
+	op.pos++
+	return &rowContext{values: op.rows[op.pos-1]}, nil
+}
+
+func (op *valuesOperator) Close() {
+	op.closed = true
+}
+
+func (op *valuesOperator) explain() string {
+	return fmt.Sprintf("VALUES (%d rows)", len(op.rows))
+}
+
+func (op *valuesOperator) children() []*operator {
+	return nil
+}
+
+// 演算子の全ての行の値を集める
+func collectRows(t *testing.T, op operator) [][]core.Value {
+	t.Helper()
+	var rows [][]core.Value
+	if err := drain(op, func(row *rowContext) error {
+		rows = append(rows, row.values)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func getTestTable(t *testing.T, session *Session, name string) *db.Table {
+	table, found := session.database.GetTable(name)
+	if !found {
+		t.Fatalf("no such table: %s", name)
+	}
+	return table
+}
+
+func TestComposeOperators(t *testing.T) {
+	session := openTestSession(t)
+	for _, text := range []string{
+		"insert into users values (1, 'alice', 3)",
+		"insert into users values (2, 'bob', 1)",
+		"insert into users values (3, 'carol', 5)",
+		"insert into users values (4, 'dave', 4)",
+		"insert into users values (5, 'eve', 2)",
+	} {
+		runStatement(t, session, text)
+	}
+	users := getTestTable(t, session, "users")
+
+	// score > 1 の行を、scoreの降順に並べて、2行目から2行
+	name, score := &sql.ColumnRef{Name: "name"}, &sql.ColumnRef{Name: "score"}
+	op := &limit{
+		child: &sortOperator{
+			child: &project{
+				child: &filter{child: &tableScan{table: users, keys: fullKeyRange}, cond: parseWhere(t, "score > 1")},
+				exprs: []sql.Expr{name, score},
+			},
+			numColumns: 1,
+			orderBy:    []sql.OrderingTerm{{Expr: score, Desc: true}},
+		},
+		offset: 1,
+		limit:  2,
+	}
+	expected := [][]core.Value{{core.TextValue("dave")}, {core.TextValue("alice")}}
+	if rows := collectRows(t, op); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %v, but got %v", expected, rows)
+	}
+
+	// 主キーの範囲を、降順に読む
+	scan := &tableScan{table: users, keys: keyRange{low: 2, high: 4}, desc: true}
+	var keys []uint32
+	drain(scan, func(row *rowContext) error {
+		keys = append(keys, row.key)
+		return nil
+	})
+	if !reflect.DeepEqual(keys, []uint32{4, 3, 2}) {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+}
+
+// LIMIT句の行数を返したら、子から行を読まない
+func TestLimitStopsPulling(t *testing.T) {
+	child := &valuesOperator{}
+	for i := 0; i < 100; i++ {
+		child.rows = append(child.rows, []core.Value{core.IntegerValue(int64(i))})
+	}
+
+	rows := collectRows(t, &limit{child: child, offset: 3, limit: 2})
+	if expected := [][]core.Value{{core.IntegerValue(3)}, {core.IntegerValue(4)}}; !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %v, but got %v", expected, rows)
+	}
+	if child.nexts != 5 || !child.closed {
+		t.Errorf("expected 5 calls to Next and Close, but got %d calls (closed: %v)", child.nexts, child.closed)
+	}
+}
+
+func TestIndexScan(t *testing.T) {
+	session := openTestSession(t)
+	runStatement(t, session, "create index by_name on users(name)")
+	for i, name := range []string{"dave", "alice", "carol", "bob", "eve"} {
+		runStatement(t, session, "insert into users values (?, ?, NULL)",
+			Param{Ordinal: 1, Value: core.IntegerValue(int64(i + 1))}, Param{Ordinal: 2, Value: core.TextValue(name)})
+	}
+	users := getTestTable(t, session, "users")
+
+	// インデックスで読むので、名前の順番になる
+	op := scanOperator(users, parseWhere(t, "name between 'b' and 'd'"), false)
+	if _, ok := op.(*filter).child.(*indexScan); !ok {
+		t.Fatalf("expected an index scan, but got %T", op.(*filter).child)
+	}
+	var names []string
+	for _, row := range collectRows(t, &project{child: op, exprs: []sql.Expr{&sql.ColumnRef{Name: "name"}}}) {
+		names = append(names, row[0].Text)
+	}
+	if !reflect.DeepEqual(names, []string{"bob", "carol"}) {
+		t.Errorf("unexpected rows: %v", names)
+	}
+}
+
+func TestNestedLoopJoin(t *testing.T) {
+	session := openTestSession(t)
+	runStatement(t, session, "create table orders (order_id integer primary key, user_id integer, amount real)")
+	for _, text := range []string{
+		"insert into users values (1, 'alice', NULL)",
+		"insert into users values (2, 'bob', NULL)",
+		"insert into users values (3, 'carol', NULL)",
+		"insert into orders values (10, 2, 1.5)",
+		"insert into orders values (11, 1, 2.5)",
+		"insert into orders values (12, 2, 3.5)",
+	} {
+		runStatement(t, session, text)
+	}
+	users, orders := getTestTable(t, session, "users"), getTestTable(t, session, "orders")
+
+	join := &nestedLoopJoin{
+		left:   &tableScan{table: users, keys: fullKeyRange},
+		right:  &tableScan{table: orders, keys: fullKeyRange},
+		cond:   parseWhere(t, "id = user_id"),
+		schema: joinSchema(users.Schema(), orders.Schema()),
+	}
+	op := &project{child: join, exprs: []sql.Expr{&sql.ColumnRef{Name: "name"}, &sql.ColumnRef{Name: "order_id"}}}
+	expected := [][]core.Value{
+		{core.TextValue("alice"), core.IntegerValue(11)},
+		{core.TextValue("bob"), core.IntegerValue(10)},
+		{core.TextValue("bob"), core.IntegerValue(12)},
+	}
+	if rows := collectRows(t, op); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %v, but got %v", expected, rows)
+	}
+}
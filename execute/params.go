@@ -0,0 +1,222 @@
+package execute
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"toydb-go/core"
+	"toydb-go/sql"
+	db "toydb-go/table"
+)
+
+// ステートメントのパラメータにバインドする値。
+// Nameが空でなければ同じ名前のパラメータに、空ならOrdinal番目（1始まり）のパラメータに対応させる
+type Param struct {
+	Name    string
+	Ordinal int
+	Value   core.Value
+}
+
+var ErrMissingParam = errors.New("missing value for parameter")
+
+// ステートメントのパラメータを、値のリテラルに置き換える。
+// 値のないパラメータがある場合と、値がtypesの型（パラメータの番号ごと）に合わない場合はエラーを返す
+func bindParams(stmt sql.Statement, params []Param, types map[int]db.ColumnType) (sql.Statement, error) {
+	return sql.ReplaceParams(stmt, paramBinder(params, types))
+}
+
+// パラメータを、paramsの値のリテラルに置き換える関数を返す。sql.ReplaceParamsとsql.ReplaceExprParamsに渡す
+func paramBinder(params []Param, types map[int]db.ColumnType) func(param *sql.Param) (sql.Expr, error) {
+	named := map[string]core.Value{}
+	positional := map[int]core.Value{}
+	for _, param := range params {
+		if param.Name != "" {
+			named[param.Name] = param.Value
+		} else {
+			positional[param.Ordinal] = param.Value
+		}
+	}
+
+	return func(param *sql.Param) (sql.Expr, error) {
+		v, ok := named[param.Name]
+		if !ok || param.Name == "" {
+			if v, ok = positional[param.Index]; !ok {
+				return nil, fmt.Errorf("%w %s", ErrMissingParam, sql.FormatExpr(param))
+			}
+		}
+		if t, ok := types[param.Index]; ok && !t.Accepts(v) {
+			return nil, fmt.Errorf("%w: parameter %s expects %s, but got %s", db.ErrTypeMismatch, sql.FormatExpr(param), t, v.Type)
+		}
+		return valueLiteral(v), nil
+	}
+}
+
+// 値をリテラルにする。評価すると同じ値に戻る
+func valueLiteral(v core.Value) sql.Expr {
+	switch v.Type {
+	case core.VALUE_INTEGER:
+		return &sql.Literal{Kind: sql.LITERAL_INTEGER, Value: strconv.FormatInt(v.Integer, 10)}
+	case core.VALUE_REAL:
+		return &sql.Literal{Kind: sql.LITERAL_FLOAT, Value: strconv.FormatFloat(v.Real, 'g', -1, 64)}
+	case core.VALUE_TEXT:
+		return &sql.Literal{Kind: sql.LITERAL_STRING, Value: v.Text}
+	case core.VALUE_BLOB:
+		return &sql.Literal{Kind: sql.LITERAL_BLOB, Value: hex.EncodeToString(v.Blob)}
+	default:
+		return &sql.Literal{Kind: sql.LITERAL_NULL}
+	}
+}
+
+// ステートメントのパラメータの番号と名前を、現れた順番に返す
+func collectParams(stmt sql.Statement) []*sql.Param {
+	var params []*sql.Param
+	sql.ReplaceParams(stmt, func(param *sql.Param) (sql.Expr, error) {
+		params = append(params, param)
+		return param, nil
+	})
+	return params
+}
+
+// パラメータが比較するカラムや、値を入れるカラムから、パラメータの型を推測する。
+// 型が決まらないパラメータと、別々の型のカラムに使われているパラメータは含まない
+func inferParamTypes(stmt sql.Statement, database *db.Database) map[int]db.ColumnType {
+	inferrer := &typeInferrer{types: map[int]db.ColumnType{}, conflicts: map[int]bool{}}
+
+	switch stmt := stmt.(type) {
+	case *sql.InsertStmt:
+		schema := lookupSchema(stmt.Table, database)
+		if schema == nil {
+			break
+		}
+		for i, value := range stmt.Values {
+			column := i
+			if len(stmt.Columns) > 0 {
+				if i >= len(stmt.Columns) {
+					break
+				}
+				column = schema.ColumnIndex(stmt.Columns[i])
+			}
+			if column >= 0 && column < len(schema.Columns) {
+				inferrer.set(value, schema.Columns[column].Type)
+			}
+		}
+	case *sql.SelectStmt:
+		inferrer.schema = lookupSchema(stmt.From, database)
+		inferrer.walk(stmt.Where)
+		inferrer.walk(stmt.Having)
+		inferrer.set(stmt.Limit, db.COLUMN_INTEGER)
+		inferrer.set(stmt.Offset, db.COLUMN_INTEGER)
+	case *sql.UpdateStmt:
+		inferrer.schema = lookupSchema(stmt.Table, database)
+		if inferrer.schema != nil {
+			for _, assignment := range stmt.Set {
+				if column := inferrer.schema.ColumnIndex(assignment.Column); column >= 0 {
+					inferrer.set(assignment.Value, inferrer.schema.Columns[column].Type)
+				}
+			}
+		}
+		inferrer.walk(stmt.Where)
+	case *sql.DeleteStmt:
+		inferrer.schema = lookupSchema(stmt.Table, database)
+		inferrer.walk(stmt.Where)
+	case *sql.ExplainStmt:
+		return inferParamTypes(stmt.Stmt, database)
+	}
+
+	for index := range inferrer.conflicts {
+		delete(inferrer.types, index)
+	}
+	return inferrer.types
+}
+
+// テーブルの定義を返す。テーブル名が空ならチュートリアル形式のテーブル。テーブルがなければnilを返す
+func lookupSchema(name string, database *db.Database) *db.Schema {
+	if name == "" {
+		name = db.DEFAULT_TABLE_NAME
+	}
+	table, found := database.GetTable(name)
+	if !found {
+		return nil
+	}
+	return table.Schema()
+}
+
+type typeInferrer struct {
+	// 式のカラムを探すテーブル。nilならカラムの型は分からない
+	schema    *db.Schema
+	types     map[int]db.ColumnType
+	conflicts map[int]bool
+}
+
+// 式がパラメータなら、型を記録する
+func (inferrer *typeInferrer) set(expr sql.Expr, t db.ColumnType) {
+	param, ok := expr.(*sql.Param)
+	if !ok {
+		return
+	}
+	if other, ok := inferrer.types[param.Index]; ok && other != t {
+		inferrer.conflicts[param.Index] = true
+	}
+	inferrer.types[param.Index] = t
+}
+
+// columnがカラムで、otherがパラメータなら、パラメータの型をカラムの型にする
+func (inferrer *typeInferrer) compare(column sql.Expr, other sql.Expr) {
+	ref, ok := column.(*sql.ColumnRef)
+	if !ok || inferrer.schema == nil {
+		return
+	}
+	if index := inferrer.schema.ColumnIndex(ref.Name); index >= 0 {
+		inferrer.set(other, inferrer.schema.Columns[index].Type)
+	}
+}
+
+var comparisonOperators = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// 条件の中の比較から、パラメータの型を推測する
+func (inferrer *typeInferrer) walk(expr sql.Expr) {
+	switch e := expr.(type) {
+	case *sql.UnaryExpr:
+		inferrer.walk(e.X)
+	case *sql.BinaryExpr:
+		if comparisonOperators[e.Op] {
+			inferrer.compare(e.X, e.Y)
+			inferrer.compare(e.Y, e.X)
+		}
+		inferrer.walk(e.X)
+		inferrer.walk(e.Y)
+	case *sql.InExpr:
+		for _, item := range e.List {
+			inferrer.compare(e.X, item)
+			inferrer.walk(item)
+		}
+		inferrer.walk(e.X)
+	case *sql.BetweenExpr:
+		inferrer.compare(e.X, e.Low)
+		inferrer.compare(e.X, e.High)
+		inferrer.walk(e.X)
+		inferrer.walk(e.Low)
+		inferrer.walk(e.High)
+	case *sql.IsNullExpr:
+		inferrer.walk(e.X)
+	case *sql.FuncCall:
+		for _, arg := range e.Args {
+			inferrer.walk(arg)
+		}
+	}
+}
+
+// PREPARE文で指定したパラメータの型を返す
+func declaredParamTypes(names []string) (map[int]db.ColumnType, error) {
+	types := map[int]db.ColumnType{}
+	for i, name := range names {
+		t, ok := db.ParseColumnType(strings.ToUpper(name))
+		if !ok {
+			return nil, fmt.Errorf("unknown type %s for parameter $%d", name, i+1)
+		}
+		types[i+1] = t
+	}
+	return types, nil
+}
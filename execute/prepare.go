@@ -0,0 +1,464 @@
+package execute
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"toydb-go/core"
+	"toydb-go/sql"
+	db "toydb-go/table"
+)
+
+type PrepareResult int
+
+const (
+	PREPARE_SUCCESS PrepareResult = iota + 1
+	PREPARE_UNRECOGNIZED_STATEMENT
+	PREPARE_SYNTAX_ERROR
+	PREPARE_STRING_TOO_LONG
+	PREPARE_NEGATIVE_ID
+	PREPARE_NO_SUCH_TABLE
+	PREPARE_INVALID_VALUE
+	PREPARE_INVALID_SCHEMA
+	PREPARE_READ_ONLY_TABLE
+	PREPARE_NO_SUCH_COLUMN
+)
+
+// パラメータに値をバインドする前に準備したステートメント。Planにキャッシュして、バインドするたびに使う
+type preparedStatement struct {
+	// パラメータをsql.Paramのまま残したステートメント
+	statement core.Statement
+	// insert only: 値を確認するテーブルの定義と、テーブルのカラムの順番に並べた値の式（指定しなかったカラムはnil）。
+	// 値は、パラメータをバインドしてから評価する
+	schema *db.Schema
+	values []sql.Expr
+	// select only: LIMIT句とOFFSET句の式。パラメータをバインドしてから評価する
+	limit  sql.Expr
+	offset sql.Expr
+}
+
+// 構文木から、ステートメントを準備する。パラメータの値は、bindでバインドする
+func prepareParsed(stmt sql.Statement, prepared *preparedStatement, database *db.Database) (PrepareResult, error) {
+	switch stmt := stmt.(type) {
+	case *sql.InsertStmt:
+		return prepareInsert(stmt, prepared, database)
+	case *sql.SelectStmt:
+		return prepareSelect(stmt, prepared, database)
+	case *sql.CreateTableStmt:
+		return prepareCreateTable(stmt, &prepared.statement, database)
+	case *sql.CreateIndexStmt:
+		return prepareCreateIndex(stmt, &prepared.statement, database)
+	case *sql.UpdateStmt:
+		return prepareUpdate(stmt, &prepared.statement, database)
+	case *sql.DeleteStmt:
+		return prepareDelete(stmt, &prepared.statement, database)
+	case *sql.TransactionStmt:
+		prepared.statement.Type = transactionStatements[stmt.Kind]
+		return PREPARE_SUCCESS, nil
+	case *sql.ExplainStmt:
+		return prepareExplain(stmt, prepared, database)
+	default:
+		return PREPARE_UNRECOGNIZED_STATEMENT, nil
+	}
+}
+
+// 準備したステートメントのパラメータにparamsの値をバインドして、実行するステートメントを作成する。
+// 値の型はtypes（パラメータの番号ごと）で確認する。INSERT文の値と、LIMIT句とOFFSET句は、ここで評価する
+func (prepared *preparedStatement) bind(params []Param, types map[int]db.ColumnType, statement *core.Statement) (PrepareResult, error) {
+	*statement = prepared.statement
+
+	// 準備したステートメントの式は共有しているので、置き換えたコピーを作る
+	replace := paramBinder(params, types)
+	var bindErr error
+	bind := func(expr sql.Expr) sql.Expr {
+		if expr == nil || bindErr != nil {
+			return expr
+		}
+		bound, err := sql.ReplaceExprParams(expr, replace)
+		bindErr = err
+		return bound
+	}
+	bindList := func(exprs []sql.Expr) []sql.Expr {
+		if exprs == nil {
+			return nil
+		}
+		bound := make([]sql.Expr, len(exprs))
+		for i, expr := range exprs {
+			bound[i] = bind(expr)
+		}
+		return bound
+	}
+
+	statement.Where = bind(statement.Where)
+	statement.Columns = bindList(statement.Columns)
+	statement.GroupBy = bindList(statement.GroupBy)
+	statement.Having = bind(statement.Having)
+	if statement.OrderBy != nil {
+		statement.OrderBy = make([]sql.OrderingTerm, len(prepared.statement.OrderBy))
+		for i, term := range prepared.statement.OrderBy {
+			statement.OrderBy[i] = sql.OrderingTerm{Expr: bind(term.Expr), Desc: term.Desc}
+		}
+	}
+	if statement.Set != nil {
+		statement.Set = make([]sql.Assignment, len(prepared.statement.Set))
+		for i, assignment := range prepared.statement.Set {
+			statement.Set[i] = sql.Assignment{Column: assignment.Column, Value: bind(assignment.Value)}
+		}
+	}
+	values := bindList(prepared.values)
+	limit, offset := bind(prepared.limit), bind(prepared.offset)
+	if bindErr != nil {
+		return PREPARE_INVALID_VALUE, bindErr
+	}
+
+	switch statement.Type {
+	case core.STATEMENT_INSERT:
+		return bindInsertValues(values, prepared.schema, statement)
+	case core.STATEMENT_SELECT:
+		var err error
+		if statement.Limit, err = evalCount(limit, "LIMIT", -1); err != nil {
+			return PREPARE_INVALID_VALUE, err
+		}
+		if statement.Offset, err = evalCount(offset, "OFFSET", 0); err != nil {
+			return PREPARE_INVALID_VALUE, err
+		}
+	}
+	return PREPARE_SUCCESS, nil
+}
+
+// EXPLAIN文を準備する。説明するステートメントを準備して、結果を演算子の木の1行ずつにする
+func prepareExplain(stmt *sql.ExplainStmt, prepared *preparedStatement, database *db.Database) (PrepareResult, error) {
+	if result, err := prepareParsed(stmt.Stmt, prepared, database); result != PREPARE_SUCCESS {
+		return result, err
+	}
+	statement := &prepared.statement
+	statement.Explain = core.EXPLAIN_QUERY_PLAN
+	if stmt.Analyze {
+		statement.Explain = core.EXPLAIN_ANALYZE
+	}
+	statement.ColumnNames = []string{"plan"}
+	return PREPARE_SUCCESS, nil
+}
+
+var transactionStatements = map[sql.TransactionKind]core.StatementType{
+	sql.TRANSACTION_BEGIN:    core.STATEMENT_BEGIN,
+	sql.TRANSACTION_COMMIT:   core.STATEMENT_COMMIT,
+	sql.TRANSACTION_ROLLBACK: core.STATEMENT_ROLLBACK,
+}
+
+// テーブルの定義を返す。writeがtrueの場合は、変更できるテーブルか確認する。
+// チュートリアル形式の場合はテーブル名が空になり、まだ作っていなければusersテーブルの定義を返す
+func getSchema(name string, database *db.Database, write bool) (*db.Schema, PrepareResult, error) {
+	if name == "" {
+		if table, found := database.GetTable(db.DEFAULT_TABLE_NAME); found {
+			return table.Schema(), PREPARE_SUCCESS, nil
+		}
+		schema, err := db.NewSchema(db.DefaultTableStmt())
+		return schema, PREPARE_SUCCESS, err
+	}
+
+	table, found := database.GetTable(name)
+	if !found {
+		return nil, PREPARE_NO_SUCH_TABLE, fmt.Errorf("no such table: %s", name)
+	}
+	if write && database.IsCatalog(table) {
+		return nil, PREPARE_READ_ONLY_TABLE, fmt.Errorf("table %s may not be modified", name)
+	}
+	return table.Schema(), PREPARE_SUCCESS, nil
+}
+
+func prepareInsert(stmt *sql.InsertStmt, prepared *preparedStatement, database *db.Database) (PrepareResult, error) {
+	schema, result, err := getSchema(stmt.Table, database, true)
+	if err != nil {
+		return result, err
+	}
+	statement := &prepared.statement
+	statement.Type = core.STATEMENT_INSERT
+	statement.TableName = stmt.Table
+	statement.Upsert = stmt.Replace
+
+	// カラム名が指定されている場合は、テーブルのカラムの順番に並べ替える。指定しなかったカラムはNULLになる
+	exprs := stmt.Values
+	if len(stmt.Columns) > 0 {
+		if len(stmt.Columns) != len(stmt.Values) {
+			return PREPARE_SYNTAX_ERROR, fmt.Errorf("%d values for %d columns", len(stmt.Values), len(stmt.Columns))
+		}
+		exprs = make([]sql.Expr, len(schema.Columns))
+		for i, name := range stmt.Columns {
+			index := schema.ColumnIndex(name)
+			if index < 0 {
+				return PREPARE_NO_SUCH_COLUMN, fmt.Errorf("no such column: %s", name)
+			}
+			exprs[index] = stmt.Values[i]
+		}
+	}
+	if len(exprs) != len(schema.Columns) {
+		return PREPARE_SYNTAX_ERROR, fmt.Errorf("table %s has %d columns but %d values were supplied", schema.Name, len(schema.Columns), len(exprs))
+	}
+
+	prepared.schema = schema
+	prepared.values = exprs
+	return PREPARE_SUCCESS, nil
+}
+
+// パラメータをバインドしたINSERT文の値を評価して、テーブルの定義に合うか確認する
+func bindInsertValues(exprs []sql.Expr, schema *db.Schema, statement *core.Statement) (PrepareResult, error) {
+	values := make([]core.Value, len(exprs))
+	for i, expr := range exprs {
+		if expr == nil {
+			continue
+		}
+		value, err := EvalConstant(expr)
+		if err != nil {
+			return PREPARE_INVALID_VALUE, err
+		}
+		values[i] = value
+	}
+
+	if err := schema.CheckRow(values); err != nil {
+		switch {
+		case errors.Is(err, db.ErrNegativeKey):
+			return PREPARE_NEGATIVE_ID, err
+		case errors.Is(err, db.ErrStringTooLong):
+			return PREPARE_STRING_TOO_LONG, err
+		default:
+			return PREPARE_INVALID_VALUE, err
+		}
+	}
+
+	statement.Values = values
+	return PREPARE_SUCCESS, nil
+}
+
+func prepareSelect(stmt *sql.SelectStmt, prepared *preparedStatement, database *db.Database) (PrepareResult, error) {
+	schema, result, err := getSchema(stmt.From, database, false)
+	if err != nil {
+		return result, err
+	}
+	statement := &prepared.statement
+
+	// *はテーブルのカラムに展開する。別名はORDER BY句から参照できる
+	var columns []sql.Expr
+	var names []string
+	aliases := map[string]sql.Expr{}
+	for _, column := range stmt.Columns {
+		if column.Star {
+			for _, c := range schema.Columns {
+				columns = append(columns, &sql.ColumnRef{Name: c.Name})
+				names = append(names, c.Name)
+			}
+			continue
+		}
+		if err := CheckColumns(column.Expr, schema); err != nil {
+			return PREPARE_NO_SUCH_COLUMN, err
+		}
+		columns = append(columns, column.Expr)
+		if column.Alias != "" {
+			aliases[strings.ToLower(column.Alias)] = column.Expr
+			names = append(names, column.Alias)
+		} else {
+			names = append(names, sql.FormatExpr(column.Expr))
+		}
+	}
+	if stmt.Where != nil {
+		if err := CheckColumns(stmt.Where, schema); err != nil {
+			return PREPARE_NO_SUCH_COLUMN, err
+		}
+	}
+
+	if stmt.Where != nil && ContainsAggregate(stmt.Where) {
+		return PREPARE_INVALID_VALUE, errors.New("misuse of aggregate function in WHERE")
+	}
+
+	// GROUP BY句とORDER BY句の別名と位置（ORDER BY 2）は、結果のカラムの式に置き換える
+	resolve := func(expr sql.Expr, clause string) (sql.Expr, PrepareResult, error) {
+		switch e := expr.(type) {
+		case *sql.Literal:
+			if e.Kind == sql.LITERAL_INTEGER {
+				position, err := strconv.Atoi(e.Value)
+				if err != nil || position < 1 || position > len(columns) {
+					return nil, PREPARE_INVALID_VALUE, fmt.Errorf("%s term out of range - should be between 1 and %d", clause, len(columns))
+				}
+				expr = columns[position-1]
+			}
+		case *sql.ColumnRef:
+			if aliased, ok := aliases[strings.ToLower(e.Name)]; ok {
+				expr = aliased
+			}
+		}
+		if err := CheckColumns(expr, schema); err != nil {
+			return nil, PREPARE_NO_SUCH_COLUMN, err
+		}
+		return expr, PREPARE_SUCCESS, nil
+	}
+
+	groupBy := make([]sql.Expr, len(stmt.GroupBy))
+	for i, expr := range stmt.GroupBy {
+		if groupBy[i], result, err = resolve(expr, "GROUP BY"); err != nil {
+			return result, err
+		}
+		if ContainsAggregate(groupBy[i]) {
+			return PREPARE_INVALID_VALUE, errors.New("aggregate functions are not allowed in the GROUP BY clause")
+		}
+	}
+	having := replaceAliases(stmt.Having, aliases, schema)
+	if having != nil {
+		if err := CheckColumns(having, schema); err != nil {
+			return PREPARE_NO_SUCH_COLUMN, err
+		}
+	}
+	orderBy := make([]sql.OrderingTerm, len(stmt.OrderBy))
+	for i, term := range stmt.OrderBy {
+		expr, result, err := resolve(term.Expr, "ORDER BY")
+		if err != nil {
+			return result, err
+		}
+		orderBy[i] = sql.OrderingTerm{Expr: expr, Desc: term.Desc}
+	}
+
+	// LIMIT句とOFFSET句は、パラメータをバインドしてから評価する
+	prepared.limit = stmt.Limit
+	prepared.offset = stmt.Offset
+
+	statement.Type = core.STATEMENT_SELECT
+	statement.TableName = stmt.From
+	statement.Columns = columns
+	statement.ColumnNames = names
+	statement.Where = stmt.Where
+	statement.GroupBy = groupBy
+	statement.Having = having
+	statement.OrderBy = orderBy
+	return PREPARE_SUCCESS, nil
+}
+
+// 式に含まれる、テーブルのカラムではない名前を、結果のカラムの別名として置き換える（HAVING s > 1 など）
+func replaceAliases(expr sql.Expr, aliases map[string]sql.Expr, schema *db.Schema) sql.Expr {
+	replace := func(x sql.Expr) sql.Expr { return replaceAliases(x, aliases, schema) }
+	switch e := expr.(type) {
+	case *sql.ColumnRef:
+		if aliased, ok := aliases[strings.ToLower(e.Name)]; ok && schema.ColumnIndex(e.Name) < 0 {
+			return aliased
+		}
+	case *sql.UnaryExpr:
+		return &sql.UnaryExpr{Op: e.Op, X: replace(e.X)}
+	case *sql.BinaryExpr:
+		return &sql.BinaryExpr{Op: e.Op, X: replace(e.X), Y: replace(e.Y)}
+	case *sql.InExpr:
+		list := make([]sql.Expr, len(e.List))
+		for i, item := range e.List {
+			list[i] = replace(item)
+		}
+		return &sql.InExpr{X: replace(e.X), List: list, Not: e.Not}
+	case *sql.BetweenExpr:
+		return &sql.BetweenExpr{X: replace(e.X), Low: replace(e.Low), High: replace(e.High), Not: e.Not}
+	case *sql.IsNullExpr:
+		return &sql.IsNullExpr{X: replace(e.X), Not: e.Not}
+	}
+	return expr
+}
+
+// LIMIT句とOFFSET句の行数を評価する。省略した場合はdefaultValueを返す
+func evalCount(expr sql.Expr, clause string, defaultValue int64) (int64, error) {
+	if expr == nil {
+		return defaultValue, nil
+	}
+	if err := CheckColumns(expr, nil); err != nil {
+		return 0, err
+	}
+	v, err := EvalConstant(expr)
+	if err != nil {
+		return 0, err
+	}
+	if v.Type != core.VALUE_INTEGER || v.Integer < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", clause)
+	}
+	return v.Integer, nil
+}
+
+func prepareUpdate(stmt *sql.UpdateStmt, statement *core.Statement, database *db.Database) (PrepareResult, error) {
+	schema, result, err := getSchema(stmt.Table, database, true)
+	if err != nil {
+		return result, err
+	}
+	columns := make([]int, len(stmt.Set))
+	for i, assignment := range stmt.Set {
+		if columns[i] = schema.ColumnIndex(assignment.Column); columns[i] < 0 {
+			return PREPARE_NO_SUCH_COLUMN, fmt.Errorf("no such column: %s", assignment.Column)
+		}
+		if err := CheckColumns(assignment.Value, schema); err != nil {
+			return PREPARE_NO_SUCH_COLUMN, err
+		}
+	}
+	if stmt.Where != nil {
+		if err := CheckColumns(stmt.Where, schema); err != nil {
+			return PREPARE_NO_SUCH_COLUMN, err
+		}
+	}
+
+	statement.Type = core.STATEMENT_UPDATE
+	statement.TableName = stmt.Table
+	statement.Set = stmt.Set
+	statement.SetColumns = columns
+	statement.Where = stmt.Where
+	return PREPARE_SUCCESS, nil
+}
+
+func prepareDelete(stmt *sql.DeleteStmt, statement *core.Statement, database *db.Database) (PrepareResult, error) {
+	schema, result, err := getSchema(stmt.Table, database, true)
+	if err != nil {
+		return result, err
+	}
+	if stmt.Where != nil {
+		if err := CheckColumns(stmt.Where, schema); err != nil {
+			return PREPARE_NO_SUCH_COLUMN, err
+		}
+	}
+
+	statement.Type = core.STATEMENT_DELETE
+	statement.TableName = stmt.Table
+	statement.Where = stmt.Where
+	return PREPARE_SUCCESS, nil
+}
+
+func prepareCreateTable(stmt *sql.CreateTableStmt, statement *core.Statement, database *db.Database) (PrepareResult, error) {
+	if _, err := db.NewSchema(stmt); err != nil {
+		return PREPARE_INVALID_SCHEMA, err
+	}
+	if _, found := database.GetTable(stmt.Name); found && !stmt.IfNotExists {
+		return PREPARE_INVALID_SCHEMA, fmt.Errorf("table %s already exists", stmt.Name)
+	}
+	if _, found := database.GetIndex(stmt.Name); found {
+		return PREPARE_INVALID_SCHEMA, fmt.Errorf("there is already an index named %s", stmt.Name)
+	}
+
+	statement.Type = core.STATEMENT_CREATE_TABLE
+	statement.TableName = stmt.Name
+	statement.CreateTable = stmt
+	return PREPARE_SUCCESS, nil
+}
+
+func prepareCreateIndex(stmt *sql.CreateIndexStmt, statement *core.Statement, database *db.Database) (PrepareResult, error) {
+	schema, result, err := getSchema(stmt.Table, database, true)
+	if err != nil {
+		return result, err
+	}
+	column := schema.ColumnIndex(stmt.Column)
+	if column < 0 {
+		return PREPARE_NO_SUCH_COLUMN, fmt.Errorf("no such column: %s", stmt.Column)
+	}
+	if stmt.Name == "" {
+		stmt.Name = db.DefaultIndexName(schema.Name, schema.Columns[column].Name)
+	}
+	if _, found := database.GetIndex(stmt.Name); found && !stmt.IfNotExists {
+		return PREPARE_INVALID_SCHEMA, fmt.Errorf("index %s already exists", stmt.Name)
+	}
+	if _, found := database.GetTable(stmt.Name); found {
+		return PREPARE_INVALID_SCHEMA, fmt.Errorf("there is already a table named %s", stmt.Name)
+	}
+
+	statement.Type = core.STATEMENT_CREATE_INDEX
+	statement.TableName = stmt.Table
+	statement.CreateIndex = stmt
+	return PREPARE_SUCCESS, nil
+}
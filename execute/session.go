@@ -0,0 +1,206 @@
+package execute
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strings"
+	"toydb-go/core"
+	"toydb-go/sql"
+	db "toydb-go/table"
+)
+
+// パースしたステートメントをキャッシュする数
+const PLAN_CACHE_SIZE = 64
+
+// パースして、パラメータの型を調べたステートメント。パラメータに値をバインドして、何度でも実行できる
+type Plan struct {
+	// キャッシュのキーにするSQL。PREPARE文で準備したステートメントの場合は空
+	text string
+	stmt sql.Statement
+	// パラメータの最大の番号
+	numParams int
+	// パラメータの名前
+	names map[string]bool
+	// パラメータの番号ごとの型。PREPARE文で指定した型か、推測した型
+	types    map[int]db.ColumnType
+	declared map[int]db.ColumnType
+	// 準備したステートメントと、準備したときのスキーマのバージョン。テーブルの定義が変わったら準備し直す
+	prepared      *preparedStatement
+	schemaVersion uint64
+}
+
+// パラメータの数（最大の番号）を返す
+func (plan *Plan) NumParams() int {
+	return plan.numParams
+}
+
+func newPlan(text string, stmt sql.Statement, declared map[int]db.ColumnType) *Plan {
+	plan := &Plan{text: text, stmt: stmt, names: map[string]bool{}, declared: declared}
+	for _, param := range collectParams(stmt) {
+		if param.Index > plan.numParams {
+			plan.numParams = param.Index
+		}
+		if param.Name != "" {
+			plan.names[param.Name] = true
+		}
+	}
+	return plan
+}
+
+// データベースを使う間の状態。PREPARE文で準備したステートメントと、パースしたステートメントのキャッシュを持つ
+type Session struct {
+	database *db.Database
+	// PREPARE文で準備したステートメント。名前は小文字にそろえる
+	prepared map[string]*Plan
+	// SQLの文字列をキーにしたキャッシュと、最近使った順に並べたリスト（先頭が最近使ったもの）
+	cache map[string]*list.Element
+	lru   *list.List
+}
+
+func NewSession(database *db.Database) *Session {
+	return &Session{
+		database: database,
+		prepared: map[string]*Plan{},
+		cache:    map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// SQLをパースする。同じSQLを最近パースしていれば、キャッシュしたものを返す
+func (session *Session) Prepare(text string) (*Plan, PrepareResult, error) {
+	if elem, ok := session.cache[text]; ok {
+		session.lru.MoveToFront(elem)
+		return elem.Value.(*Plan), PREPARE_SUCCESS, nil
+	}
+
+	stmt, err := sql.Parse(text)
+	if errors.Is(err, sql.ErrUnrecognizedStatement) {
+		return nil, PREPARE_UNRECOGNIZED_STATEMENT, err
+	}
+	if err != nil {
+		return nil, PREPARE_SYNTAX_ERROR, err
+	}
+
+	plan := newPlan(text, stmt, nil)
+	session.cache[text] = session.lru.PushFront(plan)
+	if session.lru.Len() > PLAN_CACHE_SIZE {
+		oldest := session.lru.Back()
+		session.lru.Remove(oldest)
+		delete(session.cache, oldest.Value.(*Plan).text)
+	}
+	return plan, PREPARE_SUCCESS, nil
+}
+
+// パースしたステートメントのパラメータにparamsの値をバインドして、実行するステートメントを作成する。
+// 値の型は、バインドするときに確認する
+func (session *Session) Bind(plan *Plan, params []Param, statement *core.Statement) (PrepareResult, error) {
+	if err := plan.checkParams(params); err != nil {
+		return PREPARE_INVALID_VALUE, err
+	}
+
+	switch stmt := plan.stmt.(type) {
+	case *sql.PrepareStmt:
+		return session.prepareNamed(stmt, statement)
+	case *sql.ExecuteStmt:
+		bound, err := bindParams(stmt, params, nil)
+		if err != nil {
+			return PREPARE_INVALID_VALUE, err
+		}
+		return session.executeNamed(bound.(*sql.ExecuteStmt), statement)
+	case *sql.DeallocateStmt:
+		name := strings.ToLower(stmt.Name)
+		if _, ok := session.prepared[name]; !ok {
+			return PREPARE_INVALID_VALUE, fmt.Errorf("prepared statement %s does not exist", stmt.Name)
+		}
+		delete(session.prepared, name)
+		statement.Type = core.STATEMENT_DEALLOCATE
+		return PREPARE_SUCCESS, nil
+	default:
+		if result, err := session.prepare(plan); result != PREPARE_SUCCESS {
+			return result, err
+		}
+		return plan.prepared.bind(params, plan.types, statement)
+	}
+}
+
+// 入力をパースして、ステートメントを作成する。ステートメントのパラメータには、paramsの値をバインドする
+func (session *Session) PrepareStatement(text string, params []Param, statement *core.Statement) (PrepareResult, error) {
+	plan, result, err := session.Prepare(text)
+	if result != PREPARE_SUCCESS {
+		return result, err
+	}
+	return session.Bind(plan, params, statement)
+}
+
+// ステートメントにないパラメータの値を渡していたら、エラーを返す
+func (plan *Plan) checkParams(params []Param) error {
+	for _, param := range params {
+		if param.Name != "" && !plan.names[param.Name] {
+			return fmt.Errorf("no such parameter: %s", param.Name)
+		}
+		if param.Name == "" && param.Ordinal > plan.numParams {
+			return fmt.Errorf("%d values for %d parameters", param.Ordinal, plan.numParams)
+		}
+	}
+	return nil
+}
+
+// ステートメントを準備して、パラメータの型を推測する。準備した後にテーブルの定義が変わっていなければ、準備したものを使う。
+// 準備できなかった場合はキャッシュしない
+func (session *Session) prepare(plan *Plan) (PrepareResult, error) {
+	version := session.database.SchemaVersion()
+	if plan.prepared != nil && plan.schemaVersion == version {
+		return PREPARE_SUCCESS, nil
+	}
+	plan.prepared = nil
+
+	prepared := &preparedStatement{}
+	if result, err := prepareParsed(plan.stmt, prepared, session.database); result != PREPARE_SUCCESS {
+		return result, err
+	}
+	plan.types = nil
+	if plan.numParams > 0 {
+		plan.types = inferParamTypes(plan.stmt, session.database)
+		for index, t := range plan.declared {
+			plan.types[index] = t
+		}
+	}
+	plan.prepared = prepared
+	plan.schemaVersion = version
+	return PREPARE_SUCCESS, nil
+}
+
+// PREPARE文のステートメントを、名前をつけて登録する
+func (session *Session) prepareNamed(stmt *sql.PrepareStmt, statement *core.Statement) (PrepareResult, error) {
+	name := strings.ToLower(stmt.Name)
+	if _, ok := session.prepared[name]; ok {
+		return PREPARE_INVALID_VALUE, fmt.Errorf("prepared statement %s already exists", stmt.Name)
+	}
+	declared, err := declaredParamTypes(stmt.Types)
+	if err != nil {
+		return PREPARE_INVALID_VALUE, err
+	}
+
+	session.prepared[name] = newPlan("", stmt.Stmt, declared)
+	statement.Type = core.STATEMENT_PREPARE
+	return PREPARE_SUCCESS, nil
+}
+
+// EXECUTE文の引数を、PREPARE文で準備したステートメントのパラメータに順番にバインドする
+func (session *Session) executeNamed(stmt *sql.ExecuteStmt, statement *core.Statement) (PrepareResult, error) {
+	plan, ok := session.prepared[strings.ToLower(stmt.Name)]
+	if !ok {
+		return PREPARE_INVALID_VALUE, fmt.Errorf("prepared statement %s does not exist", stmt.Name)
+	}
+
+	params := make([]Param, len(stmt.Args))
+	for i, arg := range stmt.Args {
+		v, err := EvalConstant(arg)
+		if err != nil {
+			return PREPARE_INVALID_VALUE, err
+		}
+		params[i] = Param{Ordinal: i + 1, Value: v}
+	}
+	return session.Bind(plan, params, statement)
+}
@@ -0,0 +1,201 @@
+package execute
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"toydb-go/core"
+	db "toydb-go/table"
+)
+
+// 結果の行を集めるOutput
+type rowCollector struct {
+	rows [][]core.Value
+}
+
+func (c *rowCollector) Row(values []core.Value) error {
+	c.rows = append(c.rows, append([]core.Value(nil), values...))
+	return nil
+}
+
+func (c *rowCollector) RowsAffected(n int) {}
+
+func openTestSession(t *testing.T) *Session {
+	database, err := db.DbOpen(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DbClose(database) })
+
+	session := NewSession(database)
+	runStatement(t, session, "create table users (id integer primary key, name text, score real)")
+	return session
+}
+
+func runStatement(t *testing.T, session *Session, text string, params ...Param) [][]core.Value {
+	t.Helper()
+	var statement core.Statement
+	if result, err := session.PrepareStatement(text, params, &statement); result != PREPARE_SUCCESS {
+		t.Fatalf("%s: could not prepare (result %d): %v", text, result, err)
+	}
+	var output rowCollector
+	if result, err := ExecuteStatement(statement, session.database, &output); result != EXECUTE_SUCCESS {
+		t.Fatalf("%s: could not execute (result %d): %v", text, result, err)
+	}
+	return output.rows
+}
+
+func TestPlanCache(t *testing.T) {
+	session := openTestSession(t)
+
+	plan, result, err := session.Prepare("select * from users where id = ?")
+	if result != PREPARE_SUCCESS {
+		t.Fatal(err)
+	}
+	if plan.NumParams() != 1 {
+		t.Errorf("expected 1 parameter, but got %d", plan.NumParams())
+	}
+	if cached, _, _ := session.Prepare("select * from users where id = ?"); cached != plan {
+		t.Error("expected the cached plan")
+	}
+
+	// 古いものから追い出す
+	for i := 0; i < PLAN_CACHE_SIZE; i++ {
+		session.Prepare(fmt.Sprintf("select * from users where id = %d", i))
+	}
+	if session.lru.Len() != PLAN_CACHE_SIZE {
+		t.Errorf("expected %d cached plans, but got %d", PLAN_CACHE_SIZE, session.lru.Len())
+	}
+	if cached, _, _ := session.Prepare("select * from users where id = ?"); cached == plan {
+		t.Error("expected the plan to be evicted")
+	}
+
+	if _, result, _ := session.Prepare("selec 1"); result != PREPARE_UNRECOGNIZED_STATEMENT {
+		t.Errorf("expected PREPARE_UNRECOGNIZED_STATEMENT, but got %d", result)
+	}
+}
+
+func TestBindTypeCheck(t *testing.T) {
+	session := openTestSession(t)
+
+	runStatement(t, session, "insert into users values (?, ?, ?)",
+		Param{Ordinal: 1, Value: core.IntegerValue(1)}, Param{Ordinal: 2, Value: core.TextValue("alice")}, Param{Ordinal: 3, Value: core.IntegerValue(2)})
+
+	tests := []struct {
+		text   string
+		params []Param
+	}{
+		{"insert into users values (?, 'bob', NULL)", []Param{{Ordinal: 1, Value: core.TextValue("2")}}},
+		{"select * from users where score > ?", []Param{{Ordinal: 1, Value: core.TextValue("high")}}},
+		{"update users set name = :name where id = 1", []Param{{Name: "name", Value: core.IntegerValue(3)}}},
+		{"select * from users limit ?", []Param{{Ordinal: 1, Value: core.RealValue(1.5)}}},
+	}
+	for _, test := range tests {
+		var statement core.Statement
+		result, err := session.PrepareStatement(test.text, test.params, &statement)
+		if result != PREPARE_INVALID_VALUE || !errors.Is(err, db.ErrTypeMismatch) {
+			t.Errorf("%s: expected a type mismatch, but got %d (%v)", test.text, result, err)
+		}
+	}
+
+	// NULLはどの型のパラメータにもバインドできる
+	rows := runStatement(t, session, "select name from users where id = ? or score = ?",
+		Param{Ordinal: 1, Value: core.IntegerValue(1)}, Param{Ordinal: 2, Value: core.NullValue()})
+	if len(rows) != 1 {
+		t.Errorf("expected 1 row, but got %v", rows)
+	}
+}
+
+// テーブルの定義が変わったら、パラメータの型を推測し直す
+func TestBindAfterSchemaChange(t *testing.T) {
+	session := openTestSession(t)
+	text := "insert into items values (?, ?)"
+	params := []Param{{Ordinal: 1, Value: core.IntegerValue(1)}, {Ordinal: 2, Value: core.TextValue("x")}}
+
+	// テーブルがないので、型は推測できない
+	var statement core.Statement
+	if result, err := session.PrepareStatement(text, params, &statement); result != PREPARE_NO_SUCH_TABLE {
+		t.Errorf("expected PREPARE_NO_SUCH_TABLE, but got %d (%v)", result, err)
+	}
+
+	runStatement(t, session, "create table items (id integer primary key, label integer)")
+	if result, err := session.PrepareStatement(text, params, &statement); result != PREPARE_INVALID_VALUE || !errors.Is(err, db.ErrTypeMismatch) {
+		t.Errorf("expected a type mismatch, but got %d (%v)", result, err)
+	}
+	runStatement(t, session, text, params[0], Param{Ordinal: 2, Value: core.IntegerValue(10)})
+}
+
+// バインドするときは、準備したステートメントを使い、ページを読まない。テーブルの定義が変わったら準備し直す
+func TestBindReusesPreparedStatement(t *testing.T) {
+	session := openTestSession(t)
+	plan, result, err := session.Prepare("update users set name = ? where id = ?")
+	if result != PREPARE_SUCCESS {
+		t.Fatal(err)
+	}
+	params := []Param{{Ordinal: 1, Value: core.TextValue("alice")}, {Ordinal: 2, Value: core.IntegerValue(1)}}
+
+	var statement core.Statement
+	if result, err := session.Bind(plan, params, &statement); result != PREPARE_SUCCESS {
+		t.Fatal(err)
+	}
+	prepared := plan.prepared
+	reads := session.database.PageReads()
+	if result, err := session.Bind(plan, params, &statement); result != PREPARE_SUCCESS {
+		t.Fatal(err)
+	}
+	if plan.prepared != prepared {
+		t.Error("expected the prepared statement to be reused")
+	}
+	if n := session.database.PageReads() - reads; n != 0 {
+		t.Errorf("expected no page reads, but got %d", n)
+	}
+	if len(statement.SetColumns) != 1 || statement.SetColumns[0] != 1 {
+		t.Errorf("unexpected SET columns: %v", statement.SetColumns)
+	}
+	// 準備したステートメントのパラメータは、バインドしても残っている
+	if _, err := session.Bind(plan, params[:1], &statement); !errors.Is(err, ErrMissingParam) {
+		t.Errorf("expected ErrMissingParam, but got %v", err)
+	}
+
+	runStatement(t, session, "create index users_name on users (name)")
+	if result, err := session.Bind(plan, params, &statement); result != PREPARE_SUCCESS {
+		t.Fatal(err)
+	}
+	if plan.prepared == prepared {
+		t.Error("expected the statement to be prepared again after the schema changed")
+	}
+}
+
+func TestPrepareAndExecute(t *testing.T) {
+	session := openTestSession(t)
+
+	runStatement(t, session, "prepare ins (integer, text) as insert into users values ($1, $2, NULL)")
+	runStatement(t, session, "execute ins (1, 'alice')")
+	runStatement(t, session, "EXECUTE INS (?, 'bob')", Param{Ordinal: 1, Value: core.IntegerValue(2)})
+	runStatement(t, session, "prepare find as select name from users where id = ?")
+	if rows := runStatement(t, session, "execute find (2)"); len(rows) != 1 || rows[0][0].Text != "bob" {
+		t.Errorf("unexpected rows: %v", rows)
+	}
+
+	tests := []string{
+		"prepare ins as select * from users",
+		"prepare bad (date) as select * from users where id = ?",
+		"execute ins ('x', 'carol')",
+		"execute ins (3, 'carol', 4)",
+		"execute missing",
+		"deallocate missing",
+	}
+	for _, text := range tests {
+		var statement core.Statement
+		if result, err := session.PrepareStatement(text, nil, &statement); result != PREPARE_INVALID_VALUE {
+			t.Errorf("%s: expected PREPARE_INVALID_VALUE, but got %d (%v)", text, result, err)
+		}
+	}
+
+	runStatement(t, session, "deallocate prepare ins")
+	var statement core.Statement
+	if result, _ := session.PrepareStatement("execute ins (3, 'carol')", nil, &statement); result != PREPARE_INVALID_VALUE {
+		t.Errorf("expected the prepared statement to be deallocated, but got %d", result)
+	}
+}
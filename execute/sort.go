@@ -0,0 +1,313 @@
+package execute
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"toydb-go/core"
+	"toydb-go/sql"
+)
+
+// ソートでメモリに置く行の合計サイズ（エンコードしたバイト数）の上限。
+// 上限を超えたら、ソートした行を一時ファイル（ラン）に書き出し、最後にランをマージする
+var sortMemoryBudget = 1 << 20
+
+// ソートする行。ソートキーと、結果として返す値を持つ
+type sortRow struct {
+	keys   []core.Value
+	values []core.Value
+}
+
+// ORDER BY句の順番に行を並べる。外部マージソートなので、メモリに載らない行数も扱える
+type sorter struct {
+	// ソートキーごとに、降順ならtrue
+	desc []bool
+	rows []sortRow
+	// rowsのエンコードしたサイズの合計
+	size int
+	// 書き出したラン
+	runs []*os.File
+
+	// finishの後の読み出し位置。ランがなければrowsの位置、あればランをマージするヒープを使う
+	pos   int
+	merge *runHeap
+}
+
+func newSorter(desc []bool) *sorter {
+	return &sorter{desc: desc}
+}
+
+// 行の順番を比較する
+func (s *sorter) compare(a []core.Value, b []core.Value) int {
+	for i, desc := range s.desc {
+		c := core.Compare(a[i], b[i])
+		if desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// 行を追加する
+func (s *sorter) add(keys []core.Value, values []core.Value) error {
+	s.rows = append(s.rows, sortRow{keys: keys, values: values})
+	s.size += len(encodeSortRow(nil, sortRow{keys: keys, values: values}))
+	if s.size > sortMemoryBudget {
+		return s.spill()
+	}
+	return nil
+}
+
+// メモリ上の行をソートする。キーが同じ行は、追加した順番のままにする
+func (s *sorter) sortRows() {
+	sort.SliceStable(s.rows, func(i, j int) bool {
+		return s.compare(s.rows[i].keys, s.rows[j].keys) < 0
+	})
+}
+
+// ソートキーと値を並べたレコードの長さ(uvarint) + レコード
+func encodeSortRow(buf []byte, row sortRow) []byte {
+	values := make([]core.Value, 0, len(row.keys)+len(row.values))
+	values = append(append(values, row.keys...), row.values...)
+	record := core.AppendRecord(nil, values)
+	buf = binary.AppendUvarint(buf, uint64(len(record)))
+	return append(buf, record...)
+}
+
+// メモリ上の行をソートして、ランとして一時ファイルに書き出す
+func (s *sorter) spill() error {
+	s.sortRows()
+
+	file, err := os.CreateTemp("", "toydb-sort-*")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, file)
+
+	writer := bufio.NewWriter(file)
+	var buf []byte
+	for _, row := range s.rows {
+		buf = encodeSortRow(buf[:0], row)
+		if _, err := writer.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	s.rows = nil
+	s.size = 0
+	return nil
+}
+
+// 行の追加を終えて、順番に読み出せるようにする
+func (s *sorter) finish() error {
+	if len(s.runs) == 0 {
+		s.sortRows()
+		s.pos = 0
+		return nil
+	}
+
+	if len(s.rows) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	h := &runHeap{sorter: s}
+	for i, file := range s.runs {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		reader := &runReader{index: i, reader: bufio.NewReader(file)}
+		if err := reader.next(len(s.desc)); err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		h.readers = append(h.readers, reader)
+	}
+	heap.Init(h)
+	s.merge = h
+	return nil
+}
+
+// 次の行の値を返す。行がなくなったらfalseを返す。finishの後に呼ぶ
+func (s *sorter) next() ([]core.Value, bool, error) {
+	if s.merge == nil {
+		if s.pos >= len(s.rows) {
+			return nil, false, nil
+		}
+		s.pos++
+		return s.rows[s.pos-1].values, true, nil
+	}
+
+	h := s.merge
+	if h.Len() == 0 {
+		return nil, false, nil
+	}
+	reader := h.readers[0]
+	values := reader.row.values
+	if err := reader.next(len(s.desc)); err == io.EOF {
+		heap.Pop(h)
+	} else if err != nil {
+		return nil, false, err
+	} else {
+		heap.Fix(h, 0)
+	}
+	return values, true, nil
+}
+
+// 全ての行を、順番にfnに渡す。fnがエラーを返すと、そこで止めてエラーを返す
+func (s *sorter) each(fn func(values []core.Value) error) error {
+	if err := s.finish(); err != nil {
+		return err
+	}
+	for {
+		values, ok, err := s.next()
+		if err != nil || !ok {
+			return err
+		}
+		if err := fn(values); err != nil {
+			return err
+		}
+	}
+}
+
+// ランの読み込み位置
+type runReader struct {
+	// ランの番号。キーが同じ行は、番号が小さいランを先に返す
+	index  int
+	reader *bufio.Reader
+	row    sortRow
+}
+
+// ランから次の行を読む。ランの末尾ではio.EOFを返す
+func (r *runReader) next(numKeys int) error {
+	length, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, record); err != nil {
+		return err
+	}
+	values, err := core.DecodeRecord(record)
+	if err != nil {
+		return err
+	}
+	if len(values) < numKeys {
+		return core.ErrMalformedRecord
+	}
+	r.row = sortRow{keys: values[:numKeys], values: values[numKeys:]}
+	return nil
+}
+
+// 各ランの先頭の行のうち、最も小さいものを取り出すヒープ
+type runHeap struct {
+	sorter  *sorter
+	readers []*runReader
+}
+
+func (h *runHeap) Len() int { return len(h.readers) }
+
+func (h *runHeap) Less(i, j int) bool {
+	if c := h.sorter.compare(h.readers[i].row.keys, h.readers[j].row.keys); c != 0 {
+		return c < 0
+	}
+	return h.readers[i].index < h.readers[j].index
+}
+
+func (h *runHeap) Swap(i, j int) { h.readers[i], h.readers[j] = h.readers[j], h.readers[i] }
+
+func (h *runHeap) Push(x interface{}) { h.readers = append(h.readers, x.(*runReader)) }
+
+func (h *runHeap) Pop() interface{} {
+	last := h.readers[len(h.readers)-1]
+	h.readers = h.readers[:len(h.readers)-1]
+	return last
+}
+
+// 一時ファイルを削除する
+func (s *sorter) close() {
+	for _, file := range s.runs {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	s.runs = nil
+	s.rows = nil
+	s.merge = nil
+}
+
+// ORDER BY句の順番に行を並べる演算子。子の行は、結果のカラムの後ろにソートキーを並べたもの。
+// Openで子の行を全て読んでソートし、Nextはソートキーを除いた結果のカラムを返す
+type sortOperator struct {
+	child operator
+	// 結果のカラムの数。残りはソートキー
+	numColumns int
+	// ソートキーのORDER BY句の項目
+	orderBy []sql.OrderingTerm
+	sorter  *sorter
+}
+
+func (op *sortOperator) Open() error {
+	desc := make([]bool, len(op.orderBy))
+	for i, term := range op.orderBy {
+		desc[i] = term.Desc
+	}
+	op.sorter = newSorter(desc)
+	if err := op.child.Open(); err != nil {
+		return err
+	}
+	for {
+		row, err := op.child.Next()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			break
+		}
+		if err := op.sorter.add(row.values[op.numColumns:], row.values[:op.numColumns]); err != nil {
+			return err
+		}
+	}
+	return op.sorter.finish()
+}
+
+func (op *sortOperator) Next() (*rowContext, error) {
+	values, ok, err := op.sorter.next()
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &rowContext{values: values}, nil
+}
+
+func (op *sortOperator) Close() {
+	if op.sorter != nil {
+		op.sorter.close()
+		op.sorter = nil
+	}
+	op.child.Close()
+}
+
+func (op *sortOperator) explain() string {
+	terms := make([]string, len(op.orderBy))
+	for i, term := range op.orderBy {
+		terms[i] = sql.FormatExpr(term.Expr)
+		if term.Desc {
+			terms[i] += " DESC"
+		}
+	}
+	return "SORT BY " + strings.Join(terms, ", ")
+}
+
+func (op *sortOperator) children() []*operator {
+	return []*operator{&op.child}
+}
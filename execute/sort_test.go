@@ -0,0 +1,68 @@
+package execute
+
+import (
+	"reflect"
+	"testing"
+	"toydb-go/core"
+)
+
+func TestSorterSpillsToRuns(t *testing.T) {
+	budget := sortMemoryBudget
+	sortMemoryBudget = 64
+	defer func() { sortMemoryBudget = budget }()
+
+	// (group ASC, id DESC) の順番に並べる
+	sorter := newSorter([]bool{false, true})
+	defer sorter.close()
+	for i := 0; i < 100; i++ {
+		id := int64((i * 37) % 100)
+		keys := []core.Value{core.IntegerValue(id % 3), core.IntegerValue(id)}
+		if err := sorter.add(keys, []core.Value{core.IntegerValue(id), core.TextValue("row")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sorter.runs) < 2 {
+		t.Fatalf("expected the sorter to write runs, but got %d", len(sorter.runs))
+	}
+
+	var ids []int64
+	err := sorter.each(func(values []core.Value) error {
+		ids = append(ids, values[0].Integer)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []int64
+	for group := int64(0); group < 3; group++ {
+		for id := int64(99); id >= 0; id-- {
+			if id%3 == group {
+				expected = append(expected, id)
+			}
+		}
+	}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, but got %v", expected, ids)
+	}
+}
+
+func TestSorterInMemory(t *testing.T) {
+	sorter := newSorter([]bool{false})
+	defer sorter.close()
+	// NULLは先頭、キーが同じ行は追加した順番
+	for i, key := range []core.Value{core.TextValue("b"), core.IntegerValue(2), core.NullValue(), core.TextValue("b"), core.RealValue(1.5)} {
+		if err := sorter.add([]core.Value{key}, []core.Value{core.IntegerValue(int64(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var order []int64
+	sorter.each(func(values []core.Value) error {
+		order = append(order, values[0].Integer)
+		return nil
+	})
+	if expected := []int64{2, 4, 1, 0, 3}; !reflect.DeepEqual(order, expected) || len(sorter.runs) != 0 {
+		t.Errorf("expected %v without runs, but got %v", expected, order)
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"toydb-go/core"
 	"toydb-go/execute"
+	"toydb-go/persistence"
 	db "toydb-go/table"
 )
 
@@ -20,87 +22,115 @@ func printPrompt() {
 	fmt.Print("db > ")
 }
 
+// 1行読み込む。入力の終わり（Ctrl-D）ではio.EOFを返す
 func readInput(scanner *bufio.Scanner, buf *InputBuffer) error {
-	scanner.Scan()
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
 	buf.text = scanner.Text()
 	buf.bufLen = len(buf.text)
 
 	return nil
 }
 
-type PrepareResult int
-
-const (
-	PREPARE_SUCCESS PrepareResult = iota + 1
-	PREPARE_UNRECOGNIZED_STATEMENT
-	PREPARE_SYNTAX_ERROR
-	PREPARE_STRING_TOO_LONG
-	PREPARE_NEGATIVE_ID
-)
-
-// 入力からステートメントを作成する
-func prepareStatement(buf InputBuffer, statement *core.Statement) PrepareResult {
-	if strings.HasPrefix(buf.text, "insert") {
-		statement.Type = core.STATEMENT_INSERT
-
-		var id int
-		var username, email string
-		assigned, _ := fmt.Sscanf(buf.text, "insert %d %s %s", &id, &username, &email)
-
-		if assigned != 3 {
-			return PREPARE_SYNTAX_ERROR
-		}
-
-		if id < 0 {
-			return PREPARE_NEGATIVE_ID
-		}
-
-		if len(username) > db.USERNAME_SIZE {
-			return PREPARE_STRING_TOO_LONG
-		}
-
-		if len(email) > db.EMAIL_SIZE {
-			return PREPARE_STRING_TOO_LONG
-		}
+// データベースを閉じて終了する。閉じられなかった場合は、エラーを表示して0以外で終了する
+func closeAndExit(database *db.Database, code int) {
+	if err := db.DbClose(database); err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(code)
+}
 
-		statement.RowToInsert.Id = id
-		copy(statement.RowToInsert.Username[:], username)
-		copy(statement.RowToInsert.Email[:], email)
+// ステートメントの結果を標準出力に表示する
+type printer struct {
+	statementType core.StatementType
+	// EXPLAIN文の結果なら、演算子の木の行をそのまま表示する
+	explain bool
+}
 
-		return PREPARE_SUCCESS
+func (p printer) Row(values []core.Value) error {
+	if p.explain {
+		fmt.Println(values[0].Text)
+		return nil
 	}
-	if strings.HasPrefix(buf.text, "select") {
-		statement.Type = core.STATEMENT_SELECT
-		return PREPARE_SUCCESS
+	texts := make([]string, len(values))
+	for i, value := range values {
+		texts[i] = value.String()
+	}
+	fmt.Printf("(%s)\n", strings.Join(texts, ", "))
+	return nil
+}
+
+func (p printer) RowsAffected(n int) {
+	switch p.statementType {
+	case core.STATEMENT_UPDATE:
+		fmt.Printf("Updated %d %s.\n", n, plural(n, "row", "rows"))
+	case core.STATEMENT_DELETE:
+		fmt.Printf("Deleted %d %s.\n", n, plural(n, "row", "rows"))
 	}
+}
 
-	return PREPARE_UNRECOGNIZED_STATEMENT
+func plural(n int, singular string, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
 }
 
 func main() {
+	// ページの読み書きに失敗したら、エラーを表示して終了する
+	defer func() {
+		if r := recover(); r != nil {
+			if err, ok := r.(*persistence.PagerError); ok {
+				fmt.Printf("Error: %s\n", err.Error())
+				os.Exit(1)
+			}
+			panic(r)
+		}
+	}()
+
 	if len(os.Args) < 2 {
 		fmt.Println("Must supply a database filename.")
 		os.Exit(1)
 	}
 
-	table, err := db.DbOpen(os.Args[1])
+	database, err := db.DbOpen(os.Args[1])
 	if err != nil {
 		fmt.Printf("Error: %s\n", err.Error())
 		os.Exit(1)
 	}
 
+	session := execute.NewSession(database)
 	scanner := bufio.NewScanner(os.Stdin)
 	var buf InputBuffer
 
 	for {
 		printPrompt()
-		readInput(scanner, &buf)
+		if err := readInput(scanner, &buf); err == io.EOF {
+			// .exitと同じように、データベースを閉じて終了する
+			fmt.Println()
+			closeAndExit(database, 0)
+		} else if err != nil {
+			fmt.Printf("\nError: %s\n", err.Error())
+			closeAndExit(database, 1)
+		}
+
+		// 空の行は無視する
+		if strings.TrimSpace(buf.text) == "" {
+			continue
+		}
 
 		if buf.text[0] == '.' {
-			result := execute.ExecMetaCommand(buf.text, table)
+			result := execute.ExecMetaCommand(buf.text, database)
 
 			if result == execute.META_COMMAND_SUCCESS {
 				continue
+			} else if result == execute.META_COMMAND_EXIT {
+				closeAndExit(database, 0)
 			} else {
 				fmt.Printf("Unrecognized command '%s'.\n", buf.text)
 				continue
@@ -108,25 +138,28 @@ func main() {
 		}
 
 		var statement core.Statement
-		result := prepareStatement(buf, &statement)
+		result, err := session.PrepareStatement(buf.text, nil, &statement)
 
 		switch result {
-		case PREPARE_SUCCESS:
-		case PREPARE_SYNTAX_ERROR:
-			fmt.Printf("Syntax error. Could not parse statement.\n")
+		case execute.PREPARE_SUCCESS:
+		case execute.PREPARE_SYNTAX_ERROR:
+			fmt.Printf("Syntax error: %s.\n", err.Error())
+			continue
+		case execute.PREPARE_NO_SUCH_TABLE, execute.PREPARE_INVALID_VALUE, execute.PREPARE_INVALID_SCHEMA, execute.PREPARE_READ_ONLY_TABLE, execute.PREPARE_NO_SUCH_COLUMN:
+			fmt.Printf("Error: %s.\n", err.Error())
 			continue
-		case PREPARE_UNRECOGNIZED_STATEMENT:
+		case execute.PREPARE_UNRECOGNIZED_STATEMENT:
 			fmt.Printf("Unrecognized keyword at start of '%s'.\n", buf.text)
 			continue
-		case PREPARE_STRING_TOO_LONG:
+		case execute.PREPARE_STRING_TOO_LONG:
 			fmt.Printf("String is too long.\n")
 			continue
-		case PREPARE_NEGATIVE_ID:
+		case execute.PREPARE_NEGATIVE_ID:
 			fmt.Printf("ID must be positive.\n")
 			continue
 		}
 
-		executeResult := execute.ExecuteStatement(statement, table)
+		executeResult, err := execute.ExecuteStatement(statement, database, printer{statementType: statement.Type, explain: statement.Explain != 0})
 		switch executeResult {
 		case execute.EXECUTE_SUCCESS:
 			fmt.Printf("Executed.\n")
@@ -134,6 +167,18 @@ func main() {
 			fmt.Printf("Error: Table is full.\n")
 		case execute.EXECUTE_DUPLICATE_KEY:
 			fmt.Printf("Error: Duplicate key.\n")
+		case execute.EXECUTE_COMMIT_FAILED:
+			fmt.Printf("Error: Could not commit.\n")
+		case execute.EXECUTE_ROW_TOO_LARGE:
+			fmt.Printf("Error: Row is too large.\n")
+		case execute.EXECUTE_SCHEMA_TOO_LONG:
+			fmt.Printf("Error: Table definition is too long.\n")
+		case execute.EXECUTE_CORRUPT:
+			fmt.Printf("Error: Database file is corrupt.\n")
+		case execute.EXECUTE_UNIQUE_VIOLATION:
+			fmt.Printf("Error: UNIQUE constraint failed.\n")
+		case execute.EXECUTE_ERROR:
+			fmt.Printf("Error: %s.\n", err.Error())
 		}
 	}
 }
@@ -41,6 +41,8 @@ func runScripts(commands []string) ([]string, error) {
 	for _, command := range commands {
 		io.WriteString(stdin, command+"\n")
 	}
+	// 全てのコマンドを書き込んだら、入力を終える
+	stdin.Close()
 
 	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
@@ -210,6 +212,40 @@ func TestKeepsDataAfterClosingConnection(t *testing.T) {
 	}
 }
 
+// 空の行は無視し、入力が終わったら.exitと同じようにデータベースを閉じて終了する
+func TestExitOnEndOfInput(t *testing.T) {
+	beforeEach()
+
+	results, err := runScripts([]string{
+		"insert 1 user1 person1@example.com",
+		"",
+		"   ",
+	})
+	check(err)
+
+	expected := []string{
+		"db > Executed.",
+		"db > db > db > ",
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %v, but got %v", expected, results)
+	}
+
+	results2, err := runScripts([]string{
+		"select",
+	})
+	check(err)
+
+	expected2 := []string{
+		"db > (1, user1, person1@example.com)",
+		"Executed.",
+		"db > ",
+	}
+	if !reflect.DeepEqual(results2, expected2) {
+		t.Errorf("expected %v, but got %v", expected2, results2)
+	}
+}
+
 func TestPrintOneNodeBtree(t *testing.T) {
 	beforeEach()
 
@@ -240,9 +276,10 @@ func TestPrintOneNodeBtree(t *testing.T) {
 func TestPrintBtreeOfDepthTwo(t *testing.T) {
 	beforeEach()
 
+	// 14行で1つのリーフノードがいっぱいになる
 	scripts := []string{}
-	for i := range make([]int, 14) {
-		scripts = append(scripts, fmt.Sprintf("insert %d user%d person%d@example.com", i+1, i+1, i+1))
+	for i := 1; i <= 15; i++ {
+		scripts = append(scripts, insertLongRow(i))
 	}
 	scripts = append(scripts, ".btree", ".exit")
 
@@ -252,7 +289,7 @@ func TestPrintBtreeOfDepthTwo(t *testing.T) {
 	expected := []string{
 		"db > Tree:",
 		"- internal (size 1)",
-		"  - leaf (size 7)",
+		"  - leaf (size 8)",
 		"    - 1",
 		"    - 2",
 		"    - 3",
@@ -260,23 +297,30 @@ func TestPrintBtreeOfDepthTwo(t *testing.T) {
 		"    - 5",
 		"    - 6",
 		"    - 7",
-		"  - key 7",
-		"  - leaf (size 7)",
 		"    - 8",
+		"  - key 8",
+		"  - leaf (size 7)",
 		"    - 9",
 		"    - 10",
 		"    - 11",
 		"    - 12",
 		"    - 13",
 		"    - 14",
+		"    - 15",
 		"db > ",
 	}
-	results = results[14:]
+	results = results[15:]
 	if !reflect.DeepEqual(results, expected) {
 		t.Errorf("expected\n%v, but got\n%v", strings.Join(expected, "\n"), strings.Join(results, "\n"))
 	}
 }
 
+// 行の長さがそろうように、emailを最大の長さまで伸ばしたINSERT文を返す
+func insertLongRow(id int) string {
+	email := fmt.Sprintf("person%d@example.com", id)
+	return fmt.Sprintf("insert %d user%d %s%s", id, id, strings.Repeat("x", 256-len(email)), email)
+}
+
 func assertEqualSlice(t *testing.T, results []string, expected []string) {
 	if !reflect.DeepEqual(results, expected) {
 		t.Errorf("expected\n%v, but got\n%v", strings.Join(expected, "\n"), strings.Join(results, "\n"))
@@ -320,85 +364,799 @@ func TestPrintAllRowsInMultiLevelTree(t *testing.T) {
 func TestPrintFourLeafNodeBtree(t *testing.T) {
 	beforeEach()
 
-	scripts := []string{
-		"insert 18 user18 person18@example.com",
-		"insert 7 user7 person7@example.com",
-		"insert 10 user10 person10@example.com",
-		"insert 29 user29 person29@example.com",
-		"insert 23 user23 person23@example.com",
-		"insert 4 user4 person4@example.com",
-		"insert 14 user14 person14@example.com",
-		"insert 30 user30 person30@example.com",
-		"insert 15 user15 person15@example.com",
-		"insert 26 user26 person26@example.com",
-		"insert 22 user22 person22@example.com",
-		"insert 19 user19 person19@example.com",
-		"insert 2 user2 person2@example.com",
+	// 1から40までを、順番を入れ替えて挿入する
+	scripts := []string{}
+	for i := 1; i <= 40; i++ {
+		scripts = append(scripts, insertLongRow(i*7%41))
+	}
+	scripts = append(scripts, ".btree", ".exit")
+
+	results, err := runScripts(scripts)
+	check(err)
+
+	expected := []string{
+		"db > Tree:",
+		"- internal (size 3)",
+	}
+	leaves := [][2]int{{1, 8}, {9, 16}, {17, 28}, {29, 40}}
+	for i, leaf := range leaves {
+		if i > 0 {
+			expected = append(expected, fmt.Sprintf("  - key %d", leaf[0]-1))
+		}
+		expected = append(expected, fmt.Sprintf("  - leaf (size %d)", leaf[1]-leaf[0]+1))
+		for key := leaf[0]; key <= leaf[1]; key++ {
+			expected = append(expected, fmt.Sprintf("    - %d", key))
+		}
+	}
+	expected = append(expected, "db > ")
+	assertEqualSlice(t, results[len(scripts)-2:], expected)
+}
+
+func TestPrintDbInfo(t *testing.T) {
+	beforeEach()
+
+	results, err := runScripts([]string{
 		"insert 1 user1 person1@example.com",
-		"insert 21 user21 person21@example.com",
-		"insert 11 user11 person11@example.com",
-		"insert 6 user6 person6@example.com",
-		"insert 20 user20 person20@example.com",
-		"insert 5 user5 person5@example.com",
-		"insert 8 user8 person8@example.com",
-		"insert 9 user9 person9@example.com",
-		"insert 3 user3 person3@example.com",
-		"insert 12 user12 person12@example.com",
-		"insert 27 user27 person27@example.com",
-		"insert 17 user17 person17@example.com",
-		"insert 16 user16 person16@example.com",
-		"insert 13 user13 person13@example.com",
-		"insert 24 user24 person24@example.com",
-		"insert 25 user25 person25@example.com",
-		"insert 28 user28 person28@example.com",
-		".btree",
+		".dbinfo",
+		".exit",
+	})
+	check(err)
+
+	expected := []string{
+		"db > Executed.",
+		"db > format version: 6",
+		"page size: 4096",
+		"page count: 3",
+		"free pages: 0",
+		// ファイルを作ったときと、INSERTのコミット
+		"change counter: 2",
+		"schema cookie: 1",
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
+}
+
+func TestPrintErrorOnDuplicateKey(t *testing.T) {
+	beforeEach()
+
+	results, err := runScripts([]string{
+		"insert 1 user1 person1@example.com",
+		"insert 1 user1 person1@example.com",
+		"select",
+		".exit",
+	})
+	check(err)
+
+	expected := []string{
+		"db > Executed.",
+		"db > Error: Duplicate key.",
+		"db > (1, user1, person1@example.com)",
+		"Executed.",
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
+}
+
+func TestDuplicateKeyAcrossLeafNodes(t *testing.T) {
+	beforeEach()
+
+	scripts := []string{}
+	for i := 1; i <= 14; i++ {
+		scripts = append(scripts, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	// リーフノードの境目にあるキー
+	scripts = append(scripts, "insert 7 user7 person7@example.com", "insert 8 user8 person8@example.com", ".exit")
+
+	results, err := runScripts(scripts)
+	check(err)
+
+	expected := []string{
+		"db > Error: Duplicate key.",
+		"db > Error: Duplicate key.",
+		"db > ",
+	}
+	assertEqualSlice(t, results[14:], expected)
+}
+
+func TestReplaceRowWithSameKey(t *testing.T) {
+	beforeEach()
+
+	results, err := runScripts([]string{
+		"insert 1 user1 person1@example.com",
+		"replace 1 updated updated@example.com",
+		"replace 2 user2 person2@example.com",
+		"select",
+		".exit",
+	})
+	check(err)
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (1, updated, updated@example.com)",
+		"(2, user2, person2@example.com)",
+		"Executed.",
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
+}
+
+func TestInsertWithSQLSyntax(t *testing.T) {
+	beforeEach()
+
+	results, err := runScripts([]string{
+		"CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT(32), email TEXT(256))",
+		"INSERT INTO users VALUES (1, 'John Smith', 'john@example.com');",
+		"Insert Into users (email, id, username) Values ('it''s@example.com', 2, 'user2')",
+		"insert into users values (3, 'user3'",
+		"SELECT * FROM users",
+		".exit",
+	})
+	check(err)
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		`db > Syntax error: line 1, column 37: expected ")", but got end of input.`,
+		"db > (1, John Smith, john@example.com)",
+		"(2, user2, it's@example.com)",
+		"Executed.",
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
+}
+
+func TestCreateTable(t *testing.T) {
+	beforeEach()
+
+	results, err := runScripts([]string{
+		"create table posts (id integer primary key, title text not null, score real, body blob)",
+		"create table posts (id integer)",
+		"create table if not exists posts (id integer)",
+		"create table tags (name text primary key)",
+		"insert into posts values (2, 'second', 1, x'cafe')",
+		"insert into posts (title, id) values ('first', 1)",
+		"insert into posts (title) values ('third')",
+		"insert into posts (id) values (4)",
+		"insert into posts values (5, 'fifth', 'high', NULL)",
+		"insert into tags values ('x')",
+		"select * from posts",
+		".tables",
+		".schema",
 		".exit",
+	})
+	check(err)
+
+	expected := []string{
+		"db > Executed.",
+		"db > Error: table posts already exists.",
+		"db > Executed.",
+		"db > Error: primary key must be an INTEGER column: name.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: NOT NULL constraint failed: posts.title.",
+		"db > Error: datatype mismatch: column score expects REAL, but got TEXT.",
+		"db > Error: no such table: tags.",
+		"db > (1, first, NULL, NULL)",
+		"(2, second, 1.0, x'cafe')",
+		"(3, third, NULL, NULL)",
+		"Executed.",
+		"db > posts",
+		"db > CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT NOT NULL, score REAL, body BLOB);",
+		"db > ",
 	}
+	assertEqualSlice(t, results, expected)
+
+	// 再度開いても、テーブルの定義と行が残っている
+	results, err = runScripts([]string{
+		"insert into posts values (4, 'fourth', -0.5, NULL)",
+		"select * from posts",
+		".exit",
+	})
+	check(err)
+
+	expected = []string{
+		"db > Executed.",
+		"db > (1, first, NULL, NULL)",
+		"(2, second, 1.0, x'cafe')",
+		"(3, third, NULL, NULL)",
+		"(4, fourth, -0.5, NULL)",
+		"Executed.",
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
+}
+
+func TestQueryCatalog(t *testing.T) {
+	beforeEach()
+
+	results, err := runScripts([]string{
+		"create table posts (id integer primary key, title text)",
+		"insert 1 user1 person1@example.com",
+		"select * from toydb_master",
+		"insert into toydb_master values ('table', 'x', 'x', 9, '')",
+		"create table TOYDB_MASTER (id integer)",
+		".exit",
+	})
+	check(err)
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > (table, posts, posts, 2, CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT))",
+		"(table, users, users, 3, CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT(32), email TEXT(256)))",
+		"Executed.",
+		"db > Error: table toydb_master may not be modified.",
+		"db > Error: table TOYDB_MASTER already exists.",
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
+}
+
+func TestSelectWithWhere(t *testing.T) {
+	beforeEach()
+
+	scripts := []string{"create table items (id integer primary key, name text, price real)"}
+	for i := 1; i <= 30; i++ {
+		scripts = append(scripts, fmt.Sprintf("insert into items values (%d, 'item%d', %d.5)", i, i, i%5))
+	}
+	scripts = append(scripts,
+		"select * from items where id >= 14 and id < 17",
+		"select * from items where id between 28 and 100 and price > 2",
+		"select * from items where price = 0.5 and name in ('item5', 'item10', 'item11')",
+		"select * from items where id = 12 or name is null",
+		"select * from items where id > 30",
+		"select * from items where missing = 1",
+		"select * from items where name + 1 = 2",
+		".exit",
+	)
+	results, err := runScripts(scripts)
+	check(err)
+
+	expected := []string{}
+	for i := 0; i <= 30; i++ {
+		expected = append(expected, "db > Executed.")
+	}
+	expected = append(expected,
+		"db > (14, item14, 4.5)",
+		"(15, item15, 0.5)",
+		"(16, item16, 1.5)",
+		"Executed.",
+		"db > (28, item28, 3.5)",
+		"(29, item29, 4.5)",
+		"Executed.",
+		"db > (5, item5, 0.5)",
+		"(10, item10, 0.5)",
+		"Executed.",
+		"db > (12, item12, 2.5)",
+		"Executed.",
+		"db > Executed.",
+		"db > Error: no such column: missing.",
+		"db > Error: datatype mismatch: TEXT + INTEGER.",
+		"db > ",
+	)
+	assertEqualSlice(t, results, expected)
+}
+
+func TestSelectWithOrderByAndLimit(t *testing.T) {
+	beforeEach()
+
+	scripts := []string{"create table items (id integer primary key, name text, price real)"}
+	for i := 1; i <= 30; i++ {
+		scripts = append(scripts, fmt.Sprintf("insert into items values (%d, 'item%d', %d.5)", i, i, i%5))
+	}
+	scripts = append(scripts,
+		"select name, price * 2 as doubled from items where id <= 6 order by doubled desc, id",
+		// 主キーの順番は、B-treeを逆向きに読む
+		"select id from items order by id desc limit 3",
+		"select id from items where id between 10 and 20 order by 1 desc limit 2 offset 3",
+		"select id, name from items order by price, id desc limit 3",
+		"select * from items limit 2, 2",
+		"select id from items limit 0",
+		"select id from items order by 2",
+		"select id from items limit -1",
+		".exit",
+	)
+	results, err := runScripts(scripts)
+	check(err)
+
+	expected := []string{}
+	for i := 0; i <= 30; i++ {
+		expected = append(expected, "db > Executed.")
+	}
+	expected = append(expected,
+		"db > (item4, 9.0)",
+		"(item3, 7.0)",
+		"(item2, 5.0)",
+		"(item1, 3.0)",
+		"(item6, 3.0)",
+		"(item5, 1.0)",
+		"Executed.",
+		"db > (30)",
+		"(29)",
+		"(28)",
+		"Executed.",
+		"db > (17)",
+		"(16)",
+		"Executed.",
+		"db > (30, item30)",
+		"(25, item25)",
+		"(20, item20)",
+		"Executed.",
+		"db > (3, item3, 3.5)",
+		"(4, item4, 4.5)",
+		"Executed.",
+		"db > Executed.",
+		"db > Error: ORDER BY term out of range - should be between 1 and 1.",
+		"db > Error: LIMIT must be a non-negative integer.",
+		"db > ",
+	)
+	assertEqualSlice(t, results, expected)
+}
+
+func TestAggregates(t *testing.T) {
+	beforeEach()
 
+	scripts := []string{"create table items (id integer primary key, category text, price real, stock integer)"}
+	for i := 1; i <= 30; i++ {
+		stock := fmt.Sprint(i)
+		if i%4 == 0 {
+			stock = "null"
+		}
+		scripts = append(scripts, fmt.Sprintf("insert into items values (%d, 'c%d', %d.5, %s)", i, i%3, i%5, stock))
+	}
+	scripts = append(scripts,
+		// 行をデコードせずに、リーフノードのセルの数から数える
+		"select count(*) from items",
+		"select category, count(*), count(stock), sum(stock), min(price), max(price) from items group by category",
+		"select category, avg(price) as average from items where id <= 6 group by 1 having average > 2 order by average desc",
+		"select count(*), sum(stock), avg(price) from items where id > 30",
+		"select category, sum(stock) from items group by category order by sum(stock) desc limit 1",
+		"select count(*) from items where price > 3",
+		"select * from items where count(*) > 1",
+		"select total(price) from items",
+		"select sum(category) from items",
+		".exit",
+	)
 	results, err := runScripts(scripts)
 	check(err)
 
+	expected := []string{}
+	for i := 0; i <= 30; i++ {
+		expected = append(expected, "db > Executed.")
+	}
+	expected = append(expected,
+		"db > (30)",
+		"Executed.",
+		// グループは最初に現れた順に並ぶ
+		"db > (c1, 10, 7, 97, 0.5, 4.5)",
+		"(c2, 10, 8, 127, 0.5, 4.5)",
+		"(c0, 10, 8, 129, 0.5, 4.5)",
+		"Executed.",
+		"db > (c1, 3.0)",
+		"(c0, 2.5)",
+		"Executed.",
+		"db > (0, NULL, NULL)",
+		"Executed.",
+		"db > (c0, 129)",
+		"Executed.",
+		"db > (12)",
+		"Executed.",
+		"db > Error: misuse of aggregate function in WHERE.",
+		"db > Error: no such function: TOTAL.",
+		"db > Error: datatype mismatch: SUM(TEXT).",
+		"db > ",
+	)
+	assertEqualSlice(t, results, expected)
+}
+
+func TestTransactions(t *testing.T) {
+	beforeEach()
+
+	results, err := runScripts([]string{
+		"create table items (id integer primary key, name text)",
+		"insert into items values (1, 'one')",
+		// ROLLBACKで、CREATE TABLEも含めて取り消す
+		"begin",
+		"insert into items values (2, 'two')",
+		"create table tags (name text)",
+		"select * from items",
+		"rollback",
+		"select * from items",
+		".tables",
+		"begin transaction",
+		"begin",
+		"insert into items values (3, 'three')",
+		// 途中まで削除してから失敗したステートメントは、ステートメントの分だけ取り消す
+		"delete from items where id < 2 or name + 1 = 0",
+		"select * from items",
+		"commit",
+		"commit",
+		"rollback",
+		// トランザクションの外でも、失敗したステートメントは何も変更しない
+		"delete from items where id < 2 or name + 1 = 0",
+		"begin",
+		"insert into items values (4, 'four')",
+		// コミットせずに終了すると、トランザクションの変更は残らない
+		".exit",
+	})
+	check(err)
+
 	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (1, one)",
+		"(2, two)",
+		"Executed.",
+		"db > Executed.",
+		"db > (1, one)",
+		"Executed.",
+		"db > items",
+		"db > Executed.",
+		"db > Error: cannot start a transaction within a transaction.",
+		"db > Executed.",
+		"db > Error: datatype mismatch: TEXT + INTEGER.",
+		"db > (1, one)",
+		"(3, three)",
+		"Executed.",
+		"db > Executed.",
+		"db > Error: cannot commit - no transaction is active.",
+		"db > Error: cannot rollback - no transaction is active.",
+		"db > Error: datatype mismatch: TEXT + INTEGER.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
+
+	results, err = runScripts([]string{
+		"select * from items",
+		".exit",
+	})
+	check(err)
+	assertEqualSlice(t, results, []string{
+		"db > (1, one)",
+		"(3, three)",
+		"Executed.",
+		"db > ",
+	})
+}
+
+func TestUpdateRows(t *testing.T) {
+	beforeEach()
+
+	scripts := []string{"create table items (id integer primary key, name text(8), price real)"}
+	for i := 1; i <= 20; i++ {
+		scripts = append(scripts, fmt.Sprintf("insert into items values (%d, 'item%d', %d)", i, i, i))
+	}
+	scripts = append(scripts,
+		"update items set price = price * 2, name = name || '!' where id between 2 and 3",
+		"select * from items where id <= 4",
+		// 主キーを変える更新は、削除してから挿入し直す
+		"update items set id = id + 100 where id > 18",
+		"update items set id = id + 1 where id >= 1",
+		"select * from items where id = 2 or id >= 20",
+		"update items set id = 5 where id = 2",
+		"update items set id = -1 where id = 2",
+		"update items set name = 'too long name' where id = 2",
+		"update items set price = 0 where id = 1000",
+		".exit",
+	)
+	results, err := runScripts(scripts)
+	check(err)
+
+	expected := []string{}
+	for i := 0; i <= 20; i++ {
+		expected = append(expected, "db > Executed.")
+	}
+	expected = append(expected,
+		"db > Updated 2 rows.",
+		"Executed.",
+		"db > (1, item1, 1.0)",
+		"(2, item2!, 4.0)",
+		"(3, item3!, 6.0)",
+		"(4, item4, 4.0)",
+		"Executed.",
+		"db > Updated 2 rows.",
+		"Executed.",
+		"db > Updated 20 rows.",
+		"Executed.",
+		"db > (2, item1, 1.0)",
+		"(120, item19, 19.0)",
+		"(121, item20, 20.0)",
+		"Executed.",
+		"db > Error: Duplicate key.",
+		"db > Error: primary key must not be negative.",
+		"db > Error: string is too long: column name.",
+		"db > Updated 0 rows.",
+		"Executed.",
+		"db > ",
+	)
+	assertEqualSlice(t, results, expected)
+}
+
+func TestDeleteRows(t *testing.T) {
+	beforeEach()
+
+	scripts := []string{}
+	for i := 1; i <= 30; i++ {
+		scripts = append(scripts, fmt.Sprintf("insert %d user%d person%d@example.com", i, i, i))
+	}
+	scripts = append(scripts,
+		"delete from users where id % 3 != 1",
+		"select * from users where id > 20",
+		"delete from users where id between 5 and 9",
+		"delete from users where id = 100",
+		"delete from users",
+		"select",
+		".btree",
+		".exit",
+	)
+	results, err := runScripts(scripts)
+	check(err)
+
+	expected := []string{}
+	for i := 1; i <= 30; i++ {
+		expected = append(expected, "db > Executed.")
+	}
+	expected = append(expected,
+		"db > Deleted 20 rows.",
+		"Executed.",
+		"db > (22, user22, person22@example.com)",
+		"(25, user25, person25@example.com)",
+		"(28, user28, person28@example.com)",
+		"Executed.",
+		"db > Deleted 1 row.",
+		"Executed.",
+		"db > Deleted 0 rows.",
+		"Executed.",
+		"db > Deleted 9 rows.",
+		"Executed.",
+		"db > Executed.",
 		"db > Tree:",
-		"- internal (size 3)",
-		"  - leaf (size 7)",
-		"    - 1",
-		"    - 2",
-		"    - 3",
-		"    - 4",
-		"    - 5",
-		"    - 6",
-		"    - 7",
-		"  - key 7",
-		"  - leaf (size 8)",
-		"    - 8",
-		"    - 9",
-		"    - 10",
-		"    - 11",
-		"    - 12",
-		"    - 13",
-		"    - 14",
-		"    - 15",
-		"  - key 15",
-		"  - leaf (size 7)",
-		"    - 16",
-		"    - 17",
-		"    - 18",
-		"    - 19",
-		"    - 20",
-		"    - 21",
-		"    - 22",
-		"  - key 22",
-		"  - leaf (size 8)",
-		"    - 23",
-		"    - 24",
-		"    - 25",
-		"    - 26",
-		"    - 27",
-		"    - 28",
-		"    - 29",
-		"    - 30",
+		"- leaf (size 0)",
 		"db > ",
+	)
+	assertEqualSlice(t, results, expected)
+}
+
+func TestCreateIndex(t *testing.T) {
+	beforeEach()
+
+	scripts := []string{"create table p (id integer primary key, name text, age integer)"}
+	for i := 1; i <= 12; i++ {
+		scripts = append(scripts, fmt.Sprintf("insert into p values (%d, 'p%d', %d)", i, i, i%4*10))
 	}
-	assertEqualSlice(t, results[len(scripts)-2:], expected)
+	scripts = append(scripts,
+		"create index on p(age)",
+		"create unique index by_name on p(name)",
+		"create index on p(age)",
+		"create index if not exists idx_p_age on p(age)",
+		"create index on p(height)",
+		"select id from p where age = 20",
+		// インデックスの順番で読んでも、ORDER BY句の順番に並べる
+		"select id, age from p where age > 10 order by id limit 3",
+		"insert into p values (13, 'p1', 0)",
+		"update p set name = 'p2' where id = 3",
+		"update p set age = 20 where age = 0",
+		"select id from p where age = 20",
+		"delete from p where age between 15 and 25",
+		"select count(*) from p",
+		"select id, age from p where age < 15",
+		".schema",
+		".exit",
+	)
+	results, err := runScripts(scripts)
+	check(err)
+
+	expected := []string{}
+	for i := 0; i <= 14; i++ {
+		expected = append(expected, "db > Executed.")
+	}
+	expected = append(expected,
+		"db > Error: index idx_p_age already exists.",
+		"db > Executed.",
+		"db > Error: no such column: height.",
+		"db > (2)",
+		"(6)",
+		"(10)",
+		"Executed.",
+		"db > (2, 20)",
+		"(3, 30)",
+		"(6, 20)",
+		"Executed.",
+		"db > Error: UNIQUE constraint failed.",
+		"db > Error: UNIQUE constraint failed.",
+		"db > Updated 3 rows.",
+		"Executed.",
+		"db > (2)",
+		"(4)",
+		"(6)",
+		"(8)",
+		"(10)",
+		"(12)",
+		"Executed.",
+		"db > Deleted 6 rows.",
+		"Executed.",
+		"db > (6)",
+		"Executed.",
+		"db > (1, 10)",
+		"(5, 10)",
+		"(9, 10)",
+		"Executed.",
+		"db > CREATE TABLE p (id INTEGER PRIMARY KEY, name TEXT, age INTEGER);",
+		"CREATE INDEX idx_p_age ON p (age);",
+		"CREATE UNIQUE INDEX by_name ON p (name);",
+		"db > ",
+	)
+	assertEqualSlice(t, results, expected)
+
+	// インデックスはファイルに残る
+	results, err = runScripts([]string{
+		"select id, name from p where name = 'p7'",
+		".exit",
+	})
+	check(err)
+	assertEqualSlice(t, results, []string{
+		"db > (7, p7)",
+		"Executed.",
+		"db > ",
+	})
+}
+
+func TestLargeValues(t *testing.T) {
+	beforeEach()
+
+	// 1ページに入りきらない値は、オーバーフローページに保存する
+	a, b, c := strings.Repeat("a", 10000), strings.Repeat("b", 10000), strings.Repeat("c", 5000)
+	results, err := runScripts([]string{
+		"create table docs (id integer primary key, body text)",
+		fmt.Sprintf("insert into docs values (1, '%s')", a),
+		fmt.Sprintf("insert into docs values (2, '%s')", b),
+		"insert into docs values (3, 'short')",
+		fmt.Sprintf("select id from docs where body = '%s'", b),
+		fmt.Sprintf("update docs set body = '%s' where id = 1", c),
+		"delete from docs where id = 2",
+		".dbinfo",
+		".exit",
+	})
+	check(err)
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > (2)",
+		"Executed.",
+		"db > Updated 1 row.",
+		"Executed.",
+		"db > Deleted 1 row.",
+		"Executed.",
+		"db > format version: 6",
+		"page size: 4096",
+		"page count: 9",
+		"free pages: 4",
+		"change counter: 7",
+		"schema cookie: 1",
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
+
+	// 読み直しても、値は元に戻る
+	results, err = runScripts([]string{
+		fmt.Sprintf("select id from docs where body = '%s'", c),
+		"select * from docs where id = 3",
+		".exit",
+	})
+	check(err)
+
+	expected = []string{
+		"db > (1)",
+		"Executed.",
+		"db > (3, short)",
+		"Executed.",
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	beforeEach()
+
+	scripts := []string{
+		"create table docs (id integer primary key, body text)",
+		"create index on docs(body)",
+	}
+	for i := 1; i <= 40; i++ {
+		scripts = append(scripts, insertLongRow(i*7%41))
+		scripts = append(scripts, fmt.Sprintf("insert into docs values (%d, '%s')", i, strings.Repeat("x", i*100)))
+	}
+	scripts = append(scripts,
+		"delete from users where id % 3 = 0",
+		"delete from docs where id > 30",
+		".check",
+		".exit",
+	)
+	results, err := runScripts(scripts)
+	check(err)
+
+	expected := []string{"db > ok", "db > "}
+	assertEqualSlice(t, results[len(results)-2:], expected)
+}
+
+func TestPrepareAndExecute(t *testing.T) {
+	beforeEach()
+
+	scripts := []string{
+		"create table users (id integer primary key, username text, email text)",
+		"prepare ins (integer, text, text) as insert into users values ($1, $2, $3)",
+		"execute ins (1, 'alice', 'alice@example.com')",
+		"execute ins (2, 'bob', 'bob@example.com')",
+		"execute ins ('3', 'carol', 'carol@example.com')",
+		"prepare find as select username from users where id >= ?",
+		"execute find (2)",
+		"execute find",
+		"prepare find as select * from users",
+		"deallocate prepare find",
+		"execute find (1)",
+		".exit",
+	}
+	results, err := runScripts(scripts)
+	check(err)
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Executed.",
+		"db > Error: datatype mismatch: parameter ?1 expects INTEGER, but got TEXT.",
+		"db > Executed.",
+		"db > (bob)",
+		"Executed.",
+		"db > Error: missing value for parameter ?1.",
+		"db > Error: prepared statement find already exists.",
+		"db > Executed.",
+		"db > Error: prepared statement find does not exist.",
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
+}
+
+func TestExplain(t *testing.T) {
+	beforeEach()
+
+	scripts := []string{
+		"create table users (id integer primary key, username text, email text)",
+		"create index by_email on users(email)",
+		"explain select username from users where id > 10 limit 5",
+		"explain select * from users where email = 'a@example.com'",
+		"explain analyze delete from users",
+		".exit",
+	}
+	results, err := runScripts(scripts)
+	check(err)
+
+	expected := []string{
+		"db > Executed.",
+		"db > Executed.",
+		"db > LIMIT 5",
+		"  PROJECT username",
+		"    FILTER id > 10",
+		"      SEARCH users USING PRIMARY KEY (id >= 11): seek via TableFind",
+		"Executed.",
+		"db > PROJECT id, username, email",
+		"  FILTER email = 'a@example.com'",
+		"    SEARCH users USING INDEX by_email (email = 'a@example.com'): seek via IndexSeek",
+		"Executed.",
+		`db > Syntax error: line 1, column 17: EXPLAIN ANALYZE supports only SELECT, but got "DELETE".`,
+		"db > ",
+	}
+	assertEqualSlice(t, results, expected)
 }
@@ -2,7 +2,6 @@ package persistence
 
 import (
 	"encoding/binary"
-	"fmt"
 	"math"
 )
 
@@ -11,6 +10,9 @@ type NodeType uint8
 const (
 	NODE_INTERNAL NodeType = iota
 	NODE_LEAF
+	// インデックスのB-tree（indextree.go）のノード
+	NODE_INDEX_INTERNAL
+	NODE_INDEX_LEAF
 )
 
 func uint32ToBytes(v uint32) []byte {
@@ -20,42 +22,56 @@ func uint32ToBytes(v uint32) []byte {
 	return bytes
 }
 
+// 空のB-treeを作り、ルートノードのページ番号を返す
+func CreateTree(pager *Pager) uint32 {
+	node, rootPageNum := pager.GetNewPage()
+	initLeafNode(node)
+	NodeUtil.setNodeRoot(node, true)
+	return rootPageNum
+}
+
 // リーフノードを分割してから、新しいセルを挿入する。
-// リーフノードは、左と右に半分ずつ分割する。pageは分割するページ。
-func leafNodeSplitAndInsert(pager *Pager, page *Page, cellNum uint32, key uint32, value []byte, rootPageNum uint32) {
+// リーフノードは、セルのバイト数が左と右でおよそ半分ずつになるように分割する。pageは分割するページ。
+func leafNodeSplitAndInsert(pager *Pager, page *Page, cellNum uint32, cell []byte, rootPageNum uint32) {
 	oldNode := page
 	oldMax := NodeUtil.getMaxKey(pager, oldNode)
 	// 新しいページを取得する（右）
 	newNode, rightChildPageNum := pager.GetNewPage()
 	initLeafNode(newNode)
 
-	// LEAF_NODE_MAX_CELLS+1個のセルを、左右に分割する
-	for index := LEAF_NODE_MAX_CELLS; index >= 0; index-- {
-		i := uint32(index)
-		var dstNode *Page
-		if i >= LEAF_NODE_LEFT_SPLIT_COUNT {
-			dstNode = newNode
-		} else {
-			dstNode = oldNode
-		}
-		dstCellNum := i % LEAF_NODE_LEFT_SPLIT_COUNT
-
+	// 元のセルと新しいセルを、キーの順番に並べる
+	numCells := LeafUtil.GetNumCells(oldNode)
+	cells := make([][]byte, 0, numCells+1)
+	total := 0
+	for i := uint32(0); i <= numCells; i++ {
 		if i == cellNum {
-			// 挿入する位置の場合は、挿入する
-			LeafUtil.WriteCellKey(dstNode, dstCellNum, key)
-			LeafUtil.WriteCellValue(dstNode, dstCellNum, value)
-		} else if i > cellNum {
-			// 挿入する位置より後ろの場合は、コピー元は元のページのi-1番目
-			LeafUtil.WriteCell(dstNode, dstCellNum, LeafUtil.GetCell(page, i-1))
-		} else {
-			// 挿入する位置より前の場合は、コピー元は元のページのi番目
-			LeafUtil.WriteCell(dstNode, dstCellNum, LeafUtil.GetCell(page, i))
+			cells = append(cells, cell)
+		}
+		if i < numCells {
+			cells = append(cells, append([]byte(nil), LeafUtil.GetCell(oldNode, i)...))
 		}
 	}
-	LeafUtil.WriteNumCells(oldNode, LEAF_NODE_LEFT_SPLIT_COUNT)
-	LeafUtil.WriteNumCells(newNode, LEAF_NODE_RIGHT_SPLIT_COUNT)
-	// TODO: 親ノードの番号を取得して設定する
-	// NodeUtil.setParent(newNode, )
+	for _, c := range cells {
+		total += len(c) + LEAF_NODE_CELL_POINTER_SIZE
+	}
+
+	// 左のセルのバイト数が、合計の半分以上になる最初の位置で分ける。右にも1つ以上のセルを残す
+	split, left := 0, 0
+	for split < len(cells)-1 && left*2 < total {
+		left += len(cells[split]) + LEAF_NODE_CELL_POINTER_SIZE
+		split++
+	}
+
+	LeafUtil.WriteNumCells(oldNode, 0)
+	LeafUtil.setContentStart(oldNode, PAGE_SIZE)
+	for i, c := range cells[:split] {
+		leafInsertCell(oldNode, uint32(i), c)
+	}
+	for i, c := range cells[split:] {
+		leafInsertCell(newNode, uint32(i), c)
+	}
+	// 右のノードの親は、分割したノードと同じ
+	NodeUtil.setParent(newNode, NodeUtil.GetParent(oldNode))
 	LeafUtil.setNextLeaf(newNode, LeafUtil.GetNextLeaf(oldNode))
 	LeafUtil.setNextLeaf(oldNode, rightChildPageNum)
 
@@ -67,7 +83,7 @@ func leafNodeSplitAndInsert(pager *Pager, page *Page, cellNum uint32, key uint32
 		// 分割したリーフノードがルートではない場合は、親ノードを更新する
 		parentPageNum := NodeUtil.GetParent(oldNode)
 		newMax := NodeUtil.getMaxKey(pager, oldNode)
-		parent := pager.GetPage(parentPageNum)
+		parent := pager.GetPageForWrite(parentPageNum)
 
 		updateInternalNodeKey(parent, oldMax, newMax)
 		internalNodeInsert(pager, parentPageNum, rightChildPageNum)
@@ -79,31 +95,22 @@ func leafNodeSplitAndInsert(pager *Pager, page *Page, cellNum uint32, key uint32
 // 古いルートノード（左のノード）は、新しく作成したノードにコピーする。
 // 新しく作成したルートノードには、左のノードのキーの最大値と、左右のノードのポインタ（ページ番号）をセットする。
 func createNewRoot(pager *Pager, rootPageNum uint32, rightChildPageNum uint32) {
-	root := pager.GetPage(rootPageNum)
+	root := pager.GetPageForWrite(rootPageNum)
 	leftChild, leftChildPageNum := pager.GetNewPage()
-	rightChild := pager.GetPage(rightChildPageNum)
+	rightChild := pager.GetPageForWrite(rightChildPageNum)
 
-	if NodeUtil.GetNodeType(root) == NODE_INTERNAL {
-		initInternalNode(rightChild)
-		initInternalNode(leftChild)
-	}
+	// ルートノードを左のノードにコピーする
+	copy(leftChild[:], root[:])
+	NodeUtil.setNodeRoot(leftChild, false)
 
-	// ??
+	// 左のノードが内部ノードの場合は、子ノードの親をコピー先のページにする
 	if NodeUtil.GetNodeType(leftChild) == NODE_INTERNAL {
-		var child *Page
-		for i := 0; i < int(InternalUtil.GetNumKeys(leftChild)); i++ {
-			childPage := InternalUtil.GetChild(leftChild, uint32(i))
-			child = pager.GetPage(childPage)
-			NodeUtil.setParent(child, leftChildPageNum)
+		numKeys := InternalUtil.GetNumKeys(leftChild)
+		for i := uint32(0); i <= numKeys; i++ {
+			NodeUtil.setParent(pager.GetPageForWrite(InternalUtil.GetChild(leftChild, i)), leftChildPageNum)
 		}
-		// child = pager.GetPage(InternalUtil.GetRightChild(leftChild))
-		// NodeUtil.setParent(child, leftChildPageNum)
 	}
 
-	// ルートノードを左のノードにコピーする
-	copy(leftChild[:], root[:])
-	NodeUtil.setNodeRoot(leftChild, false)
-
 	// 新しいルートノードにデータをセットする
 	initInternalNode(root)
 	NodeUtil.setNodeRoot(root, true)
@@ -119,11 +126,13 @@ func createNewRoot(pager *Pager, rootPageNum uint32, rightChildPageNum uint32) {
 	NodeUtil.setParent(rightChild, rootPageNum)
 }
 
-// リーフノードを分割した後に、内部ノードのキーを更新する
+// 子ノードを分割した後に、内部ノードのキーを更新する。
+// 子ノードが一番右の子ノードの場合は、内部ノードにキーがないので何もしない
 func updateInternalNodeKey(node *Page, oldKey uint32, newKey uint32) {
 	oldChildIndex := internalNodeFindChild(node, oldKey)
-	// oldChildIndexが、nodeのキーの数と同じだった場合は大丈夫？
-	InternalUtil.setKey(node, oldChildIndex, newKey)
+	if oldChildIndex < InternalUtil.GetNumKeys(node) {
+		InternalUtil.setKey(node, oldChildIndex, newKey)
+	}
 }
 
 // キーが含まれる子ノードのインデックスを返す
@@ -149,79 +158,85 @@ func internalNodeFindChild(node *Page, key uint32) uint32 {
 
 const INVALID_PAGE_NUM = math.MaxUint32
 
-// 内部ノードを分割する。parentPageNumが分割する内部ノードで、childPageNumは新しく追加した右側の子ノード（？）
+// 内部ノードの子ノードと、その最大のキー
+type internalEntry struct {
+	pageNum uint32
+	maxKey  uint32
+}
+
+// 内部ノードを分割してから、子ノードを挿入する。parentPageNumが分割する内部ノードで、childPageNumは挿入する子ノード。
+// 元の子ノードと挿入する子ノードをキーの順番に並べて、前半を分割したノードに、後半を新しいノード（右）に置く
 func internalNodeSplitAndInsert(pager *Pager, parentPageNum uint32, childPageNum uint32) {
 	oldPageNum := parentPageNum
-	oldNode := pager.GetPage(oldPageNum)
+	oldNode := pager.GetPageForWrite(oldPageNum)
 	oldMax := NodeUtil.getMaxKey(pager, oldNode)
-	fmt.Println(oldPageNum, oldMax)
 
 	child := pager.GetPage(childPageNum)
-	childMax := NodeUtil.getMaxKey(pager, child)
-
-	newNode, newPageNum := pager.GetNewPage()
-	splittingRoot := isNodeRoot(oldNode)
-
-	var parent *Page
-	if splittingRoot {
-		// oldNodeがルートノードだった場合
-		createNewRoot(pager, oldPageNum, newPageNum)
-		parent = pager.GetPage(oldPageNum)
-
-		// oldPageNumが、新しいルートノードの左の子ノードを指すようにする
-		oldPageNum := InternalUtil.GetChild(parent, 0)
-		oldNode = pager.GetPage(oldPageNum)
-	} else {
-		// TODO:
-		parent = pager.GetPage(NodeUtil.GetParent(oldNode))
-		initInternalNode(newNode)
+	childEntry := internalEntry{pageNum: childPageNum, maxKey: NodeUtil.getMaxKey(pager, child)}
+
+	// 元の子ノードと挿入する子ノードを、キーの順番に並べる
+	numKeys := InternalUtil.GetNumKeys(oldNode)
+	entries := make([]internalEntry, 0, numKeys+2)
+	inserted := false
+	for i := uint32(0); i <= numKeys; i++ {
+		entry := internalEntry{pageNum: InternalUtil.GetChild(oldNode, i)}
+		if i < numKeys {
+			entry.maxKey = InternalUtil.GetKey(oldNode, i)
+		} else {
+			entry.maxKey = NodeUtil.getMaxKey(pager, pager.GetPage(entry.pageNum))
+		}
+		if !inserted && childEntry.maxKey < entry.maxKey {
+			entries = append(entries, childEntry)
+			inserted = true
+		}
+		entries = append(entries, entry)
 	}
-
-	// newNodeに移動する
-	curPageNum := InternalUtil.GetRightChild(oldNode)
-	fmt.Println(curPageNum)
-	cur := pager.GetPage(curPageNum)
-
-	fmt.Println(newPageNum, curPageNum)
-	internalNodeInsert(pager, newPageNum, curPageNum)
-	NodeUtil.setParent(cur, newPageNum)
-	InternalUtil.setRightChild(oldNode, INVALID_PAGE_NUM)
-
-	for i := INTERNAL_NODE_MAX_CELLS - 1; i > INTERNAL_NODE_MAX_CELLS/2; i-- {
-		curPageNum = InternalUtil.GetChild(oldNode, uint32(i))
-		cur = pager.GetPage(curPageNum)
-		internalNodeInsert(pager, newPageNum, curPageNum)
-
-		NodeUtil.setParent(cur, newPageNum)
-		InternalUtil.setNumKeys(oldNode, InternalUtil.GetNumKeys(oldNode)-1)
+	if !inserted {
+		entries = append(entries, childEntry)
 	}
 
-	oldNumKeys := InternalUtil.GetNumKeys(oldNode)
-	InternalUtil.setRightChild(oldNode, InternalUtil.GetChild(oldNode, oldNumKeys-1))
-	InternalUtil.setNumKeys(oldNode, oldNumKeys-1)
+	newNode, newPageNum := pager.GetNewPage()
+	initInternalNode(newNode)
+	// 右のノードの親は、分割したノードと同じ
+	NodeUtil.setParent(newNode, NodeUtil.GetParent(oldNode))
 
-	maxAfterSplit := NodeUtil.getMaxKey(pager, oldNode)
-	var destinationPageNum uint32
-	if childMax < maxAfterSplit {
-		destinationPageNum = oldPageNum
-	} else {
-		destinationPageNum = newPageNum
+	split := (len(entries) + 1) / 2
+	internalSetEntries(pager, oldNode, oldPageNum, entries[:split])
+	internalSetEntries(pager, newNode, newPageNum, entries[split:])
+
+	if isNodeRoot(oldNode) {
+		// 新しいルートノードを作成する
+		createNewRoot(pager, oldPageNum, newPageNum)
+		return
 	}
 
-	internalNodeInsert(pager, destinationPageNum, childPageNum)
-	NodeUtil.setParent(child, destinationPageNum)
-	updateInternalNodeKey(parent, oldMax, NodeUtil.getMaxKey(pager, oldNode))
+	// 分割した内部ノードがルートではない場合は、親ノードを更新する
+	grandParentPageNum := NodeUtil.GetParent(oldNode)
+	grandParent := pager.GetPageForWrite(grandParentPageNum)
+	updateInternalNodeKey(grandParent, oldMax, entries[split-1].maxKey)
+	internalNodeInsert(pager, grandParentPageNum, newPageNum)
+}
 
-	if !splittingRoot {
-		internalNodeInsert(pager, NodeUtil.GetParent(oldNode), newPageNum)
-		NodeUtil.setParent(newNode, NodeUtil.GetParent(oldNode))
+// 内部ノードの子ノードを、entriesで置き換える。最後の子ノードは一番右の子ノードにする。
+// 子ノードの親は、内部ノードのページにする
+func internalSetEntries(pager *Pager, node *Page, pageNum uint32, entries []internalEntry) {
+	last := len(entries) - 1
+	InternalUtil.setNumKeys(node, uint32(last))
+	for i, entry := range entries {
+		if i < last {
+			InternalUtil.setChild(node, uint32(i), entry.pageNum)
+			InternalUtil.setKey(node, uint32(i), entry.maxKey)
+		} else {
+			InternalUtil.setRightChild(node, entry.pageNum)
+		}
+		NodeUtil.setParent(pager.GetPageForWrite(entry.pageNum), pageNum)
 	}
 }
 
 // 新たに追加したノードとキーを、内部ノードの適切な位置に追加する
 func internalNodeInsert(pager *Pager, parentPageNum uint32, childPageNum uint32) {
-	parent := pager.GetPage(parentPageNum)
-	child := pager.GetPage(childPageNum)
+	parent := pager.GetPageForWrite(parentPageNum)
+	child := pager.GetPageForWrite(childPageNum)
 	childMaxKey := NodeUtil.getMaxKey(pager, child)
 	index := internalNodeFindChild(parent, childMaxKey)
 
@@ -232,9 +247,11 @@ func internalNodeInsert(pager *Pager, parentPageNum uint32, childPageNum uint32)
 		return
 	}
 
+	NodeUtil.setParent(child, parentPageNum)
+
 	rightChildPageNum := InternalUtil.GetRightChild(parent)
 	if rightChildPageNum == INVALID_PAGE_NUM {
-		// ?
+		// 子ノードがない内部ノードの場合は、一番右の子ノードにする
 		InternalUtil.setRightChild(parent, childPageNum)
 		return
 	}
@@ -260,3 +277,322 @@ func internalNodeInsert(pager *Pager, parentPageNum uint32, childPageNum uint32)
 		InternalUtil.setKey(parent, index, childMaxKey)
 	}
 }
+
+// ルートからリーフまでたどった経路の、内部ノードの情報
+type pathEntry struct {
+	// 内部ノードのページ番号
+	pageNum uint32
+	// たどった子ノードのインデックス（numKeysの場合は一番右の子ノード）
+	index uint32
+}
+
+// キーが含まれるリーフノードまでたどって、経路とリーフノードのページ番号を返す
+func findPath(pager *Pager, rootPageNum uint32, key uint32) ([]pathEntry, uint32) {
+	var path []pathEntry
+	pageNum := rootPageNum
+
+	for {
+		page := pager.GetPage(pageNum)
+		if NodeUtil.GetNodeType(page) == NODE_LEAF {
+			return path, pageNum
+		}
+
+		index := internalNodeFindChild(page, key)
+		path = append(path, pathEntry{pageNum: pageNum, index: index})
+		pageNum = InternalUtil.GetChild(page, index)
+	}
+}
+
+// リーフノードから、キー以上の最初のセルのインデックスを返す
+func leafNodeFindCell(page *Page, key uint32) uint32 {
+	ng, ok := -1, int(LeafUtil.GetNumCells(page))
+	for ok-ng > 1 {
+		i := (ok + ng) / 2
+		if LeafUtil.GetCellKey(page, uint32(i)) >= key {
+			ok = i
+		} else {
+			ng = i
+		}
+	}
+	return uint32(ok)
+}
+
+// キーのセルをB-treeから削除する。キーが見つからない場合はfalseを返す。
+// ノードのセルが少なくなりすぎたら、兄弟ノードから借りるかマージする。
+func DeleteKey(pager *Pager, rootPageNum uint32, key uint32) bool {
+	path, leafPageNum := findPath(pager, rootPageNum, key)
+	leaf := pager.GetPageForWrite(leafPageNum)
+	cellNum := leafNodeFindCell(leaf, key)
+	if cellNum >= LeafUtil.GetNumCells(leaf) || LeafUtil.GetCellKey(leaf, cellNum) != key {
+		return false
+	}
+
+	numCells := LeafUtil.GetNumCells(leaf)
+	removedMax := cellNum == numCells-1
+	freeOverflow(pager, LeafUtil.getOverflowPage(leaf, cellNum))
+	leafRemoveCell(leaf, cellNum)
+
+	if len(path) == 0 {
+		// ルートノードがリーフの場合は、空になってもよい
+		return true
+	}
+
+	if LeafUtil.usedBytes(leaf) < LEAF_NODE_MIN_BYTES {
+		rebalanceLeaf(pager, path, leafPageNum)
+	} else if removedMax {
+		updateSeparatorKey(pager, path, len(path)-1, NodeUtil.getMaxKey(pager, leaf))
+	}
+	return true
+}
+
+// ノードの最大のキーが変わったときに、祖先の内部ノードのキーを更新する。
+// levelは、ノードの親の経路上の位置。ノードが一番右の子ノードの場合は、さらに上の祖先のキーを更新する。
+func updateSeparatorKey(pager *Pager, path []pathEntry, level int, maxKey uint32) {
+	for l := level; l >= 0; l-- {
+		parent := pager.GetPage(path[l].pageNum)
+		if path[l].index < InternalUtil.GetNumKeys(parent) {
+			InternalUtil.setKey(pager.GetPageForWrite(path[l].pageNum), path[l].index, maxKey)
+			return
+		}
+	}
+}
+
+// 内部ノードのindex番目の子ノードを設定する（numKeysの場合は一番右の子ノード）
+func internalSetChildAt(page *Page, index uint32, childPageNum uint32) {
+	if index == InternalUtil.GetNumKeys(page) {
+		InternalUtil.setRightChild(page, childPageNum)
+	} else {
+		InternalUtil.setChild(page, index, childPageNum)
+	}
+}
+
+// index番目とindex+1番目の子ノードをマージした後に、内部ノードからindex番目のセルを取り除く。
+// マージしたノードは、index+1番目の位置に置く
+func internalRemoveCell(page *Page, index uint32, mergedPageNum uint32) {
+	internalSetChildAt(page, index+1, mergedPageNum)
+
+	numKeys := InternalUtil.GetNumKeys(page)
+	for i := index; i+1 < numKeys; i++ {
+		InternalUtil.setCell(page, i, InternalUtil.GetCell(page, i+1))
+	}
+	InternalUtil.setNumKeys(page, numKeys-1)
+}
+
+// セルが少なくなりすぎたリーフノードを、兄弟ノードから借りるかマージして直す。
+// 兄弟ノードは、セルを渡してもLEAF_NODE_MIN_BYTES以上残る間だけ貸せる
+func rebalanceLeaf(pager *Pager, path []pathEntry, pageNum uint32) {
+	level := len(path) - 1
+	parent := pager.GetPageForWrite(path[level].pageNum)
+	index := path[level].index
+	node := pager.GetPageForWrite(pageNum)
+
+	// セルを渡した後に、兄弟ノードに残るバイト数
+	remaining := func(sibling *Page, cellNum uint32) uint32 {
+		return LeafUtil.usedBytes(sibling) - uint32(len(LeafUtil.GetCell(sibling, cellNum))) - LEAF_NODE_CELL_POINTER_SIZE
+	}
+
+	if index > 0 {
+		// 左の兄弟ノードがある場合
+		leftPageNum := InternalUtil.GetChild(parent, index-1)
+		left := pager.GetPageForWrite(leftPageNum)
+		if remaining(left, LeafUtil.GetNumCells(left)-1) < LEAF_NODE_MIN_BYTES {
+			mergeLeaves(pager, path, index-1)
+			return
+		}
+
+		// 左の兄弟ノードの最後のセルを借りる
+		for LeafUtil.usedBytes(node) < LEAF_NODE_MIN_BYTES {
+			last := LeafUtil.GetNumCells(left) - 1
+			if remaining(left, last) < LEAF_NODE_MIN_BYTES {
+				break
+			}
+			leafInsertCell(node, 0, append([]byte(nil), LeafUtil.GetCell(left, last)...))
+			leafRemoveCell(left, last)
+		}
+		InternalUtil.setKey(parent, index-1, NodeUtil.getMaxKey(pager, left))
+		updateSeparatorKey(pager, path, level, NodeUtil.getMaxKey(pager, node))
+		return
+	}
+
+	// 一番左の子ノードの場合は、右の兄弟ノードを使う
+	rightPageNum := InternalUtil.GetChild(parent, index+1)
+	right := pager.GetPageForWrite(rightPageNum)
+	if remaining(right, 0) < LEAF_NODE_MIN_BYTES {
+		mergeLeaves(pager, path, index)
+		return
+	}
+
+	// 右の兄弟ノードの最初のセルを借りる
+	for LeafUtil.usedBytes(node) < LEAF_NODE_MIN_BYTES && remaining(right, 0) >= LEAF_NODE_MIN_BYTES {
+		leafInsertCell(node, LeafUtil.GetNumCells(node), append([]byte(nil), LeafUtil.GetCell(right, 0)...))
+		leafRemoveCell(right, 0)
+	}
+	InternalUtil.setKey(parent, index, NodeUtil.getMaxKey(pager, node))
+}
+
+// 親ノードのleftIndex番目とleftIndex+1番目のリーフノードをマージする。右のノードのページは解放する
+func mergeLeaves(pager *Pager, path []pathEntry, leftIndex uint32) {
+	level := len(path) - 1
+	parentPageNum := path[level].pageNum
+	parent := pager.GetPageForWrite(parentPageNum)
+	leftPageNum := InternalUtil.GetChild(parent, leftIndex)
+	rightPageNum := InternalUtil.GetChild(parent, leftIndex+1)
+	left := pager.GetPageForWrite(leftPageNum)
+	right := pager.GetPage(rightPageNum)
+
+	// 右のノードのセルを、左のノードの後ろにコピーする
+	leftNumCells := LeafUtil.GetNumCells(left)
+	rightNumCells := LeafUtil.GetNumCells(right)
+	for i := uint32(0); i < rightNumCells; i++ {
+		leafInsertCell(left, leftNumCells+i, LeafUtil.GetCell(right, i))
+	}
+	LeafUtil.setNextLeaf(left, LeafUtil.GetNextLeaf(right))
+
+	internalRemoveCell(parent, leftIndex, leftPageNum)
+	pager.FreePage(rightPageNum)
+
+	// 右のノードが空だった場合は、マージしたノードの最大のキーが変わる
+	if leftNumCells+rightNumCells > 0 {
+		path[level].index = leftIndex
+		updateSeparatorKey(pager, path, level, NodeUtil.getMaxKey(pager, left))
+	}
+
+	rebalanceInternal(pager, path[:level], parentPageNum)
+}
+
+// キーが少なくなりすぎた内部ノードを、兄弟ノードから借りるかマージして直す。
+// pathは、ノードの親までの経路
+func rebalanceInternal(pager *Pager, path []pathEntry, pageNum uint32) {
+	node := pager.GetPage(pageNum)
+	numKeys := InternalUtil.GetNumKeys(node)
+
+	if len(path) == 0 {
+		// ルートノードの子ノードが1つだけになったら、木の高さを1つ減らす
+		if numKeys == 0 {
+			shrinkRoot(pager, pageNum)
+		}
+		return
+	}
+	if numKeys >= INTERNAL_NODE_MIN_KEYS {
+		return
+	}
+
+	level := len(path) - 1
+	parent := pager.GetPageForWrite(path[level].pageNum)
+	index := path[level].index
+
+	if index > 0 {
+		left := pager.GetPageForWrite(InternalUtil.GetChild(parent, index-1))
+		if InternalUtil.GetNumKeys(left) > INTERNAL_NODE_MIN_KEYS {
+			internalBorrowFromLeft(pager, parent, index, pageNum, left)
+			return
+		}
+		mergeInternalNodes(pager, path, index-1)
+		return
+	}
+
+	right := pager.GetPageForWrite(InternalUtil.GetChild(parent, index+1))
+	if InternalUtil.GetNumKeys(right) > INTERNAL_NODE_MIN_KEYS {
+		internalBorrowFromRight(pager, parent, index, pageNum, right)
+		return
+	}
+	mergeInternalNodes(pager, path, index)
+}
+
+// 左の兄弟ノードの一番右の子ノードを、ノードの一番左に移動する
+func internalBorrowFromLeft(pager *Pager, parent *Page, index uint32, pageNum uint32, left *Page) {
+	node := pager.GetPageForWrite(pageNum)
+	numKeys := InternalUtil.GetNumKeys(node)
+
+	// 親ノードの区切りのキーは、左の兄弟ノードの最大のキー（=移動する子ノードの最大のキー）
+	separator := InternalUtil.GetKey(parent, index-1)
+	movedPageNum := InternalUtil.GetRightChild(left)
+
+	for i := numKeys; i > 0; i-- {
+		InternalUtil.setCell(node, i, InternalUtil.GetCell(node, i-1))
+	}
+	InternalUtil.setNumKeys(node, numKeys+1)
+	InternalUtil.setChild(node, 0, movedPageNum)
+	InternalUtil.setKey(node, 0, separator)
+	NodeUtil.setParent(pager.GetPageForWrite(movedPageNum), pageNum)
+
+	// 左の兄弟ノードの最後のセルを、一番右の子ノードにする
+	leftNumKeys := InternalUtil.GetNumKeys(left)
+	newMax := InternalUtil.GetKey(left, leftNumKeys-1)
+	InternalUtil.setRightChild(left, InternalUtil.GetChild(left, leftNumKeys-1))
+	InternalUtil.setNumKeys(left, leftNumKeys-1)
+	InternalUtil.setKey(parent, index-1, newMax)
+}
+
+// 右の兄弟ノードの一番左の子ノードを、ノードの一番右に移動する
+func internalBorrowFromRight(pager *Pager, parent *Page, index uint32, pageNum uint32, right *Page) {
+	node := pager.GetPageForWrite(pageNum)
+	numKeys := InternalUtil.GetNumKeys(node)
+
+	// 今の一番右の子ノードを、区切りのキー（=ノードの最大のキー）と一緒にセルにする
+	separator := InternalUtil.GetKey(parent, index)
+	InternalUtil.setNumKeys(node, numKeys+1)
+	InternalUtil.setChild(node, numKeys, InternalUtil.GetRightChild(node))
+	InternalUtil.setKey(node, numKeys, separator)
+
+	movedPageNum := InternalUtil.GetChild(right, 0)
+	InternalUtil.setRightChild(node, movedPageNum)
+	NodeUtil.setParent(pager.GetPageForWrite(movedPageNum), pageNum)
+	InternalUtil.setKey(parent, index, InternalUtil.GetKey(right, 0))
+
+	rightNumKeys := InternalUtil.GetNumKeys(right)
+	for i := uint32(0); i+1 < rightNumKeys; i++ {
+		InternalUtil.setCell(right, i, InternalUtil.GetCell(right, i+1))
+	}
+	InternalUtil.setNumKeys(right, rightNumKeys-1)
+}
+
+// 親ノードのleftIndex番目とleftIndex+1番目の内部ノードをマージする。右のノードのページは解放する
+func mergeInternalNodes(pager *Pager, path []pathEntry, leftIndex uint32) {
+	level := len(path) - 1
+	parentPageNum := path[level].pageNum
+	parent := pager.GetPageForWrite(parentPageNum)
+	leftPageNum := InternalUtil.GetChild(parent, leftIndex)
+	rightPageNum := InternalUtil.GetChild(parent, leftIndex+1)
+	left := pager.GetPageForWrite(leftPageNum)
+	right := pager.GetPage(rightPageNum)
+
+	// 左のノードの一番右の子ノードを、親ノードの区切りのキーと一緒にセルにする
+	leftNumKeys := InternalUtil.GetNumKeys(left)
+	rightNumKeys := InternalUtil.GetNumKeys(right)
+	InternalUtil.setNumKeys(left, leftNumKeys+1+rightNumKeys)
+	InternalUtil.setChild(left, leftNumKeys, InternalUtil.GetRightChild(left))
+	InternalUtil.setKey(left, leftNumKeys, InternalUtil.GetKey(parent, leftIndex))
+
+	// 右のノードのセルと一番右の子ノードを移動する
+	for i := uint32(0); i < rightNumKeys; i++ {
+		InternalUtil.setCell(left, leftNumKeys+1+i, InternalUtil.GetCell(right, i))
+	}
+	InternalUtil.setRightChild(left, InternalUtil.GetRightChild(right))
+	for i := leftNumKeys + 1; i <= leftNumKeys+1+rightNumKeys; i++ {
+		NodeUtil.setParent(pager.GetPageForWrite(InternalUtil.GetChild(left, i)), leftPageNum)
+	}
+
+	internalRemoveCell(parent, leftIndex, leftPageNum)
+	pager.FreePage(rightPageNum)
+
+	rebalanceInternal(pager, path[:level], parentPageNum)
+}
+
+// ルートノードの唯一の子ノードを、ルートノードのページにコピーする
+func shrinkRoot(pager *Pager, rootPageNum uint32) {
+	root := pager.GetPageForWrite(rootPageNum)
+	childPageNum := InternalUtil.GetRightChild(root)
+	child := pager.GetPage(childPageNum)
+
+	copy(root[:], child[:])
+	NodeUtil.setNodeRoot(root, true)
+
+	if NodeUtil.GetNodeType(root) == NODE_INTERNAL {
+		numKeys := InternalUtil.GetNumKeys(root)
+		for i := uint32(0); i <= numKeys; i++ {
+			NodeUtil.setParent(pager.GetPageForWrite(InternalUtil.GetChild(root, i)), rootPageNum)
+		}
+	}
+	pager.FreePage(childPageNum)
+}
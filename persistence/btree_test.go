@@ -0,0 +1,430 @@
+package persistence
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// テスト用のvalueのサイズ。リーフノードに13個のセルが入る
+const testValueSize = 296
+
+// テスト用に、キーをB-treeに挿入する
+func insertKey(pager *Pager, rootPageNum uint32, key uint32) {
+	_, leafPageNum := findPath(pager, rootPageNum, key)
+	leaf := pager.GetPageForWrite(leafPageNum)
+	value := make([]byte, testValueSize)
+	copy(value, uint32ToBytes(key))
+	LeafUtil.InsertCell(pager, leaf, leafNodeFindCell(leaf, key), key, value, rootPageNum)
+	pager.ReleasePages()
+}
+
+// リーフノードを左からたどって、全てのキーを返す
+func collectKeys(pager *Pager, rootPageNum uint32) []uint32 {
+	defer pager.ReleasePages()
+
+	pageNum := rootPageNum
+	for NodeUtil.GetNodeType(pager.GetPage(pageNum)) == NODE_INTERNAL {
+		pageNum = InternalUtil.GetChild(pager.GetPage(pageNum), 0)
+	}
+
+	keys := []uint32{}
+	for {
+		page := pager.GetPage(pageNum)
+		for i := uint32(0); i < LeafUtil.GetNumCells(page); i++ {
+			keys = append(keys, LeafUtil.GetCellKey(page, i))
+		}
+		pageNum = LeafUtil.GetNextLeaf(page)
+		if pageNum == 0 {
+			return keys
+		}
+	}
+}
+
+// 内部ノードのキーが、子ノードの最大のキーと一致しているか確認する
+func checkSeparatorKeys(t *testing.T, pager *Pager, pageNum uint32) {
+	defer pager.ReleasePages()
+
+	page := pager.GetPage(pageNum)
+	if NodeUtil.GetNodeType(page) == NODE_LEAF {
+		return
+	}
+	numKeys := InternalUtil.GetNumKeys(page)
+	for i := uint32(0); i < numKeys; i++ {
+		child := pager.GetPage(InternalUtil.GetChild(page, i))
+		if key, max := InternalUtil.GetKey(page, i), NodeUtil.getMaxKey(pager, child); key != max {
+			t.Errorf("page %d: key %d is %d, but child max is %d", pageNum, i, key, max)
+		}
+	}
+	for i := uint32(0); i <= numKeys; i++ {
+		checkSeparatorKeys(t, pager, InternalUtil.GetChild(pager.GetPage(pageNum), i))
+	}
+}
+
+func TestDeleteKeyMergesAndShrinksTree(t *testing.T) {
+	pager, err := InitPager(filepath.Join(t.TempDir(), "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+	rootPageNum := CreateTree(pager)
+
+	// 4つのリーフノードを持つ木を作る
+	keys := []uint32{18, 7, 10, 29, 23, 4, 14, 30, 15, 26, 22, 19, 2, 1, 21, 11, 6, 20, 5, 8, 9, 3, 12, 27, 17, 16, 13, 24, 25, 28}
+	for _, key := range keys {
+		insertKey(pager, rootPageNum, key)
+	}
+	numPages := pager.NumPages()
+
+	remaining := map[uint32]bool{}
+	for _, key := range keys {
+		remaining[key] = true
+	}
+
+	// 右端、左端、真ん中のキーを混ぜて削除する
+	order := []uint32{30, 1, 15, 16, 7, 8, 29, 2, 22, 23, 14, 3, 28, 27, 26, 25, 24, 4, 5, 6, 9, 10, 11, 12, 13, 17, 18, 19, 20, 21}
+	for _, key := range order {
+		if !DeleteKey(pager, rootPageNum, key) {
+			t.Fatalf("key %d was not found", key)
+		}
+		pager.ReleasePages()
+		delete(remaining, key)
+
+		expected := []uint32{}
+		for k := range remaining {
+			expected = append(expected, k)
+		}
+		sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+		if actual := collectKeys(pager, rootPageNum); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("after deleting %d: expected %v, but got %v", key, expected, actual)
+		}
+		checkSeparatorKeys(t, pager, rootPageNum)
+	}
+
+	// 最後はルートノードだけのリーフになる
+	if NodeUtil.GetNodeType(pager.GetPage(rootPageNum)) != NODE_LEAF {
+		t.Errorf("expected root to be a leaf")
+	}
+	if !isNodeRoot(pager.GetPage(rootPageNum)) {
+		t.Errorf("expected root flag to be set")
+	}
+	// ヘッダページ、カタログのルートノード、ルートノード以外が空きページになる
+	if free := pager.NumFreePages(); free != numPages-3 {
+		t.Errorf("expected %d free pages, but got %d", numPages-3, free)
+	}
+	pager.ReleasePages()
+}
+
+func TestDeleteMissingKey(t *testing.T) {
+	pager, err := InitPager(filepath.Join(t.TempDir(), "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+	rootPageNum := CreateTree(pager)
+
+	insertKey(pager, rootPageNum, 1)
+	if DeleteKey(pager, rootPageNum, 2) {
+		t.Errorf("deleted a key that does not exist")
+	}
+	if !DeleteKey(pager, rootPageNum, 1) {
+		t.Errorf("key 1 was not found")
+	}
+	if DeleteKey(pager, rootPageNum, 1) {
+		t.Errorf("deleted key 1 twice")
+	}
+}
+
+// テスト用に、サイズがsizeでキーから決まる内容のvalueを作る
+func testValue(key uint32, size int) []byte {
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = byte(key + uint32(i))
+	}
+	return value
+}
+
+func TestLeafNodeHoldsVariableLengthCells(t *testing.T) {
+	pager, err := InitPager(filepath.Join(t.TempDir(), "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+	rootPageNum := CreateTree(pager)
+	root := pager.GetPageForWrite(rootPageNum)
+
+	// 小さいセルなら、1つのリーフノードに100個入る
+	for key := uint32(0); key < 200; key += 2 {
+		LeafUtil.InsertCell(pager, root, leafNodeFindCell(root, key), key, testValue(key, 10), rootPageNum)
+	}
+	if NodeUtil.GetNodeType(root) != NODE_LEAF || LeafUtil.GetNumCells(root) != 100 {
+		t.Fatalf("expected a leaf with 100 cells, but got %d cells", LeafUtil.GetNumCells(root))
+	}
+
+	// 半分を削除した隙間を詰めて、大きいセルを挿入する
+	for key := uint32(0); key < 200; key += 4 {
+		cellNum := leafNodeFindCell(root, key)
+		leafRemoveCell(root, cellNum)
+	}
+	for key := uint32(1); key < 80; key += 2 {
+		LeafUtil.InsertCell(pager, root, leafNodeFindCell(root, key), key, testValue(key, 60), rootPageNum)
+	}
+	// valueを大きくする
+	LeafUtil.UpdateCellValue(pager, root, leafNodeFindCell(root, 2), testValue(2, 100), rootPageNum)
+
+	if NodeUtil.GetNodeType(root) != NODE_LEAF {
+		t.Fatalf("expected the root to stay a leaf")
+	}
+	for i := uint32(0); i < LeafUtil.GetNumCells(root); i++ {
+		key := LeafUtil.GetCellKey(root, i)
+		size := 10
+		switch {
+		case key == 2:
+			size = 100
+		case key%2 == 1:
+			size = 60
+		}
+		if value := LeafUtil.GetCellValue(pager, root, i); !reflect.DeepEqual(value, testValue(key, size)) {
+			t.Errorf("cell %d (key %d) has a wrong value %v", i, key, value)
+		}
+		if i > 0 && LeafUtil.GetCellKey(root, i-1) >= key {
+			t.Errorf("keys are not sorted at cell %d", i)
+		}
+	}
+	pager.ReleasePages()
+}
+
+func TestLeafNodeSplitsByBytes(t *testing.T) {
+	pager, err := InitPager(filepath.Join(t.TempDir(), "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+	rootPageNum := CreateTree(pager)
+
+	// 大きいセルと小さいセルを混ぜて、リーフノードを分割させる
+	expected := []uint32{}
+	for key := uint32(1); key <= 20; key++ {
+		_, leafPageNum := findPath(pager, rootPageNum, key)
+		leaf := pager.GetPageForWrite(leafPageNum)
+		size := 20
+		if key%3 == 0 {
+			size = LEAF_NODE_MAX_LOCAL_SIZE
+		}
+		LeafUtil.InsertCell(pager, leaf, leafNodeFindCell(leaf, key), key, testValue(key, size), rootPageNum)
+		pager.ReleasePages()
+		expected = append(expected, key)
+	}
+
+	if actual := collectKeys(pager, rootPageNum); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v, but got %v", expected, actual)
+	}
+	checkSeparatorKeys(t, pager, rootPageNum)
+
+	// どのリーフノードも、セルの領域に収まっている
+	root := pager.GetPage(rootPageNum)
+	if NodeUtil.GetNodeType(root) != NODE_INTERNAL {
+		t.Fatal("expected the root to be split")
+	}
+	for i := uint32(0); i <= InternalUtil.GetNumKeys(root); i++ {
+		leaf := pager.GetPage(InternalUtil.GetChild(root, i))
+		if used := LeafUtil.usedBytes(leaf); used > LEAF_NODE_SPACE_FOR_CELLS || LeafUtil.getContentStart(leaf) < LEAF_NODE_HEADER_SIZE+LeafUtil.GetNumCells(leaf)*LEAF_NODE_CELL_POINTER_SIZE {
+			t.Errorf("leaf %d overflows: %d bytes", i, used)
+		}
+	}
+	pager.ReleasePages()
+}
+
+// キーのセルのvalueを、B-treeから読む
+func lookupValue(t *testing.T, pager *Pager, rootPageNum uint32, key uint32) []byte {
+	defer pager.ReleasePages()
+
+	_, leafPageNum := findPath(pager, rootPageNum, key)
+	leaf := pager.GetPage(leafPageNum)
+	cellNum := leafNodeFindCell(leaf, key)
+	if cellNum >= LeafUtil.GetNumCells(leaf) || LeafUtil.GetCellKey(leaf, cellNum) != key {
+		t.Fatalf("key %d is not found", key)
+	}
+	return LeafUtil.GetCellValue(pager, leaf, cellNum)
+}
+
+func TestOverflowPages(t *testing.T) {
+	pager, err := InitPager(filepath.Join(t.TempDir(), "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+	rootPageNum := CreateTree(pager)
+	numPages := pager.NumPages()
+
+	// セルに入りきらないvalueは、オーバーフローページに続きを保存する
+	large := testValue(1, 3*PAGE_SIZE)
+	root := pager.GetPageForWrite(rootPageNum)
+	LeafUtil.InsertCell(pager, root, 0, 1, large, rootPageNum)
+	LeafUtil.InsertCell(pager, root, 1, 2, testValue(2, 10), rootPageNum)
+	pager.ReleasePages()
+	if value := lookupValue(t, pager, rootPageNum, 1); !reflect.DeepEqual(value, large) {
+		t.Errorf("expected a value of %d bytes, but got %d bytes", len(large), len(value))
+	}
+	overflowPages := pager.NumPages() - numPages
+	if overflowPages != 3 {
+		t.Errorf("expected 3 overflow pages, but got %d", overflowPages)
+	}
+
+	// valueを書き換えると、古いオーバーフローページは空きページになる（1ページは再利用する）
+	smaller := testValue(3, PAGE_SIZE)
+	root = pager.GetPageForWrite(rootPageNum)
+	LeafUtil.UpdateCellValue(pager, root, 0, smaller, rootPageNum)
+	pager.ReleasePages()
+	if value := lookupValue(t, pager, rootPageNum, 1); !reflect.DeepEqual(value, smaller) {
+		t.Errorf("expected a value of %d bytes, but got %d bytes", len(smaller), len(value))
+	}
+	if free := pager.NumFreePages(); free != 2 {
+		t.Errorf("expected 2 free pages, but got %d", free)
+	}
+
+	// 削除すると、全てのオーバーフローページが空きページになる
+	if !DeleteKey(pager, rootPageNum, 1) {
+		t.Fatal("key 1 is not deleted")
+	}
+	pager.ReleasePages()
+	if free := pager.NumFreePages(); free != overflowPages {
+		t.Errorf("expected %d free pages, but got %d", overflowPages, free)
+	}
+	if value := lookupValue(t, pager, rootPageNum, 2); !reflect.DeepEqual(value, testValue(2, 10)) {
+		t.Errorf("unexpected value %v", value)
+	}
+}
+
+// オーバーフローページは1ページずつ固定を解除するので、大きなvalueを読み書きしてもキャッシュは上限を超えない
+func TestOverflowPagesStayWithinCache(t *testing.T) {
+	pager, err := InitPager(filepath.Join(t.TempDir(), "test.db"), MIN_CACHE_PAGES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+	rootPageNum := CreateTree(pager)
+	pager.ReleasePages()
+
+	large := testValue(1, 50*PAGE_SIZE)
+	LeafUtil.InsertCell(pager, pager.GetPageForWrite(rootPageNum), 0, 1, large, rootPageNum)
+	if n := pager.NumCachedPages(); n > MIN_CACHE_PAGES {
+		t.Errorf("cached %d pages while writing, but capacity is %d", n, MIN_CACHE_PAGES)
+	}
+	pager.ReleasePages()
+
+	leaf := pager.GetPage(rootPageNum)
+	if value := LeafUtil.GetCellValue(pager, leaf, 0); !reflect.DeepEqual(value, large) {
+		t.Errorf("expected a value of %d bytes, but got %d bytes", len(large), len(value))
+	}
+	if n := pager.NumCachedPages(); n > MIN_CACHE_PAGES {
+		t.Errorf("cached %d pages while reading, but capacity is %d", n, MIN_CACHE_PAGES)
+	}
+	pager.ReleasePages()
+
+	if !DeleteKey(pager, rootPageNum, 1) {
+		t.Fatal("key 1 is not deleted")
+	}
+	if n := pager.NumCachedPages(); n > MIN_CACHE_PAGES {
+		t.Errorf("cached %d pages while freeing, but capacity is %d", n, MIN_CACHE_PAGES)
+	}
+	pager.ReleasePages()
+}
+
+func TestSplitLeafNodeWithOverflowPages(t *testing.T) {
+	pager, err := InitPager(filepath.Join(t.TempDir(), "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+	rootPageNum := CreateTree(pager)
+
+	// セルを別のノードに移しても、オーバーフローページは同じものを使う
+	for key := uint32(1); key <= 30; key++ {
+		_, leafPageNum := findPath(pager, rootPageNum, key)
+		leaf := pager.GetPageForWrite(leafPageNum)
+		LeafUtil.InsertCell(pager, leaf, leafNodeFindCell(leaf, key), key, testValue(key, 2000), rootPageNum)
+		pager.ReleasePages()
+	}
+	if NodeUtil.GetNodeType(pager.GetPage(rootPageNum)) != NODE_INTERNAL {
+		t.Fatal("expected the root to be split")
+	}
+	pager.ReleasePages()
+	checkSeparatorKeys(t, pager, rootPageNum)
+	for key := uint32(1); key <= 30; key++ {
+		if value := lookupValue(t, pager, rootPageNum, key); !reflect.DeepEqual(value, testValue(key, 2000)) {
+			t.Errorf("key %d has a wrong value", key)
+		}
+	}
+}
+
+// 子ノードの親ノードのポインタが、内部ノードを指しているか確認する。木の高さを返す
+func checkParentPointers(t *testing.T, pager *Pager, pageNum uint32) int {
+	defer pager.ReleasePages()
+
+	page := pager.GetPage(pageNum)
+	if NodeUtil.GetNodeType(page) == NODE_LEAF {
+		return 1
+	}
+	numKeys := InternalUtil.GetNumKeys(page)
+	depth := 0
+	for i := uint32(0); i <= numKeys; i++ {
+		childPageNum := InternalUtil.GetChild(pager.GetPage(pageNum), i)
+		child := pager.GetPage(childPageNum)
+		if parent := NodeUtil.GetParent(child); parent != pageNum {
+			t.Errorf("page %d: parent is %d, but expected %d", childPageNum, parent, pageNum)
+		}
+		if isNodeRoot(child) {
+			t.Errorf("page %d: non-root node has the root flag", childPageNum)
+		}
+		depth = checkParentPointers(t, pager, childPageNum) + 1
+	}
+	return depth
+}
+
+func TestSplitInternalNodes(t *testing.T) {
+	pager, err := InitPager(filepath.Join(t.TempDir(), "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+	rootPageNum := CreateTree(pager)
+
+	// ルートの内部ノードが分割されるまで、順番を入れ替えたキーを挿入する
+	const numKeys = 8000
+	for i := uint32(0); i < numKeys; i++ {
+		insertKey(pager, rootPageNum, i*7919%numKeys+1)
+	}
+
+	expected := []uint32{}
+	for key := uint32(1); key <= numKeys; key++ {
+		expected = append(expected, key)
+	}
+	if actual := collectKeys(pager, rootPageNum); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected keys 1 to %d in order, but got %d keys", numKeys, len(actual))
+	}
+	checkSeparatorKeys(t, pager, rootPageNum)
+	if depth := checkParentPointers(t, pager, rootPageNum); depth != 3 {
+		t.Errorf("expected a tree of depth 3, but got %d", depth)
+	}
+
+	// 全て削除すると、ルートノードだけのリーフに戻る
+	for i := uint32(0); i < numKeys; i++ {
+		if key := i*3989%numKeys + 1; !DeleteKey(pager, rootPageNum, key) {
+			t.Fatalf("key %d was not found", key)
+		}
+		pager.ReleasePages()
+		if i%1000 == 0 {
+			checkSeparatorKeys(t, pager, rootPageNum)
+			checkParentPointers(t, pager, rootPageNum)
+		}
+	}
+	if actual := collectKeys(pager, rootPageNum); len(actual) != 0 {
+		t.Errorf("expected no keys, but got %v", actual)
+	}
+	if NodeUtil.GetNodeType(pager.GetPage(rootPageNum)) != NODE_LEAF {
+		t.Errorf("expected root to be a leaf")
+	}
+	pager.ReleasePages()
+}
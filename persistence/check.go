@@ -0,0 +1,355 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ファイル全体の整合性チェック。
+// B-treeのキーの順番、内部ノードのキー、親ノードのポインタ、ルートノードのフラグ、リーフノードのリンクを確認し、
+// B-tree、オーバーフローページ、空きページリストのどこからも参照されていないページや、2回以上参照されているページを見つける
+
+// 整合性チェックで見つかった問題
+type Violation struct {
+	PageNum uint32
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("page %d: %s", v.PageNum, v.Message)
+}
+
+type checker struct {
+	pager    *Pager
+	numPages uint32
+	// ページを参照しているページ（ヘッダページからの参照は0）
+	referrers  map[uint32]uint32
+	violations []Violation
+}
+
+func (c *checker) errorf(pageNum uint32, format string, args ...interface{}) {
+	c.violations = append(c.violations, Violation{PageNum: pageNum, Message: fmt.Sprintf(format, args...)})
+}
+
+// ページの参照を記録する。範囲外のページや、既に参照されているページならfalseを返す
+func (c *checker) reference(pageNum uint32, from uint32) bool {
+	if pageNum == HEADER_PAGE_NUM || pageNum >= c.numPages {
+		c.errorf(from, "refers to page %d, which is out of range", pageNum)
+		return false
+	}
+	if other, ok := c.referrers[pageNum]; ok {
+		c.errorf(pageNum, "referenced twice (from page %d and page %d)", other, from)
+		return false
+	}
+	c.referrers[pageNum] = from
+	return true
+}
+
+// ページのコピーを返す。ページを固定したままにしないように、読んだらすぐに固定を解除する
+func (c *checker) readPage(pageNum uint32) *Page {
+	page := *c.pager.GetPage(pageNum)
+	c.pager.ReleasePages()
+	return &page
+}
+
+// B-treeのルートノードのページ番号を受け取って、ファイル全体の整合性を確認する。問題がなければ空のスライスを返す。
+// 呼び出し側は、固定しているページを使い終わっておく
+func CheckIntegrity(pager *Pager, roots []uint32) []Violation {
+	c := &checker{pager: pager, numPages: pager.NumPages(), referrers: map[uint32]uint32{}}
+
+	for _, root := range roots {
+		c.checkTree(root)
+	}
+	c.checkFreeList()
+
+	for pageNum := uint32(1); pageNum < c.numPages; pageNum++ {
+		if _, ok := c.referrers[pageNum]; !ok {
+			c.errorf(pageNum, "page is never used")
+		}
+	}
+	return c.violations
+}
+
+// B-treeを確認する。ルートノードの種類で、テーブルのB-treeとインデックスのB-treeを見分ける
+func (c *checker) checkTree(rootPageNum uint32) {
+	if !c.reference(rootPageNum, HEADER_PAGE_NUM) {
+		return
+	}
+	var leaves []uint32
+	switch NodeUtil.GetNodeType(c.readPage(rootPageNum)) {
+	case NODE_INDEX_INTERNAL, NODE_INDEX_LEAF:
+		c.checkIndexNode(rootPageNum, true, nil, nil, &leaves)
+		c.checkLeafLinks(leaves, IndexUtil.GetNextLeaf)
+	default:
+		c.checkNode(rootPageNum, 0, true, nil, nil, &leaves)
+		c.checkLeafLinks(leaves, LeafUtil.GetNextLeaf)
+	}
+}
+
+// リーフノードを左からたどると、全てのリーフノードを1回ずつ順番に訪れるか確認する
+func (c *checker) checkLeafLinks(leaves []uint32, nextLeaf func(page *Page) uint32) {
+	if len(leaves) == 0 {
+		return
+	}
+	pageNum := leaves[0]
+	for i := 0; i < len(leaves); i++ {
+		if pageNum != leaves[i] {
+			c.errorf(leaves[i-1], "next leaf is %d, but expected %d", pageNum, leaves[i])
+			return
+		}
+		pageNum = nextLeaf(c.readPage(pageNum))
+	}
+	if pageNum != 0 {
+		c.errorf(leaves[len(leaves)-1], "next leaf is %d, but the page is the last leaf", pageNum)
+	}
+}
+
+// ノード以下を確認して、最大のキーを返す。ノードにキーがなければfalseを返す。
+// ノードのキーは、(low, high]の範囲に入っている必要がある（nilの場合は制限しない）。リーフノードはleavesに追加する
+func (c *checker) checkNode(pageNum uint32, parentPageNum uint32, isRoot bool, low *uint32, high *uint32, leaves *[]uint32) (uint32, bool) {
+	page := c.readPage(pageNum)
+
+	if isNodeRoot(page) != isRoot {
+		c.errorf(pageNum, "root flag is %t, but expected %t", isNodeRoot(page), isRoot)
+	}
+	if parent := NodeUtil.GetParent(page); !isRoot && parent != parentPageNum {
+		c.errorf(pageNum, "parent is %d, but expected %d", parent, parentPageNum)
+	}
+
+	inRange := func(key uint32) bool {
+		return (low == nil || key > *low) && (high == nil || key <= *high)
+	}
+
+	switch NodeUtil.GetNodeType(page) {
+	case NODE_LEAF:
+		*leaves = append(*leaves, pageNum)
+		return c.checkLeaf(pageNum, page, inRange)
+	case NODE_INTERNAL:
+		return c.checkInternal(pageNum, page, low, high, inRange, leaves)
+	default:
+		c.errorf(pageNum, "unknown node type %d", NodeUtil.GetNodeType(page))
+		return 0, false
+	}
+}
+
+func (c *checker) checkLeaf(pageNum uint32, page *Page, inRange func(uint32) bool) (uint32, bool) {
+	numCells := LeafUtil.GetNumCells(page)
+	pointersEnd := LEAF_NODE_HEADER_SIZE + numCells*LEAF_NODE_CELL_POINTER_SIZE
+	if pointersEnd > PAGE_SIZE {
+		c.errorf(pageNum, "too many cells: %d", numCells)
+		return 0, false
+	}
+	if start := LeafUtil.getContentStart(page); start < pointersEnd || start > PAGE_SIZE {
+		c.errorf(pageNum, "content start %d overlaps the cell pointers", start)
+	}
+
+	var maxKey uint32
+	found := false
+	for i := uint32(0); i < numCells; i++ {
+		offset := LeafUtil.getCellOffset(page, i)
+		if offset < pointersEnd || offset+LEAF_NODE_CELL_HEADER_SIZE > PAGE_SIZE {
+			c.errorf(pageNum, "cell %d is out of the page", i)
+			continue
+		}
+		size := binary.LittleEndian.Uint32(page[offset+LEAF_NODE_VALUE_SIZE_OFFSET:])
+		if offset+LEAF_NODE_CELL_HEADER_SIZE+leafLocalSize(size) > PAGE_SIZE {
+			c.errorf(pageNum, "cell %d is out of the page", i)
+			continue
+		}
+
+		key := LeafUtil.GetCellKey(page, i)
+		if found && key <= maxKey {
+			c.errorf(pageNum, "key %d of cell %d is not greater than the previous key %d", key, i, maxKey)
+		}
+		if !inRange(key) {
+			c.errorf(pageNum, "key %d of cell %d is out of the range of the parent", key, i)
+		}
+		maxKey, found = key, true
+
+		if overflow := LeafUtil.getOverflowPage(page, i); overflow != 0 {
+			c.checkOverflow(pageNum, overflow, size-LEAF_NODE_OVERFLOW_LOCAL_SIZE)
+		} else if size > LEAF_NODE_MAX_LOCAL_SIZE {
+			c.errorf(pageNum, "cell %d has no overflow page", i)
+		}
+	}
+	return maxKey, found
+}
+
+func (c *checker) checkInternal(pageNum uint32, page *Page, low *uint32, high *uint32, inRange func(uint32) bool, leaves *[]uint32) (uint32, bool) {
+	numKeys := InternalUtil.GetNumKeys(page)
+	if numKeys > INTERNAL_NODE_MAX_CELLS {
+		c.errorf(pageNum, "too many keys: %d", numKeys)
+		return 0, false
+	}
+	rightChild := InternalUtil.GetRightChild(page)
+	if rightChild == INVALID_PAGE_NUM {
+		c.errorf(pageNum, "right child is not set")
+		return 0, false
+	}
+
+	for i := uint32(0); i <= numKeys; i++ {
+		childLow := low
+		if i > 0 {
+			prev := InternalUtil.GetKey(page, i-1)
+			childLow = &prev
+		}
+		childHigh := high
+		var key uint32
+		if i < numKeys {
+			key = InternalUtil.GetKey(page, i)
+			childHigh = &key
+			if i > 0 && key <= *childLow {
+				c.errorf(pageNum, "key %d of cell %d is not greater than the previous key %d", key, i, *childLow)
+			}
+			if !inRange(key) {
+				c.errorf(pageNum, "key %d of cell %d is out of the range of the parent", key, i)
+			}
+		}
+
+		childPageNum := rightChild
+		if i < numKeys {
+			childPageNum = InternalUtil.GetChild(page, i)
+		}
+		if !c.reference(childPageNum, pageNum) {
+			continue
+		}
+		childMax, found := c.checkNode(childPageNum, pageNum, false, childLow, childHigh, leaves)
+		if i == numKeys {
+			return childMax, found
+		}
+		if found && childMax != key {
+			c.errorf(pageNum, "key %d of cell %d does not match the max key %d of child %d", key, i, childMax, childPageNum)
+		}
+	}
+	return 0, false
+}
+
+// オーバーフローページの連結リストを確認する。sizeは、オーバーフローページに保存したバイト数。
+// 連結リストをたどって読める場合はtrueを返す
+func (c *checker) checkOverflow(leafPageNum uint32, pageNum uint32, size uint32) bool {
+	from := leafPageNum
+	for size > 0 {
+		if pageNum == 0 {
+			c.errorf(from, "overflow chain ends before the value")
+			return false
+		}
+		if !c.reference(pageNum, from) {
+			return false
+		}
+		n := size
+		if n > OVERFLOW_PAGE_DATA_SIZE {
+			n = OVERFLOW_PAGE_DATA_SIZE
+		}
+		size -= n
+		from, pageNum = pageNum, getOverflowNext(c.readPage(pageNum))
+	}
+	if pageNum != 0 {
+		c.errorf(from, "overflow chain continues after the value")
+	}
+	return true
+}
+
+// インデックスのB-treeのノード以下を確認する。
+// ノードのキーは、(low, high]の範囲に入っている必要がある（nilの場合は制限しない）。リーフノードはleavesに追加する
+func (c *checker) checkIndexNode(pageNum uint32, isRoot bool, low []byte, high []byte, leaves *[]uint32) {
+	page := c.readPage(pageNum)
+
+	if isNodeRoot(page) != isRoot {
+		c.errorf(pageNum, "root flag is %t, but expected %t", isNodeRoot(page), isRoot)
+	}
+	nodeType := NodeUtil.GetNodeType(page)
+	if nodeType != NODE_INDEX_INTERNAL && nodeType != NODE_INDEX_LEAF {
+		c.errorf(pageNum, "unknown node type %d in an index", nodeType)
+		return
+	}
+
+	numCells := IndexUtil.GetNumCells(page)
+	pointersEnd := INDEX_NODE_HEADER_SIZE + numCells*INDEX_NODE_CELL_POINTER_SIZE
+	if pointersEnd > PAGE_SIZE {
+		c.errorf(pageNum, "too many cells: %d", numCells)
+		return
+	}
+	if start := IndexUtil.getContentStart(page); start < pointersEnd || start > PAGE_SIZE {
+		c.errorf(pageNum, "content start %d overlaps the cell pointers", start)
+	}
+
+	// セルのキーを読む。セルがページからはみ出しているか、オーバーフローページをたどれない場合はfalseを返す
+	readKey := func(i uint32) ([]byte, bool) {
+		offset := IndexUtil.getCellOffset(page, i)
+		sizeOffset := offset + indexKeySizeOffset(page)
+		if offset < pointersEnd || sizeOffset+INDEX_NODE_KEY_SIZE_SIZE > PAGE_SIZE {
+			c.errorf(pageNum, "cell %d is out of the page", i)
+			return nil, false
+		}
+		size := binary.LittleEndian.Uint32(page[sizeOffset:])
+		if sizeOffset+INDEX_NODE_KEY_SIZE_SIZE+indexLocalSize(size) > PAGE_SIZE {
+			c.errorf(pageNum, "cell %d is out of the page", i)
+			return nil, false
+		}
+		if overflow := IndexUtil.getOverflowPage(page, i); overflow != 0 {
+			if !c.checkOverflow(pageNum, overflow, size-INDEX_NODE_OVERFLOW_LOCAL_SIZE) {
+				return nil, false
+			}
+		} else if size > INDEX_NODE_MAX_LOCAL_SIZE {
+			c.errorf(pageNum, "cell %d has no overflow page", i)
+			return nil, false
+		}
+		key := append([]byte(nil), IndexUtil.GetCellKey(c.pager, page, i)...)
+		c.pager.ReleasePages()
+		return key, true
+	}
+
+	prev := low
+	for i := uint32(0); i <= numCells; i++ {
+		var key []byte
+		if i < numCells {
+			var ok bool
+			if key, ok = readKey(i); !ok {
+				return
+			}
+			if prev != nil && bytes.Compare(key, prev) <= 0 {
+				c.errorf(pageNum, "key of cell %d is not greater than the previous key", i)
+			}
+			if high != nil && bytes.Compare(key, high) > 0 {
+				c.errorf(pageNum, "key of cell %d is out of the range of the parent", i)
+			}
+		}
+
+		if nodeType == NODE_INDEX_INTERNAL {
+			childHigh := high
+			if i < numCells {
+				childHigh = key
+			}
+			childPageNum := IndexUtil.GetChild(page, i)
+			if c.reference(childPageNum, pageNum) {
+				c.checkIndexNode(childPageNum, false, prev, childHigh, leaves)
+			}
+		}
+		if i < numCells {
+			prev = key
+		}
+	}
+	if nodeType == NODE_INDEX_LEAF {
+		*leaves = append(*leaves, pageNum)
+	}
+}
+
+// 空きページリストを確認する
+func (c *checker) checkFreeList() {
+	header := c.readPage(HEADER_PAGE_NUM)
+	count := HeaderUtil.GetFreeListCount(header)
+
+	from := uint32(HEADER_PAGE_NUM)
+	found := uint32(0)
+	for pageNum := HeaderUtil.GetFreeListHead(header); pageNum != 0; found++ {
+		if !c.reference(pageNum, from) {
+			return
+		}
+		page := c.readPage(pageNum)
+		from, pageNum = pageNum, binary.LittleEndian.Uint32(page[FREE_PAGE_NEXT_OFFSET:FREE_PAGE_NEXT_OFFSET+FREE_PAGE_NEXT_SIZE])
+	}
+	if found != count {
+		c.errorf(HEADER_PAGE_NUM, "free list has %d pages, but the header says %d", found, count)
+	}
+}
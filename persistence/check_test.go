@@ -0,0 +1,148 @@
+package persistence
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 4つのリーフノードを持つ木を作る
+func createCheckedTree(t *testing.T) (*Pager, uint32) {
+	pager, err := InitPager(filepath.Join(t.TempDir(), "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPageNum := CreateTree(pager)
+	for key := uint32(1); key <= 30; key++ {
+		insertKey(pager, rootPageNum, key)
+	}
+	return pager, rootPageNum
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	pager, rootPageNum := createCheckedTree(t)
+	defer pager.FlushPages()
+
+	// 大きいvalueと空きページも確認する
+	leaf := pager.GetPageForWrite(InternalUtil.GetRightChild(pager.GetPage(rootPageNum)))
+	LeafUtil.UpdateCellValue(pager, leaf, 0, testValue(0, 3*PAGE_SIZE), rootPageNum)
+	pager.ReleasePages()
+	DeleteKey(pager, rootPageNum, 1)
+	pager.ReleasePages()
+
+	if violations := CheckIntegrity(pager, []uint32{pager.GetCatalogRoot(), rootPageNum}); len(violations) != 0 {
+		t.Errorf("unexpected violations: %v", violations)
+	}
+}
+
+func TestCheckIntegrityFindsViolations(t *testing.T) {
+	cases := []struct {
+		name string
+		// 木を壊して、問題が見つかるページ番号を返す
+		corrupt func(pager *Pager, rootPageNum uint32, root *Page) uint32
+		message string
+	}{
+		{
+			name: "unsorted keys",
+			corrupt: func(pager *Pager, rootPageNum uint32, root *Page) uint32 {
+				leafPageNum := InternalUtil.GetChild(root, 0)
+				leaf := pager.GetPageForWrite(leafPageNum)
+				LeafUtil.WriteCellKey(leaf, 0, 5)
+				return leafPageNum
+			},
+			message: "is not greater than the previous key",
+		},
+		{
+			name: "key out of the range of the parent",
+			corrupt: func(pager *Pager, rootPageNum uint32, root *Page) uint32 {
+				leafPageNum := InternalUtil.GetChild(root, 1)
+				leaf := pager.GetPageForWrite(leafPageNum)
+				LeafUtil.WriteCellKey(leaf, 0, 1)
+				return leafPageNum
+			},
+			message: "out of the range of the parent",
+		},
+		{
+			name: "separator key",
+			corrupt: func(pager *Pager, rootPageNum uint32, root *Page) uint32 {
+				InternalUtil.setKey(root, 0, InternalUtil.GetKey(root, 0)+1)
+				return rootPageNum
+			},
+			message: "does not match the max key",
+		},
+		{
+			name: "parent pointer",
+			corrupt: func(pager *Pager, rootPageNum uint32, root *Page) uint32 {
+				leafPageNum := InternalUtil.GetChild(root, 2)
+				NodeUtil.setParent(pager.GetPageForWrite(leafPageNum), leafPageNum)
+				return leafPageNum
+			},
+			message: "parent is",
+		},
+		{
+			name: "root flag",
+			corrupt: func(pager *Pager, rootPageNum uint32, root *Page) uint32 {
+				leafPageNum := InternalUtil.GetChild(root, 1)
+				NodeUtil.setNodeRoot(pager.GetPageForWrite(leafPageNum), true)
+				return leafPageNum
+			},
+			message: "root flag is true",
+		},
+		{
+			name: "next leaf",
+			corrupt: func(pager *Pager, rootPageNum uint32, root *Page) uint32 {
+				leafPageNum := InternalUtil.GetChild(root, 0)
+				LeafUtil.setNextLeaf(pager.GetPageForWrite(leafPageNum), InternalUtil.GetChild(root, 2))
+				return leafPageNum
+			},
+			message: "next leaf is",
+		},
+		{
+			name: "orphaned page",
+			corrupt: func(pager *Pager, rootPageNum uint32, root *Page) uint32 {
+				page, pageNum := pager.GetNewPage()
+				initLeafNode(page)
+				return pageNum
+			},
+			message: "never used",
+		},
+		{
+			name: "page referenced twice",
+			corrupt: func(pager *Pager, rootPageNum uint32, root *Page) uint32 {
+				leafPageNum := InternalUtil.GetChild(root, 0)
+				InternalUtil.setChild(root, 1, leafPageNum)
+				return leafPageNum
+			},
+			message: "referenced twice",
+		},
+		{
+			name: "free page in use",
+			corrupt: func(pager *Pager, rootPageNum uint32, root *Page) uint32 {
+				leafPageNum := InternalUtil.GetChild(root, 1)
+				header := pager.GetPageForWrite(HEADER_PAGE_NUM)
+				HeaderUtil.setUint32(header, HEADER_FREELIST_HEAD_OFFSET, leafPageNum)
+				HeaderUtil.setUint32(header, HEADER_FREELIST_COUNT_OFFSET, 1)
+				return leafPageNum
+			},
+			message: "referenced twice",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pager, rootPageNum := createCheckedTree(t)
+			defer pager.FlushPages()
+
+			pageNum := c.corrupt(pager, rootPageNum, pager.GetPageForWrite(rootPageNum))
+			pager.ReleasePages()
+
+			violations := CheckIntegrity(pager, []uint32{pager.GetCatalogRoot(), rootPageNum})
+			for _, v := range violations {
+				if v.PageNum == pageNum && strings.Contains(v.Message, c.message) {
+					return
+				}
+			}
+			t.Errorf("expected a violation %q on page %d, but got %v", c.message, pageNum, violations)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package persistence
+
+import "encoding/binary"
+
+// 使わなくなったページは、空きページリスト（連結リスト）につないで再利用する。
+// リストの先頭のページ番号と空きページの数は、ヘッダに保存する。
+
+// Free Page Layout
+const (
+	// 次の空きページのページ番号（0は次がないことを表す）
+	FREE_PAGE_NEXT_SIZE   = 4
+	FREE_PAGE_NEXT_OFFSET = 0
+)
+
+// ページを空きページリストに追加する。追加した後は、ページを使ってはいけない
+func (pager *Pager) FreePage(pageNum uint32) {
+	header := pager.GetPageForWrite(HEADER_PAGE_NUM)
+	page := pager.GetPageForWrite(pageNum)
+
+	*page = Page{}
+	copy(page[FREE_PAGE_NEXT_OFFSET:FREE_PAGE_NEXT_OFFSET+FREE_PAGE_NEXT_SIZE], uint32ToBytes(HeaderUtil.GetFreeListHead(header)))
+
+	HeaderUtil.setUint32(header, HEADER_FREELIST_HEAD_OFFSET, pageNum)
+	HeaderUtil.setUint32(header, HEADER_FREELIST_COUNT_OFFSET, HeaderUtil.GetFreeListCount(header)+1)
+}
+
+// 空きページリストの先頭からページを取り出す
+func (pager *Pager) popFreePage() (uint32, bool) {
+	header := pager.GetPage(HEADER_PAGE_NUM)
+	pageNum := HeaderUtil.GetFreeListHead(header)
+	if pageNum == 0 {
+		return 0, false
+	}
+	header = pager.GetPageForWrite(HEADER_PAGE_NUM)
+
+	page := pager.GetPage(pageNum)
+	next := binary.LittleEndian.Uint32(page[FREE_PAGE_NEXT_OFFSET : FREE_PAGE_NEXT_OFFSET+FREE_PAGE_NEXT_SIZE])
+
+	HeaderUtil.setUint32(header, HEADER_FREELIST_HEAD_OFFSET, next)
+	HeaderUtil.setUint32(header, HEADER_FREELIST_COUNT_OFFSET, HeaderUtil.GetFreeListCount(header)-1)
+
+	return pageNum, true
+}
+
+// 空きページの数を返す
+func (pager *Pager) NumFreePages() uint32 {
+	return HeaderUtil.GetFreeListCount(pager.GetPage(HEADER_PAGE_NUM))
+}
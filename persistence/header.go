@@ -0,0 +1,165 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// DBファイルの先頭ページ（ページ0）には、ファイル全体の情報を持つヘッダを置く
+
+// ファイルの先頭に書き込むマジックバイト
+const HEADER_MAGIC = "toydb-go format\x00"
+
+// ファイルフォーマットのバージョン。互換性のない変更をしたら上げる
+const FORMAT_VERSION = 6
+
+// ヘッダページのページ番号
+const HEADER_PAGE_NUM = 0
+
+// Header Page Layout
+const (
+	HEADER_MAGIC_SIZE   = 16
+	HEADER_MAGIC_OFFSET = 0
+	// ファイルフォーマットのバージョン
+	HEADER_FORMAT_VERSION_SIZE   = 4
+	HEADER_FORMAT_VERSION_OFFSET = HEADER_MAGIC_OFFSET + HEADER_MAGIC_SIZE
+	// ページサイズ
+	HEADER_PAGE_SIZE_SIZE   = 4
+	HEADER_PAGE_SIZE_OFFSET = HEADER_FORMAT_VERSION_OFFSET + HEADER_FORMAT_VERSION_SIZE
+	// ファイルに含まれるページ数
+	HEADER_PAGE_COUNT_SIZE   = 4
+	HEADER_PAGE_COUNT_OFFSET = HEADER_PAGE_SIZE_OFFSET + HEADER_PAGE_SIZE_SIZE
+	// カタログ（テーブルの定義を保存するB-tree）のルートページ番号
+	HEADER_CATALOG_ROOT_SIZE   = 4
+	HEADER_CATALOG_ROOT_OFFSET = HEADER_PAGE_COUNT_OFFSET + HEADER_PAGE_COUNT_SIZE
+	// 空きページリストの先頭のページ番号（0は空きページがないことを表す）
+	HEADER_FREELIST_HEAD_SIZE   = 4
+	HEADER_FREELIST_HEAD_OFFSET = HEADER_CATALOG_ROOT_OFFSET + HEADER_CATALOG_ROOT_SIZE
+	// 空きページの数
+	HEADER_FREELIST_COUNT_SIZE   = 4
+	HEADER_FREELIST_COUNT_OFFSET = HEADER_FREELIST_HEAD_OFFSET + HEADER_FREELIST_HEAD_SIZE
+	// ファイルを書き込んだ回数
+	HEADER_CHANGE_COUNTER_SIZE   = 4
+	HEADER_CHANGE_COUNTER_OFFSET = HEADER_FREELIST_COUNT_OFFSET + HEADER_FREELIST_COUNT_SIZE
+	// スキーマを変更した回数
+	HEADER_SCHEMA_COOKIE_SIZE   = 4
+	HEADER_SCHEMA_COOKIE_OFFSET = HEADER_CHANGE_COUNTER_OFFSET + HEADER_CHANGE_COUNTER_SIZE
+	HEADER_SIZE                 = HEADER_SCHEMA_COOKIE_OFFSET + HEADER_SCHEMA_COOKIE_SIZE
+)
+
+var (
+	ErrNotDatabase         = errors.New("file is not a toydb database")
+	ErrCorrupt             = errors.New("database file is corrupt")
+	ErrUnsupportedVersion  = errors.New("unsupported file format version")
+	ErrUnsupportedPageSize = errors.New("unsupported page size")
+)
+
+// ヘッダに関するユーティリティ関数
+type headerUtil struct{}
+
+var HeaderUtil headerUtil
+
+func (headerUtil) getUint32(page *Page, offset int) uint32 {
+	return binary.LittleEndian.Uint32(page[offset : offset+4])
+}
+
+func (headerUtil) setUint32(page *Page, offset int, v uint32) {
+	copy(page[offset:offset+4], uint32ToBytes(v))
+}
+
+// ヘッダを初期化する
+func initHeader(page *Page, catalogRoot uint32) {
+	copy(page[HEADER_MAGIC_OFFSET:HEADER_MAGIC_OFFSET+HEADER_MAGIC_SIZE], HEADER_MAGIC)
+	HeaderUtil.setUint32(page, HEADER_FORMAT_VERSION_OFFSET, FORMAT_VERSION)
+	HeaderUtil.setUint32(page, HEADER_PAGE_SIZE_OFFSET, PAGE_SIZE)
+	HeaderUtil.setUint32(page, HEADER_PAGE_COUNT_OFFSET, 0)
+	HeaderUtil.setUint32(page, HEADER_CATALOG_ROOT_OFFSET, catalogRoot)
+	HeaderUtil.setUint32(page, HEADER_FREELIST_HEAD_OFFSET, 0)
+	HeaderUtil.setUint32(page, HEADER_FREELIST_COUNT_OFFSET, 0)
+	HeaderUtil.setUint32(page, HEADER_CHANGE_COUNTER_OFFSET, 0)
+	HeaderUtil.setUint32(page, HEADER_SCHEMA_COOKIE_OFFSET, 0)
+}
+
+// このビルドで読めるファイルかどうかを確認する
+func validateHeader(page *Page) error {
+	if string(page[HEADER_MAGIC_OFFSET:HEADER_MAGIC_OFFSET+HEADER_MAGIC_SIZE]) != HEADER_MAGIC {
+		return ErrNotDatabase
+	}
+	if version := HeaderUtil.GetFormatVersion(page); version != FORMAT_VERSION {
+		return fmt.Errorf("%w %d (expected %d)", ErrUnsupportedVersion, version, FORMAT_VERSION)
+	}
+	if pageSize := HeaderUtil.GetPageSize(page); pageSize != PAGE_SIZE {
+		return fmt.Errorf("%w %d (expected %d)", ErrUnsupportedPageSize, pageSize, PAGE_SIZE)
+	}
+	return nil
+}
+
+// ファイルフォーマットのバージョンを返す
+func (headerUtil) GetFormatVersion(page *Page) uint32 {
+	return HeaderUtil.getUint32(page, HEADER_FORMAT_VERSION_OFFSET)
+}
+
+// ページサイズを返す
+func (headerUtil) GetPageSize(page *Page) uint32 {
+	return HeaderUtil.getUint32(page, HEADER_PAGE_SIZE_OFFSET)
+}
+
+// ページ数を返す
+func (headerUtil) GetPageCount(page *Page) uint32 {
+	return HeaderUtil.getUint32(page, HEADER_PAGE_COUNT_OFFSET)
+}
+
+// カタログのルートページ番号を返す
+func (headerUtil) GetCatalogRoot(page *Page) uint32 {
+	return HeaderUtil.getUint32(page, HEADER_CATALOG_ROOT_OFFSET)
+}
+
+// 空きページリストの先頭のページ番号を返す
+func (headerUtil) GetFreeListHead(page *Page) uint32 {
+	return HeaderUtil.getUint32(page, HEADER_FREELIST_HEAD_OFFSET)
+}
+
+// 空きページの数を返す
+func (headerUtil) GetFreeListCount(page *Page) uint32 {
+	return HeaderUtil.getUint32(page, HEADER_FREELIST_COUNT_OFFSET)
+}
+
+// ファイルを書き込んだ回数を返す
+func (headerUtil) GetChangeCounter(page *Page) uint32 {
+	return HeaderUtil.getUint32(page, HEADER_CHANGE_COUNTER_OFFSET)
+}
+
+// スキーマを変更した回数を返す
+func (headerUtil) GetSchemaCookie(page *Page) uint32 {
+	return HeaderUtil.getUint32(page, HEADER_SCHEMA_COOKIE_OFFSET)
+}
+
+// スキーマを変更した回数を1増やす
+func (pager *Pager) IncrementSchemaCookie() {
+	header := pager.GetPageForWrite(HEADER_PAGE_NUM)
+	HeaderUtil.setUint32(header, HEADER_SCHEMA_COOKIE_OFFSET, HeaderUtil.GetSchemaCookie(header)+1)
+}
+
+// ヘッダから読み取った、ファイル全体の情報
+type FileInfo struct {
+	FormatVersion uint32
+	PageSize      uint32
+	PageCount     uint32
+	FreePages     uint32
+	ChangeCounter uint32
+	SchemaCookie  uint32
+}
+
+// ファイル全体の情報を返す
+func (pager *Pager) Info() FileInfo {
+	header := pager.GetPage(HEADER_PAGE_NUM)
+	return FileInfo{
+		FormatVersion: HeaderUtil.GetFormatVersion(header),
+		PageSize:      HeaderUtil.GetPageSize(header),
+		PageCount:     pager.numPages,
+		FreePages:     HeaderUtil.GetFreeListCount(header),
+		ChangeCounter: HeaderUtil.GetChangeCounter(header),
+		SchemaCookie:  HeaderUtil.GetSchemaCookie(header),
+	}
+}
@@ -0,0 +1,501 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// インデックスのB-tree。キーは可変長のバイト列で、bytes.Compareの順番に並べる。valueは持たない。
+// 内部ノードのセルは (子ノード, 区切りのキー) で、子ノードのキーは全て区切りのキー以下、次の子ノードのキーは全て区切りのキーより大きい。
+// 区切りのキーより大きいキーは、ヘッダの一番右の子ノードに入る。
+// テーブルのB-treeと違い、親ノードへのポインタは持たず、ルートからたどった経路を使って親ノードを更新する
+
+// Index Node Header Layout
+//
+// ノードの種類とルートノードかどうかは、テーブルのB-treeと同じ位置に置く
+const (
+	// ノードに含まれるセルの数
+	INDEX_NODE_NUM_CELLS_SIZE   = 4
+	INDEX_NODE_NUM_CELLS_OFFSET = IS_ROOT_OFFSET + IS_ROOT_SIZE
+	// リーフノードは右隣のリーフノード（0は隣のノードがないことを表す）、内部ノードは一番右の子ノードのページ番号
+	INDEX_NODE_RIGHT_POINTER_SIZE   = 4
+	INDEX_NODE_RIGHT_POINTER_OFFSET = INDEX_NODE_NUM_CELLS_OFFSET + INDEX_NODE_NUM_CELLS_SIZE
+	// セルの領域の先頭の位置。セルはページの末尾から先頭に向かって詰めていく
+	INDEX_NODE_CONTENT_START_SIZE   = 4
+	INDEX_NODE_CONTENT_START_OFFSET = INDEX_NODE_RIGHT_POINTER_OFFSET + INDEX_NODE_RIGHT_POINTER_SIZE
+	INDEX_NODE_HEADER_SIZE          = INDEX_NODE_CONTENT_START_OFFSET + INDEX_NODE_CONTENT_START_SIZE
+)
+
+// Index Node Body Layout
+//
+// ヘッダの後ろに、セルの位置をキーの順番に並べる。
+// リーフノードのセルは、キーのサイズ、キーの順に並ぶ。内部ノードのセルは、その前に子ノードのページ番号を置く。
+// キーが大きい場合は、先頭の一部だけをセルに置き、その後ろに残りを保存したオーバーフローページのページ番号を置く
+const (
+	INDEX_NODE_CELL_POINTER_SIZE = 2
+	INDEX_NODE_CHILD_SIZE        = 4
+	INDEX_NODE_KEY_SIZE_SIZE     = 4
+	INDEX_NODE_OVERFLOW_SIZE     = 4
+
+	INDEX_NODE_SPACE_FOR_CELLS = PAGE_SIZE - INDEX_NODE_HEADER_SIZE
+
+	// セルに全て置けるキーの最大サイズ。分割したときに左右のノードに収まるように、
+	// 1つのセル（とセルの位置）はセルの領域の1/4以下にする
+	INDEX_NODE_MAX_LOCAL_SIZE = INDEX_NODE_SPACE_FOR_CELLS/4 - INDEX_NODE_CHILD_SIZE - INDEX_NODE_KEY_SIZE_SIZE - INDEX_NODE_CELL_POINTER_SIZE
+	// オーバーフローページを使う場合に、セルに置くキーの先頭のサイズ
+	INDEX_NODE_OVERFLOW_LOCAL_SIZE = INDEX_NODE_SPACE_FOR_CELLS/16 - INDEX_NODE_CHILD_SIZE - INDEX_NODE_KEY_SIZE_SIZE - INDEX_NODE_CELL_POINTER_SIZE - INDEX_NODE_OVERFLOW_SIZE
+
+	// 削除して、セル（とセルの位置）のバイト数がこれより少なくなったら、兄弟ノードとのマージを試す
+	INDEX_NODE_MIN_BYTES = INDEX_NODE_SPACE_FOR_CELLS / 3
+)
+
+// インデックスのノードに関するユーティリティ関数
+type indexUtil struct{}
+
+var IndexUtil indexUtil
+
+func initIndexNode(node *Page, nodeType NodeType) {
+	*node = Page{}
+	NodeUtil.setNodeType(node, nodeType)
+	IndexUtil.setContentStart(node, PAGE_SIZE)
+}
+
+// 空のインデックスのB-treeを作り、ルートノードのページ番号を返す
+func CreateIndexTree(pager *Pager) uint32 {
+	node, rootPageNum := pager.GetNewPage()
+	initIndexNode(node, NODE_INDEX_LEAF)
+	NodeUtil.setNodeRoot(node, true)
+	return rootPageNum
+}
+
+// ページのセルの数を返す
+func (indexUtil) GetNumCells(page *Page) uint32 {
+	return binary.LittleEndian.Uint32(page[INDEX_NODE_NUM_CELLS_OFFSET:])
+}
+
+func (indexUtil) setNumCells(page *Page, numCells uint32) {
+	binary.LittleEndian.PutUint32(page[INDEX_NODE_NUM_CELLS_OFFSET:], numCells)
+}
+
+// リーフノードの右隣のリーフノードのページ番号を返す
+func (indexUtil) GetNextLeaf(page *Page) uint32 {
+	return binary.LittleEndian.Uint32(page[INDEX_NODE_RIGHT_POINTER_OFFSET:])
+}
+
+// 内部ノードの一番右の子ノード、またはリーフノードの右隣のリーフノードを設定する
+func (indexUtil) setRightPointer(page *Page, pageNum uint32) {
+	binary.LittleEndian.PutUint32(page[INDEX_NODE_RIGHT_POINTER_OFFSET:], pageNum)
+}
+
+func (indexUtil) getContentStart(page *Page) uint32 {
+	return binary.LittleEndian.Uint32(page[INDEX_NODE_CONTENT_START_OFFSET:])
+}
+
+func (indexUtil) setContentStart(page *Page, offset uint32) {
+	binary.LittleEndian.PutUint32(page[INDEX_NODE_CONTENT_START_OFFSET:], offset)
+}
+
+func (indexUtil) getCellOffset(page *Page, cellNum uint32) uint32 {
+	start := INDEX_NODE_HEADER_SIZE + cellNum*INDEX_NODE_CELL_POINTER_SIZE
+	return uint32(binary.LittleEndian.Uint16(page[start:]))
+}
+
+func (indexUtil) setCellOffset(page *Page, cellNum uint32, offset uint32) {
+	start := INDEX_NODE_HEADER_SIZE + cellNum*INDEX_NODE_CELL_POINTER_SIZE
+	binary.LittleEndian.PutUint16(page[start:], uint16(offset))
+}
+
+// 内部ノードならtrue
+func isIndexInternal(page *Page) bool {
+	return NodeUtil.GetNodeType(page) == NODE_INDEX_INTERNAL
+}
+
+// セルのキーのサイズの位置（セルの先頭から）を返す。内部ノードのセルは、先頭に子ノードを置く
+func indexKeySizeOffset(page *Page) uint32 {
+	if isIndexInternal(page) {
+		return INDEX_NODE_CHILD_SIZE
+	}
+	return 0
+}
+
+// キーのサイズから、セルのキーの部分（オーバーフローページのページ番号を含む）のバイト数を返す
+func indexLocalSize(size uint32) uint32 {
+	if size <= INDEX_NODE_MAX_LOCAL_SIZE {
+		return size
+	}
+	return INDEX_NODE_OVERFLOW_LOCAL_SIZE + INDEX_NODE_OVERFLOW_SIZE
+}
+
+// セルを作る。キーがセルに入りきらない場合は、残りをオーバーフローページに書き込む。
+// internalがtrueなら、先頭にchildを置いた内部ノードのセルにする
+func makeIndexCell(pager *Pager, internal bool, child uint32, key []byte) []byte {
+	var cell []byte
+	if internal {
+		cell = binary.LittleEndian.AppendUint32(cell, child)
+	}
+	cell = binary.LittleEndian.AppendUint32(cell, uint32(len(key)))
+	if len(key) <= INDEX_NODE_MAX_LOCAL_SIZE {
+		return append(cell, key...)
+	}
+	cell = append(cell, key[:INDEX_NODE_OVERFLOW_LOCAL_SIZE]...)
+	return binary.LittleEndian.AppendUint32(cell, writeOverflow(pager, key[INDEX_NODE_OVERFLOW_LOCAL_SIZE:]))
+}
+
+// セルを返す
+func (indexUtil) GetCell(page *Page, cellNum uint32) []byte {
+	offset := IndexUtil.getCellOffset(page, cellNum)
+	sizeOffset := offset + indexKeySizeOffset(page)
+	size := binary.LittleEndian.Uint32(page[sizeOffset:])
+	return page[offset : sizeOffset+INDEX_NODE_KEY_SIZE_SIZE+indexLocalSize(size)]
+}
+
+// セルのキーのサイズと、セルに置いたキーの部分（オーバーフローページのページ番号を除く）を返す
+func indexCellLocalKey(page *Page, cellNum uint32) (uint32, []byte) {
+	cell := IndexUtil.GetCell(page, cellNum)
+	cell = cell[indexKeySizeOffset(page):]
+	size := binary.LittleEndian.Uint32(cell)
+	local := cell[INDEX_NODE_KEY_SIZE_SIZE:]
+	if size > INDEX_NODE_MAX_LOCAL_SIZE {
+		local = local[:INDEX_NODE_OVERFLOW_LOCAL_SIZE]
+	}
+	return size, local
+}
+
+// セルのキーの続きを保存したオーバーフローページのページ番号を返す。オーバーフローページがない場合は0を返す
+func (indexUtil) getOverflowPage(page *Page, cellNum uint32) uint32 {
+	cell := IndexUtil.GetCell(page, cellNum)
+	if binary.LittleEndian.Uint32(cell[indexKeySizeOffset(page):]) <= INDEX_NODE_MAX_LOCAL_SIZE {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(cell[len(cell)-INDEX_NODE_OVERFLOW_SIZE:])
+}
+
+// セルのキーを返す。オーバーフローページに続きがある場合は、つなげたものを返す
+func (indexUtil) GetCellKey(pager *Pager, page *Page, cellNum uint32) []byte {
+	size, local := indexCellLocalKey(page, cellNum)
+	if size <= INDEX_NODE_MAX_LOCAL_SIZE {
+		return local
+	}
+	key := make([]byte, 0, size)
+	key = append(key, local...)
+	return readOverflow(pager, IndexUtil.getOverflowPage(page, cellNum), size-INDEX_NODE_OVERFLOW_LOCAL_SIZE, key)
+}
+
+// セルのキーとkeyを比較する。オーバーフローページは、セルに置いた部分で決まらない場合だけ読む
+func compareIndexCellKey(pager *Pager, page *Page, cellNum uint32, key []byte) int {
+	size, local := indexCellLocalKey(page, cellNum)
+	if size <= INDEX_NODE_MAX_LOCAL_SIZE {
+		return bytes.Compare(local, key)
+	}
+	if len(key) <= len(local) {
+		if c := bytes.Compare(local[:len(key)], key); c != 0 {
+			return c
+		}
+		// keyはセルのキーの先頭と一致していて、セルのキーの方が長い
+		return 1
+	}
+	if c := bytes.Compare(local, key[:len(local)]); c != 0 {
+		return c
+	}
+	return bytes.Compare(IndexUtil.GetCellKey(pager, page, cellNum), key)
+}
+
+// 内部ノードのindex番目の子ノードを返す（セルの数の場合は一番右の子ノード）
+func (indexUtil) GetChild(page *Page, index uint32) uint32 {
+	if index == IndexUtil.GetNumCells(page) {
+		return binary.LittleEndian.Uint32(page[INDEX_NODE_RIGHT_POINTER_OFFSET:])
+	}
+	return binary.LittleEndian.Uint32(page[IndexUtil.getCellOffset(page, index):])
+}
+
+// 内部ノードのindex番目の子ノードを設定する（セルの数の場合は一番右の子ノード）
+func (indexUtil) setChild(page *Page, index uint32, pageNum uint32) {
+	if index == IndexUtil.GetNumCells(page) {
+		IndexUtil.setRightPointer(page, pageNum)
+		return
+	}
+	binary.LittleEndian.PutUint32(page[IndexUtil.getCellOffset(page, index):], pageNum)
+}
+
+// セルとセルの位置が使うバイト数の合計を返す
+func (indexUtil) usedBytes(page *Page) uint32 {
+	numCells := IndexUtil.GetNumCells(page)
+	used := numCells * INDEX_NODE_CELL_POINTER_SIZE
+	for i := uint32(0); i < numCells; i++ {
+		used += uint32(len(IndexUtil.GetCell(page, i)))
+	}
+	return used
+}
+
+// 分割せずにセルを挿入する。呼び出し側は、セルが入ることを確認しておく
+func indexInsertCellAt(page *Page, cellNum uint32, cell []byte) {
+	numCells := IndexUtil.GetNumCells(page)
+	pointersEnd := INDEX_NODE_HEADER_SIZE + (numCells+1)*INDEX_NODE_CELL_POINTER_SIZE
+	if IndexUtil.getContentStart(page) < pointersEnd+uint32(len(cell)) {
+		// 空きの合計は足りているので、削除したセルの隙間を詰める
+		indexDefragment(page)
+	}
+
+	offset := IndexUtil.getContentStart(page) - uint32(len(cell))
+	copy(page[offset:], cell)
+	IndexUtil.setContentStart(page, offset)
+
+	for i := numCells; i > cellNum; i-- {
+		IndexUtil.setCellOffset(page, i, IndexUtil.getCellOffset(page, i-1))
+	}
+	IndexUtil.setCellOffset(page, cellNum, offset)
+	IndexUtil.setNumCells(page, numCells+1)
+}
+
+// セルを取り除いて、後ろのセルの位置を詰める。セルの領域は、次に詰めるまで隙間として残る
+func indexRemoveCell(page *Page, cellNum uint32) {
+	numCells := IndexUtil.GetNumCells(page)
+	for i := cellNum; i+1 < numCells; i++ {
+		IndexUtil.setCellOffset(page, i, IndexUtil.getCellOffset(page, i+1))
+	}
+	IndexUtil.setNumCells(page, numCells-1)
+	if numCells == 1 {
+		IndexUtil.setContentStart(page, PAGE_SIZE)
+	}
+}
+
+// セルをページの末尾に詰め直して、隙間をなくす
+func indexDefragment(page *Page) {
+	cells := indexCells(page)
+	IndexUtil.setNumCells(page, 0)
+	IndexUtil.setContentStart(page, PAGE_SIZE)
+	for i, cell := range cells {
+		indexInsertCellAt(page, uint32(i), cell)
+	}
+}
+
+// ノードの全てのセルのコピーを返す
+func indexCells(page *Page) [][]byte {
+	numCells := IndexUtil.GetNumCells(page)
+	cells := make([][]byte, numCells)
+	for i := uint32(0); i < numCells; i++ {
+		cells[i] = append([]byte(nil), IndexUtil.GetCell(page, i)...)
+	}
+	return cells
+}
+
+// ノードのセルを、cellsで置き換える
+func indexSetCells(page *Page, cells [][]byte) {
+	IndexUtil.setNumCells(page, 0)
+	IndexUtil.setContentStart(page, PAGE_SIZE)
+	for i, cell := range cells {
+		indexInsertCellAt(page, uint32(i), cell)
+	}
+}
+
+// ノードから、キー以上の最初のセルのインデックスを返す
+func indexFindCell(pager *Pager, page *Page, key []byte) uint32 {
+	ng, ok := -1, int(IndexUtil.GetNumCells(page))
+	for ok-ng > 1 {
+		i := (ok + ng) / 2
+		if compareIndexCellKey(pager, page, uint32(i), key) >= 0 {
+			ok = i
+		} else {
+			ng = i
+		}
+	}
+	return uint32(ok)
+}
+
+// キーが含まれるリーフノードまでたどって、経路とリーフノードのページ番号を返す
+func findIndexPath(pager *Pager, rootPageNum uint32, key []byte) ([]pathEntry, uint32) {
+	var path []pathEntry
+	pageNum := rootPageNum
+	for {
+		page := pager.GetPage(pageNum)
+		if !isIndexInternal(page) {
+			return path, pageNum
+		}
+		// key以上の最初の区切りのキーの子ノード。なければ一番右の子ノード
+		index := indexFindCell(pager, page, key)
+		path = append(path, pathEntry{pageNum: pageNum, index: index})
+		pageNum = IndexUtil.GetChild(page, index)
+	}
+}
+
+// キーをインデックスのB-treeに追加する。同じキーがある場合は、追加せずにfalseを返す
+func IndexInsertKey(pager *Pager, rootPageNum uint32, key []byte) bool {
+	path, leafPageNum := findIndexPath(pager, rootPageNum, key)
+	leaf := pager.GetPage(leafPageNum)
+	cellNum := indexFindCell(pager, leaf, key)
+	if cellNum < IndexUtil.GetNumCells(leaf) && compareIndexCellKey(pager, leaf, cellNum, key) == 0 {
+		return false
+	}
+	indexInsertCell(pager, path, leafPageNum, cellNum, makeIndexCell(pager, false, 0, key))
+	return true
+}
+
+// ノードのcellNumの位置にセルを挿入する。入りきらない場合は、ノードを分割する。
+// pathは、ノードの親までの経路
+func indexInsertCell(pager *Pager, path []pathEntry, pageNum uint32, cellNum uint32, cell []byte) {
+	page := pager.GetPageForWrite(pageNum)
+	if IndexUtil.usedBytes(page)+uint32(len(cell))+INDEX_NODE_CELL_POINTER_SIZE <= INDEX_NODE_SPACE_FOR_CELLS {
+		indexInsertCellAt(page, cellNum, cell)
+		return
+	}
+
+	if len(path) == 0 {
+		// ルートノードのページ番号を変えないように、ルートノードの内容を新しいページに移して、
+		// ルートノードをその親（子ノードが1つの内部ノード）にしてから分割する
+		child, childPageNum := pager.GetNewPage()
+		copy(child[:], page[:])
+		NodeUtil.setNodeRoot(child, false)
+		initIndexNode(page, NODE_INDEX_INTERNAL)
+		NodeUtil.setNodeRoot(page, true)
+		IndexUtil.setRightPointer(page, childPageNum)
+
+		path = []pathEntry{{pageNum: pageNum, index: 0}}
+		pageNum, page = childPageNum, child
+	}
+	indexSplitAndInsert(pager, path, pageNum, page, cellNum, cell)
+}
+
+// ノードを分割してから、新しいセルを挿入する。ノードは、セルのバイト数が左と右でおよそ半分ずつになるように分割する。
+// 分割したノードのページを左、新しいページを右にして、親ノードに左のノードと区切りのキーのセルを挿入する
+func indexSplitAndInsert(pager *Pager, path []pathEntry, pageNum uint32, page *Page, cellNum uint32, cell []byte) {
+	cells := indexCells(page)
+	cells = append(cells[:cellNum], append([][]byte{cell}, cells[cellNum:]...)...)
+	total := 0
+	for _, c := range cells {
+		total += len(c) + INDEX_NODE_CELL_POINTER_SIZE
+	}
+
+	// 左のセルのバイト数が、合計の半分以上になる最初の位置で分ける。右にも1つ以上のセルを残す
+	split, left := 0, 0
+	for split < len(cells)-1 && left*2 < total {
+		left += len(cells[split]) + INDEX_NODE_CELL_POINTER_SIZE
+		split++
+	}
+
+	newPage, newPageNum := pager.GetNewPage()
+	var separator []byte
+	if isIndexInternal(page) {
+		// 真ん中のセルを親ノードに移し、その子ノードを左のノードの一番右の子ノードにする
+		initIndexNode(newPage, NODE_INDEX_INTERNAL)
+		IndexUtil.setRightPointer(newPage, IndexUtil.GetChild(page, IndexUtil.GetNumCells(page)))
+		middle := cells[split-1]
+		IndexUtil.setRightPointer(page, binary.LittleEndian.Uint32(middle))
+		indexSetCells(page, cells[:split-1])
+		indexSetCells(newPage, cells[split:])
+
+		separator = middle
+		binary.LittleEndian.PutUint32(separator, pageNum)
+	} else {
+		initIndexNode(newPage, NODE_INDEX_LEAF)
+		IndexUtil.setRightPointer(newPage, IndexUtil.GetNextLeaf(page))
+		IndexUtil.setRightPointer(page, newPageNum)
+		indexSetCells(page, cells[:split])
+		indexSetCells(newPage, cells[split:])
+
+		// 区切りのキーは、左のノードの最大のキー
+		separator = makeIndexCell(pager, true, pageNum, IndexUtil.GetCellKey(pager, page, uint32(split-1)))
+	}
+
+	// 親ノードで分割したノードを指していた位置を右のノードにして、その前に左のノードを挿入する
+	parent := path[len(path)-1]
+	IndexUtil.setChild(pager.GetPageForWrite(parent.pageNum), parent.index, newPageNum)
+	indexInsertCell(pager, path[:len(path)-1], parent.pageNum, parent.index, separator)
+}
+
+// キーをインデックスのB-treeから削除する。キーが見つからない場合はfalseを返す。
+// ノードのセルが少なくなりすぎたら、兄弟ノードとマージする
+func IndexDeleteKey(pager *Pager, rootPageNum uint32, key []byte) bool {
+	path, leafPageNum := findIndexPath(pager, rootPageNum, key)
+	leaf := pager.GetPageForWrite(leafPageNum)
+	cellNum := indexFindCell(pager, leaf, key)
+	if cellNum >= IndexUtil.GetNumCells(leaf) || compareIndexCellKey(pager, leaf, cellNum, key) != 0 {
+		return false
+	}
+
+	freeOverflow(pager, IndexUtil.getOverflowPage(leaf, cellNum))
+	indexRemoveCell(leaf, cellNum)
+	indexRebalance(pager, path, leafPageNum)
+	return true
+}
+
+// セルが少なくなりすぎたノードを、隣の兄弟ノードとマージする。マージすると1ページに収まらない場合は、そのままにする。
+// 区切りのキーは子ノードのキーの上限なので、キーを削除しても更新しなくてよい。pathは、ノードの親までの経路
+func indexRebalance(pager *Pager, path []pathEntry, pageNum uint32) {
+	page := pager.GetPage(pageNum)
+	if len(path) == 0 {
+		// ルートノードの子ノードが1つだけになったら、木の高さを1つ減らす
+		if isIndexInternal(page) && IndexUtil.GetNumCells(page) == 0 {
+			childPageNum := IndexUtil.GetChild(page, 0)
+			root := pager.GetPageForWrite(pageNum)
+			copy(root[:], pager.GetPage(childPageNum)[:])
+			NodeUtil.setNodeRoot(root, true)
+			pager.FreePage(childPageNum)
+		}
+		return
+	}
+	if IndexUtil.usedBytes(page) >= INDEX_NODE_MIN_BYTES {
+		return
+	}
+
+	level := len(path) - 1
+	parentPageNum := path[level].pageNum
+	parent := pager.GetPage(parentPageNum)
+	// 右の兄弟ノードとマージする。一番右の子ノードの場合は、左の兄弟ノードとマージする
+	leftIndex := path[level].index
+	if leftIndex == IndexUtil.GetNumCells(parent) {
+		if leftIndex == 0 {
+			return
+		}
+		leftIndex--
+	}
+	leftPageNum := IndexUtil.GetChild(parent, leftIndex)
+	rightPageNum := IndexUtil.GetChild(parent, leftIndex+1)
+	left := pager.GetPage(leftPageNum)
+	right := pager.GetPage(rightPageNum)
+	separator := append([]byte(nil), IndexUtil.GetCell(parent, leftIndex)...)
+
+	used := IndexUtil.usedBytes(left) + IndexUtil.usedBytes(right)
+	if isIndexInternal(left) {
+		// 内部ノードは、区切りのキーを左のノードの一番右の子ノードのセルにして、間に入れる
+		used += uint32(len(separator)) + INDEX_NODE_CELL_POINTER_SIZE
+	}
+	if used > INDEX_NODE_SPACE_FOR_CELLS {
+		return
+	}
+
+	left = pager.GetPageForWrite(leftPageNum)
+	parent = pager.GetPageForWrite(parentPageNum)
+	cells := indexCells(left)
+	if isIndexInternal(left) {
+		binary.LittleEndian.PutUint32(separator, IndexUtil.GetChild(left, IndexUtil.GetNumCells(left)))
+		cells = append(cells, separator)
+		IndexUtil.setRightPointer(left, IndexUtil.GetChild(right, IndexUtil.GetNumCells(right)))
+	} else {
+		// リーフノードの区切りのキーは、親ノードから取り除くと使わなくなる
+		freeOverflow(pager, IndexUtil.getOverflowPage(parent, leftIndex))
+		IndexUtil.setRightPointer(left, IndexUtil.GetNextLeaf(right))
+	}
+	indexSetCells(left, append(cells, indexCells(right)...))
+
+	indexRemoveCell(parent, leftIndex)
+	IndexUtil.setChild(parent, leftIndex, leftPageNum)
+	pager.FreePage(rightPageNum)
+
+	indexRebalance(pager, path[:level], parentPageNum)
+}
+
+// キー以上の最初のキーの位置（リーフノードのページ番号とセルのインデックス）を返す。
+// そのようなキーがない場合は、最後のリーフノードのセルの数をセルのインデックスにして返す
+func IndexSeek(pager *Pager, rootPageNum uint32, key []byte) (uint32, uint32) {
+	_, pageNum := findIndexPath(pager, rootPageNum, key)
+	page := pager.GetPage(pageNum)
+	cellNum := indexFindCell(pager, page, key)
+	for cellNum >= IndexUtil.GetNumCells(page) {
+		next := IndexUtil.GetNextLeaf(page)
+		if next == 0 {
+			break
+		}
+		pageNum, page, cellNum = next, pager.GetPage(next), 0
+	}
+	return pageNum, cellNum
+}
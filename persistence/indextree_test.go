@@ -0,0 +1,122 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// テスト用のキー。iから決まる内容で、iが3の倍数のキーはオーバーフローページを使う長さにする
+func testIndexKey(i int) []byte {
+	key := []byte(fmt.Sprintf("key%06d", i))
+	if i%3 == 0 {
+		key = append(key, bytes.Repeat([]byte{byte(i)}, INDEX_NODE_MAX_LOCAL_SIZE+i%500)...)
+	}
+	return key
+}
+
+// リーフノードを左からたどって、全てのキーを返す
+func collectIndexKeys(pager *Pager, rootPageNum uint32) [][]byte {
+	defer pager.ReleasePages()
+
+	keys := [][]byte{}
+	pageNum, cellNum := IndexSeek(pager, rootPageNum, nil)
+	for {
+		page := pager.GetPage(pageNum)
+		for ; cellNum < IndexUtil.GetNumCells(page); cellNum++ {
+			keys = append(keys, append([]byte(nil), IndexUtil.GetCellKey(pager, page, cellNum)...))
+		}
+		if pageNum = IndexUtil.GetNextLeaf(page); pageNum == 0 {
+			return keys
+		}
+		cellNum = 0
+	}
+}
+
+func checkIndexTree(t *testing.T, pager *Pager, rootPageNum uint32, expected [][]byte) {
+	t.Helper()
+	if violations := CheckIntegrity(pager, []uint32{pager.GetCatalogRoot(), rootPageNum}); len(violations) != 0 {
+		t.Fatalf("unexpected violations: %v", violations)
+	}
+	sorted := append([][]byte{}, expected...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	if keys := collectIndexKeys(pager, rootPageNum); !reflect.DeepEqual(keys, sorted) {
+		t.Fatalf("expected %d keys in order, but got %d keys", len(sorted), len(keys))
+	}
+}
+
+func TestIndexTreeInsertAndDelete(t *testing.T) {
+	pager, err := InitPager(filepath.Join(t.TempDir(), "test.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+	rootPageNum := CreateIndexTree(pager)
+	pager.ReleasePages()
+
+	// 前半は順番に、後半はランダムな順番に挿入する
+	const numKeys = 600
+	order := rand.New(rand.NewSource(1)).Perm(numKeys / 2)
+	keys := make([][]byte, numKeys)
+	for i := 0; i < numKeys; i++ {
+		n := i
+		if i >= numKeys/2 {
+			n = numKeys/2 + order[i-numKeys/2]
+		}
+		keys[n] = testIndexKey(n)
+		if !IndexInsertKey(pager, rootPageNum, keys[n]) {
+			t.Fatalf("could not insert key %d", n)
+		}
+		pager.ReleasePages()
+	}
+	if IndexInsertKey(pager, rootPageNum, testIndexKey(7)) {
+		t.Errorf("inserted key 7 twice")
+	}
+	pager.ReleasePages()
+	if NodeUtil.GetNodeType(pager.GetPage(rootPageNum)) != NODE_INDEX_INTERNAL {
+		t.Fatalf("expected the root to be split")
+	}
+	pager.ReleasePages()
+	checkIndexTree(t, pager, rootPageNum, keys)
+
+	// キー以上の最初のキーを探す
+	pageNum, cellNum := IndexSeek(pager, rootPageNum, []byte("key000100x"))
+	if key := IndexUtil.GetCellKey(pager, pager.GetPage(pageNum), cellNum); !bytes.Equal(key, testIndexKey(101)) {
+		t.Errorf("expected key 101, but got %q", key[:9])
+	}
+	pager.ReleasePages()
+
+	// 全て削除すると、ルートノードだけの木に戻り、ページは全て空きページになる
+	for count, i := range rand.New(rand.NewSource(2)).Perm(numKeys) {
+		if !IndexDeleteKey(pager, rootPageNum, keys[i]) {
+			t.Fatalf("key %d was not found", i)
+		}
+		pager.ReleasePages()
+		keys[i] = nil
+		if count%50 == 0 {
+			var rest [][]byte
+			for _, key := range keys {
+				if key != nil {
+					rest = append(rest, key)
+				}
+			}
+			checkIndexTree(t, pager, rootPageNum, rest)
+		}
+	}
+	if IndexDeleteKey(pager, rootPageNum, testIndexKey(7)) {
+		t.Errorf("deleted key 7 twice")
+	}
+	pager.ReleasePages()
+	checkIndexTree(t, pager, rootPageNum, [][]byte{})
+	if NodeUtil.GetNodeType(pager.GetPage(rootPageNum)) != NODE_INDEX_LEAF {
+		t.Errorf("expected the root to be a leaf")
+	}
+	if free, used := pager.NumFreePages(), pager.NumPages()-3; free != used {
+		t.Errorf("expected %d free pages, but got %d", used, free)
+	}
+	pager.ReleasePages()
+}
@@ -2,8 +2,6 @@ package persistence
 
 import (
 	"encoding/binary"
-	"fmt"
-	"os"
 )
 
 // Common Node Header Layout
@@ -28,23 +26,43 @@ const (
 	// 右隣のリーフノードのページ番号
 	LEAF_NODE_NEXT_LEAF_SIZE   = 4
 	LEAF_NODE_NEXT_LEAF_OFFSET = LEAF_NODE_NUM_CELLS_OFFSET + LEAF_NODE_NUM_CELLS_SIZE
-	LEAF_NODE_HEADER_SIZE      = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE + LEAF_NODE_NEXT_LEAF_SIZE
+	// セルの領域の先頭の位置。セルはページの末尾から先頭に向かって詰めていく
+	LEAF_NODE_CONTENT_START_SIZE   = 4
+	LEAF_NODE_CONTENT_START_OFFSET = LEAF_NODE_NEXT_LEAF_OFFSET + LEAF_NODE_NEXT_LEAF_SIZE
+	LEAF_NODE_HEADER_SIZE          = COMMON_NODE_HEADER_SIZE + LEAF_NODE_NUM_CELLS_SIZE + LEAF_NODE_NEXT_LEAF_SIZE + LEAF_NODE_CONTENT_START_SIZE
 )
 
 // Leaf Node Body Layout
+//
+// ヘッダの後ろに、セルの位置（ページの先頭からのオフセット）をキーの順番に並べる。
+// セルは可変長で、キー、valueのサイズ、valueの順に並ぶ。
+// valueが大きい場合は、先頭の一部だけをセルに置き、その後ろに残りを保存したオーバーフローページのページ番号を置く。
+// セルを削除した後の隙間は、セルを挿入する場所が足りなくなったときに詰める
 const (
-	LEAF_NODE_KEY_OFFSET   = 0
-	LEAF_NODE_KEY_SIZE     = 4
-	LEAF_NODE_VALUE_OFFSET = LEAF_NODE_KEY_SIZE
-	LEAF_NODE_VALUE_SIZE   = ROW_SIZE
-	LEAF_NODE_CELL_SIZE    = LEAF_NODE_KEY_SIZE + LEAF_NODE_VALUE_SIZE
+	LEAF_NODE_CELL_POINTER_SIZE = 2
+
+	LEAF_NODE_KEY_OFFSET        = 0
+	LEAF_NODE_KEY_SIZE          = 4
+	LEAF_NODE_VALUE_SIZE_OFFSET = LEAF_NODE_KEY_OFFSET + LEAF_NODE_KEY_SIZE
+	LEAF_NODE_VALUE_SIZE_SIZE   = 4
+	LEAF_NODE_VALUE_OFFSET      = LEAF_NODE_VALUE_SIZE_OFFSET + LEAF_NODE_VALUE_SIZE_SIZE
+	LEAF_NODE_CELL_HEADER_SIZE  = LEAF_NODE_VALUE_OFFSET
+	LEAF_NODE_OVERFLOW_SIZE     = 4
 
 	LEAF_NODE_SPACE_FOR_CELLS = PAGE_SIZE - LEAF_NODE_HEADER_SIZE
-	LEAF_NODE_MAX_CELLS       = LEAF_NODE_SPACE_FOR_CELLS / LEAF_NODE_CELL_SIZE
 
-	// MAX + 1個になったとき、右は半分（切捨て）、左は残りに分割する
-	LEAF_NODE_RIGHT_SPLIT_COUNT = (LEAF_NODE_MAX_CELLS + 1) / 2
-	LEAF_NODE_LEFT_SPLIT_COUNT  = (LEAF_NODE_MAX_CELLS + 1) - LEAF_NODE_RIGHT_SPLIT_COUNT
+	// セルに全て置けるvalueの最大サイズ。分割したときに左右のノードに収まるように、
+	// 1つのセル（とセルの位置）はセルの領域の1/4以下にする
+	LEAF_NODE_MAX_LOCAL_SIZE = LEAF_NODE_SPACE_FOR_CELLS/4 - LEAF_NODE_CELL_HEADER_SIZE - LEAF_NODE_CELL_POINTER_SIZE
+	// オーバーフローページを使う場合に、セルに置くvalueの先頭のサイズ
+	LEAF_NODE_OVERFLOW_LOCAL_SIZE = LEAF_NODE_SPACE_FOR_CELLS/16 - LEAF_NODE_CELL_HEADER_SIZE - LEAF_NODE_CELL_POINTER_SIZE - LEAF_NODE_OVERFLOW_SIZE
+
+	// エンコードしたレコードの最大サイズ。読み書きするときはvalue全体をメモリに置くので、1MiBまでにする
+	LEAF_NODE_MAX_VALUE_SIZE = 1 << 20
+
+	// 削除して、セル（とセルの位置）のバイト数がこれより少なくなったら、兄弟ノードから借りるかマージする。
+	// 借りられない兄弟ノードとは、マージしても1ページに収まる
+	LEAF_NODE_MIN_BYTES = LEAF_NODE_SPACE_FOR_CELLS / 3
 )
 
 // Internal Node Header Layout
@@ -65,12 +83,18 @@ const (
 	INTERNAL_NODE_CELL_SIZE  = INTERNAL_NODE_CHILD_SIZE + INTERNAL_NODE_KEY_SIZE
 )
 
-const INTERNAL_NODE_MAX_CELLS = 3
+// 内部ノードに入るセルの最大数。一番右の子ノードはヘッダに置くので、子ノードの数はこれより1つ多い
+const INTERNAL_NODE_MAX_CELLS = (PAGE_SIZE - INTERNAL_NODE_HEADER_SIZE) / INTERNAL_NODE_CELL_SIZE
+
+// 削除してこれより少なくなったら、兄弟ノードから借りるかマージする
+const INTERNAL_NODE_MIN_KEYS = INTERNAL_NODE_MAX_CELLS / 2
 
 func initLeafNode(node *Page) {
 	NodeUtil.setNodeType(node, NODE_LEAF)
 	NodeUtil.setNodeRoot(node, false)
 	LeafUtil.setNextLeaf(node, 0) // 0は隣のノードがないことを表す
+	LeafUtil.WriteNumCells(node, 0)
+	LeafUtil.setContentStart(node, PAGE_SIZE)
 }
 
 func initInternalNode(node *Page) {
@@ -192,14 +216,12 @@ func (internalUtil) GetChild(page *Page, cellNum uint32) uint32 {
 	numKeys := InternalUtil.GetNumKeys(page)
 
 	if cellNum > numKeys {
-		fmt.Printf("Tried to get cellNum %d > numKeys %d\n", cellNum, numKeys)
-		os.Exit(1)
+		pagerPanic("%w: tried to get cellNum %d > numKeys %d", ErrCorrupt, cellNum, numKeys)
 		return 0
 	} else if cellNum == numKeys {
 		rightChild := InternalUtil.GetRightChild(page)
 		if rightChild == INVALID_PAGE_NUM {
-			fmt.Println("Tried to access right child of node, but was invalid page")
-			os.Exit(1)
+			pagerPanic("%w: tried to access right child of node, but was invalid page", ErrCorrupt)
 		}
 		return rightChild
 	} else {
@@ -214,12 +236,10 @@ func (internalUtil) setChild(page *Page, cellNum uint32, pageNum uint32) {
 
 	// インデックスがnumKeysまでのchildがある
 	if cellNum > numKeys {
-		fmt.Printf("Tried to set cellNum %d > numKeys %d\n", cellNum, numKeys)
-		os.Exit(1)
+		pagerPanic("%w: tried to set cellNum %d > numKeys %d", ErrCorrupt, cellNum, numKeys)
 	} else if cellNum == numKeys {
 		// ここの処理必要なのかな
-		fmt.Printf("Tried to set cellNum %d = numKeys %d\n", cellNum, numKeys)
-		os.Exit(1)
+		pagerPanic("%w: tried to set cellNum %d = numKeys %d", ErrCorrupt, cellNum, numKeys)
 	} else {
 		start, end := InternalUtil.getChildPos(cellNum)
 		copy(page[start:end], uint32ToBytes(pageNum))
@@ -288,87 +308,174 @@ func (leafUtil) setNextLeaf(page *Page, pageNum uint32) {
 	copy(page[LEAF_NODE_NEXT_LEAF_OFFSET:LEAF_NODE_NEXT_LEAF_OFFSET+LEAF_NODE_NEXT_LEAF_SIZE], bytes)
 }
 
-// セルの個数を1増やす
-func (leafUtil) IncrementNumCells(page *Page) {
-	numCells := LeafUtil.GetNumCells(page)
-	LeafUtil.WriteNumCells(page, numCells+1)
+// セルの領域の先頭の位置を返す
+func (leafUtil) getContentStart(page *Page) uint32 {
+	bytes := page[LEAF_NODE_CONTENT_START_OFFSET : LEAF_NODE_CONTENT_START_OFFSET+LEAF_NODE_CONTENT_START_SIZE]
+	return binary.LittleEndian.Uint32(bytes)
 }
 
-// ノードにセルを挿入する
-func (leafUtil) InsertCell(pager *Pager, page *Page, cellNum uint32, key uint32, value []byte, rootPageNum uint32) {
-	numCells := LeafUtil.GetNumCells(page)
+// セルの領域の先頭の位置を設定する
+func (leafUtil) setContentStart(page *Page, offset uint32) {
+	copy(page[LEAF_NODE_CONTENT_START_OFFSET:LEAF_NODE_CONTENT_START_OFFSET+LEAF_NODE_CONTENT_START_SIZE], uint32ToBytes(offset))
+}
 
-	if numCells >= LEAF_NODE_MAX_CELLS {
-		leafNodeSplitAndInsert(pager, page, cellNum, key, value, rootPageNum)
-		return
+// セルの位置を返す
+func (leafUtil) getCellOffset(page *Page, cellNum uint32) uint32 {
+	start := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_POINTER_SIZE
+	return uint32(binary.LittleEndian.Uint16(page[start : start+LEAF_NODE_CELL_POINTER_SIZE]))
+}
+
+// セルの位置を設定する
+func (leafUtil) setCellOffset(page *Page, cellNum uint32, offset uint32) {
+	start := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_POINTER_SIZE
+	binary.LittleEndian.PutUint16(page[start:start+LEAF_NODE_CELL_POINTER_SIZE], uint16(offset))
+}
+
+// セル（キー、valueのサイズ、value）を作る。valueがセルに入りきらない場合は、残りをオーバーフローページに書き込む
+func makeLeafCell(pager *Pager, key uint32, value []byte) []byte {
+	size := uint32(len(value))
+	cell := make([]byte, LEAF_NODE_CELL_HEADER_SIZE+leafLocalSize(size))
+	binary.LittleEndian.PutUint32(cell[LEAF_NODE_KEY_OFFSET:], key)
+	binary.LittleEndian.PutUint32(cell[LEAF_NODE_VALUE_SIZE_OFFSET:], size)
+	if size <= LEAF_NODE_MAX_LOCAL_SIZE {
+		copy(cell[LEAF_NODE_VALUE_OFFSET:], value)
+		return cell
 	}
 
-	if cellNum < numCells {
-		// cellNumに挿入できるように、それより後ろにあるセルを1つずつずらす
-		for i := numCells; i > cellNum; i-- {
-			toStart, toEnd := LeafUtil.getCellPos(i)
-			copy(page[toStart:toEnd], LeafUtil.GetCell(page, i-1))
-		}
+	copy(cell[LEAF_NODE_VALUE_OFFSET:], value[:LEAF_NODE_OVERFLOW_LOCAL_SIZE])
+	overflow := writeOverflow(pager, value[LEAF_NODE_OVERFLOW_LOCAL_SIZE:])
+	binary.LittleEndian.PutUint32(cell[LEAF_NODE_VALUE_OFFSET+LEAF_NODE_OVERFLOW_LOCAL_SIZE:], overflow)
+	return cell
+}
+
+// valueのサイズから、セルのvalueの部分（オーバーフローページのページ番号を含む）のバイト数を返す
+func leafLocalSize(size uint32) uint32 {
+	if size <= LEAF_NODE_MAX_LOCAL_SIZE {
+		return size
 	}
-	LeafUtil.IncrementNumCells(page)
-	LeafUtil.WriteCellKey(page, cellNum, key)
-	LeafUtil.WriteCellValue(page, cellNum, value)
+	return LEAF_NODE_OVERFLOW_LOCAL_SIZE + LEAF_NODE_OVERFLOW_SIZE
 }
 
-// リーフノードのセル（key + value）を返す
-func (leafUtil) GetCell(page *Page, cellNum uint32) []byte {
-	start, end := LeafUtil.getCellPos(cellNum)
-	return page[start:end]
+// セルとセルの位置が使うバイト数の合計を返す
+func (leafUtil) usedBytes(page *Page) uint32 {
+	numCells := LeafUtil.GetNumCells(page)
+	used := numCells * LEAF_NODE_CELL_POINTER_SIZE
+	for i := uint32(0); i < numCells; i++ {
+		used += uint32(len(LeafUtil.GetCell(page, i)))
+	}
+	return used
 }
 
-// リーフノードにセルを書き込む
-func (leafUtil) WriteCell(page *Page, cellNum uint32, cell []byte) {
-	start, end := LeafUtil.getCellPos(cellNum)
-	copy(page[start:end], cell)
+// バイト数がsizeのセルを、分割せずに挿入できるならtrue
+func (leafUtil) fits(page *Page, size int) bool {
+	return LeafUtil.usedBytes(page)+uint32(size)+LEAF_NODE_CELL_POINTER_SIZE <= LEAF_NODE_SPACE_FOR_CELLS
 }
 
-// セルのキーの値を返す
-func (leafUtil) GetCellKey(page *Page, cellNum uint32) uint32 {
-	start, end := LeafUtil.getKeyPos(cellNum)
-	key := binary.LittleEndian.Uint32(page[start:end])
-	return key
+// ノードにセルを挿入する。入りきらない場合は、ノードを分割する
+func (leafUtil) InsertCell(pager *Pager, page *Page, cellNum uint32, key uint32, value []byte, rootPageNum uint32) {
+	cell := makeLeafCell(pager, key, value)
+	if !LeafUtil.fits(page, len(cell)) {
+		leafNodeSplitAndInsert(pager, page, cellNum, cell, rootPageNum)
+		return
+	}
+	leafInsertCell(page, cellNum, cell)
 }
 
-// セルのキーをページに書き込む
-func (leafUtil) WriteCellKey(page *Page, cellNum uint32, key uint32) {
-	start, end := LeafUtil.getKeyPos(cellNum)
-	copy(page[start:end], uint32ToBytes(key))
+// セルのvalueを書き換える。新しいvalueが入りきらない場合は、ノードを分割する
+func (leafUtil) UpdateCellValue(pager *Pager, page *Page, cellNum uint32, value []byte, rootPageNum uint32) {
+	key := LeafUtil.GetCellKey(page, cellNum)
+	freeOverflow(pager, LeafUtil.getOverflowPage(page, cellNum))
+	leafRemoveCell(page, cellNum)
+	LeafUtil.InsertCell(pager, page, cellNum, key, value, rootPageNum)
 }
 
-// セルのvalueを返す
-func (leafUtil) GetCellValue(page *Page, cellNum uint32) []byte {
-	start, end := LeafUtil.getValuePos(cellNum)
-	return page[start:end]
+// 分割せずにセルを挿入する。呼び出し側は、セルが入ることを確認しておく
+func leafInsertCell(page *Page, cellNum uint32, cell []byte) {
+	numCells := LeafUtil.GetNumCells(page)
+	pointersEnd := LEAF_NODE_HEADER_SIZE + (numCells+1)*LEAF_NODE_CELL_POINTER_SIZE
+	if LeafUtil.getContentStart(page) < pointersEnd+uint32(len(cell)) {
+		// 空きの合計は足りているので、削除したセルの隙間を詰める
+		leafDefragment(page)
+	}
+
+	offset := LeafUtil.getContentStart(page) - uint32(len(cell))
+	copy(page[offset:], cell)
+	LeafUtil.setContentStart(page, offset)
+
+	// cellNumに挿入できるように、それより後ろにあるセルの位置を1つずつずらす
+	for i := numCells; i > cellNum; i-- {
+		LeafUtil.setCellOffset(page, i, LeafUtil.getCellOffset(page, i-1))
+	}
+	LeafUtil.setCellOffset(page, cellNum, offset)
+	LeafUtil.WriteNumCells(page, numCells+1)
 }
 
-// セルのvalueをページに書き込む
-func (leafUtil) WriteCellValue(page *Page, cellNum uint32, value []byte) {
-	start, end := LeafUtil.getValuePos(cellNum)
-	copy(page[start:end], value)
+// リーフノードからセルを取り除いて、後ろのセルの位置を詰める。セルの領域は、次に詰めるまで隙間として残る
+func leafRemoveCell(page *Page, cellNum uint32) {
+	numCells := LeafUtil.GetNumCells(page)
+	for i := cellNum; i+1 < numCells; i++ {
+		LeafUtil.setCellOffset(page, i, LeafUtil.getCellOffset(page, i+1))
+	}
+	LeafUtil.WriteNumCells(page, numCells-1)
+	if numCells == 1 {
+		LeafUtil.setContentStart(page, PAGE_SIZE)
+	}
 }
 
-// リーフノードのセルの位置を返す
-func (leafUtil) getCellPos(cellNum uint32) (uint32, uint32) {
-	cellStart := LEAF_NODE_HEADER_SIZE + cellNum*LEAF_NODE_CELL_SIZE
+// セルをページの末尾に詰め直して、隙間をなくす
+func leafDefragment(page *Page) {
+	numCells := LeafUtil.GetNumCells(page)
+	cells := make([][]byte, numCells)
+	for i := uint32(0); i < numCells; i++ {
+		cells[i] = append([]byte(nil), LeafUtil.GetCell(page, i)...)
+	}
 
-	return cellStart, cellStart + LEAF_NODE_CELL_SIZE
+	offset := uint32(PAGE_SIZE)
+	for i, cell := range cells {
+		offset -= uint32(len(cell))
+		copy(page[offset:], cell)
+		LeafUtil.setCellOffset(page, uint32(i), offset)
+	}
+	LeafUtil.setContentStart(page, offset)
 }
 
-// リーフノードのキーの位置を返す
-func (leafUtil) getKeyPos(cellNum uint32) (uint32, uint32) {
-	cellStart, _ := LeafUtil.getCellPos(cellNum)
+// リーフノードのセル（キー、valueのサイズ、value）を返す
+func (leafUtil) GetCell(page *Page, cellNum uint32) []byte {
+	offset := LeafUtil.getCellOffset(page, cellNum)
+	size := binary.LittleEndian.Uint32(page[offset+LEAF_NODE_VALUE_SIZE_OFFSET:])
+	return page[offset : offset+LEAF_NODE_CELL_HEADER_SIZE+leafLocalSize(size)]
+}
 
-	return cellStart, cellStart + LEAF_NODE_KEY_SIZE
+// セルのキーの値を返す
+func (leafUtil) GetCellKey(page *Page, cellNum uint32) uint32 {
+	offset := LeafUtil.getCellOffset(page, cellNum)
+	return binary.LittleEndian.Uint32(page[offset+LEAF_NODE_KEY_OFFSET:])
 }
 
-// リーフノードの値の位置を返す
-func (leafUtil) getValuePos(cellNum uint32) (uint32, uint32) {
-	cellStart, _ := LeafUtil.getCellPos(cellNum)
+// セルのキーをページに書き込む
+func (leafUtil) WriteCellKey(page *Page, cellNum uint32, key uint32) {
+	offset := LeafUtil.getCellOffset(page, cellNum)
+	binary.LittleEndian.PutUint32(page[offset+LEAF_NODE_KEY_OFFSET:], key)
+}
 
-	return cellStart + LEAF_NODE_KEY_SIZE, cellStart + LEAF_NODE_KEY_SIZE + LEAF_NODE_VALUE_SIZE
+// セルのvalueを返す。オーバーフローページに続きがある場合は、つなげたものを返す
+func (leafUtil) GetCellValue(pager *Pager, page *Page, cellNum uint32) []byte {
+	cell := LeafUtil.GetCell(page, cellNum)
+	size := binary.LittleEndian.Uint32(cell[LEAF_NODE_VALUE_SIZE_OFFSET:])
+	if size <= LEAF_NODE_MAX_LOCAL_SIZE {
+		return cell[LEAF_NODE_VALUE_OFFSET:]
+	}
+
+	value := make([]byte, 0, size)
+	value = append(value, cell[LEAF_NODE_VALUE_OFFSET:LEAF_NODE_VALUE_OFFSET+LEAF_NODE_OVERFLOW_LOCAL_SIZE]...)
+	return readOverflow(pager, LeafUtil.getOverflowPage(page, cellNum), size-LEAF_NODE_OVERFLOW_LOCAL_SIZE, value)
+}
+
+// セルのvalueの続きを保存したオーバーフローページのページ番号を返す。オーバーフローページがない場合は0を返す
+func (leafUtil) getOverflowPage(page *Page, cellNum uint32) uint32 {
+	cell := LeafUtil.GetCell(page, cellNum)
+	if binary.LittleEndian.Uint32(cell[LEAF_NODE_VALUE_SIZE_OFFSET:]) <= LEAF_NODE_MAX_LOCAL_SIZE {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(cell[LEAF_NODE_VALUE_OFFSET+LEAF_NODE_OVERFLOW_LOCAL_SIZE:])
 }
@@ -0,0 +1,72 @@
+package persistence
+
+import "encoding/binary"
+
+// リーフノードのセルに入りきらない大きなvalueは、先頭の一部だけをセルに置き、
+// 残りをオーバーフローページの連結リストに保存する。
+
+// Overflow Page Layout
+const (
+	// 次のオーバーフローページのページ番号（0は次がないことを表す）
+	OVERFLOW_PAGE_NEXT_SIZE   = 4
+	OVERFLOW_PAGE_NEXT_OFFSET = 0
+	// valueの続き
+	OVERFLOW_PAGE_DATA_OFFSET = OVERFLOW_PAGE_NEXT_OFFSET + OVERFLOW_PAGE_NEXT_SIZE
+	OVERFLOW_PAGE_DATA_SIZE   = PAGE_SIZE - OVERFLOW_PAGE_DATA_OFFSET
+)
+
+// 次のオーバーフローページのページ番号を返す
+func getOverflowNext(page *Page) uint32 {
+	return binary.LittleEndian.Uint32(page[OVERFLOW_PAGE_NEXT_OFFSET : OVERFLOW_PAGE_NEXT_OFFSET+OVERFLOW_PAGE_NEXT_SIZE])
+}
+
+// dataをオーバーフローページの連結リストに書き込んで、先頭のページ番号を返す。
+// 大きなvalueでもキャッシュが上限を超えないように、次のページを取得して番号を書き込んだら、書き終わったページの固定を解除する
+func writeOverflow(pager *Pager, data []byte) uint32 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	page, first := pager.GetNewPage()
+	pageNum := first
+	for {
+		n := copy(page[OVERFLOW_PAGE_DATA_OFFSET:], data)
+		data = data[n:]
+		if len(data) == 0 {
+			pager.ReleasePage(pageNum)
+			return first
+		}
+
+		next, nextPageNum := pager.GetNewPage()
+		copy(page[OVERFLOW_PAGE_NEXT_OFFSET:OVERFLOW_PAGE_NEXT_OFFSET+OVERFLOW_PAGE_NEXT_SIZE], uint32ToBytes(nextPageNum))
+		pager.ReleasePage(pageNum)
+		page, pageNum = next, nextPageNum
+	}
+}
+
+// pageNumから始まるオーバーフローページを読んで、sizeバイトをvalueの後ろに追加する。読んだページはすぐに固定を解除する
+func readOverflow(pager *Pager, pageNum uint32, size uint32, value []byte) []byte {
+	for size > 0 && pageNum != 0 {
+		page := pager.GetPage(pageNum)
+		n := size
+		if n > OVERFLOW_PAGE_DATA_SIZE {
+			n = OVERFLOW_PAGE_DATA_SIZE
+		}
+		value = append(value, page[OVERFLOW_PAGE_DATA_OFFSET:OVERFLOW_PAGE_DATA_OFFSET+n]...)
+		size -= n
+		next := getOverflowNext(page)
+		pager.ReleasePage(pageNum)
+		pageNum = next
+	}
+	return value
+}
+
+// pageNumから始まるオーバーフローページを、全て空きページにする。空きページにしたページはすぐに固定を解除する
+func freeOverflow(pager *Pager, pageNum uint32) {
+	for pageNum != 0 {
+		next := getOverflowNext(pager.GetPage(pageNum))
+		pager.FreePage(pageNum)
+		pager.ReleasePage(pageNum)
+		pageNum = next
+	}
+}
@@ -1,112 +1,513 @@
 package persistence
 
 import (
+	"container/list"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 )
 
-// TODO:
-const ROW_SIZE = 296
-
 const (
-	PAGE_SIZE       = 4096
-	TABLE_MAX_PAGES = 100
-	ROWS_PER_PAGE   = PAGE_SIZE / ROW_SIZE
-	TABLE_MAX_ROWS  = ROWS_PER_PAGE * TABLE_MAX_PAGES
+	PAGE_SIZE = 4096
+	// キャッシュするページ数のデフォルト値
+	DEFAULT_CACHE_PAGES = 100
+	// キャッシュするページ数の下限。1回の操作で同時に使うページより少ないと、すぐに追い出しが起きてしまう
+	MIN_CACHE_PAGES = 8
 )
 
 type Page [PAGE_SIZE]byte
 
+// バッファプールのフレーム。1つのページをキャッシュする
+type frame struct {
+	page    *Page
+	pageNum uint32
+	// GetPageForWriteで取得してから、WALに書き出していなければtrue
+	dirty bool
+	// 操作中のページは追い出さないように固定する
+	pinned bool
+	// LRUリストの要素
+	elem *list.Element
+}
+
 type Pager struct {
-	file     *os.File
-	pages    [TABLE_MAX_PAGES](*Page)
+	file *os.File
+	// 変更したページは、DBファイルに書き戻す前にWALに書き込む
+	wal *wal
+	// ページ番号からフレームへのマップ
+	frames map[uint32]*frame
+	// 最近使った順に並べたフレームのリスト（先頭が最近使ったもの）
+	lru      *list.List
+	capacity int
+	numPages uint32
+	// BEGINで始めたトランザクションの途中ならtrue
+	inTransaction bool
+	// トランザクションとステートメントを始めた時点の状態。ロールバックでこの状態に戻す
+	transaction savepoint
+	statement   savepoint
+	// GetPageを呼んだ回数。EXPLAIN ANALYZEで、演算子が読んだページ数を数える
+	pageReads uint64
+}
+
+// ロールバックで戻す状態
+type savepoint struct {
+	wal      walMark
 	numPages uint32
 }
 
-// ページャを初期化する。DBファイルのサイズからページ数を計算して、設定する。
-func InitPager(name string) (*Pager, error) {
+var (
+	ErrTransactionActive = errors.New("cannot start a transaction within a transaction")
+	ErrNoTransaction     = errors.New("no transaction is active")
+)
+
+// ページの読み書きに失敗した、またはページの内容が壊れている。
+// B-treeの操作の途中で起きるのでエラーを返せず、このエラーでpanicする。呼び出し側はRecoverPagerErrorで受け取る
+type PagerError struct {
+	Err error
+}
+
+func (e *PagerError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PagerError) Unwrap() error {
+	return e.Err
+}
+
+func pagerPanic(format string, args ...interface{}) {
+	panic(&PagerError{Err: fmt.Errorf(format, args...)})
+}
+
+// deferで呼び出して、PagerErrorのpanicを*errに変換する。それ以外のpanicはそのまま続ける
+func RecoverPagerError(err *error) {
+	if r := recover(); r != nil {
+		pagerErr, ok := r.(*PagerError)
+		if !ok {
+			panic(r)
+		}
+		*err = pagerErr
+	}
+}
+
+// WALファイルの名前を返す
+func WalFileName(name string) string {
+	return name + "-wal"
+}
+
+// ページャを初期化する。WALのコミット済みのフレームを読み直してから、ヘッダページを確認して、ページ数を設定する。
+// cachePagesはキャッシュするページ数の上限で、0の場合はデフォルト値を使う。
+func InitPager(name string, cachePages int) (*Pager, error) {
 	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
 
-	// ページ数を計算する。ファイルサイズとページサイズから計算できる。
+	// ファイルに含まれるページ数を計算する。ファイルサイズとページサイズから計算できる。
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 	numPages := fi.Size() / PAGE_SIZE
 
 	if fi.Size()%PAGE_SIZE != 0 {
-		fmt.Printf("Db file is not a whole number of pages. Corrupt file.\n")
-		os.Exit(1)
+		f.Close()
+		return nil, fmt.Errorf("%w: file is not a whole number of pages", ErrCorrupt)
+	}
+
+	if cachePages == 0 {
+		cachePages = DEFAULT_CACHE_PAGES
+	}
+	if cachePages < MIN_CACHE_PAGES {
+		cachePages = MIN_CACHE_PAGES
+	}
+
+	w, err := openWal(WalFileName(name))
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
 
 	// ページャーを初期化する
 	pager := Pager{
 		file:     f,
-		pages:    [TABLE_MAX_PAGES]*Page{},
+		wal:      w,
+		frames:   map[uint32]*frame{},
+		lru:      list.New(),
+		capacity: cachePages,
 		numPages: uint32(numPages),
 	}
+	if w.pageCount > pager.numPages {
+		// DBファイルに書き戻す前のページがWALにある
+		pager.numPages = w.pageCount
+	}
 
-	// ページ0を初期化する
 	if pager.numPages == 0 {
-		node := pager.GetPage(0)
-		initLeafNode(node)
-		NodeUtil.setNodeRoot(node, true)
+		// 新しいファイルの場合は、ヘッダページと空のカタログ（ルートノードはページ1）を作ってコミットする。
+		// コミットしておかないと、最初のステートメントをロールバックしたときにヘッダも消えてしまう
+		header := pager.GetPageForWrite(HEADER_PAGE_NUM)
+		initHeader(header, CreateTree(&pager))
+		pager.ReleasePages()
+		if err := pager.Commit(); err != nil {
+			pager.close()
+			return nil, err
+		}
+		return &pager, nil
 	}
 
-	return &pager, err
+	// ヘッダを確認して、ページ数を読み取る
+	header := pager.GetPage(HEADER_PAGE_NUM)
+	defer pager.ReleasePages()
+	if err := validateHeader(header); err != nil {
+		pager.close()
+		return nil, err
+	}
+	pageCount := HeaderUtil.GetPageCount(header)
+	if pageCount > pager.numPages {
+		pager.close()
+		return nil, fmt.Errorf("%w: header says %d pages, but file has %d", ErrCorrupt, pageCount, pager.numPages)
+	}
+	pager.numPages = pageCount
+
+	return &pager, nil
+}
+
+// カタログのルートページ番号を返す
+func (pager *Pager) GetCatalogRoot() uint32 {
+	return HeaderUtil.GetCatalogRoot(pager.GetPage(HEADER_PAGE_NUM))
 }
 
 // ページを取得する。ページがキャッシュされていない場合は、ファイルから読み取ってキャッシュする。
+// 取得したページは、ReleasePagesを呼ぶまで追い出されない。
+// 取得したページは読むだけにする。変更する場合は、GetPageForWriteで取得する
 func (pager *Pager) GetPage(pageNum uint32) *Page {
-	if pager.pages[pageNum] != nil {
-		return pager.pages[pageNum]
+	return pager.getFrame(pageNum).page
+}
+
+// ページを変更するために取得する。取得したページはダーティになり、追い出すときやコミットのときにWALに書き込む
+func (pager *Pager) GetPageForWrite(pageNum uint32) *Page {
+	f := pager.getFrame(pageNum)
+	f.dirty = true
+	return f.page
+}
+
+// ページのフレームを取得して、固定する
+func (pager *Pager) getFrame(pageNum uint32) *frame {
+	pager.pageReads++
+	if f, ok := pager.frames[pageNum]; ok {
+		pager.lru.MoveToFront(f.elem)
+		f.pinned = true
+		return f
 	}
 
 	// ファイルから読み取って、ページャに設定する
-	pager.file.Seek(int64(pageNum*PAGE_SIZE), 0)
-	page := Page{}
-	pager.file.Read(page[:])
-	pager.pages[pageNum] = &page
+	f := pager.allocFrame()
+	f.pageNum = pageNum
+	f.pinned = true
+	pager.readPage(pageNum, f.page)
+	// ファイルに存在しないページは、内容に関わらず書き込む必要がある
+	f.dirty = pageNum >= pager.numPages
+	f.elem = pager.lru.PushFront(f)
+	pager.frames[pageNum] = f
 
 	// ここでページ数を増やすのちょっと変
 	if uint32(pageNum) >= pager.numPages {
 		pager.numPages = uint32(pageNum) + 1
 	}
 
-	return pager.pages[pageNum]
+	return f
+}
+
+// ページを読み取る。WALにあればWALから、なければDBファイルから読み取る。ファイルの範囲外の部分はゼロで埋める
+func (pager *Pager) readPage(pageNum uint32, page *Page) {
+	found, err := pager.wal.readPage(pageNum, page)
+	if err != nil {
+		pagerPanic("reading page %d from WAL: %w", pageNum, err)
+	}
+	if found {
+		return
+	}
+
+	n, err := pager.file.ReadAt(page[:], int64(pageNum)*PAGE_SIZE)
+	if err != nil && err != io.EOF {
+		pagerPanic("reading page %d: %w", pageNum, err)
+	}
+	for i := n; i < PAGE_SIZE; i++ {
+		page[i] = 0
+	}
+}
+
+// ページをDBファイルに書き込む
+func (pager *Pager) writePage(pageNum uint32, page *Page) error {
+	_, err := pager.file.WriteAt(page[:], int64(pageNum)*PAGE_SIZE)
+	return err
+}
+
+// 空いているフレームを返す。キャッシュがいっぱいの場合は、最も長く使われていないページを追い出してフレームを再利用する
+func (pager *Pager) allocFrame() *frame {
+	if len(pager.frames) < pager.capacity {
+		return &frame{page: &Page{}}
+	}
+
+	victim := pager.findVictim()
+	if victim == nil {
+		// 全てのページが使用中の場合は、上限を超えてフレームを増やす
+		return &frame{page: &Page{}}
+	}
+	if err := pager.evict(victim); err != nil {
+		pagerPanic("writing page %d: %w", victim.pageNum, err)
+	}
+
+	return &frame{page: victim.page}
+}
+
+// 追い出すフレームを、最も長く使われていないものから探す
+func (pager *Pager) findVictim() *frame {
+	for e := pager.lru.Back(); e != nil; e = e.Prev() {
+		f := e.Value.(*frame)
+		if !f.pinned {
+			return f
+		}
+	}
+	return nil
 }
 
-// 使っていない新しいページを取得する
+// フレームをキャッシュから取り除く。ダーティな場合は、コミット前のページとしてWALに書き出す
+func (pager *Pager) evict(f *frame) error {
+	if f.dirty {
+		if err := pager.wal.appendPage(f.pageNum, f.page); err != nil {
+			return err
+		}
+	}
+	pager.lru.Remove(f.elem)
+	delete(pager.frames, f.pageNum)
+	return nil
+}
+
+// 操作が終わったページの固定を解除する。キャッシュが上限を超えている場合は、超えた分を追い出す。
+// 解除した後は、GetPageで取得したページのポインタを使ってはいけない。
+func (pager *Pager) ReleasePages() {
+	for _, f := range pager.frames {
+		f.pinned = false
+	}
+
+	for len(pager.frames) > pager.capacity {
+		victim := pager.findVictim()
+		if err := pager.evict(victim); err != nil {
+			pagerPanic("writing page %d: %w", victim.pageNum, err)
+		}
+	}
+}
+
+// 1つのページの固定を解除する。オーバーフローページのように1ページずつ順に読み書きする場合に、
+// ReleasePagesを待たずに追い出せるようにする。解除した後は、そのページのポインタを使ってはいけない。
+func (pager *Pager) ReleasePage(pageNum uint32) {
+	if f, ok := pager.frames[pageNum]; ok {
+		f.pinned = false
+	}
+}
+
+// これまでにGetPageでページを読んだ回数を返す。キャッシュにあったページも数える
+func (pager *Pager) PageReads() uint64 {
+	return pager.pageReads
+}
+
+// キャッシュしているページ数を返す
+func (pager *Pager) NumCachedPages() int {
+	return len(pager.frames)
+}
+
+// 使っていない新しいページを取得する。空きページがあれば再利用し、なければファイルの末尾に追加する。
+// 取得したページは、GetPageForWriteで取得したページと同じくダーティになる
 func (pager *Pager) GetNewPage() (*Page, uint32) {
+	if pageNum, ok := pager.popFreePage(); ok {
+		page := pager.GetPageForWrite(pageNum)
+		*page = Page{}
+		return page, pageNum
+	}
+
+	// ファイルの末尾より後ろのページを取得すると、ページ数が増える
 	newPageNum := pager.numPages
-	pager.numPages++
 
-	return pager.GetPage(newPageNum), newPageNum
+	return pager.GetPageForWrite(newPageNum), newPageNum
 }
 
-// ページャの内容をディスクに書き込む
-func (pager *Pager) FlushPages() error {
-	defer pager.file.Close()
+// ページ数を返す
+func (pager *Pager) NumPages() uint32 {
+	return pager.numPages
+}
 
-	file := pager.file
+// 変更されたページがキャッシュにあるかどうか
+func (pager *Pager) hasDirtyPages() bool {
+	for _, f := range pager.frames {
+		if f.dirty {
+			return true
+		}
+	}
+	return false
+}
 
-	// 全ての行が埋まっているページの書き込み
-	for i := uint32(0); i < pager.numPages; i++ {
-		// ページがキャッシュにない場合は何もしない（読み取りも書き込みもされていない場合）
-		page := pager.pages[i]
-		if page == nil {
-			continue
+// 変更されたページをWALに書き込んで、コミットする。トランザクションの途中なら、トランザクションを終える
+func (pager *Pager) Commit() error {
+	if !pager.hasDirtyPages() && len(pager.wal.pending) == 0 {
+		pager.inTransaction = false
+		return nil
+	}
+
+	// ヘッダのページ数と書き込み回数を更新する
+	header := pager.GetPageForWrite(HEADER_PAGE_NUM)
+	HeaderUtil.setUint32(header, HEADER_PAGE_COUNT_OFFSET, pager.numPages)
+	HeaderUtil.setUint32(header, HEADER_CHANGE_COUNTER_OFFSET, HeaderUtil.GetChangeCounter(header)+1)
+
+	// 変更されたページをページ番号順に書き込む
+	pageNums := make([]uint32, 0, len(pager.frames))
+	for pageNum, f := range pager.frames {
+		if f.dirty {
+			pageNums = append(pageNums, pageNum)
+		}
+	}
+	sort.Slice(pageNums, func(i, j int) bool { return pageNums[i] < pageNums[j] })
+
+	for _, pageNum := range pageNums {
+		f := pager.frames[pageNum]
+		if err := pager.wal.appendPage(pageNum, f.page); err != nil {
+			return err
 		}
+		f.dirty = false
+	}
+	if err := pager.wal.commit(pager.numPages); err != nil {
+		return err
+	}
+	pager.inTransaction = false
+
+	if pager.wal.numFrames >= WAL_AUTOCHECKPOINT_FRAMES {
+		return pager.Checkpoint()
+	}
+	return nil
+}
 
-		file.Seek(int64(PAGE_SIZE*i), 0)
-		_, err := file.Write(page[:])
-		if err != nil {
+// 変更されたページを、コミットせずにWALに書き出す。書き出したページはダーティではなくなる
+func (pager *Pager) writeDirtyPages() error {
+	for pageNum, f := range pager.frames {
+		if !f.dirty {
+			continue
+		}
+		if err := pager.wal.appendPage(pageNum, f.page); err != nil {
 			return err
 		}
+		f.dirty = false
 	}
+	return nil
+}
+
+// 現在の状態を、ロールバックで戻る位置として記録する
+func (pager *Pager) savepoint() (savepoint, error) {
+	if err := pager.writeDirtyPages(); err != nil {
+		return savepoint{}, err
+	}
+	return savepoint{wal: pager.wal.mark(), numPages: pager.numPages}, nil
+}
 
+// 記録した状態に戻す。キャッシュしたページは、コミットしていない内容を含むかもしれないので全て捨てる
+func (pager *Pager) rollbackTo(sp savepoint) error {
+	pager.frames = map[uint32]*frame{}
+	pager.lru.Init()
+	if err := pager.wal.rollback(sp.wal); err != nil {
+		return err
+	}
+	pager.numPages = sp.numPages
 	return nil
 }
+
+// トランザクションを始める。コミットするまでの変更は、ロールバックで取り消せる
+func (pager *Pager) Begin() error {
+	if pager.inTransaction {
+		return ErrTransactionActive
+	}
+	sp, err := pager.savepoint()
+	if err != nil {
+		return err
+	}
+	pager.transaction = sp
+	pager.inTransaction = true
+	return nil
+}
+
+// トランザクションの途中ならtrue
+func (pager *Pager) InTransaction() bool {
+	return pager.inTransaction
+}
+
+// トランザクションの変更を全て取り消して、トランザクションを終える
+func (pager *Pager) Rollback() error {
+	if !pager.inTransaction {
+		return ErrNoTransaction
+	}
+	pager.inTransaction = false
+	return pager.rollbackTo(pager.transaction)
+}
+
+// ステートメントを始める。ステートメントが失敗したら、RollbackStatementで始めた時点に戻す
+func (pager *Pager) BeginStatement() error {
+	sp, err := pager.savepoint()
+	if err != nil {
+		return err
+	}
+	pager.statement = sp
+	return nil
+}
+
+// BeginStatementからの変更を取り消す。トランザクションは続ける
+func (pager *Pager) RollbackStatement() error {
+	return pager.rollbackTo(pager.statement)
+}
+
+// WALのコミット済みのページを、DBファイルに書き戻す。コミットしていない変更がある場合は、先にコミットする
+func (pager *Pager) Checkpoint() error {
+	if err := pager.Commit(); err != nil {
+		return err
+	}
+	if len(pager.wal.index) == 0 {
+		return nil
+	}
+
+	page := &Page{}
+	for _, pageNum := range pager.wal.committedPages() {
+		if _, err := pager.wal.readPage(pageNum, page); err != nil {
+			return err
+		}
+		if err := pager.writePage(pageNum, page); err != nil {
+			return err
+		}
+	}
+	if err := pager.file.Sync(); err != nil {
+		return err
+	}
+
+	// DBファイルに書き込めたので、WALを空にする
+	return pager.wal.reset()
+}
+
+// ファイルを閉じる
+func (pager *Pager) close() {
+	pager.wal.file.Close()
+	pager.file.Close()
+}
+
+// 変更を書き込まずにファイルを閉じる。WALは残す
+func (pager *Pager) Abandon() {
+	pager.close()
+}
+
+// ページャの内容をディスクに書き込んで、ファイルを閉じる
+func (pager *Pager) FlushPages() error {
+	defer pager.close()
+
+	if err := pager.Checkpoint(); err != nil {
+		return err
+	}
+
+	// 正常に閉じた場合は、WALファイルは必要ない
+	return os.Remove(pager.wal.file.Name())
+}
@@ -0,0 +1,304 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPagerEvictsPagesBeyondCapacity(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	pager, err := InitPager(name, MIN_CACHE_PAGES)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// キャッシュの上限を大きく超えるページを書き込む
+	const numPages = 300
+	for i := uint32(2); i < numPages; i++ {
+		page, pageNum := pager.GetNewPage()
+		if pageNum != i {
+			t.Fatalf("expected new page %d, but got %d", i, pageNum)
+		}
+		binary.LittleEndian.PutUint32(page[100:], pageNum)
+		pager.ReleasePages()
+
+		if pager.NumCachedPages() > MIN_CACHE_PAGES {
+			t.Fatalf("cached %d pages, but capacity is %d", pager.NumCachedPages(), MIN_CACHE_PAGES)
+		}
+	}
+
+	// 追い出したページを読み直しても、書き込んだ内容が残っている
+	for i := uint32(2); i < numPages; i++ {
+		page := pager.GetPage(i)
+		if v := binary.LittleEndian.Uint32(page[100:]); v != i {
+			t.Fatalf("page %d: expected %d, but got %d", i, i, v)
+		}
+		pager.ReleasePages()
+	}
+	if err := pager.FlushPages(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 開き直しても、全てのページが残っている
+	pager, err = InitPager(name, MIN_CACHE_PAGES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pager.numPages != numPages {
+		t.Errorf("expected %d pages, but got %d", numPages, pager.numPages)
+	}
+	page := pager.GetPage(numPages - 1)
+	if v := binary.LittleEndian.Uint32(page[100:]); v != numPages-1 {
+		t.Errorf("expected %d, but got %d", numPages-1, v)
+	}
+	pager.FlushPages()
+}
+
+func TestPagerKeepsPinnedPages(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	pager, err := InitPager(name, MIN_CACHE_PAGES)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1回の操作の中では、上限を超えてもページは追い出されない
+	first := pager.GetPage(1)
+	for i := 0; i < MIN_CACHE_PAGES*2; i++ {
+		pager.GetNewPage()
+	}
+	if pager.GetPage(1) != first {
+		t.Errorf("pinned page was evicted")
+	}
+
+	pager.ReleasePages()
+	if pager.NumCachedPages() != MIN_CACHE_PAGES {
+		t.Errorf("expected %d cached pages, but got %d", MIN_CACHE_PAGES, pager.NumCachedPages())
+	}
+	pager.FlushPages()
+}
+
+// GetPageで読んだだけのページは、追い出してもコミットしてもWALに書き込まない
+func TestPagerWritesOnlyDirtyPages(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	pager, err := InitPager(name, MIN_CACHE_PAGES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+
+	const numPages = 40
+	for i := uint32(2); i < numPages; i++ {
+		pager.GetNewPage()
+		pager.ReleasePages()
+	}
+	if err := pager.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := pager.wal.numFrames
+	for i := uint32(2); i < numPages; i++ {
+		pager.GetPage(i)
+		pager.ReleasePages()
+	}
+	binary.LittleEndian.PutUint32(pager.GetPageForWrite(2)[100:], 42)
+	pager.ReleasePages()
+	if err := pager.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// 変更したページと、ページ数を更新したヘッダページだけを書き込む
+	if written := pager.wal.numFrames - frames; written != 2 {
+		t.Errorf("expected 2 pages written, but got %d", written)
+	}
+}
+
+// キャッシュにあるページを読んでも、読んだ回数に数える
+func TestPagerCountsPageReads(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	pager, err := InitPager(name, MIN_CACHE_PAGES)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := pager.PageReads()
+	pager.GetPage(1)
+	pager.GetPage(1)
+	pager.ReleasePages()
+	if reads := pager.PageReads() - before; reads != 2 {
+		t.Errorf("expected 2 page reads, but got %d", reads)
+	}
+	pager.FlushPages()
+}
+
+func TestInitPagerWritesHeader(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	pager, err := InitPager(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pager.FlushPages(); err != nil {
+		t.Fatal(err)
+	}
+
+	pager, err = InitPager(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+
+	header := pager.GetPage(HEADER_PAGE_NUM)
+	if v := HeaderUtil.GetFormatVersion(header); v != FORMAT_VERSION {
+		t.Errorf("expected format version %d, but got %d", FORMAT_VERSION, v)
+	}
+	if v := HeaderUtil.GetPageSize(header); v != PAGE_SIZE {
+		t.Errorf("expected page size %d, but got %d", PAGE_SIZE, v)
+	}
+	if v := HeaderUtil.GetPageCount(header); v != 2 {
+		t.Errorf("expected page count 2, but got %d", v)
+	}
+	if v := HeaderUtil.GetCatalogRoot(header); v != 1 {
+		t.Errorf("expected catalog root 1, but got %d", v)
+	}
+	if v := HeaderUtil.GetChangeCounter(header); v != 1 {
+		t.Errorf("expected change counter 1, but got %d", v)
+	}
+}
+
+func TestInitPagerRejectsIncompatibleFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// ヘッダのないファイル（古いフォーマット）
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := os.WriteFile(garbage, make([]byte, PAGE_SIZE), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InitPager(garbage, 0); !errors.Is(err, ErrNotDatabase) {
+		t.Errorf("expected ErrNotDatabase, but got %v", err)
+	}
+
+	// バージョンが違うファイル
+	page := &Page{}
+	initHeader(page, 1)
+	HeaderUtil.setUint32(page, HEADER_FORMAT_VERSION_OFFSET, FORMAT_VERSION+1)
+	HeaderUtil.setUint32(page, HEADER_PAGE_COUNT_OFFSET, 1)
+	newer := filepath.Join(dir, "newer.db")
+	if err := os.WriteFile(newer, page[:], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InitPager(newer, 0); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, but got %v", err)
+	}
+}
+
+func TestFreePagesAreReused(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	pager, err := InitPager(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pageNums []uint32
+	for i := 0; i < 3; i++ {
+		_, pageNum := pager.GetNewPage()
+		pageNums = append(pageNums, pageNum)
+	}
+	pager.FreePage(pageNums[0])
+	pager.FreePage(pageNums[2])
+	if n := pager.NumFreePages(); n != 2 {
+		t.Errorf("expected 2 free pages, but got %d", n)
+	}
+	pager.ReleasePages()
+	if err := pager.FlushPages(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 開き直しても空きページリストが残っていて、最後に解放したページから再利用される
+	pager, err = InitPager(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+
+	numPages := pager.NumPages()
+	for _, expected := range []uint32{pageNums[2], pageNums[0], numPages} {
+		page, pageNum := pager.GetNewPage()
+		if pageNum != expected {
+			t.Errorf("expected page %d, but got %d", expected, pageNum)
+		}
+		if *page != (Page{}) {
+			t.Errorf("reused page %d is not empty", pageNum)
+		}
+	}
+	if n := pager.NumFreePages(); n != 0 {
+		t.Errorf("expected no free pages, but got %d", n)
+	}
+}
+
+func TestRollbackRestoresPages(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	pager, err := InitPager(name, MIN_CACHE_PAGES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pager.FlushPages()
+
+	// コミットした状態
+	const numPages = 20
+	for i := uint32(2); i < numPages; i++ {
+		page, pageNum := pager.GetNewPage()
+		binary.LittleEndian.PutUint32(page[100:], pageNum)
+		pager.ReleasePages()
+	}
+	if err := pager.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pager.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pager.Begin(); !errors.Is(err, ErrTransactionActive) {
+		t.Errorf("expected ErrTransactionActive, but got %v", err)
+	}
+	// キャッシュの上限を超えて変更し、コミットしていないページをWALに追い出す
+	for i := uint32(2); i < numPages; i++ {
+		binary.LittleEndian.PutUint32(pager.GetPageForWrite(i)[100:], 1000+i)
+		pager.ReleasePages()
+	}
+	pager.GetNewPage()
+	pager.ReleasePages()
+
+	// ステートメントのロールバックは、ステートメントを始めた後の変更だけを取り消す
+	if err := pager.BeginStatement(); err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(pager.GetPageForWrite(2)[100:], 2000)
+	pager.ReleasePages()
+	if err := pager.RollbackStatement(); err != nil {
+		t.Fatal(err)
+	}
+	if v := binary.LittleEndian.Uint32(pager.GetPage(2)[100:]); v != 1002 {
+		t.Errorf("expected 1002 after the statement rollback, but got %d", v)
+	}
+	pager.ReleasePages()
+
+	if err := pager.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if pager.InTransaction() {
+		t.Errorf("expected the transaction to end")
+	}
+	if pager.NumPages() != numPages {
+		t.Errorf("expected %d pages, but got %d", numPages, pager.NumPages())
+	}
+	for i := uint32(2); i < numPages; i++ {
+		if v := binary.LittleEndian.Uint32(pager.GetPage(i)[100:]); v != i {
+			t.Errorf("page %d: expected %d, but got %d", i, i, v)
+		}
+		pager.ReleasePages()
+	}
+	if err := pager.Rollback(); !errors.Is(err, ErrNoTransaction) {
+		t.Errorf("expected ErrNoTransaction, but got %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package persistence
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// 先行書き込みログ（WAL）。変更したページは、DBファイルを直接書き換えずにWALファイルの末尾に追記する。
+// コミットするときは、ページのイメージを追記した後にコミットレコードを書き込む。
+// 開くときは、コミットレコードまでのフレームを読み直し、それより後ろの（書き込み途中の）フレームは捨てる。
+// チェックポイントで、WALの内容をDBファイルに書き戻す。
+
+// WALファイルの先頭に書き込むマジックバイト
+const WAL_MAGIC = "toydbwal"
+
+// WALのフォーマットのバージョン
+const WAL_FORMAT_VERSION = 1
+
+// コミット済みのフレームがこの数を超えたら、自動でチェックポイントを行う
+const WAL_AUTOCHECKPOINT_FRAMES = 1000
+
+// WAL Header Layout
+const (
+	WAL_MAGIC_SIZE   = 8
+	WAL_MAGIC_OFFSET = 0
+	// WALのフォーマットのバージョン
+	WAL_VERSION_SIZE   = 4
+	WAL_VERSION_OFFSET = WAL_MAGIC_OFFSET + WAL_MAGIC_SIZE
+	// ページサイズ
+	WAL_PAGE_SIZE_SIZE   = 4
+	WAL_PAGE_SIZE_OFFSET = WAL_VERSION_OFFSET + WAL_VERSION_SIZE
+	// WALをリセットするたびに変わる値。リセット前の古いフレームと区別するために使う
+	WAL_SALT_SIZE   = 4
+	WAL_SALT_OFFSET = WAL_PAGE_SIZE_OFFSET + WAL_PAGE_SIZE_SIZE
+	// ヘッダのチェックサム
+	WAL_HEADER_CHECKSUM_SIZE   = 4
+	WAL_HEADER_CHECKSUM_OFFSET = WAL_SALT_OFFSET + WAL_SALT_SIZE
+	WAL_HEADER_SIZE            = WAL_HEADER_CHECKSUM_OFFSET + WAL_HEADER_CHECKSUM_SIZE
+)
+
+// WAL Frame Header Layout
+const (
+	// フレームの種類（ページ / コミット）
+	WAL_FRAME_TYPE_SIZE   = 4
+	WAL_FRAME_TYPE_OFFSET = 0
+	// ページフレームの場合はページ番号、コミットレコードの場合はコミット時のページ数
+	WAL_FRAME_VALUE_SIZE   = 4
+	WAL_FRAME_VALUE_OFFSET = WAL_FRAME_TYPE_OFFSET + WAL_FRAME_TYPE_SIZE
+	// WALヘッダと同じソルト
+	WAL_FRAME_SALT_SIZE   = 4
+	WAL_FRAME_SALT_OFFSET = WAL_FRAME_VALUE_OFFSET + WAL_FRAME_VALUE_SIZE
+	// ヘッダからこのフレームまでの累積のチェックサム
+	WAL_FRAME_CHECKSUM_SIZE   = 4
+	WAL_FRAME_CHECKSUM_OFFSET = WAL_FRAME_SALT_OFFSET + WAL_FRAME_SALT_SIZE
+	WAL_FRAME_HEADER_SIZE     = WAL_FRAME_CHECKSUM_OFFSET + WAL_FRAME_CHECKSUM_SIZE
+)
+
+type walFrameType uint32
+
+const (
+	WAL_FRAME_PAGE walFrameType = iota + 1
+	WAL_FRAME_COMMIT
+)
+
+type wal struct {
+	file *os.File
+	salt uint32
+	// 最後に書き込んだフレームまでの累積のチェックサム
+	checksum uint32
+	// 次にフレームを追記する位置
+	size int64
+	// コミット済みのページ番号から、WALファイル内のページの位置へのマップ
+	index map[uint32]int64
+	// まだコミットしていないページの位置
+	pending map[uint32]int64
+	// コミット済みのフレームの数
+	numFrames int
+	// 最後にコミットしたときのページ数（コミットがない場合は0）
+	pageCount uint32
+}
+
+// WALファイルを開いて、コミット済みのフレームを読み直す
+func openWal(name string) (*wal, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{
+		file:    f,
+		index:   map[uint32]int64{},
+		pending: map[uint32]int64{},
+	}
+
+	header := make([]byte, WAL_HEADER_SIZE)
+	if _, err := f.ReadAt(header, 0); err != nil || string(header[WAL_MAGIC_OFFSET:WAL_MAGIC_OFFSET+WAL_MAGIC_SIZE]) != WAL_MAGIC {
+		// ヘッダが書き込まれる前に終了した場合は、空のWALとして作り直す
+		if err := w.reset(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+
+	if version := binary.LittleEndian.Uint32(header[WAL_VERSION_OFFSET:]); version != WAL_FORMAT_VERSION {
+		f.Close()
+		return nil, fmt.Errorf("%w: unsupported WAL version %d", ErrCorrupt, version)
+	}
+	if pageSize := binary.LittleEndian.Uint32(header[WAL_PAGE_SIZE_OFFSET:]); pageSize != PAGE_SIZE {
+		f.Close()
+		return nil, fmt.Errorf("%w: WAL page size %d", ErrCorrupt, pageSize)
+	}
+	checksum := crc32.ChecksumIEEE(header[:WAL_HEADER_CHECKSUM_OFFSET])
+	if binary.LittleEndian.Uint32(header[WAL_HEADER_CHECKSUM_OFFSET:]) != checksum {
+		if err := w.reset(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+	w.salt = binary.LittleEndian.Uint32(header[WAL_SALT_OFFSET:])
+	w.checksum = checksum
+
+	if err := w.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// コミットレコードまでのフレームを読み直して、インデックスを作る。最後のコミットより後ろは切り捨てる
+func (w *wal) recover() error {
+	pos := int64(WAL_HEADER_SIZE)
+	committedPos := pos
+	committedChecksum := w.checksum
+	checksum := w.checksum
+	pending := map[uint32]int64{}
+	frameHeader := make([]byte, WAL_FRAME_HEADER_SIZE)
+	data := make([]byte, PAGE_SIZE)
+
+	for {
+		if _, err := w.file.ReadAt(frameHeader, pos); err != nil {
+			break
+		}
+		frameType := walFrameType(binary.LittleEndian.Uint32(frameHeader[WAL_FRAME_TYPE_OFFSET:]))
+		value := binary.LittleEndian.Uint32(frameHeader[WAL_FRAME_VALUE_OFFSET:])
+		if binary.LittleEndian.Uint32(frameHeader[WAL_FRAME_SALT_OFFSET:]) != w.salt {
+			break
+		}
+
+		var frameData []byte
+		if frameType == WAL_FRAME_PAGE {
+			if _, err := w.file.ReadAt(data, pos+WAL_FRAME_HEADER_SIZE); err != nil {
+				break
+			}
+			frameData = data
+		} else if frameType != WAL_FRAME_COMMIT {
+			break
+		}
+
+		next := frameChecksum(checksum, frameHeader, frameData)
+		if binary.LittleEndian.Uint32(frameHeader[WAL_FRAME_CHECKSUM_OFFSET:]) != next {
+			// 書き込み途中で終了したフレーム
+			break
+		}
+		checksum = next
+
+		if frameType == WAL_FRAME_PAGE {
+			pending[value] = pos + WAL_FRAME_HEADER_SIZE
+			pos += WAL_FRAME_HEADER_SIZE + PAGE_SIZE
+			continue
+		}
+
+		// コミットレコードまで読めたら、それまでのフレームを有効にする
+		pos += WAL_FRAME_HEADER_SIZE
+		for pageNum, offset := range pending {
+			w.index[pageNum] = offset
+		}
+		w.numFrames += len(pending)
+		pending = map[uint32]int64{}
+		w.pageCount = value
+		committedPos = pos
+		committedChecksum = checksum
+	}
+
+	w.size = committedPos
+	w.checksum = committedChecksum
+	return w.file.Truncate(committedPos)
+}
+
+// フレームのチェックサムを計算する。前のフレームまでのチェックサムに、このフレームの内容を足し込む
+func frameChecksum(prev uint32, frameHeader []byte, data []byte) uint32 {
+	checksum := crc32.Update(prev, crc32.IEEETable, frameHeader[:WAL_FRAME_CHECKSUM_OFFSET])
+	return crc32.Update(checksum, crc32.IEEETable, data)
+}
+
+// WALを空にする。新しいソルトを使うので、古いフレームが残っていても読まれない
+func (w *wal) reset() error {
+	salt := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+
+	header := make([]byte, WAL_HEADER_SIZE)
+	copy(header[WAL_MAGIC_OFFSET:], WAL_MAGIC)
+	binary.LittleEndian.PutUint32(header[WAL_VERSION_OFFSET:], WAL_FORMAT_VERSION)
+	binary.LittleEndian.PutUint32(header[WAL_PAGE_SIZE_OFFSET:], PAGE_SIZE)
+	copy(header[WAL_SALT_OFFSET:], salt)
+	checksum := crc32.ChecksumIEEE(header[:WAL_HEADER_CHECKSUM_OFFSET])
+	binary.LittleEndian.PutUint32(header[WAL_HEADER_CHECKSUM_OFFSET:], checksum)
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	w.salt = binary.LittleEndian.Uint32(salt)
+	w.checksum = checksum
+	w.size = WAL_HEADER_SIZE
+	w.index = map[uint32]int64{}
+	w.pending = map[uint32]int64{}
+	w.numFrames = 0
+	return nil
+}
+
+// フレームを末尾に追記する
+func (w *wal) appendFrame(frameType walFrameType, value uint32, data []byte) error {
+	frame := make([]byte, WAL_FRAME_HEADER_SIZE+len(data))
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_TYPE_OFFSET:], uint32(frameType))
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_VALUE_OFFSET:], value)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_SALT_OFFSET:], w.salt)
+	checksum := frameChecksum(w.checksum, frame, data)
+	binary.LittleEndian.PutUint32(frame[WAL_FRAME_CHECKSUM_OFFSET:], checksum)
+	copy(frame[WAL_FRAME_HEADER_SIZE:], data)
+
+	if _, err := w.file.WriteAt(frame, w.size); err != nil {
+		return err
+	}
+	w.checksum = checksum
+	w.size += int64(len(frame))
+	return nil
+}
+
+// ページのイメージを追記する。コミットするまでは、開き直したときに読まれない
+func (w *wal) appendPage(pageNum uint32, page *Page) error {
+	offset := w.size + WAL_FRAME_HEADER_SIZE
+	if err := w.appendFrame(WAL_FRAME_PAGE, pageNum, page[:]); err != nil {
+		return err
+	}
+	w.pending[pageNum] = offset
+	return nil
+}
+
+// コミットレコードを追記して、ディスクに書き込む
+func (w *wal) commit(pageCount uint32) error {
+	if err := w.appendFrame(WAL_FRAME_COMMIT, pageCount, nil); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	for pageNum, offset := range w.pending {
+		w.index[pageNum] = offset
+	}
+	w.numFrames += len(w.pending)
+	w.pending = map[uint32]int64{}
+	w.pageCount = pageCount
+	return nil
+}
+
+// WALに書き込んだ位置。ロールバックすると、この位置より後ろのフレームを捨てる
+type walMark struct {
+	size     int64
+	checksum uint32
+	pending  map[uint32]int64
+}
+
+// 現在の書き込み位置を返す
+func (w *wal) mark() walMark {
+	pending := make(map[uint32]int64, len(w.pending))
+	for pageNum, offset := range w.pending {
+		pending[pageNum] = offset
+	}
+	return walMark{size: w.size, checksum: w.checksum, pending: pending}
+}
+
+// 書き込み位置をmarkまで戻す。markより後ろに追記した、コミットしていないフレームは読まれなくなる
+func (w *wal) rollback(m walMark) error {
+	if err := w.file.Truncate(m.size); err != nil {
+		return err
+	}
+	w.size = m.size
+	w.checksum = m.checksum
+	w.pending = m.pending
+	return nil
+}
+
+// WALにあるページの最新のイメージを読み取る。WALにない場合はfalseを返す
+func (w *wal) readPage(pageNum uint32, page *Page) (bool, error) {
+	offset, ok := w.pending[pageNum]
+	if !ok {
+		offset, ok = w.index[pageNum]
+	}
+	if !ok {
+		return false, nil
+	}
+
+	_, err := w.file.ReadAt(page[:], offset)
+	return true, err
+}
+
+// コミット済みのページ番号を昇順で返す
+func (w *wal) committedPages() []uint32 {
+	pageNums := make([]uint32, 0, len(w.index))
+	for pageNum := range w.index {
+		pageNums = append(pageNums, pageNum)
+	}
+	sort.Slice(pageNums, func(i, j int) bool { return pageNums[i] < pageNums[j] })
+	return pageNums
+}
@@ -0,0 +1,241 @@
+package sql
+
+// パーサが作る構文木
+
+type Statement interface {
+	statementNode()
+}
+
+type Expr interface {
+	exprNode()
+}
+
+// INSERT INTO table (columns) VALUES (values)
+type InsertStmt struct {
+	// テーブル名。チュートリアル形式（insert 1 name email）の場合は空
+	Table string
+	// カラム名のリスト。省略した場合は空
+	Columns []string
+	Values  []Expr
+	// INSERT OR REPLACE / REPLACE の場合はtrue
+	Replace bool
+}
+
+// SELECT columns FROM table [WHERE expr] [GROUP BY exprs [HAVING expr]] [ORDER BY terms] [LIMIT expr [OFFSET expr]]
+type SelectStmt struct {
+	Columns []ResultColumn
+	// テーブル名。チュートリアル形式（select）の場合は空
+	From string
+	// WHERE句の条件。省略した場合はnil
+	Where Expr
+	// GROUP BY句。省略した場合は空
+	GroupBy []Expr
+	// HAVING句の条件。省略した場合はnil
+	Having Expr
+	// ORDER BY句。省略した場合は空
+	OrderBy []OrderingTerm
+	// LIMIT句とOFFSET句。省略した場合はnil
+	Limit  Expr
+	Offset Expr
+}
+
+// ORDER BY句の1つの項目
+type OrderingTerm struct {
+	Expr Expr
+	// DESCの場合はtrue
+	Desc bool
+}
+
+// UPDATE table SET column = expr, ... [WHERE expr]
+type UpdateStmt struct {
+	Table string
+	Set   []Assignment
+	// WHERE句の条件。省略した場合はnil
+	Where Expr
+}
+
+// DELETE FROM table [WHERE expr]
+type DeleteStmt struct {
+	Table string
+	// WHERE句の条件。省略した場合はnil
+	Where Expr
+}
+
+type TransactionKind int
+
+const (
+	TRANSACTION_BEGIN TransactionKind = iota + 1
+	TRANSACTION_COMMIT
+	TRANSACTION_ROLLBACK
+)
+
+// BEGIN / COMMIT / ROLLBACK [TRANSACTION]
+type TransactionStmt struct {
+	Kind TransactionKind
+}
+
+// PREPARE name [(type, ...)] AS statement
+type PrepareStmt struct {
+	Name string
+	// パラメータの型名（INTEGERなど）。大文字にそろえる。指定しない場合は空
+	Types []string
+	Stmt  Statement
+}
+
+// EXECUTE name [(expr, ...)]
+type ExecuteStmt struct {
+	Name string
+	// パラメータに順番にバインドする値
+	Args []Expr
+}
+
+// DEALLOCATE [PREPARE] name
+type DeallocateStmt struct {
+	Name string
+}
+
+// EXPLAIN [ANALYZE] stmt
+type ExplainStmt struct {
+	// ANALYZEを指定した場合はtrue
+	Analyze bool
+	Stmt    Statement
+}
+
+// SET句の column = expr
+type Assignment struct {
+	Column string
+	Value  Expr
+}
+
+// SELECTの結果のカラム
+type ResultColumn struct {
+	// *の場合はtrue
+	Star bool
+	Expr Expr
+	// AS で指定した別名。指定しない場合は空
+	Alias string
+}
+
+// CREATE TABLE [IF NOT EXISTS] table (column definitions)
+type CreateTableStmt struct {
+	Name        string
+	IfNotExists bool
+	Columns     []ColumnDef
+	// 表制約のPRIMARY KEY (column) で指定したカラム名。指定しない場合は空
+	PrimaryKey string
+}
+
+// CREATE [UNIQUE] INDEX [IF NOT EXISTS] [name] ON table (column)
+type CreateIndexStmt struct {
+	// インデックス名。省略した場合は空
+	Name        string
+	IfNotExists bool
+	Unique      bool
+	Table       string
+	Column      string
+}
+
+// カラムの定義
+type ColumnDef struct {
+	Name string
+	// 型名（INTEGER、TEXTなど）。大文字にそろえる
+	Type string
+	// TEXT(32) のように指定した最大長。指定しない場合は0
+	Length     int
+	PrimaryKey bool
+	NotNull    bool
+}
+
+func (*InsertStmt) statementNode()      {}
+func (*SelectStmt) statementNode()      {}
+func (*CreateTableStmt) statementNode() {}
+func (*CreateIndexStmt) statementNode() {}
+func (*UpdateStmt) statementNode()      {}
+func (*DeleteStmt) statementNode()      {}
+func (*TransactionStmt) statementNode() {}
+func (*PrepareStmt) statementNode()     {}
+func (*ExecuteStmt) statementNode()     {}
+func (*DeallocateStmt) statementNode()  {}
+func (*ExplainStmt) statementNode()     {}
+
+type LiteralKind int
+
+const (
+	LITERAL_INTEGER LiteralKind = iota + 1
+	LITERAL_FLOAT
+	LITERAL_STRING
+	LITERAL_BLOB
+	LITERAL_NULL
+)
+
+// リテラル。Valueは、ソースコード上の表記（文字列の場合はクォートを外したもの、BLOBの場合は16進数）
+type Literal struct {
+	Kind  LiteralKind
+	Value string
+}
+
+// カラムの参照
+type ColumnRef struct {
+	Name string
+}
+
+// 単項演算（-x、+x、NOT x）
+type UnaryExpr struct {
+	Op string
+	X  Expr
+}
+
+// 二項演算。Opは演算子（比較演算子は=と!=にそろえる）か、AND / OR
+type BinaryExpr struct {
+	Op string
+	X  Expr
+	Y  Expr
+}
+
+// x [NOT] IN (list)
+type InExpr struct {
+	X    Expr
+	List []Expr
+	Not  bool
+}
+
+// x [NOT] BETWEEN low AND high
+type BetweenExpr struct {
+	X    Expr
+	Low  Expr
+	High Expr
+	Not  bool
+}
+
+// x IS [NOT] NULL
+type IsNullExpr struct {
+	X   Expr
+	Not bool
+}
+
+// 関数呼び出し（COUNT(*)、SUM(x)など）
+type FuncCall struct {
+	// 関数名。大文字にそろえる
+	Name string
+	Args []Expr
+	// COUNT(*) の場合はtrue
+	Star bool
+}
+
+// パラメータ（?、?NNN、$NNN、:name、@name、$name）。実行する前に値に置き換える。
+// 全てのパラメータは1から始まる番号を持つ。名前付きのパラメータは、名前でも値を対応させられる
+type Param struct {
+	Index int
+	// 記号を除いた名前。番号だけのパラメータの場合は空
+	Name string
+}
+
+func (*Literal) exprNode()     {}
+func (*ColumnRef) exprNode()   {}
+func (*UnaryExpr) exprNode()   {}
+func (*BinaryExpr) exprNode()  {}
+func (*InExpr) exprNode()      {}
+func (*BetweenExpr) exprNode() {}
+func (*IsNullExpr) exprNode()  {}
+func (*FuncCall) exprNode()    {}
+func (*Param) exprNode()       {}
@@ -0,0 +1,76 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 式をSQLの文字列に戻す。結果のカラム名などに使う。
+// 演算の優先順位を保つために、二項演算などの中にある演算は括弧で囲む
+func FormatExpr(expr Expr) string {
+	switch expr := expr.(type) {
+	case *Literal:
+		switch expr.Kind {
+		case LITERAL_STRING:
+			return "'" + strings.ReplaceAll(expr.Value, "'", "''") + "'"
+		case LITERAL_BLOB:
+			return "X'" + expr.Value + "'"
+		case LITERAL_NULL:
+			return "NULL"
+		default:
+			return expr.Value
+		}
+	case *ColumnRef:
+		return QuoteIdent(expr.Name)
+	case *Param:
+		if expr.Name != "" {
+			return ":" + expr.Name
+		}
+		return "?" + strconv.Itoa(expr.Index)
+	case *UnaryExpr:
+		if expr.Op == "NOT" {
+			return "NOT " + formatOperand(expr.X)
+		}
+		return expr.Op + formatOperand(expr.X)
+	case *BinaryExpr:
+		return formatOperand(expr.X) + " " + expr.Op + " " + formatOperand(expr.Y)
+	case *InExpr:
+		items := make([]string, len(expr.List))
+		for i, item := range expr.List {
+			items[i] = FormatExpr(item)
+		}
+		return formatOperand(expr.X) + not(expr.Not) + " IN (" + strings.Join(items, ", ") + ")"
+	case *BetweenExpr:
+		return formatOperand(expr.X) + not(expr.Not) + " BETWEEN " + formatOperand(expr.Low) + " AND " + formatOperand(expr.High)
+	case *IsNullExpr:
+		return formatOperand(expr.X) + " IS" + not(expr.Not) + " NULL"
+	case *FuncCall:
+		if expr.Star {
+			return expr.Name + "(*)"
+		}
+		args := make([]string, len(expr.Args))
+		for i, arg := range expr.Args {
+			args[i] = FormatExpr(arg)
+		}
+		return expr.Name + "(" + strings.Join(args, ", ") + ")"
+	default:
+		return ""
+	}
+}
+
+// 演算の中にある式を文字列に戻す。リテラル、カラム、関数呼び出し、パラメータ以外は括弧で囲む
+func formatOperand(expr Expr) string {
+	switch expr.(type) {
+	case *Literal, *ColumnRef, *FuncCall, *Param:
+		return FormatExpr(expr)
+	default:
+		return "(" + FormatExpr(expr) + ")"
+	}
+}
+
+func not(v bool) string {
+	if v {
+		return " NOT"
+	}
+	return ""
+}
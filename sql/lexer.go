@@ -0,0 +1,367 @@
+package sql
+
+import (
+	"strings"
+	"unicode"
+)
+
+type TokenType int
+
+const (
+	TOKEN_EOF TokenType = iota + 1
+	// 識別子（テーブル名、カラム名など）
+	TOKEN_IDENT
+	// キーワード（SELECTなど）。Textは大文字にそろえる
+	TOKEN_KEYWORD
+	// 整数
+	TOKEN_INTEGER
+	// 小数
+	TOKEN_FLOAT
+	// 文字列（'...'）。Textはクォートを外した中身
+	TOKEN_STRING
+	// BLOB（x'...'）。Textは16進数の文字列
+	TOKEN_BLOB
+	// 演算子と記号
+	TOKEN_OPERATOR
+	// パラメータ（?、?NNN、$NNN、:name、@name、$name）。Textは記号を含めた表記
+	TOKEN_PARAM
+)
+
+type Token struct {
+	Type TokenType
+	Text string
+	// トークンの開始位置（1始まり）
+	Line   int
+	Column int
+}
+
+var keywords = map[string]bool{
+	"SELECT":      true,
+	"FROM":        true,
+	"INSERT":      true,
+	"INTO":        true,
+	"VALUES":      true,
+	"REPLACE":     true,
+	"OR":          true,
+	"NULL":        true,
+	"CREATE":      true,
+	"TABLE":       true,
+	"PRIMARY":     true,
+	"KEY":         true,
+	"NOT":         true,
+	"IF":          true,
+	"EXISTS":      true,
+	"WHERE":       true,
+	"AND":         true,
+	"IN":          true,
+	"BETWEEN":     true,
+	"IS":          true,
+	"UPDATE":      true,
+	"SET":         true,
+	"DELETE":      true,
+	"AS":          true,
+	"ORDER":       true,
+	"BY":          true,
+	"ASC":         true,
+	"DESC":        true,
+	"LIMIT":       true,
+	"OFFSET":      true,
+	"GROUP":       true,
+	"HAVING":      true,
+	"BEGIN":       true,
+	"COMMIT":      true,
+	"ROLLBACK":    true,
+	"TRANSACTION": true,
+	"INDEX":       true,
+	"UNIQUE":      true,
+	"ON":          true,
+	"PREPARE":     true,
+	"EXECUTE":     true,
+	"DEALLOCATE":  true,
+	"EXPLAIN":     true,
+	"ANALYZE":     true,
+}
+
+// 2文字の演算子。1文字の演算子より先に調べる
+var twoCharOperators = []string{"<=", ">=", "<>", "!=", "==", "||"}
+
+const oneCharOperators = "()*,;.+-/%=<>"
+
+// SQLの文字列をトークンに分割する。トークンは、パーサが必要になったときに1つずつ読み取る
+type Lexer struct {
+	input  []rune
+	pos    int
+	line   int
+	column int
+}
+
+func NewLexer(input string) *Lexer {
+	return &Lexer{input: []rune(input), line: 1, column: 1}
+}
+
+// まだ読み取っていない部分の文字列を返す
+func (l *Lexer) Rest() string {
+	return string(l.input[l.pos:])
+}
+
+// 残りの文字列を読み飛ばす
+func (l *Lexer) skipToEnd() {
+	for l.pos < len(l.input) {
+		l.advance()
+	}
+}
+
+func (l *Lexer) peekRune(offset int) rune {
+	if l.pos+offset >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos+offset]
+}
+
+// 1文字進める。改行の場合は行番号を増やす
+func (l *Lexer) advance() rune {
+	r := l.input[l.pos]
+	l.pos++
+	if r == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+	return r
+}
+
+func (l *Lexer) errorf(line int, column int, format string, args ...interface{}) *ParseError {
+	return newParseError(line, column, format, args...)
+}
+
+// 空白とコメントを読み飛ばす
+func (l *Lexer) skipSpacesAndComments() *ParseError {
+	for l.pos < len(l.input) {
+		r := l.peekRune(0)
+		switch {
+		case unicode.IsSpace(r):
+			l.advance()
+		case r == '-' && l.peekRune(1) == '-':
+			// 行コメント
+			for l.pos < len(l.input) && l.peekRune(0) != '\n' {
+				l.advance()
+			}
+		case r == '/' && l.peekRune(1) == '*':
+			// ブロックコメント
+			line, column := l.line, l.column
+			l.advance()
+			l.advance()
+			for {
+				if l.pos >= len(l.input) {
+					return l.errorf(line, column, "unterminated comment")
+				}
+				if l.peekRune(0) == '*' && l.peekRune(1) == '/' {
+					l.advance()
+					l.advance()
+					break
+				}
+				l.advance()
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r)
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+// 次のトークンを読み取る
+func (l *Lexer) Next() (Token, error) {
+	if err := l.skipSpacesAndComments(); err != nil {
+		return Token{}, err
+	}
+
+	token := Token{Line: l.line, Column: l.column}
+	if l.pos >= len(l.input) {
+		token.Type = TOKEN_EOF
+		return token, nil
+	}
+
+	r := l.peekRune(0)
+	switch {
+	case (r == 'x' || r == 'X') && l.peekRune(1) == '\'':
+		l.advance()
+		text, err := l.readQuoted('\'')
+		if err != nil {
+			return Token{}, err
+		}
+		if !isHexString(text) {
+			return Token{}, l.errorf(token.Line, token.Column, "malformed blob literal")
+		}
+		token.Type = TOKEN_BLOB
+		token.Text = text
+		return token, nil
+
+	case isIdentStart(r):
+		start := l.pos
+		for l.pos < len(l.input) && isIdentPart(l.peekRune(0)) {
+			l.advance()
+		}
+		word := string(l.input[start:l.pos])
+		if upper := strings.ToUpper(word); keywords[upper] {
+			token.Type = TOKEN_KEYWORD
+			token.Text = upper
+		} else {
+			token.Type = TOKEN_IDENT
+			token.Text = word
+		}
+		return token, nil
+
+	case isDigit(r) || (r == '.' && isDigit(l.peekRune(1))):
+		return l.readNumber(token)
+
+	case r == '\'':
+		text, err := l.readQuoted('\'')
+		if err != nil {
+			return Token{}, err
+		}
+		token.Type = TOKEN_STRING
+		token.Text = text
+		return token, nil
+
+	case r == '?' || (r == '$' && isDigit(l.peekRune(1))) || ((r == '$' || r == ':' || r == '@') && isIdentStart(l.peekRune(1))):
+		begin := l.pos
+		l.advance()
+		for l.pos < len(l.input) && isIdentPart(l.peekRune(0)) {
+			l.advance()
+		}
+		token.Type = TOKEN_PARAM
+		token.Text = string(l.input[begin:l.pos])
+		return token, nil
+
+	case r == '"' || r == '`':
+		// クォートした識別子
+		text, err := l.readQuoted(r)
+		if err != nil {
+			return Token{}, err
+		}
+		token.Type = TOKEN_IDENT
+		token.Text = text
+		return token, nil
+	}
+
+	rest := string(l.input[l.pos:minInt(l.pos+2, len(l.input))])
+	for _, op := range twoCharOperators {
+		if strings.HasPrefix(rest, op) {
+			l.advance()
+			l.advance()
+			token.Type = TOKEN_OPERATOR
+			token.Text = op
+			return token, nil
+		}
+	}
+	if strings.ContainsRune(oneCharOperators, r) {
+		l.advance()
+		token.Type = TOKEN_OPERATOR
+		token.Text = string(r)
+		return token, nil
+	}
+
+	return Token{}, l.errorf(token.Line, token.Column, "unexpected character %q", r)
+}
+
+// 偶数桁の16進数の文字列ならtrue
+func isHexString(text string) bool {
+	if len(text)%2 != 0 {
+		return false
+	}
+	for _, r := range text {
+		if !isDigit(r) && !('a' <= r && r <= 'f') && !('A' <= r && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// 識別子をSQLに埋め込める形にする。キーワードや記号を含む場合はダブルクォートで囲む
+func QuoteIdent(name string) string {
+	plain := name != "" && !keywords[strings.ToUpper(name)]
+	for i, r := range name {
+		if (i == 0 && !isIdentStart(r)) || !isIdentPart(r) {
+			plain = false
+		}
+	}
+	if plain {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// 数値を読み取る。小数点か指数がある場合は小数になる
+func (l *Lexer) readNumber(token Token) (Token, error) {
+	start := l.pos
+	token.Type = TOKEN_INTEGER
+
+	for isDigit(l.peekRune(0)) {
+		l.advance()
+	}
+	if l.peekRune(0) == '.' {
+		token.Type = TOKEN_FLOAT
+		l.advance()
+		for isDigit(l.peekRune(0)) {
+			l.advance()
+		}
+	}
+	if r := l.peekRune(0); r == 'e' || r == 'E' {
+		next := l.peekRune(1)
+		if isDigit(next) || ((next == '+' || next == '-') && isDigit(l.peekRune(2))) {
+			token.Type = TOKEN_FLOAT
+			l.advance()
+			l.advance()
+			for isDigit(l.peekRune(0)) {
+				l.advance()
+			}
+		}
+	}
+	if isIdentStart(l.peekRune(0)) {
+		return Token{}, l.errorf(l.line, l.column, "unexpected character %q in number", l.peekRune(0))
+	}
+
+	token.Text = string(l.input[start:l.pos])
+	return token, nil
+}
+
+// クォートで囲まれた文字列を読み取る。クォートを2つ続けると、クォート自体を表す
+func (l *Lexer) readQuoted(quote rune) (string, error) {
+	line, column := l.line, l.column
+	l.advance()
+
+	var text []rune
+	for {
+		if l.pos >= len(l.input) {
+			return "", l.errorf(line, column, "unterminated string")
+		}
+		r := l.advance()
+		if r == quote {
+			if l.peekRune(0) != quote {
+				return string(text), nil
+			}
+			l.advance()
+		}
+		text = append(text, r)
+	}
+}
@@ -0,0 +1,113 @@
+package sql
+
+// ステートメントのパラメータを、replaceが返す式に置き換えたコピーを返す。元のステートメントは変更しない。
+// replaceがエラーを返したら、置き換えを止めてエラーを返す
+func ReplaceParams(stmt Statement, replace func(param *Param) (Expr, error)) (Statement, error) {
+	r := &paramReplacer{replace: replace}
+
+	switch stmt := stmt.(type) {
+	case *InsertStmt:
+		s := *stmt
+		s.Values = r.list(stmt.Values)
+		return &s, r.err
+	case *SelectStmt:
+		s := *stmt
+		s.Columns = make([]ResultColumn, len(stmt.Columns))
+		for i, column := range stmt.Columns {
+			column.Expr = r.expr(column.Expr)
+			s.Columns[i] = column
+		}
+		s.Where = r.expr(stmt.Where)
+		s.GroupBy = r.list(stmt.GroupBy)
+		s.Having = r.expr(stmt.Having)
+		s.OrderBy = make([]OrderingTerm, len(stmt.OrderBy))
+		for i, term := range stmt.OrderBy {
+			term.Expr = r.expr(term.Expr)
+			s.OrderBy[i] = term
+		}
+		s.Limit = r.expr(stmt.Limit)
+		s.Offset = r.expr(stmt.Offset)
+		return &s, r.err
+	case *UpdateStmt:
+		s := *stmt
+		s.Set = make([]Assignment, len(stmt.Set))
+		for i, assignment := range stmt.Set {
+			assignment.Value = r.expr(assignment.Value)
+			s.Set[i] = assignment
+		}
+		s.Where = r.expr(stmt.Where)
+		return &s, r.err
+	case *DeleteStmt:
+		s := *stmt
+		s.Where = r.expr(stmt.Where)
+		return &s, r.err
+	case *ExecuteStmt:
+		s := *stmt
+		s.Args = r.list(stmt.Args)
+		return &s, r.err
+	case *ExplainStmt:
+		s := *stmt
+		inner, err := ReplaceParams(stmt.Stmt, replace)
+		s.Stmt = inner
+		return &s, err
+	default:
+		// 式を含まないステートメント。PREPARE文のパラメータは、EXECUTE文でバインドする
+		return stmt, nil
+	}
+}
+
+// 式のパラメータを、replaceが返す式に置き換えたコピーを返す。元の式は変更しない
+func ReplaceExprParams(expr Expr, replace func(param *Param) (Expr, error)) (Expr, error) {
+	r := &paramReplacer{replace: replace}
+	result := r.expr(expr)
+	return result, r.err
+}
+
+type paramReplacer struct {
+	replace func(param *Param) (Expr, error)
+	// 最初に起きたエラー
+	err error
+}
+
+func (r *paramReplacer) list(exprs []Expr) []Expr {
+	if exprs == nil {
+		return nil
+	}
+	result := make([]Expr, len(exprs))
+	for i, expr := range exprs {
+		result[i] = r.expr(expr)
+	}
+	return result
+}
+
+// 式のパラメータを置き換えたコピーを返す。パラメータを含まない部分は、元の式を共有する
+func (r *paramReplacer) expr(expr Expr) Expr {
+	if r.err != nil {
+		return expr
+	}
+
+	switch e := expr.(type) {
+	case *Param:
+		replaced, err := r.replace(e)
+		if err != nil {
+			r.err = err
+			return expr
+		}
+		return replaced
+	case *UnaryExpr:
+		return &UnaryExpr{Op: e.Op, X: r.expr(e.X)}
+	case *BinaryExpr:
+		return &BinaryExpr{Op: e.Op, X: r.expr(e.X), Y: r.expr(e.Y)}
+	case *InExpr:
+		return &InExpr{X: r.expr(e.X), List: r.list(e.List), Not: e.Not}
+	case *BetweenExpr:
+		return &BetweenExpr{X: r.expr(e.X), Low: r.expr(e.Low), High: r.expr(e.High), Not: e.Not}
+	case *IsNullExpr:
+		return &IsNullExpr{X: r.expr(e.X), Not: e.Not}
+	case *FuncCall:
+		return &FuncCall{Name: e.Name, Args: r.list(e.Args), Star: e.Star}
+	default:
+		// リテラル、カラムなど、パラメータを含まない式
+		return expr
+	}
+}
@@ -0,0 +1,1200 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 構文エラー。エラーが起きた位置を持つ
+type ParseError struct {
+	Line    int
+	Column  int
+	Message string
+	// エラーの種類を区別したい場合に設定する
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func newParseError(line int, column int, format string, args ...interface{}) *ParseError {
+	return &ParseError{Line: line, Column: column, Message: fmt.Sprintf(format, args...)}
+}
+
+// 知らないキーワードで始まるステートメント
+var ErrUnrecognizedStatement = errors.New("unrecognized statement")
+
+// パラメータの番号の上限
+const MAX_PARAM_INDEX = 32766
+
+// 再帰下降パーサ
+type Parser struct {
+	lexer *Lexer
+	// 現在のトークン（まだ消費していない）
+	tok Token
+	// これまでに現れたパラメータの最大の番号と、名前付きのパラメータの番号
+	maxParam    int
+	namedParams map[string]int
+}
+
+// SQLをパースして、構文木を返す
+func Parse(input string) (Statement, error) {
+	p := &Parser{lexer: NewLexer(input), namedParams: map[string]int{}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+
+	// 末尾のセミコロンは省略できる
+	if p.isOperator(";") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.tok.Type != TOKEN_EOF {
+		return nil, p.unexpected("end of statement")
+	}
+	return stmt, nil
+}
+
+// 次のトークンに進む
+func (p *Parser) next() error {
+	tok, err := p.lexer.Next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *Parser) isKeyword(keyword string) bool {
+	return p.tok.Type == TOKEN_KEYWORD && p.tok.Text == keyword
+}
+
+func (p *Parser) isOperator(op string) bool {
+	return p.tok.Type == TOKEN_OPERATOR && p.tok.Text == op
+}
+
+// 現在のトークンの説明を返す（エラーメッセージ用）
+func (p *Parser) describe() string {
+	switch p.tok.Type {
+	case TOKEN_EOF:
+		return "end of input"
+	case TOKEN_STRING:
+		return fmt.Sprintf("'%s'", p.tok.Text)
+	default:
+		return fmt.Sprintf("%q", p.tok.Text)
+	}
+}
+
+func (p *Parser) errorf(format string, args ...interface{}) error {
+	return newParseError(p.tok.Line, p.tok.Column, format, args...)
+}
+
+func (p *Parser) unexpected(expected string) error {
+	return p.errorf("expected %s, but got %s", expected, p.describe())
+}
+
+// キーワードを読み取る
+func (p *Parser) expectKeyword(keyword string) error {
+	if !p.isKeyword(keyword) {
+		return p.unexpected(keyword)
+	}
+	return p.next()
+}
+
+// 演算子・記号を読み取る
+func (p *Parser) expectOperator(op string) error {
+	if !p.isOperator(op) {
+		return p.unexpected(fmt.Sprintf("%q", op))
+	}
+	return p.next()
+}
+
+// 識別子を読み取る
+func (p *Parser) expectIdent() (string, error) {
+	if p.tok.Type != TOKEN_IDENT {
+		return "", p.unexpected("identifier")
+	}
+	name := p.tok.Text
+	return name, p.next()
+}
+
+func (p *Parser) parseStatement() (Statement, error) {
+	switch {
+	case p.isKeyword("SELECT"):
+		return p.parseSelect()
+	case p.isKeyword("INSERT"), p.isKeyword("REPLACE"):
+		return p.parseInsert()
+	case p.isKeyword("CREATE"):
+		return p.parseCreate()
+	case p.isKeyword("UPDATE"):
+		return p.parseUpdate()
+	case p.isKeyword("DELETE"):
+		return p.parseDelete()
+	case p.isKeyword("BEGIN"), p.isKeyword("COMMIT"), p.isKeyword("ROLLBACK"):
+		return p.parseTransaction()
+	case p.isKeyword("PREPARE"):
+		return p.parsePrepare()
+	case p.isKeyword("EXECUTE"):
+		return p.parseExecute()
+	case p.isKeyword("DEALLOCATE"):
+		return p.parseDeallocate()
+	case p.isKeyword("EXPLAIN"):
+		return p.parseExplain()
+	default:
+		return nil, &ParseError{
+			Line:    p.tok.Line,
+			Column:  p.tok.Column,
+			Message: fmt.Sprintf("%s starting with %s", ErrUnrecognizedStatement.Error(), p.describe()),
+			Err:     ErrUnrecognizedStatement,
+		}
+	}
+}
+
+// SELECT文をパースする
+//
+//	SELECT * | expr [[AS] alias], ... FROM table [WHERE expr]
+//	  [GROUP BY expr, ... [HAVING expr]] [ORDER BY expr [ASC | DESC], ...] [LIMIT expr [OFFSET expr]]
+//	select（チュートリアル形式）
+func (p *Parser) parseSelect() (Statement, error) {
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	stmt := &SelectStmt{}
+
+	if p.tok.Type == TOKEN_EOF || p.isOperator(";") {
+		// チュートリアル形式
+		stmt.Columns = []ResultColumn{{Star: true}}
+		return stmt, nil
+	}
+
+	for {
+		if p.isOperator("*") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			stmt.Columns = append(stmt.Columns, ResultColumn{Star: true})
+		} else {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			alias, err := p.parseAlias()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Columns = append(stmt.Columns, ResultColumn{Expr: expr, Alias: alias})
+		}
+
+		if !p.isOperator(",") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt.From = name
+
+	where, err := p.parseWhere()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Where = where
+
+	if p.isKeyword("GROUP") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, expr)
+			if !p.isOperator(",") {
+				break
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.isKeyword("HAVING") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if stmt.Having, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+
+	if stmt.OrderBy, err = p.parseOrderBy(); err != nil {
+		return nil, err
+	}
+
+	if p.isKeyword("LIMIT") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if stmt.Limit, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+		// LIMIT count OFFSET skip の他に、LIMIT skip, count の形も使える
+		if p.isKeyword("OFFSET") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if stmt.Offset, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		} else if p.isOperator(",") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			stmt.Offset = stmt.Limit
+			if stmt.Limit, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return stmt, nil
+}
+
+// 結果のカラムの別名をパースする。別名がない場合は空を返す
+func (p *Parser) parseAlias() (string, error) {
+	if p.isKeyword("AS") {
+		if err := p.next(); err != nil {
+			return "", err
+		}
+		return p.expectIdent()
+	}
+	if p.tok.Type == TOKEN_IDENT {
+		return p.expectIdent()
+	}
+	return "", nil
+}
+
+// ORDER BY句をパースする。ORDER BY句がない場合はnilを返す
+func (p *Parser) parseOrderBy() ([]OrderingTerm, error) {
+	if !p.isKeyword("ORDER") {
+		return nil, nil
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("BY"); err != nil {
+		return nil, err
+	}
+
+	var terms []OrderingTerm
+	for {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		term := OrderingTerm{Expr: expr}
+		if p.isKeyword("ASC") || p.isKeyword("DESC") {
+			term.Desc = p.isKeyword("DESC")
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		terms = append(terms, term)
+
+		if !p.isOperator(",") {
+			return terms, nil
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WHERE句をパースする。WHERE句がない場合はnilを返す
+func (p *Parser) parseWhere() (Expr, error) {
+	if !p.isKeyword("WHERE") {
+		return nil, nil
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	return p.parseExpr()
+}
+
+var transactionKinds = map[string]TransactionKind{
+	"BEGIN":    TRANSACTION_BEGIN,
+	"COMMIT":   TRANSACTION_COMMIT,
+	"ROLLBACK": TRANSACTION_ROLLBACK,
+}
+
+// トランザクションの文をパースする
+//
+//	BEGIN [TRANSACTION]
+//	COMMIT [TRANSACTION]
+//	ROLLBACK [TRANSACTION]
+func (p *Parser) parseTransaction() (Statement, error) {
+	stmt := &TransactionStmt{Kind: transactionKinds[p.tok.Text]}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.isKeyword("TRANSACTION") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// PREPARE文をパースする。準備するステートメントは、PREPARE文とEXECUTE文とDEALLOCATE文以外
+//
+//	PREPARE name [(type, ...)] AS statement
+func (p *Parser) parsePrepare() (Statement, error) {
+	if err := p.expectKeyword("PREPARE"); err != nil {
+		return nil, err
+	}
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &PrepareStmt{Name: name}
+
+	if p.isOperator("(") {
+		types, err := p.parseIdentList()
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range types {
+			stmt.Types = append(stmt.Types, strings.ToUpper(t))
+		}
+	}
+	if err := p.expectKeyword("AS"); err != nil {
+		return nil, err
+	}
+	if p.isKeyword("PREPARE") || p.isKeyword("EXECUTE") || p.isKeyword("DEALLOCATE") {
+		return nil, p.errorf("cannot prepare %s", p.tok.Text)
+	}
+	if stmt.Stmt, err = p.parseStatement(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// EXECUTE文をパースする
+//
+//	EXECUTE name [(expr, ...)]
+func (p *Parser) parseExecute() (Statement, error) {
+	if err := p.expectKeyword("EXECUTE"); err != nil {
+		return nil, err
+	}
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &ExecuteStmt{Name: name}
+
+	if p.isOperator("(") {
+		if stmt.Args, err = p.parseExprList(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// DEALLOCATE文をパースする
+//
+//	DEALLOCATE [PREPARE] name
+func (p *Parser) parseDeallocate() (Statement, error) {
+	if err := p.expectKeyword("DEALLOCATE"); err != nil {
+		return nil, err
+	}
+	if p.isKeyword("PREPARE") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	return &DeallocateStmt{Name: name}, nil
+}
+
+// DELETE文をパースする
+//
+//	DELETE FROM table [WHERE expr]
+func (p *Parser) parseDelete() (Statement, error) {
+	if err := p.expectKeyword("DELETE"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &DeleteStmt{Table: name}
+
+	where, err := p.parseWhere()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Where = where
+
+	return stmt, nil
+}
+
+// UPDATE文をパースする
+//
+//	UPDATE table SET column = expr, ... [WHERE expr]
+func (p *Parser) parseUpdate() (Statement, error) {
+	if err := p.expectKeyword("UPDATE"); err != nil {
+		return nil, err
+	}
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &UpdateStmt{Table: name}
+
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		column, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectOperator("="); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Set = append(stmt.Set, Assignment{Column: column, Value: value})
+
+		if !p.isOperator(",") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	where, err := p.parseWhere()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Where = where
+
+	return stmt, nil
+}
+
+// INSERT文をパースする
+//
+//	INSERT [OR REPLACE] INTO table [(columns)] VALUES (values)
+//	REPLACE INTO table [(columns)] VALUES (values)
+//	insert 1 name email（チュートリアル形式）
+func (p *Parser) parseInsert() (Statement, error) {
+	stmt := &InsertStmt{Replace: p.isKeyword("REPLACE")}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.tok.Type == TOKEN_INTEGER || p.isOperator("-") {
+		return p.parseLegacyInsert(stmt)
+	}
+
+	if !stmt.Replace && p.isKeyword("OR") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("REPLACE"); err != nil {
+			return nil, err
+		}
+		stmt.Replace = true
+	}
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Table = name
+
+	if p.isOperator("(") {
+		columns, err := p.parseIdentList()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = columns
+	}
+
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	values, err := p.parseExprList()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Values = values
+
+	return stmt, nil
+}
+
+// チュートリアル形式のinsert（insert 1 name email）をパースする。
+// 名前とメールアドレスには記号が含まれるので、トークンに分割せずに残りの文字列を空白で区切って使う
+func (p *Parser) parseLegacyInsert(stmt *InsertStmt) (Statement, error) {
+	line, column := p.tok.Line, p.tok.Column
+	words := strings.Fields(p.lexer.Rest())
+
+	id := p.tok.Text
+	if p.isOperator("-") {
+		if len(words) == 0 {
+			return nil, p.unexpected("id")
+		}
+		id, words = words[0], words[1:]
+	}
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil || len(words) != 2 {
+		return nil, newParseError(line, column, "expected id, name and email")
+	}
+
+	var idExpr Expr = &Literal{Kind: LITERAL_INTEGER, Value: id}
+	if p.isOperator("-") {
+		idExpr = &UnaryExpr{Op: "-", X: idExpr}
+	}
+	stmt.Values = []Expr{
+		idExpr,
+		&Literal{Kind: LITERAL_STRING, Value: words[0]},
+		&Literal{Kind: LITERAL_STRING, Value: words[1]},
+	}
+
+	p.lexer.skipToEnd()
+	return stmt, p.next()
+}
+
+// CREATE文をパースする。CREATEの後のキーワードで、CREATE TABLE文かCREATE INDEX文に分ける
+func (p *Parser) parseCreate() (Statement, error) {
+	if err := p.expectKeyword("CREATE"); err != nil {
+		return nil, err
+	}
+	if p.isKeyword("UNIQUE") || p.isKeyword("INDEX") {
+		return p.parseCreateIndex()
+	}
+	return p.parseCreateTable()
+}
+
+// IF NOT EXISTS があれば読み取ってtrueを返す
+func (p *Parser) parseIfNotExists() (bool, error) {
+	if !p.isKeyword("IF") {
+		return false, nil
+	}
+	if err := p.next(); err != nil {
+		return false, err
+	}
+	if err := p.expectKeyword("NOT"); err != nil {
+		return false, err
+	}
+	if err := p.expectKeyword("EXISTS"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CREATE TABLE文のCREATEより後をパースする
+//
+//	CREATE TABLE [IF NOT EXISTS] table (
+//	  column type [(length)] [PRIMARY KEY] [NOT NULL], ...
+//	  [, PRIMARY KEY (column)]
+//	)
+func (p *Parser) parseCreateTable() (Statement, error) {
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	stmt := &CreateTableStmt{}
+
+	ifNotExists, err := p.parseIfNotExists()
+	if err != nil {
+		return nil, err
+	}
+	stmt.IfNotExists = ifNotExists
+
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Name = name
+
+	if err := p.expectOperator("("); err != nil {
+		return nil, err
+	}
+	for {
+		if p.isKeyword("PRIMARY") {
+			// 表制約
+			if stmt.PrimaryKey != "" {
+				return nil, p.errorf("multiple primary keys")
+			}
+			if err := p.parsePrimaryKeyClause(); err != nil {
+				return nil, err
+			}
+			columns, err := p.parseIdentList()
+			if err != nil {
+				return nil, err
+			}
+			if len(columns) != 1 {
+				return nil, p.errorf("primary key must be a single column")
+			}
+			stmt.PrimaryKey = columns[0]
+		} else {
+			column, err := p.parseColumnDef()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Columns = append(stmt.Columns, column)
+		}
+
+		if !p.isOperator(",") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectOperator(")"); err != nil {
+		return nil, err
+	}
+
+	return stmt, nil
+}
+
+// CREATE INDEX文のCREATEより後をパースする
+//
+//	CREATE [UNIQUE] INDEX [IF NOT EXISTS] [name] ON table (column)
+func (p *Parser) parseCreateIndex() (Statement, error) {
+	stmt := &CreateIndexStmt{}
+	if p.isKeyword("UNIQUE") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		stmt.Unique = true
+	}
+	if err := p.expectKeyword("INDEX"); err != nil {
+		return nil, err
+	}
+
+	ifNotExists, err := p.parseIfNotExists()
+	if err != nil {
+		return nil, err
+	}
+	stmt.IfNotExists = ifNotExists
+
+	if !p.isKeyword("ON") {
+		name, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Name = name
+	}
+	if err := p.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Table = table
+
+	columns, err := p.parseIdentList()
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) != 1 {
+		return nil, p.errorf("index must be on a single column")
+	}
+	stmt.Column = columns[0]
+	return stmt, nil
+}
+
+// PRIMARY KEY を読み取る
+func (p *Parser) parsePrimaryKeyClause() error {
+	if err := p.expectKeyword("PRIMARY"); err != nil {
+		return err
+	}
+	return p.expectKeyword("KEY")
+}
+
+// カラムの定義をパースする
+func (p *Parser) parseColumnDef() (ColumnDef, error) {
+	name, err := p.expectIdent()
+	if err != nil {
+		return ColumnDef{}, err
+	}
+	typeName, err := p.expectIdent()
+	if err != nil {
+		return ColumnDef{}, err
+	}
+	column := ColumnDef{Name: name, Type: strings.ToUpper(typeName)}
+
+	if p.isOperator("(") {
+		if err := p.next(); err != nil {
+			return ColumnDef{}, err
+		}
+		if p.tok.Type != TOKEN_INTEGER {
+			return ColumnDef{}, p.unexpected("length")
+		}
+		length, err := strconv.Atoi(p.tok.Text)
+		if err != nil || length <= 0 {
+			return ColumnDef{}, p.errorf("invalid length %s", p.tok.Text)
+		}
+		column.Length = length
+		if err := p.next(); err != nil {
+			return ColumnDef{}, err
+		}
+		if err := p.expectOperator(")"); err != nil {
+			return ColumnDef{}, err
+		}
+	}
+
+	for {
+		switch {
+		case p.isKeyword("PRIMARY"):
+			if err := p.parsePrimaryKeyClause(); err != nil {
+				return ColumnDef{}, err
+			}
+			column.PrimaryKey = true
+		case p.isKeyword("NOT"):
+			if err := p.next(); err != nil {
+				return ColumnDef{}, err
+			}
+			if err := p.expectKeyword("NULL"); err != nil {
+				return ColumnDef{}, err
+			}
+			column.NotNull = true
+		default:
+			return column, nil
+		}
+	}
+}
+
+// (a, b, c) をパースする
+func (p *Parser) parseIdentList() ([]string, error) {
+	if err := p.expectOperator("("); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for {
+		name, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+
+		if !p.isOperator(",") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expectOperator(")"); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// (expr, expr, ...) をパースする
+func (p *Parser) parseExprList() ([]Expr, error) {
+	if err := p.expectOperator("("); err != nil {
+		return nil, err
+	}
+
+	var exprs []Expr
+	for {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+
+		if !p.isOperator(",") {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expectOperator(")"); err != nil {
+		return nil, err
+	}
+	return exprs, nil
+}
+
+// 式をパースする。演算子の優先順位は低いものから
+//
+//	OR
+//	AND
+//	NOT
+//	=, !=, <, <=, >, >=, IS [NOT] NULL, [NOT] IN, [NOT] BETWEEN
+//	+, -, ||
+//	*, /, %
+//	単項の -, +
+func (p *Parser) parseExpr() (Expr, error) {
+	return p.parseOr()
+}
+
+func (p *Parser) parseOr() (Expr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = &BinaryExpr{Op: "OR", X: x, Y: y}
+	}
+	return x, nil
+}
+
+func (p *Parser) parseAnd() (Expr, error) {
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		y, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		x = &BinaryExpr{Op: "AND", X: x, Y: y}
+	}
+	return x, nil
+}
+
+func (p *Parser) parseNot() (Expr, error) {
+	if p.isKeyword("NOT") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: "NOT", X: x}, nil
+	}
+	return p.parseComparison()
+}
+
+// 比較演算子。同じ意味の演算子は1つにそろえる
+var comparisonOperators = map[string]string{
+	"=": "=", "==": "=", "!=": "!=", "<>": "!=", "<": "<", "<=": "<=", ">": ">", ">=": ">=",
+}
+
+func (p *Parser) parseComparison() (Expr, error) {
+	x, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if op, ok := comparisonOperators[p.tok.Text]; ok && p.tok.Type == TOKEN_OPERATOR {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			y, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			x = &BinaryExpr{Op: op, X: x, Y: y}
+			continue
+		}
+
+		if p.isKeyword("IS") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			expr := &IsNullExpr{X: x}
+			if p.isKeyword("NOT") {
+				expr.Not = true
+				if err := p.next(); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.expectKeyword("NULL"); err != nil {
+				return nil, err
+			}
+			x = expr
+			continue
+		}
+
+		not := false
+		if p.isKeyword("NOT") {
+			// NOT IN / NOT BETWEEN
+			not = true
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if !p.isKeyword("IN") && !p.isKeyword("BETWEEN") {
+				return nil, p.unexpected("IN or BETWEEN")
+			}
+		}
+		switch {
+		case p.isKeyword("IN"):
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			list, err := p.parseExprList()
+			if err != nil {
+				return nil, err
+			}
+			x = &InExpr{X: x, List: list, Not: not}
+		case p.isKeyword("BETWEEN"):
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			low, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectKeyword("AND"); err != nil {
+				return nil, err
+			}
+			high, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			x = &BetweenExpr{X: x, Low: low, High: high, Not: not}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *Parser) parseAdditive() (Expr, error) {
+	x, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("+") || p.isOperator("-") || p.isOperator("||") {
+		op := p.tok.Text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		y, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		x = &BinaryExpr{Op: op, X: x, Y: y}
+	}
+	return x, nil
+}
+
+func (p *Parser) parseMultiplicative() (Expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("*") || p.isOperator("/") || p.isOperator("%") {
+		op := p.tok.Text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = &BinaryExpr{Op: op, X: x, Y: y}
+	}
+	return x, nil
+}
+
+// 単項演算をパースする
+func (p *Parser) parseUnary() (Expr, error) {
+	if p.isOperator("-") || p.isOperator("+") {
+		op := p.tok.Text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: op, X: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+// リテラル、カラム、括弧で囲まれた式をパースする
+func (p *Parser) parsePrimary() (Expr, error) {
+	tok := p.tok
+	switch {
+	case tok.Type == TOKEN_INTEGER:
+		return &Literal{Kind: LITERAL_INTEGER, Value: tok.Text}, p.next()
+	case tok.Type == TOKEN_FLOAT:
+		return &Literal{Kind: LITERAL_FLOAT, Value: tok.Text}, p.next()
+	case tok.Type == TOKEN_STRING:
+		return &Literal{Kind: LITERAL_STRING, Value: tok.Text}, p.next()
+	case tok.Type == TOKEN_BLOB:
+		return &Literal{Kind: LITERAL_BLOB, Value: tok.Text}, p.next()
+	case p.isKeyword("NULL"):
+		return &Literal{Kind: LITERAL_NULL}, p.next()
+	case tok.Type == TOKEN_PARAM:
+		return p.parseParam()
+	case tok.Type == TOKEN_IDENT:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.isOperator("(") {
+			return p.parseFuncCall(tok.Text)
+		}
+		return &ColumnRef{Name: tok.Text}, nil
+	case p.isOperator("("):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expectOperator(")")
+	default:
+		return nil, p.unexpected("expression")
+	}
+}
+
+// パラメータをパースする。番号のない?は、それまでの最大の番号の次の番号になる。
+// 名前付きのパラメータは、最初に現れたときに同じように番号をつけて、同じ名前には同じ番号を使う
+//
+//	? | ?NNN | $NNN | :name | @name | $name
+func (p *Parser) parseParam() (Expr, error) {
+	prefix, rest := p.tok.Text[:1], p.tok.Text[1:]
+	param := &Param{}
+	switch {
+	case rest == "" && prefix == "?":
+		param.Index = p.maxParam + 1
+	case isDigit(rune(rest[0])) && (prefix == "?" || prefix == "$"):
+		index, err := strconv.Atoi(rest)
+		if err != nil || index < 1 || index > MAX_PARAM_INDEX {
+			return nil, p.errorf("parameter number must be between 1 and %d: %s", MAX_PARAM_INDEX, p.tok.Text)
+		}
+		param.Index = index
+	case !isDigit(rune(rest[0])) && prefix != "?":
+		param.Name = rest
+		index, ok := p.namedParams[rest]
+		if !ok {
+			index = p.maxParam + 1
+			p.namedParams[rest] = index
+		}
+		param.Index = index
+	default:
+		return nil, p.errorf("malformed parameter %s", p.tok.Text)
+	}
+	if param.Index > MAX_PARAM_INDEX {
+		return nil, p.errorf("too many parameters")
+	}
+	if param.Index > p.maxParam {
+		p.maxParam = param.Index
+	}
+	return param, p.next()
+}
+
+// 関数呼び出しの引数をパースする。関数名は読み終えている
+//
+//	name(*) | name() | name(expr, ...)
+func (p *Parser) parseFuncCall(name string) (Expr, error) {
+	call := &FuncCall{Name: strings.ToUpper(name)}
+	if err := p.expectOperator("("); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.isOperator("*"):
+		call.Star = true
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	case p.isOperator(")"):
+	default:
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, arg)
+			if !p.isOperator(",") {
+				break
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return call, p.expectOperator(")")
+}
+
+// EXPLAIN文をパースする。説明できるのは、行を読むステートメントだけ。
+// ANALYZEはステートメントを実行するので、書き込まないSELECT文だけに使える
+//
+//	EXPLAIN [ANALYZE] select-stmt | update-stmt | delete-stmt
+func (p *Parser) parseExplain() (Statement, error) {
+	if err := p.expectKeyword("EXPLAIN"); err != nil {
+		return nil, err
+	}
+	stmt := &ExplainStmt{}
+	if p.isKeyword("ANALYZE") {
+		stmt.Analyze = true
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case p.isKeyword("SELECT"):
+	case !stmt.Analyze && (p.isKeyword("UPDATE") || p.isKeyword("DELETE")):
+	case stmt.Analyze:
+		return nil, p.errorf("EXPLAIN ANALYZE supports only SELECT, but got %s", p.describe())
+	default:
+		return nil, p.errorf("EXPLAIN supports only SELECT, UPDATE and DELETE, but got %s", p.describe())
+	}
+	var err error
+	if stmt.Stmt, err = p.parseStatement(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
@@ -0,0 +1,588 @@
+package sql
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestLexer(t *testing.T) {
+	input := "SELECT a, 'it''s' -- comment\n FROM t /* block */ WHERE x <= 1.5e3"
+	expected := []Token{
+		{Type: TOKEN_KEYWORD, Text: "SELECT", Line: 1, Column: 1},
+		{Type: TOKEN_IDENT, Text: "a", Line: 1, Column: 8},
+		{Type: TOKEN_OPERATOR, Text: ",", Line: 1, Column: 9},
+		{Type: TOKEN_STRING, Text: "it's", Line: 1, Column: 11},
+		{Type: TOKEN_KEYWORD, Text: "FROM", Line: 2, Column: 2},
+		{Type: TOKEN_IDENT, Text: "t", Line: 2, Column: 7},
+		{Type: TOKEN_KEYWORD, Text: "WHERE", Line: 2, Column: 21},
+		{Type: TOKEN_IDENT, Text: "x", Line: 2, Column: 27},
+		{Type: TOKEN_OPERATOR, Text: "<=", Line: 2, Column: 29},
+		{Type: TOKEN_FLOAT, Text: "1.5e3", Line: 2, Column: 32},
+		{Type: TOKEN_EOF, Line: 2, Column: 37},
+	}
+
+	lexer := NewLexer(input)
+	for _, e := range expected {
+		tok, err := lexer.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok != e {
+			t.Errorf("expected %+v, but got %+v", e, tok)
+		}
+	}
+}
+
+func TestParseInsert(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Statement
+	}{
+		{
+			"insert into users values (1, 'John Smith', 'john@example.com');",
+			&InsertStmt{
+				Table: "users",
+				Values: []Expr{
+					&Literal{Kind: LITERAL_INTEGER, Value: "1"},
+					&Literal{Kind: LITERAL_STRING, Value: "John Smith"},
+					&Literal{Kind: LITERAL_STRING, Value: "john@example.com"},
+				},
+			},
+		},
+		{
+			"INSERT OR REPLACE INTO users (id, email) VALUES (-2, NULL)",
+			&InsertStmt{
+				Table:   "users",
+				Columns: []string{"id", "email"},
+				Values: []Expr{
+					&UnaryExpr{Op: "-", X: &Literal{Kind: LITERAL_INTEGER, Value: "2"}},
+					&Literal{Kind: LITERAL_NULL},
+				},
+				Replace: true,
+			},
+		},
+		{
+			// チュートリアル形式
+			"insert 1 user1 person1@example.com",
+			&InsertStmt{
+				Values: []Expr{
+					&Literal{Kind: LITERAL_INTEGER, Value: "1"},
+					&Literal{Kind: LITERAL_STRING, Value: "user1"},
+					&Literal{Kind: LITERAL_STRING, Value: "person1@example.com"},
+				},
+			},
+		},
+		{
+			"replace -1 select it's",
+			&InsertStmt{
+				Values: []Expr{
+					&UnaryExpr{Op: "-", X: &Literal{Kind: LITERAL_INTEGER, Value: "1"}},
+					&Literal{Kind: LITERAL_STRING, Value: "select"},
+					&Literal{Kind: LITERAL_STRING, Value: "it's"},
+				},
+				Replace: true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		stmt, err := Parse(test.input)
+		if err != nil {
+			t.Errorf("%s: %s", test.input, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(stmt, test.expected) {
+			t.Errorf("%s: expected %+v, but got %+v", test.input, test.expected, stmt)
+		}
+	}
+}
+
+func TestParseSelect(t *testing.T) {
+	stmt, err := Parse("select * from users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &SelectStmt{Columns: []ResultColumn{{Star: true}}, From: "users"}
+	if !reflect.DeepEqual(stmt, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, stmt)
+	}
+
+	// チュートリアル形式
+	stmt, err = Parse("select")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = &SelectStmt{Columns: []ResultColumn{{Star: true}}}
+	if !reflect.DeepEqual(stmt, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, stmt)
+	}
+}
+
+func TestParseOrderByAndLimit(t *testing.T) {
+	integer := func(v string) Expr { return &Literal{Kind: LITERAL_INTEGER, Value: v} }
+	tests := []struct {
+		input    string
+		expected *SelectStmt
+	}{
+		{
+			"select id, username as name, email e from users order by name desc, id limit 10 offset 5",
+			&SelectStmt{
+				Columns: []ResultColumn{
+					{Expr: &ColumnRef{Name: "id"}},
+					{Expr: &ColumnRef{Name: "username"}, Alias: "name"},
+					{Expr: &ColumnRef{Name: "email"}, Alias: "e"},
+				},
+				From:    "users",
+				OrderBy: []OrderingTerm{{Expr: &ColumnRef{Name: "name"}, Desc: true}, {Expr: &ColumnRef{Name: "id"}}},
+				Limit:   integer("10"),
+				Offset:  integer("5"),
+			},
+		},
+		{
+			// LIMIT skip, count
+			"select * from users where id > 1 order by 2 asc limit 5, 10",
+			&SelectStmt{
+				Columns: []ResultColumn{{Star: true}},
+				From:    "users",
+				Where:   &BinaryExpr{Op: ">", X: &ColumnRef{Name: "id"}, Y: integer("1")},
+				OrderBy: []OrderingTerm{{Expr: integer("2")}},
+				Limit:   integer("10"),
+				Offset:  integer("5"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		stmt, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("%s: %v", test.input, err)
+		}
+		if !reflect.DeepEqual(stmt, test.expected) {
+			t.Errorf("%s: expected %+v, but got %+v", test.input, test.expected, stmt)
+		}
+	}
+
+	for _, input := range []string{"select * from users order id", "select * from users limit", "select id as from users"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("%s: expected a syntax error", input)
+		}
+	}
+}
+
+func TestParseGroupBy(t *testing.T) {
+	stmt, err := Parse("select name, count(*), sum(price * 2) from items group by name, id having count(*) > 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &SelectStmt{
+		Columns: []ResultColumn{
+			{Expr: &ColumnRef{Name: "name"}},
+			{Expr: &FuncCall{Name: "COUNT", Star: true}},
+			{Expr: &FuncCall{Name: "SUM", Args: []Expr{
+				&BinaryExpr{Op: "*", X: &ColumnRef{Name: "price"}, Y: &Literal{Kind: LITERAL_INTEGER, Value: "2"}},
+			}}},
+		},
+		From:    "items",
+		GroupBy: []Expr{&ColumnRef{Name: "name"}, &ColumnRef{Name: "id"}},
+		Having:  &BinaryExpr{Op: ">", X: &FuncCall{Name: "COUNT", Star: true}, Y: &Literal{Kind: LITERAL_INTEGER, Value: "1"}},
+	}
+	if !reflect.DeepEqual(stmt, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, stmt)
+	}
+
+	for _, input := range []string{"select count(* from items", "select * from items group name", "select max(a,) from items"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("%s: expected a syntax error", input)
+		}
+	}
+}
+
+func TestParseTransaction(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected TransactionKind
+	}{
+		{"begin", TRANSACTION_BEGIN},
+		{"BEGIN TRANSACTION;", TRANSACTION_BEGIN},
+		{"commit", TRANSACTION_COMMIT},
+		{"rollback transaction", TRANSACTION_ROLLBACK},
+	}
+	for _, test := range tests {
+		stmt, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("%s: %v", test.input, err)
+		}
+		if !reflect.DeepEqual(stmt, &TransactionStmt{Kind: test.expected}) {
+			t.Errorf("%s: expected kind %d, but got %+v", test.input, test.expected, stmt)
+		}
+	}
+
+	if _, err := Parse("begin work"); err == nil {
+		t.Errorf("expected a syntax error")
+	}
+}
+
+func TestParseCreateIndex(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected *CreateIndexStmt
+	}{
+		{"create index on users(email)", &CreateIndexStmt{Table: "users", Column: "email"}},
+		{"CREATE UNIQUE INDEX IF NOT EXISTS by_email ON users (email);", &CreateIndexStmt{Name: "by_email", IfNotExists: true, Unique: true, Table: "users", Column: "email"}},
+	}
+	for _, test := range tests {
+		stmt, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("%s: %v", test.input, err)
+		}
+		if !reflect.DeepEqual(stmt, test.expected) {
+			t.Errorf("%s: expected %+v, but got %+v", test.input, test.expected, stmt)
+		}
+	}
+
+	for _, input := range []string{"create index i on t(a, b)", "create unique table t(a integer)", "create index i t(a)"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("%s: expected a syntax error", input)
+		}
+	}
+}
+
+func TestParseWhere(t *testing.T) {
+	stmt, err := Parse("select * from t where not a + 1 * 2 >= 3 and b is not null or c not between 1 and 2 and d in (1, 'x')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	integer := func(v string) Expr { return &Literal{Kind: LITERAL_INTEGER, Value: v} }
+	expected := &SelectStmt{
+		Columns: []ResultColumn{{Star: true}},
+		From:    "t",
+		Where: &BinaryExpr{
+			Op: "OR",
+			X: &BinaryExpr{
+				Op: "AND",
+				X: &UnaryExpr{Op: "NOT", X: &BinaryExpr{
+					Op: ">=",
+					X:  &BinaryExpr{Op: "+", X: &ColumnRef{Name: "a"}, Y: &BinaryExpr{Op: "*", X: integer("1"), Y: integer("2")}},
+					Y:  integer("3"),
+				}},
+				Y: &IsNullExpr{X: &ColumnRef{Name: "b"}, Not: true},
+			},
+			Y: &BinaryExpr{
+				Op: "AND",
+				X:  &BetweenExpr{X: &ColumnRef{Name: "c"}, Low: integer("1"), High: integer("2"), Not: true},
+				Y:  &InExpr{X: &ColumnRef{Name: "d"}, List: []Expr{integer("1"), &Literal{Kind: LITERAL_STRING, Value: "x"}}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(stmt, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, stmt)
+	}
+
+	// 比較演算子はそろえる
+	stmt, err = Parse("select * from t where a <> 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if where := stmt.(*SelectStmt).Where.(*BinaryExpr); where.Op != "!=" {
+		t.Errorf("expected !=, but got %s", where.Op)
+	}
+}
+
+func TestParseUpdate(t *testing.T) {
+	stmt, err := Parse("update users set email = 'x@example.com', id = id + 1 where id = 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &UpdateStmt{
+		Table: "users",
+		Set: []Assignment{
+			{Column: "email", Value: &Literal{Kind: LITERAL_STRING, Value: "x@example.com"}},
+			{Column: "id", Value: &BinaryExpr{Op: "+", X: &ColumnRef{Name: "id"}, Y: &Literal{Kind: LITERAL_INTEGER, Value: "1"}}},
+		},
+		Where: &BinaryExpr{Op: "=", X: &ColumnRef{Name: "id"}, Y: &Literal{Kind: LITERAL_INTEGER, Value: "3"}},
+	}
+	if !reflect.DeepEqual(stmt, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, stmt)
+	}
+
+	if _, err := Parse("update users set where id = 1"); err == nil {
+		t.Error("expected an error for an empty SET clause")
+	}
+}
+
+func TestParseDelete(t *testing.T) {
+	stmt, err := Parse("DELETE FROM users WHERE id > 1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &DeleteStmt{
+		Table: "users",
+		Where: &BinaryExpr{Op: ">", X: &ColumnRef{Name: "id"}, Y: &Literal{Kind: LITERAL_INTEGER, Value: "1"}},
+	}
+	if !reflect.DeepEqual(stmt, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, stmt)
+	}
+
+	stmt, err = Parse("delete from users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stmt, &DeleteStmt{Table: "users"}) {
+		t.Errorf("unexpected statement %+v", stmt)
+	}
+}
+
+func TestParseCreateTable(t *testing.T) {
+	stmt, err := Parse(`CREATE TABLE IF NOT EXISTS posts (
+		id INTEGER,
+		title text(100) NOT NULL,
+		score REAL,
+		body BLOB,
+		PRIMARY KEY (id)
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &CreateTableStmt{
+		Name:        "posts",
+		IfNotExists: true,
+		Columns: []ColumnDef{
+			{Name: "id", Type: "INTEGER"},
+			{Name: "title", Type: "TEXT", Length: 100, NotNull: true},
+			{Name: "score", Type: "REAL"},
+			{Name: "body", Type: "BLOB"},
+		},
+		PrimaryKey: "id",
+	}
+	if !reflect.DeepEqual(stmt, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, stmt)
+	}
+
+	stmt, err = Parse("create table t (k integer primary key, v blob); ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = &CreateTableStmt{
+		Name: "t",
+		Columns: []ColumnDef{
+			{Name: "k", Type: "INTEGER", PrimaryKey: true},
+			{Name: "v", Type: "BLOB"},
+		},
+	}
+	if !reflect.DeepEqual(stmt, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, stmt)
+	}
+}
+
+func TestParseBlobLiteral(t *testing.T) {
+	stmt, err := Parse("insert into t values (x'00ff')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &InsertStmt{Table: "t", Values: []Expr{&Literal{Kind: LITERAL_BLOB, Value: "00ff"}}}
+	if !reflect.DeepEqual(stmt, expected) {
+		t.Errorf("expected %+v, but got %+v", expected, stmt)
+	}
+
+	if _, err := Parse("insert into t values (x'0f0')"); err == nil {
+		t.Error("expected an error for an odd-length blob literal")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		input   string
+		message string
+	}{
+		{"insert into users values (1, 'a'", `line 1, column 33: expected ")", but got end of input`},
+		{"select *\nfrom 1", `line 2, column 6: expected identifier, but got "1"`},
+		{"insert into users values ('abc)", "line 1, column 27: unterminated string"},
+		{"select * from users extra", `line 1, column 21: expected end of statement, but got "extra"`},
+		{"insert 1 user1", "line 1, column 8: expected id, name and email"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.input)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.input)
+			continue
+		}
+		if err.Error() != test.message {
+			t.Errorf("%s: expected %q, but got %q", test.input, test.message, err.Error())
+		}
+	}
+
+	if _, err := Parse("vacuum users"); !errors.Is(err, ErrUnrecognizedStatement) {
+		t.Errorf("expected ErrUnrecognizedStatement, but got %v", err)
+	}
+}
+
+func TestFormatExpr(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a", "a"},
+		{"count(*)", "COUNT(*)"},
+		{"sum(score) * 2", "SUM(score) * 2"},
+		{"-(a + 1) || 'it''s'", "(-(a + 1)) || 'it''s'"},
+		{"a not between 1 and x'0a'", "a NOT BETWEEN 1 AND X'0a'"},
+		{"\"order\" in (1, null) and b is not null", "(\"order\" IN (1, NULL)) AND (b IS NOT NULL)"},
+	}
+	for _, test := range tests {
+		stmt, err := Parse("select " + test.input + " from t")
+		if err != nil {
+			t.Fatalf("%s: %v", test.input, err)
+		}
+		if actual := FormatExpr(stmt.(*SelectStmt).Columns[0].Expr); actual != test.expected {
+			t.Errorf("%s: expected %s, but got %s", test.input, test.expected, actual)
+		}
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	stmt, err := Parse("select * from t where a = ? and b = :name and c in (?5, $2, @name, ?) limit $name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params []Param
+	_, err = ReplaceParams(stmt, func(param *Param) (Expr, error) {
+		params = append(params, *param)
+		return &Literal{Kind: LITERAL_NULL}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 番号のない?は、それまでの最大の番号の次になる。同じ名前は同じ番号になる
+	expected := []Param{
+		{Index: 1},
+		{Index: 2, Name: "name"},
+		{Index: 5},
+		{Index: 2},
+		{Index: 2, Name: "name"},
+		{Index: 6},
+		{Index: 2, Name: "name"},
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("expected %v, but got %v", expected, params)
+	}
+
+	for _, input := range []string{"select ?0", "select $99999", "select ?abc"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+}
+
+func TestReplaceParams(t *testing.T) {
+	stmt, err := Parse("update t set a = ? + 1 where id = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := ReplaceParams(stmt, func(param *Param) (Expr, error) {
+		return &Literal{Kind: LITERAL_INTEGER, Value: FormatExpr(param)[1:]}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := replaced.(*UpdateStmt)
+	if actual := FormatExpr(update.Set[0].Value) + " " + FormatExpr(update.Where); actual != "1 + 1 id = 2" {
+		t.Errorf("unexpected statement: %s", actual)
+	}
+	// 元のステートメントは変わらない
+	if actual := FormatExpr(stmt.(*UpdateStmt).Where); actual != "id = ?2" {
+		t.Errorf("the original statement was changed: %s", actual)
+	}
+
+	expectedErr := errors.New("no value")
+	if _, err := ReplaceParams(stmt, func(param *Param) (Expr, error) { return nil, expectedErr }); err != expectedErr {
+		t.Errorf("expected %v, but got %v", expectedErr, err)
+	}
+}
+
+func TestParsePrepare(t *testing.T) {
+	stmt, err := Parse("PREPARE find (integer, text) AS select * from t where id = $1 and name = $2;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepare, ok := stmt.(*PrepareStmt)
+	if !ok {
+		t.Fatalf("expected a PREPARE statement, but got %+v", stmt)
+	}
+	if prepare.Name != "find" || !reflect.DeepEqual(prepare.Types, []string{"INTEGER", "TEXT"}) {
+		t.Errorf("unexpected statement: %+v", prepare)
+	}
+	if where := FormatExpr(prepare.Stmt.(*SelectStmt).Where); where != "(id = ?1) AND (name = ?2)" {
+		t.Errorf("unexpected WHERE clause: %s", where)
+	}
+
+	tests := []struct {
+		input    string
+		expected Statement
+	}{
+		{"execute find", &ExecuteStmt{Name: "find"}},
+		{"EXECUTE find(1, ?)", &ExecuteStmt{Name: "find", Args: []Expr{&Literal{Kind: LITERAL_INTEGER, Value: "1"}, &Param{Index: 1}}}},
+		{"deallocate find", &DeallocateStmt{Name: "find"}},
+		{"DEALLOCATE PREPARE find;", &DeallocateStmt{Name: "find"}},
+	}
+	for _, test := range tests {
+		stmt, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("%s: %v", test.input, err)
+		}
+		if !reflect.DeepEqual(stmt, test.expected) {
+			t.Errorf("%s: expected %+v, but got %+v", test.input, test.expected, stmt)
+		}
+	}
+
+	for _, input := range []string{"prepare p select 1", "prepare p as prepare q as select * from t", "prepare p as execute q", "execute", "deallocate"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+}
+
+func TestParseExplain(t *testing.T) {
+	tests := []struct {
+		input   string
+		analyze bool
+	}{
+		{"explain select * from t where id = ?", false},
+		{"EXPLAIN ANALYZE SELECT a FROM t ORDER BY a;", true},
+		{"explain update t set a = 1", false},
+		{"explain delete from t where a > 1", false},
+	}
+	for _, test := range tests {
+		stmt, err := Parse(test.input)
+		if err != nil {
+			t.Fatalf("%s: %v", test.input, err)
+		}
+		explain, ok := stmt.(*ExplainStmt)
+		if !ok || explain.Analyze != test.analyze || explain.Stmt == nil {
+			t.Errorf("%s: unexpected statement %+v", test.input, stmt)
+		}
+	}
+
+	// EXPLAIN文のパラメータも置き換える
+	stmt, _ := Parse("explain select * from t where id = ?")
+	replaced, err := ReplaceParams(stmt, func(param *Param) (Expr, error) {
+		return &Literal{Kind: LITERAL_INTEGER, Value: "7"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if where := FormatExpr(replaced.(*ExplainStmt).Stmt.(*SelectStmt).Where); where != "id = 7" {
+		t.Errorf("unexpected WHERE clause: %s", where)
+	}
+
+	for _, input := range []string{"explain", "explain insert into t values (1)", "explain analyze delete from t", "explain explain select * from t"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package table
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"toydb-go/core"
+	"toydb-go/persistence"
+	"toydb-go/sql"
+)
+
+// セカンダリインデックス。カラムの値から行のキーを探すためのB-tree。
+// エントリ (値, 行のキー) を、順番を保つバイト列（core.AppendKeyでエンコードした値の後ろに、行のキーをビッグエンディアンで続けたもの）にして、
+// インデックスのB-treeのキーにする。エントリは、値の順番（値が同じなら行のキーの順番）に並ぶ
+type Index struct {
+	name   string
+	table  *Table
+	column int
+	unique bool
+	// エントリを保存するB-treeのルートノードのページ番号
+	rootPageNum uint32
+}
+
+var (
+	ErrIndexExists     = errors.New("index already exists")
+	ErrUniqueViolation = errors.New("UNIQUE constraint failed")
+)
+
+func newIndex(name string, table *Table, column int, unique bool, rootPageNum uint32) *Index {
+	return &Index{
+		name:        name,
+		table:       table,
+		column:      column,
+		unique:      unique,
+		rootPageNum: rootPageNum,
+	}
+}
+
+func (index *Index) Name() string {
+	return index.name
+}
+
+// インデックスをつけたテーブルを返す
+func (index *Index) Table() *Table {
+	return index.table
+}
+
+// インデックスをつけたカラムの、テーブルでのインデックスを返す
+func (index *Index) Column() int {
+	return index.column
+}
+
+func (index *Index) Unique() bool {
+	return index.unique
+}
+
+// エントリを保存するB-treeのルートノードのページ番号を返す
+func (index *Index) RootPageNum() uint32 {
+	return index.rootPageNum
+}
+
+// インデックスを作るCREATE文を返す。カタログにはこの文を保存する
+func (index *Index) SQL() string {
+	create := "CREATE INDEX "
+	if index.unique {
+		create = "CREATE UNIQUE INDEX "
+	}
+	return create + sql.QuoteIdent(index.name) + " ON " + sql.QuoteIdent(index.table.schema.Name) +
+		" (" + sql.QuoteIdent(index.table.schema.Columns[index.column].Name) + ")"
+}
+
+// インデックスのエントリ
+type indexEntry struct {
+	value core.Value
+	key   uint32
+}
+
+// エントリを、B-treeのキーにエンコードする
+func encodeEntry(entry indexEntry) []byte {
+	return binary.BigEndian.AppendUint32(core.AppendKey(nil, entry.value), entry.key)
+}
+
+// B-treeのキーを、エントリにデコードする
+func (index *Index) decodeEntry(b []byte) (indexEntry, error) {
+	value, rest, err := core.DecodeKey(b)
+	if err != nil {
+		return indexEntry{}, fmt.Errorf("%w: index %s: %s", persistence.ErrCorrupt, index.name, err.Error())
+	}
+	if len(rest) != 4 {
+		return indexEntry{}, fmt.Errorf("%w: index %s: malformed entry", persistence.ErrCorrupt, index.name)
+	}
+	return indexEntry{value: value, key: binary.BigEndian.Uint32(rest)}, nil
+}
+
+// インデックスのエントリを指すカーソル
+type indexCursor struct {
+	index   *Index
+	pageNum uint32
+	cellNum uint32
+	end     bool
+}
+
+// B-treeのキーがkey以上の最初のエントリを指すカーソルを返す
+func (index *Index) seek(key []byte) *indexCursor {
+	pager := index.table.pager
+	defer pager.ReleasePages()
+
+	pageNum, cellNum := persistence.IndexSeek(pager, index.rootPageNum, key)
+	end := cellNum >= persistence.IndexUtil.GetNumCells(pager.GetPage(pageNum))
+	return &indexCursor{index: index, pageNum: pageNum, cellNum: cellNum, end: end}
+}
+
+// カーソルが指すエントリを読む
+func (cursor *indexCursor) entry() (indexEntry, error) {
+	pager := cursor.index.table.pager
+	defer pager.ReleasePages()
+
+	page := pager.GetPage(cursor.pageNum)
+	return cursor.index.decodeEntry(persistence.IndexUtil.GetCellKey(pager, page, cursor.cellNum))
+}
+
+// カーソルを1つ進める
+func (cursor *indexCursor) advance() {
+	pager := cursor.index.table.pager
+	defer pager.ReleasePages()
+
+	page := pager.GetPage(cursor.pageNum)
+	cursor.cellNum++
+	for cursor.cellNum >= persistence.IndexUtil.GetNumCells(page) {
+		next := persistence.IndexUtil.GetNextLeaf(page)
+		if next == 0 {
+			cursor.end = true
+			return
+		}
+		cursor.pageNum, cursor.cellNum, page = next, 0, pager.GetPage(next)
+	}
+}
+
+// エントリを追加する
+func (index *Index) insert(entry indexEntry) error {
+	defer index.table.pager.ReleasePages()
+
+	if !persistence.IndexInsertKey(index.table.pager, index.rootPageNum, encodeEntry(entry)) {
+		return fmt.Errorf("%w: index %s already has an entry for row %d", persistence.ErrCorrupt, index.name, entry.key)
+	}
+	return nil
+}
+
+// エントリを削除する
+func (index *Index) delete(entry indexEntry) error {
+	defer index.table.pager.ReleasePages()
+
+	if !persistence.IndexDeleteKey(index.table.pager, index.rootPageNum, encodeEntry(entry)) {
+		return fmt.Errorf("%w: index %s has no entry for row %d", persistence.ErrCorrupt, index.name, entry.key)
+	}
+	return nil
+}
+
+// エントリをインデックスに追加できるか確認する
+func (index *Index) checkEntry(entry indexEntry) error {
+	if len(encodeEntry(entry)) > persistence.LEAF_NODE_MAX_VALUE_SIZE {
+		return fmt.Errorf("%w: index %s", ErrRowTooLarge, index.name)
+	}
+	return index.checkUnique(entry.value, entry.key)
+}
+
+// 値がUNIQUEインデックスの他の行と重複しないか確認する。NULLはどの値とも重複しない
+func (index *Index) checkUnique(value core.Value, key uint32) error {
+	if !index.unique || value.IsNull() {
+		return nil
+	}
+	for cursor := index.seek(core.AppendKey(nil, value)); !cursor.end; cursor.advance() {
+		entry, err := cursor.entry()
+		if err != nil {
+			return err
+		}
+		if core.Compare(entry.value, value) != 0 {
+			break
+		}
+		if entry.key != key {
+			return fmt.Errorf("%w: %s.%s", ErrUniqueViolation, index.table.schema.Name, index.table.schema.Columns[index.column].Name)
+		}
+	}
+	return nil
+}
+
+// 値の範囲の端。Inclusiveがtrueなら、値そのものも範囲に含む
+type IndexBound struct {
+	Value     core.Value
+	Inclusive bool
+}
+
+// インデックスの値の範囲のエントリを、値の順番に1つずつ読む
+type IndexIterator struct {
+	low    *IndexBound
+	high   *IndexBound
+	cursor *indexCursor
+}
+
+// 値が範囲 [low, high] に入るエントリを読むイテレータを返す。
+// lowかhighがnilの場合は、その側を制限しない。NULLは比較の結果がNULLなので、どの範囲にも入らない
+func (index *Index) Iterate(low *IndexBound, high *IndexBound) (*IndexIterator, error) {
+	var key []byte
+	switch {
+	case low == nil:
+		// NULLのエントリの後ろから読む
+		key = []byte{core.KEY_NULL + 1}
+	case !low.Inclusive:
+		// 値が同じエントリは、値のキーの後ろに行のキーの4バイトが続くので、それより後ろから読む
+		key = append(core.AppendKey(nil, low.Value), 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	case low.Value.Type == core.VALUE_INTEGER || low.Value.Type == core.VALUE_REAL:
+		// INTEGERとREALのエントリは、float64にすると同じ値なら等しいので、float64の部分だけで探す
+		key = core.AppendKey(nil, low.Value)[:core.KEY_NUMBER_PREFIX_SIZE]
+	default:
+		key = core.AppendKey(nil, low.Value)
+	}
+	return &IndexIterator{low: low, high: high, cursor: index.seek(key)}, nil
+}
+
+// 次のエントリの行のキーを返す。範囲の終わりに達したらfalseを返す
+func (it *IndexIterator) Next() (uint32, bool, error) {
+	for !it.cursor.end {
+		entry, err := it.cursor.entry()
+		if err != nil {
+			return 0, false, err
+		}
+		// 探し始めた位置の近くには、範囲の下限より前のエントリ（float64にすると同じ値になる整数など）があるかもしれない
+		if it.low != nil {
+			if c := core.Compare(entry.value, it.low.Value); c < 0 || (c == 0 && !it.low.Inclusive) {
+				it.cursor.advance()
+				continue
+			}
+		}
+		if it.high != nil {
+			if c := core.Compare(entry.value, it.high.Value); c > 0 || (c == 0 && !it.high.Inclusive) {
+				it.cursor.end = true
+				return 0, false, nil
+			}
+		}
+		it.cursor.advance()
+		return entry.key, true, nil
+	}
+	return 0, false, nil
+}
+
+// 値が範囲 [low, high] に入るエントリの行のキーを、値の順番にfnに渡す。
+// lowかhighがnilの場合は、その側を制限しない。
+// fnがエラーを返すと、そこで止めてエラーを返す
+func (index *Index) Scan(low *IndexBound, high *IndexBound, fn func(key uint32) error) error {
+	it, err := index.Iterate(low, high)
+	if err != nil {
+		return err
+	}
+	for {
+		key, ok, err := it.Next()
+		if err != nil || !ok {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+}
+
+// 行をインデックスに追加できるか確認する
+func (table *Table) checkIndexes(values []core.Value, key uint32) error {
+	for _, index := range table.indexes {
+		if err := index.checkEntry(indexEntry{value: values[index.column], key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 行のエントリを、全てのインデックスに追加する
+func (table *Table) insertIndexEntries(values []core.Value, key uint32) error {
+	for _, index := range table.indexes {
+		if err := index.insert(indexEntry{value: values[index.column], key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 行のエントリを、全てのインデックスから削除する
+func (table *Table) deleteIndexEntries(values []core.Value, key uint32) error {
+	for _, index := range table.indexes {
+		if err := index.delete(indexEntry{value: values[index.column], key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// テーブルのインデックスを、作成した順に返す
+func (table *Table) Indexes() []*Index {
+	return table.indexes
+}
+
+// 行のキーで行を取得する。行がない場合はfalseを返す
+func (table *Table) GetRow(key uint32) ([]core.Value, bool, error) {
+	defer table.pager.ReleasePages()
+
+	cursor, found := tableFindKey(table, key)
+	if !found {
+		return nil, false, nil
+	}
+	page := table.pager.GetPage(cursor.PageNum)
+	row, err := decodeRecord(table.schema, key, persistence.LeafUtil.GetCellValue(table.pager, page, cursor.CellNum))
+	return row, true, err
+}
+
+// インデックスを作る。B-treeを作り、テーブルの全ての行のエントリを追加してから、定義をカタログに追加する。
+// エントリはメモリに集めずに、テーブルの行を読みながら1つずつ追加する。
+// UNIQUEインデックスで値が重複していた場合はエラーになるので、呼び出し側でステートメントをロールバックする
+func (database *Database) CreateIndex(stmt *sql.CreateIndexStmt) (*Index, error) {
+	defer database.pager.ReleasePages()
+
+	table, found := database.GetTable(stmt.Table)
+	if !found {
+		return nil, fmt.Errorf("no such table: %s", stmt.Table)
+	}
+	column := table.schema.ColumnIndex(stmt.Column)
+	if column < 0 {
+		return nil, fmt.Errorf("no such column: %s", stmt.Column)
+	}
+	name := stmt.Name
+	if name == "" {
+		name = DefaultIndexName(table.schema.Name, table.schema.Columns[column].Name)
+	}
+	if _, found := database.GetIndex(name); found {
+		return nil, fmt.Errorf("%w: %s", ErrIndexExists, name)
+	}
+	if _, found := database.GetTable(name); found {
+		return nil, fmt.Errorf("%w: %s", ErrTableExists, name)
+	}
+
+	index := newIndex(name, table, column, stmt.Unique, persistence.CreateIndexTree(database.pager))
+
+	// テーブルの行を読みながら、エントリを1つずつ追加する
+	for cursor := TableStart(table); !cursor.EndOfTable; CursorAdvance(cursor) {
+		row, err := table.GetRowByCursor(cursor.PageNum, cursor.CellNum)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", persistence.ErrCorrupt, err.Error())
+		}
+		entry := indexEntry{value: row[column], key: CursorKey(cursor)}
+		if err := index.checkEntry(entry); err != nil {
+			return nil, err
+		}
+		if err := index.insert(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	row := []core.Value{
+		core.TextValue("index"),
+		core.TextValue(name),
+		core.TextValue(table.schema.Name),
+		core.IntegerValue(int64(index.rootPageNum)),
+		core.TextValue(index.SQL()),
+	}
+	if err := database.insertCatalogRow(row, name); err != nil {
+		return nil, err
+	}
+	database.schemaChanged()
+
+	table.indexes = append(table.indexes, index)
+	return index, nil
+}
+
+// CREATE INDEX文でインデックス名を省略したときの名前を返す
+func DefaultIndexName(table string, column string) string {
+	return "idx_" + table + "_" + column
+}
+
+// カタログのCREATE INDEX文から、インデックスを作ってテーブルに追加する
+func (database *Database) loadIndex(query string, rootPageNum uint32) error {
+	stmt, err := sql.Parse(query)
+	if err != nil {
+		return err
+	}
+	createIndex, ok := stmt.(*sql.CreateIndexStmt)
+	if !ok {
+		return fmt.Errorf("unexpected statement: %s", query)
+	}
+	table, found := database.GetTable(createIndex.Table)
+	if !found {
+		return fmt.Errorf("no such table: %s", createIndex.Table)
+	}
+	column := table.schema.ColumnIndex(createIndex.Column)
+	if column < 0 {
+		return fmt.Errorf("no such column: %s", createIndex.Column)
+	}
+	table.indexes = append(table.indexes, newIndex(createIndex.Name, table, column, createIndex.Unique, rootPageNum))
+	return nil
+}
+
+// インデックスを名前で探す。大文字と小文字は区別しない
+func (database *Database) GetIndex(name string) (*Index, bool) {
+	for _, table := range database.tables {
+		for _, index := range table.indexes {
+			if strings.EqualFold(index.name, name) {
+				return index, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// インデックスのエントリが、テーブルの行と一致しているか確認する。エントリの順番は、B-treeの整合性チェックで確認する。
+// 問題は、インデックスのルートノードのページ番号で報告する
+func (index *Index) check() []persistence.Violation {
+	var violations []persistence.Violation
+	errorf := func(format string, args ...interface{}) {
+		violations = append(violations, persistence.Violation{
+			PageNum: index.rootPageNum,
+			Message: fmt.Sprintf("index %s: ", index.name) + fmt.Sprintf(format, args...),
+		})
+	}
+
+	count := uint32(0)
+	for cursor := index.seek(nil); !cursor.end; cursor.advance() {
+		count++
+		entry, err := cursor.entry()
+		if err != nil {
+			errorf("%s", err.Error())
+			continue
+		}
+
+		row, found, err := index.table.GetRow(entry.key)
+		switch {
+		case err != nil:
+			errorf("row %d: %s", entry.key, err.Error())
+		case !found:
+			errorf("row %d does not exist", entry.key)
+		case core.Compare(row[index.column], entry.value) != 0:
+			errorf("entry for row %d has %s, but the row has %s", entry.key, entry.value, row[index.column])
+		}
+	}
+	if rows := index.table.CountRows(); rows != count {
+		errorf("has %d entries, but the table has %d rows", count, rows)
+	}
+	return violations
+}
+
+// インデックスのB-treeを表示する。キーは (値, 行のキー) で表示する
+func PrintIndexTree(index *Index) {
+	defer index.table.pager.ReleasePages()
+
+	index.printTree(index.rootPageNum, 0)
+}
+
+func (index *Index) printTree(pageNum uint32, depth int) {
+	pager := index.table.pager
+	node := pager.GetPage(pageNum)
+	numCells := persistence.IndexUtil.GetNumCells(node)
+
+	describe := func(cellNum uint32) string {
+		entry, err := index.decodeEntry(persistence.IndexUtil.GetCellKey(pager, node, cellNum))
+		if err != nil {
+			return "(malformed)"
+		}
+		return fmt.Sprintf("(%s, %d)", entry.value, entry.key)
+	}
+
+	if persistence.NodeUtil.GetNodeType(node) == persistence.NODE_INDEX_LEAF {
+		fmt.Printf("%s- leaf (size %d)\n", indent(depth), numCells)
+		for i := uint32(0); i < numCells; i++ {
+			fmt.Printf("%s- %s\n", indent(depth+1), describe(i))
+		}
+		return
+	}
+
+	fmt.Printf("%s- internal (size %d)\n", indent(depth), numCells)
+	for i := uint32(0); i <= numCells; i++ {
+		// 子ノードを表示してから、区切りのキーを表示する
+		index.printTree(persistence.IndexUtil.GetChild(node, i), depth+1)
+		if i < numCells {
+			fmt.Printf("%s- key %s\n", indent(depth+1), describe(i))
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package table
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"toydb-go/core"
+	"toydb-go/persistence"
+	"toydb-go/sql"
+)
+
+func createIndex(t *testing.T, database *Database, query string) *Index {
+	stmt, err := sql.Parse(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := database.CreateIndex(stmt.(*sql.CreateIndexStmt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+// インデックスの範囲の行のキーを、順番に返す
+func scanIndex(t *testing.T, index *Index, low *IndexBound, high *IndexBound) []uint32 {
+	keys := []uint32{}
+	err := index.Scan(low, high, func(key uint32) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// エントリが (値, 行のキー) の順番に並んでいるか確認する
+func checkIndexOrder(t *testing.T, index *Index) {
+	var prev *indexEntry
+	for cursor := index.seek(nil); !cursor.end; cursor.advance() {
+		entry, err := cursor.entry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev != nil {
+			if c := core.Compare(prev.value, entry.value); c > 0 || (c == 0 && prev.key >= entry.key) {
+				t.Fatalf("entry %v is not after %v", entry, *prev)
+			}
+		}
+		prev = &entry
+	}
+}
+
+func TestIndexKeepsEntriesInOrder(t *testing.T) {
+	database, err := DbOpen(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DbClose(database)
+	table := createTable(t, database, "create table t (id integer primary key, v integer)")
+	index := createIndex(t, database, "create index on t(v)")
+
+	table.InsertRow([]core.Value{core.IntegerValue(1), core.IntegerValue(0)})
+	table.InsertRow([]core.Value{core.IntegerValue(2), core.IntegerValue(100)})
+	// 同じ2つのエントリの間に挿入し続けても、値が同じエントリは行のキーの順番に並ぶ
+	for key := int64(30); key > 2; key-- {
+		if result := table.InsertRow([]core.Value{core.IntegerValue(key), core.IntegerValue(50)}); result != INSERT_SUCCESS {
+			t.Fatalf("insert %d failed: %d", key, result)
+		}
+	}
+	checkIndexOrder(t, index)
+
+	expected := []uint32{1}
+	for key := uint32(3); key <= 30; key++ {
+		expected = append(expected, key)
+	}
+	expected = append(expected, 2)
+	if keys := scanIndex(t, index, nil, nil); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, but got %v", expected, keys)
+	}
+
+	fifty := core.IntegerValue(50)
+	if keys := scanIndex(t, index, &IndexBound{Value: fifty, Inclusive: false}, nil); !reflect.DeepEqual(keys, []uint32{2}) {
+		t.Errorf("expected [2] for v > 50, but got %v", keys)
+	}
+	if keys := scanIndex(t, index, nil, &IndexBound{Value: fifty, Inclusive: false}); !reflect.DeepEqual(keys, []uint32{1}) {
+		t.Errorf("expected [1] for v < 50, but got %v", keys)
+	}
+
+	// 削除した行と、値を変えた行のエントリが変わる
+	for key := uint32(3); key <= 29; key++ {
+		if found, err := table.DeleteRow(key); !found || err != nil {
+			t.Fatalf("delete %d failed: %v", key, err)
+		}
+	}
+	table.UpsertRow([]core.Value{core.IntegerValue(30), core.IntegerValue(-1)})
+	if keys := scanIndex(t, index, nil, nil); !reflect.DeepEqual(keys, []uint32{30, 1, 2}) {
+		t.Errorf("expected [30 1 2], but got %v", keys)
+	}
+	checkIndexOrder(t, index)
+}
+
+// 値の順番に挿入しても、B-treeが分割されるだけでエントリを書き直さない
+func TestIndexSequentialInserts(t *testing.T) {
+	database, err := DbOpen(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DbClose(database)
+	table := createTable(t, database, "create table t (id integer primary key, v integer)")
+	index := createIndex(t, database, "create index on t(v)")
+
+	// float64にすると同じになる大きな整数と、負の数を含める
+	const numRows = 2000
+	for key := int64(1); key <= numRows; key++ {
+		v := key - numRows/2
+		if key%2 == 0 {
+			v += 1 << 60
+		}
+		if result := table.InsertRow([]core.Value{core.IntegerValue(key), core.IntegerValue(v)}); result != INSERT_SUCCESS {
+			t.Fatalf("insert %d failed: %d", key, result)
+		}
+	}
+	checkIndexOrder(t, index)
+	if violations := database.CheckIntegrity(); len(violations) != 0 {
+		t.Fatalf("unexpected violations: %v", violations)
+	}
+
+	// REALの境界でも、範囲に入るINTEGERのエントリだけを返す
+	low := &IndexBound{Value: core.RealValue(-2.5), Inclusive: true}
+	high := &IndexBound{Value: core.IntegerValue(1), Inclusive: true}
+	if keys := scanIndex(t, index, low, high); !reflect.DeepEqual(keys, []uint32{999, 1001}) {
+		t.Errorf("expected [999 1001] for -2.5 <= v <= 1, but got %v", keys)
+	}
+	// float64にすると同じになる整数は、範囲の下限より小さければ読み飛ばす
+	big := core.IntegerValue(1<<60 + 2)
+	if keys := scanIndex(t, index, &IndexBound{Value: big, Inclusive: true}, &IndexBound{Value: big, Inclusive: true}); !reflect.DeepEqual(keys, []uint32{numRows/2 + 2}) {
+		t.Errorf("expected [%d] for v = 2^60+2, but got %v", numRows/2+2, keys)
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	database, err := DbOpen(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := createTable(t, database, "create table t (id integer primary key, email text)")
+	createIndex(t, database, "create unique index by_email on t(email)")
+
+	if result := table.InsertRow([]core.Value{core.IntegerValue(1), core.TextValue("a")}); result != INSERT_SUCCESS {
+		t.Fatalf("insert failed: %d", result)
+	}
+	if result := table.InsertRow([]core.Value{core.IntegerValue(2), core.TextValue("a")}); result != INSERT_UNIQUE_VIOLATION {
+		t.Errorf("expected a unique violation, but got %d", result)
+	}
+	// NULLは重複しない
+	for _, key := range []int64{3, 4} {
+		if result := table.InsertRow([]core.Value{core.IntegerValue(key), core.NullValue()}); result != INSERT_SUCCESS {
+			t.Errorf("insert %d failed: %d", key, result)
+		}
+	}
+	// 同じ行の値は重複にならない
+	if result := table.UpsertRow([]core.Value{core.IntegerValue(1), core.TextValue("a")}); result != INSERT_SUCCESS {
+		t.Errorf("upsert failed: %d", result)
+	}
+	if result := table.UpsertRow([]core.Value{core.IntegerValue(3), core.TextValue("a")}); result != INSERT_UNIQUE_VIOLATION {
+		t.Errorf("expected a unique violation, but got %d", result)
+	}
+
+	// 重複した値があるカラムには、UNIQUEインデックスを作れない
+	stmt, _ := sql.Parse("create unique index on t(id)")
+	if _, err := database.CreateIndex(stmt.(*sql.CreateIndexStmt)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	other := createTable(t, database, "create table u (v integer)")
+	other.InsertRow([]core.Value{core.IntegerValue(1)})
+	other.InsertRow([]core.Value{core.IntegerValue(1)})
+	stmt, _ = sql.Parse("create unique index on u(v)")
+	if _, err := database.CreateIndex(stmt.(*sql.CreateIndexStmt)); !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("expected ErrUniqueViolation, but got %v", err)
+	}
+
+	if err := database.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	DbClose(database)
+
+	// インデックスはカタログから読み直される
+	database, err = DbOpen(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DbClose(database)
+	index, found := database.GetIndex("BY_EMAIL")
+	if !found {
+		t.Fatal("index by_email was not reloaded")
+	}
+	if !index.Unique() || index.Table().Schema().Name != "t" || index.Column() != 1 {
+		t.Errorf("unexpected index: %s", index.SQL())
+	}
+	a := &IndexBound{Value: core.TextValue("a"), Inclusive: true}
+	if keys := scanIndex(t, index, a, a); !reflect.DeepEqual(keys, []uint32{1}) {
+		t.Errorf("expected [1], but got %v", keys)
+	}
+	if _, found := database.GetIndex("idx_t_id"); !found {
+		t.Error("index idx_t_id was not reloaded")
+	}
+}
+
+func TestCheckIndexEntries(t *testing.T) {
+	database, err := DbOpen(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DbClose(database)
+	table := createTable(t, database, "create table t (id integer primary key, v integer)")
+	index := createIndex(t, database, "create index on t(v)")
+	for key := int64(1); key <= 20; key++ {
+		table.InsertRow([]core.Value{core.IntegerValue(key), core.IntegerValue(key % 5)})
+	}
+	if violations := database.CheckIntegrity(); len(violations) != 0 {
+		t.Fatalf("unexpected violations: %v", violations)
+	}
+
+	// インデックスを更新せずに行を削除すると、エントリが行と一致しなくなる
+	persistence.DeleteKey(table.pager, table.rootPageNum, 7)
+	table.pager.ReleasePages()
+	violations := database.CheckIntegrity()
+	expected := []string{"index idx_t_v: row 7 does not exist", "index idx_t_v: has 20 entries, but the table has 19 rows"}
+	if len(violations) != len(expected) {
+		t.Fatalf("expected %d violations, but got %v", len(expected), violations)
+	}
+	for i, v := range violations {
+		if v.PageNum != index.RootPageNum() || v.Message != expected[i] {
+			t.Errorf("expected %q on page %d, but got %v", expected[i], index.RootPageNum(), v)
+		}
+	}
+}
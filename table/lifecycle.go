@@ -1,25 +1,304 @@
 package table
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"toydb-go/core"
 	"toydb-go/persistence"
+	"toydb-go/sql"
 )
 
-func DbOpen(name string) (*Table, error) {
-	pager, err := persistence.InitPager(name)
+type Options struct {
+	// キャッシュするページ数の上限（0の場合はデフォルト値）
+	CachePages int
+}
+
+// 1つのDBファイルと、そこに含まれるテーブル
+type Database struct {
+	pager *persistence.Pager
+	// テーブルの定義を保存するテーブル
+	catalog *Table
+	// 作成した順に並べたテーブル（カタログを除く）
+	tables []*Table
+	// カタログを読み込むか、スキーマを変更するたびに増やす。準備したステートメントが古くなったか確かめるのに使う。
+	// ロールバックで戻るファイルのスキーマクッキーと違って、前と同じ値には戻らない
+	schemaVersion uint64
+}
+
+var (
+	ErrTableExists   = errors.New("table already exists")
+	ErrSchemaTooLong = errors.New("table definition is too long")
+)
+
+// カタログ。sqlite_masterと同じように、テーブルごとに1行を持つ
+const (
+	CATALOG_TABLE_NAME = "toydb_master"
+	CATALOG_TABLE_SQL  = "CREATE TABLE toydb_master (type TEXT, name TEXT, tbl_name TEXT, rootpage INTEGER, sql TEXT)"
+)
+
+// Catalog Columns
+const (
+	CATALOG_TYPE_COLUMN = iota
+	CATALOG_NAME_COLUMN
+	CATALOG_TBL_NAME_COLUMN
+	CATALOG_ROOTPAGE_COLUMN
+	CATALOG_SQL_COLUMN
+)
+
+func DbOpen(name string) (*Database, error) {
+	return DbOpenWithOptions(name, Options{})
+}
+
+func DbOpenWithOptions(name string, options Options) (*Database, error) {
+	pager, err := persistence.InitPager(name, options.CachePages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// カタログから、テーブルの定義を読み込む
+	database := &Database{pager: pager}
+	if err := database.loadCatalog(); err != nil {
+		pager.ReleasePages()
+		pager.FlushPages()
+		return nil, err
+	}
+	pager.ReleasePages()
+
+	return database, nil
+}
+
+// CREATE文からテーブルを作る
+func (database *Database) newTable(query string, rootPageNum uint32) (*Table, error) {
+	stmt, err := sql.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	createTable, ok := stmt.(*sql.CreateTableStmt)
+	if !ok {
+		return nil, fmt.Errorf("unexpected statement: %s", query)
+	}
+	schema, err := NewSchema(createTable)
+	if err != nil {
+		return nil, err
+	}
+	return &Table{pager: database.pager, rootPageNum: rootPageNum, schema: schema}, nil
+}
+
+func (database *Database) loadCatalog() error {
+	database.schemaVersion++
+	database.tables = nil
+	catalog, err := database.newTable(CATALOG_TABLE_SQL, database.pager.GetCatalogRoot())
+	if err != nil {
+		return err
+	}
+	database.catalog = catalog
+
+	for cursor := TableStart(catalog); !cursor.EndOfTable; CursorAdvance(cursor) {
+		row, err := catalog.GetRowByCursor(cursor.PageNum, cursor.CellNum)
+		if err != nil {
+			return fmt.Errorf("%w: %s", persistence.ErrCorrupt, err.Error())
+		}
+		rootPageNum := uint32(row[CATALOG_ROOTPAGE_COLUMN].Integer)
+		switch row[CATALOG_TYPE_COLUMN].Text {
+		case "table":
+			table, err := database.newTable(row[CATALOG_SQL_COLUMN].Text, rootPageNum)
+			if err != nil {
+				return fmt.Errorf("%w: %s", persistence.ErrCorrupt, err.Error())
+			}
+			database.tables = append(database.tables, table)
+		case "index":
+			// インデックスは、テーブルより後にカタログに追加される
+			if err := database.loadIndex(row[CATALOG_SQL_COLUMN].Text, rootPageNum); err != nil {
+				return fmt.Errorf("%w: %s", persistence.ErrCorrupt, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// データベースを閉じる。トランザクションの途中なら、コミットせずにロールバックする
+func DbClose(database *Database) error {
+	if database.pager.InTransaction() {
+		database.pager.Rollback()
+	}
+	return database.pager.FlushPages()
+}
+
+// 変更を書き込まずにファイルを閉じる。ページの読み書きに失敗した後など、キャッシュの内容を信用できない場合に使う。
+// コミット済みの変更はWALに残っていて、次に開いたときに読み直す
+func DbAbandon(database *Database) {
+	database.pager.Abandon()
+}
+
+// テーブルを名前で探す。大文字と小文字は区別しない。カタログもテーブルとして返す
+func (database *Database) GetTable(name string) (*Table, bool) {
+	if strings.EqualFold(name, CATALOG_TABLE_NAME) {
+		return database.catalog, true
+	}
+	for _, table := range database.tables {
+		if strings.EqualFold(table.schema.Name, name) {
+			return table, true
+		}
+	}
+	return nil, false
+}
+
+// カタログを除く全てのテーブルを、作成した順に返す
+func (database *Database) Tables() []*Table {
+	return database.tables
+}
+
+// カタログならtrue。カタログは、CREATE TABLE以外で変更してはいけない
+func (database *Database) IsCatalog(table *Table) bool {
+	return table == database.catalog
+}
 
+// テーブルを作成する。B-treeを作り、定義をカタログに追加する
+func (database *Database) CreateTable(stmt *sql.CreateTableStmt) (*Table, error) {
+	defer database.pager.ReleasePages()
+
+	if _, found := database.GetTable(stmt.Name); found {
+		return nil, fmt.Errorf("%w: %s", ErrTableExists, stmt.Name)
+	}
+	if _, found := database.GetIndex(stmt.Name); found {
+		return nil, fmt.Errorf("%w: %s", ErrIndexExists, stmt.Name)
+	}
+	schema, err := NewSchema(stmt)
 	if err != nil {
 		return nil, err
 	}
 
-	// テーブルを初期化する
-	table := Table{
-		pager:       *pager,
-		rootPageNum: 0,
+	table := &Table{
+		pager:       database.pager,
+		rootPageNum: persistence.CreateTree(database.pager),
+		schema:      schema,
+	}
+
+	row := []core.Value{
+		core.TextValue("table"),
+		core.TextValue(schema.Name),
+		core.TextValue(schema.Name),
+		core.IntegerValue(int64(table.rootPageNum)),
+		core.TextValue(schema.SQL()),
+	}
+	if err := database.insertCatalogRow(row, schema.Name); err != nil {
+		database.pager.FreePage(table.rootPageNum)
+		return nil, err
+	}
+	database.schemaChanged()
+
+	database.tables = append(database.tables, table)
+	return table, nil
+}
+
+// スキーマを変更したことを記録する。ファイルのスキーマクッキーと、メモリのスキーマのバージョンを増やす
+func (database *Database) schemaChanged() {
+	database.pager.IncrementSchemaCookie()
+	database.schemaVersion++
+}
+
+// スキーマのバージョンを返す。テーブルかインデックスが変わると、違う値になる
+func (database *Database) SchemaVersion() uint64 {
+	return database.schemaVersion
+}
+
+// カタログに定義の行を追加する。定義が長すぎてカタログに入らない場合はErrSchemaTooLongを返す
+func (database *Database) insertCatalogRow(row []core.Value, name string) error {
+	switch result := database.catalog.InsertRow(row); result {
+	case INSERT_SUCCESS:
+		return nil
+	case INSERT_ROW_TOO_LARGE:
+		return fmt.Errorf("%w: %s", ErrSchemaTooLong, name)
+	case INSERT_CORRUPT:
+		return fmt.Errorf("%w: catalog", persistence.ErrCorrupt)
+	default:
+		return fmt.Errorf("could not add %s to the catalog (result %d)", name, result)
+	}
+}
+
+// 変更をコミットする。トランザクションの途中なら、トランザクションを終える
+func (database *Database) Commit() error {
+	defer database.pager.ReleasePages()
+
+	return database.pager.Commit()
+}
+
+// トランザクションを始める。COMMITまでの変更はDBファイルに反映されず、ROLLBACKで取り消せる
+func (database *Database) Begin() error {
+	defer database.pager.ReleasePages()
+
+	return database.pager.Begin()
+}
+
+// トランザクションの途中ならtrue
+func (database *Database) InTransaction() bool {
+	return database.pager.InTransaction()
+}
+
+// トランザクションの変更を取り消す
+func (database *Database) Rollback() error {
+	defer database.pager.ReleasePages()
+
+	if err := database.pager.Rollback(); err != nil {
+		return err
+	}
+	// 取り消したCREATE TABLEを忘れるために、カタログを読み直す
+	return database.loadCatalog()
+}
+
+// ステートメントを始める。ステートメントが失敗したら、RollbackStatementで始める前の状態に戻す
+func (database *Database) BeginStatement() error {
+	defer database.pager.ReleasePages()
+
+	return database.pager.BeginStatement()
+}
+
+// BeginStatementからの変更を取り消す
+func (database *Database) RollbackStatement() error {
+	defer database.pager.ReleasePages()
+
+	if err := database.pager.RollbackStatement(); err != nil {
+		return err
 	}
+	return database.loadCatalog()
+}
+
+// これまでにページャからページを読んだ回数を返す
+func (database *Database) PageReads() uint64 {
+	return database.pager.PageReads()
+}
+
+// データベースファイルの情報を返す
+func (database *Database) FileInfo() persistence.FileInfo {
+	defer database.pager.ReleasePages()
 
-	return &table, nil
+	return database.pager.Info()
 }
 
-func DbClose(table *Table) {
-	table.pager.FlushPages()
+// ファイル全体の整合性を確認する。カタログ、テーブル、インデックスのB-treeを確認してから、
+// インデックスのエントリがテーブルの行と一致しているか確認する。問題がなければ空のスライスを返す
+func (database *Database) CheckIntegrity() []persistence.Violation {
+	defer database.pager.ReleasePages()
+
+	roots := []uint32{database.catalog.rootPageNum}
+	for _, table := range database.tables {
+		roots = append(roots, table.rootPageNum)
+		for _, index := range table.indexes {
+			roots = append(roots, index.rootPageNum)
+		}
+	}
+	violations := persistence.CheckIntegrity(database.pager, roots)
+	if len(violations) > 0 {
+		// B-treeが壊れている場合は、たどれないのでインデックスのエントリは確認しない
+		return violations
+	}
+
+	for _, table := range database.tables {
+		for _, index := range table.indexes {
+			violations = append(violations, index.check()...)
+		}
+	}
+	return violations
 }
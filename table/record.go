@@ -0,0 +1,36 @@
+package table
+
+import (
+	"toydb-go/core"
+)
+
+// 行は、カラムの値を順番に並べたレコード（core.AppendRecord）にエンコードしてB-treeに保存する。
+// 主キーの値はB-treeのキーと同じなので、レコードにはNULLとして保存する
+
+// 行をレコードにエンコードする
+func encodeRecord(schema *Schema, values []core.Value) []byte {
+	if schema.PrimaryKey >= 0 {
+		values = append([]core.Value{}, values...)
+		values[schema.PrimaryKey] = core.NullValue()
+	}
+	return core.AppendRecord(nil, values)
+}
+
+// レコードをデコードして、行を返す。主キーのカラムにはkeyを入れる
+func decodeRecord(schema *Schema, key uint32, record []byte) ([]core.Value, error) {
+	values, err := core.DecodeRecord(record)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) > len(schema.Columns) {
+		return nil, core.ErrMalformedRecord
+	}
+	for len(values) < len(schema.Columns) {
+		values = append(values, core.NullValue())
+	}
+	if schema.PrimaryKey >= 0 {
+		values[schema.PrimaryKey] = core.IntegerValue(int64(key))
+	}
+	return values, nil
+}
@@ -0,0 +1,240 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"toydb-go/core"
+	"toydb-go/persistence"
+	"toydb-go/sql"
+)
+
+type ColumnType int
+
+const (
+	COLUMN_INTEGER ColumnType = iota + 1
+	COLUMN_TEXT
+	COLUMN_REAL
+	COLUMN_BLOB
+)
+
+// 型名とカラムの型の対応
+var columnTypes = map[string]ColumnType{
+	"INTEGER": COLUMN_INTEGER,
+	"INT":     COLUMN_INTEGER,
+	"TEXT":    COLUMN_TEXT,
+	"VARCHAR": COLUMN_TEXT,
+	"CHAR":    COLUMN_TEXT,
+	"REAL":    COLUMN_REAL,
+	"FLOAT":   COLUMN_REAL,
+	"DOUBLE":  COLUMN_REAL,
+	"BLOB":    COLUMN_BLOB,
+}
+
+// 型名からカラムの型を返す。型名は大文字にそろえておく
+func ParseColumnType(name string) (ColumnType, bool) {
+	t, ok := columnTypes[name]
+	return t, ok
+}
+
+// カラムに値を入れられるならtrue。NULLはどの型にも入れられ、REALには整数も入れられる
+func (t ColumnType) Accepts(value core.Value) bool {
+	switch value.Type {
+	case core.VALUE_NULL:
+		return true
+	case core.VALUE_INTEGER:
+		return t == COLUMN_INTEGER || t == COLUMN_REAL
+	case core.VALUE_REAL:
+		return t == COLUMN_REAL
+	case core.VALUE_TEXT:
+		return t == COLUMN_TEXT
+	case core.VALUE_BLOB:
+		return t == COLUMN_BLOB
+	default:
+		return false
+	}
+}
+
+func (t ColumnType) String() string {
+	switch t {
+	case COLUMN_INTEGER:
+		return "INTEGER"
+	case COLUMN_TEXT:
+		return "TEXT"
+	case COLUMN_REAL:
+		return "REAL"
+	case COLUMN_BLOB:
+		return "BLOB"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+type Column struct {
+	Name string
+	Type ColumnType
+	// TEXTとBLOBの最大長（バイト数）。0の場合は制限しない
+	MaxLength int
+	NotNull   bool
+}
+
+// テーブルの定義
+type Schema struct {
+	Name    string
+	Columns []Column
+	// 主キーのカラムのインデックス。主キーがない場合は-1で、行には連番のキーをつける
+	PrimaryKey int
+}
+
+var (
+	ErrNegativeKey   = errors.New("primary key must not be negative")
+	ErrKeyOutOfRange = errors.New("primary key is out of range")
+	ErrStringTooLong = errors.New("string is too long")
+	ErrTypeMismatch  = errors.New("datatype mismatch")
+	ErrNotNull       = errors.New("NOT NULL constraint failed")
+	ErrRowTooLarge   = errors.New("row is too large")
+)
+
+// CREATE TABLE文から、テーブルの定義を作る
+func NewSchema(stmt *sql.CreateTableStmt) (*Schema, error) {
+	schema := &Schema{Name: stmt.Name, PrimaryKey: -1}
+
+	for i, def := range stmt.Columns {
+		if schema.ColumnIndex(def.Name) >= 0 {
+			return nil, fmt.Errorf("duplicate column name: %s", def.Name)
+		}
+		columnType, ok := columnTypes[def.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown column type %s for column %s", def.Type, def.Name)
+		}
+		if def.Length > 0 && columnType != COLUMN_TEXT && columnType != COLUMN_BLOB {
+			return nil, fmt.Errorf("length can only be specified for TEXT and BLOB columns: %s", def.Name)
+		}
+		schema.Columns = append(schema.Columns, Column{
+			Name:      def.Name,
+			Type:      columnType,
+			MaxLength: def.Length,
+			NotNull:   def.NotNull,
+		})
+
+		if def.PrimaryKey {
+			if schema.PrimaryKey >= 0 {
+				return nil, fmt.Errorf("table %s has more than one primary key", stmt.Name)
+			}
+			schema.PrimaryKey = i
+		}
+	}
+
+	if stmt.PrimaryKey != "" {
+		if schema.PrimaryKey >= 0 {
+			return nil, fmt.Errorf("table %s has more than one primary key", stmt.Name)
+		}
+		schema.PrimaryKey = schema.ColumnIndex(stmt.PrimaryKey)
+		if schema.PrimaryKey < 0 {
+			return nil, fmt.Errorf("no such column: %s", stmt.PrimaryKey)
+		}
+	}
+
+	// B-treeのキーは整数なので、主キーはINTEGERに限る
+	if schema.PrimaryKey >= 0 && schema.Columns[schema.PrimaryKey].Type != COLUMN_INTEGER {
+		return nil, fmt.Errorf("primary key must be an INTEGER column: %s", schema.Columns[schema.PrimaryKey].Name)
+	}
+
+	return schema, nil
+}
+
+// カラムのインデックスを返す。カラム名の大文字と小文字は区別しない。見つからない場合は-1
+func (schema *Schema) ColumnIndex(name string) int {
+	for i, column := range schema.Columns {
+		if strings.EqualFold(column.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// テーブルを作るCREATE文を返す。スキーマページにはこの文を保存する
+func (schema *Schema) SQL() string {
+	var b strings.Builder
+	b.WriteString("CREATE TABLE ")
+	b.WriteString(sql.QuoteIdent(schema.Name))
+	b.WriteString(" (")
+	for i, column := range schema.Columns {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(sql.QuoteIdent(column.Name))
+		b.WriteString(" ")
+		b.WriteString(column.Type.String())
+		if column.MaxLength > 0 {
+			b.WriteString("(" + strconv.Itoa(column.MaxLength) + ")")
+		}
+		if i == schema.PrimaryKey {
+			b.WriteString(" PRIMARY KEY")
+		}
+		if column.NotNull {
+			b.WriteString(" NOT NULL")
+		}
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// 行の値がカラムの型と制約を満たすか確認する。REALのカラムに整数を入れた場合など、変換できる値は変換する
+func (schema *Schema) CheckRow(values []core.Value) error {
+	if len(values) != len(schema.Columns) {
+		return fmt.Errorf("table %s has %d columns but %d values were supplied", schema.Name, len(schema.Columns), len(values))
+	}
+
+	for i, column := range schema.Columns {
+		value := values[i]
+		if value.IsNull() {
+			// 主キーがNULLの場合は、挿入するときに連番のキーをつける
+			if column.NotNull && i != schema.PrimaryKey {
+				return fmt.Errorf("%w: %s.%s", ErrNotNull, schema.Name, column.Name)
+			}
+			continue
+		}
+
+		if !column.Type.Accepts(value) {
+			return fmt.Errorf("%w: column %s expects %s, but got %s", ErrTypeMismatch, column.Name, column.Type, value.Type)
+		}
+		if column.Type == COLUMN_REAL && value.Type == core.VALUE_INTEGER {
+			values[i] = core.RealValue(float64(value.Integer))
+		}
+
+		if column.MaxLength > 0 && (len(value.Text) > column.MaxLength || len(value.Blob) > column.MaxLength) {
+			return fmt.Errorf("%w: column %s", ErrStringTooLong, column.Name)
+		}
+		if i == schema.PrimaryKey {
+			if value.Integer < 0 {
+				return ErrNegativeKey
+			}
+			if value.Integer > math.MaxUint32 {
+				return fmt.Errorf("%w: %d", ErrKeyOutOfRange, value.Integer)
+			}
+		}
+	}
+
+	if len(encodeRecord(schema, values)) > persistence.LEAF_NODE_MAX_VALUE_SIZE {
+		return ErrRowTooLarge
+	}
+	return nil
+}
+
+// チュートリアル形式のinsert/selectが使うテーブル。最初にinsertしたときに作る
+const (
+	DEFAULT_TABLE_NAME = "users"
+	DEFAULT_TABLE_SQL  = "CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT(32), email TEXT(256))"
+)
+
+// チュートリアル形式のテーブルを作るCREATE TABLE文を返す
+func DefaultTableStmt() *sql.CreateTableStmt {
+	stmt, err := sql.Parse(DEFAULT_TABLE_SQL)
+	if err != nil {
+		panic(err)
+	}
+	return stmt.(*sql.CreateTableStmt)
+}
@@ -1,44 +1,30 @@
 package table
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"strings"
+	"toydb-go/core"
 	"toydb-go/persistence"
-	"unsafe"
-)
-
-type Row struct {
-	Id       int
-	Username [32]byte
-	Email    [256]byte
-}
-
-const (
-	PAGE_SIZE       = 4096
-	TABLE_MAX_PAGES = 100
-	ROWS_PER_PAGE   = PAGE_SIZE / ROW_SIZE
-	TABLE_MAX_ROWS  = ROWS_PER_PAGE * TABLE_MAX_PAGES
-)
-
-const (
-	ID_OFFSET       = 0
-	USERNAME_OFFSET = ID_OFFSET + int(unsafe.Sizeof(int(0)))
-	EMAIL_OFFSET    = USERNAME_OFFSET + int(unsafe.Sizeof([32]byte{}))
-	ID_SIZE         = int(unsafe.Sizeof(int(0)))
-	USERNAME_SIZE   = int(unsafe.Sizeof([32]byte{}))
-	EMAIL_SIZE      = int(unsafe.Sizeof([256]byte{}))
-	ROW_SIZE        = ID_SIZE + USERNAME_SIZE + EMAIL_SIZE
 )
 
 type Table struct {
-	pager       persistence.Pager
+	pager       *persistence.Pager
 	rootPageNum uint32
+	schema      *Schema
+	// 作成した順に並べたインデックス
+	indexes []*Index
 }
 
-func rowToBytes(row *Row) []byte {
-	bytes := (*[unsafe.Sizeof(Row{})]byte)(unsafe.Pointer(row))
-	return bytes[:]
+// ルートノードのページ番号を返す
+func (table *Table) RootPageNum() uint32 {
+	return table.rootPageNum
+}
+
+// テーブルの定義を返す
+func (table *Table) Schema() *Schema {
+	return table.schema
 }
 
 type InsertResult int
@@ -47,36 +33,221 @@ const (
 	INSERT_SUCCESS InsertResult = iota + 1
 	INSERT_TABLE_FULL
 	INSERT_DUPLICATE_KEY
+	INSERT_ROW_TOO_LARGE
+	INSERT_UNIQUE_VIOLATION
+	INSERT_CORRUPT
 )
 
-// 行を挿入する
-func (table *Table) InsertRow(row *Row) InsertResult {
-	keyToInsert := uint32(row.Id)
-	cursor := TableFind(table, keyToInsert)
-	page := table.pager.GetPage(cursor.PageNum)
+// インデックスの操作のエラーを、InsertResultにする
+func indexInsertResult(err error) InsertResult {
+	switch {
+	case errors.Is(err, ErrUniqueViolation):
+		return INSERT_UNIQUE_VIOLATION
+	case errors.Is(err, ErrRowTooLarge):
+		return INSERT_ROW_TOO_LARGE
+	default:
+		return INSERT_CORRUPT
+	}
+}
+
+// 行を挿入する。valuesはSchema.CheckRowで確認済みのもの。
+// 同じキーの行がある場合は、INSERT_DUPLICATE_KEYを返す。
+// UNIQUEインデックスの値が他の行と重複する場合は、INSERT_UNIQUE_VIOLATIONを返す
+func (table *Table) InsertRow(values []core.Value) InsertResult {
+	defer table.pager.ReleasePages()
+
+	key := table.rowKey(values)
+	record := encodeRecord(table.schema, values)
+	if len(record) > persistence.LEAF_NODE_MAX_VALUE_SIZE {
+		return INSERT_ROW_TOO_LARGE
+	}
+
+	cursor, found := tableFindKey(table, key)
+	if found {
+		return INSERT_DUPLICATE_KEY
+	}
+	if err := table.checkIndexes(values, key); err != nil {
+		return indexInsertResult(err)
+	}
+	page := table.pager.GetPageForWrite(cursor.PageNum)
 
 	persistence.LeafUtil.InsertCell(
-		&table.pager,
+		table.pager,
 		page,
 		cursor.CellNum,
-		uint32(row.Id),
-		rowToBytes(row),
+		key,
+		record,
 		table.rootPageNum,
 	)
+	if err := table.insertIndexEntries(values, key); err != nil {
+		return indexInsertResult(err)
+	}
 	return INSERT_SUCCESS
 }
 
-// 行を取得する
-func (table *Table) GetRowByCursor(pageNum uint32, cellNum uint32) Row {
-	// ページから、Row構造体に書き込む
-	row := &Row{}
-	destinationBytes := (*[unsafe.Sizeof(Row{})]byte)(unsafe.Pointer(row))
+// 行を挿入する。同じキーの行がある場合は、その行を置き換える
+func (table *Table) UpsertRow(values []core.Value) InsertResult {
+	defer table.pager.ReleasePages()
+
+	key := table.rowKey(values)
+	if _, found := tableFindKey(table, key); !found {
+		return table.InsertRow(values)
+	}
+	return table.UpdateRow(key, values)
+}
+
+// キーの行の値を、valuesに置き換える。valuesはSchema.CheckRowで確認済みのもの。
+// 主キーのないテーブルでも、行のキーは変わらない。キーの行がない場合は、INSERT_CORRUPTを返す
+func (table *Table) UpdateRow(key uint32, values []core.Value) InsertResult {
+	defer table.pager.ReleasePages()
+
+	record := encodeRecord(table.schema, values)
+	if len(record) > persistence.LEAF_NODE_MAX_VALUE_SIZE {
+		return INSERT_ROW_TOO_LARGE
+	}
+
+	cursor, found := tableFindKey(table, key)
+	if !found {
+		return INSERT_CORRUPT
+	}
+
+	// 値が変わるインデックスのエントリを、置き換える
+	var changed []*Index
+	if len(table.indexes) > 0 {
+		page := table.pager.GetPage(cursor.PageNum)
+		old, err := decodeRecord(table.schema, key, persistence.LeafUtil.GetCellValue(table.pager, page, cursor.CellNum))
+		if err != nil {
+			return INSERT_CORRUPT
+		}
+		if err := table.checkIndexes(values, key); err != nil {
+			return indexInsertResult(err)
+		}
+		for _, index := range table.indexes {
+			if core.Compare(old[index.column], values[index.column]) != 0 {
+				if err := index.delete(indexEntry{value: old[index.column], key: key}); err != nil {
+					return indexInsertResult(err)
+				}
+				changed = append(changed, index)
+			}
+		}
+	}
+
+	page := table.pager.GetPageForWrite(cursor.PageNum)
+	persistence.LeafUtil.UpdateCellValue(table.pager, page, cursor.CellNum, record, table.rootPageNum)
+	for _, index := range changed {
+		if err := index.insert(indexEntry{value: values[index.column], key: key}); err != nil {
+			return indexInsertResult(err)
+		}
+	}
+	return INSERT_SUCCESS
+}
+
+// 行のキーを返す。主キーがないか、主キーがNULLの場合は、最大のキー+1をキーにして主キーに入れる
+func (table *Table) rowKey(values []core.Value) uint32 {
+	if table.schema.PrimaryKey >= 0 && !values[table.schema.PrimaryKey].IsNull() {
+		return uint32(values[table.schema.PrimaryKey].Integer)
+	}
+
+	key := uint32(1)
+	cursor := TableFind(table, math.MaxUint32)
+	page := table.pager.GetPage(cursor.PageNum)
+	if numCells := persistence.LeafUtil.GetNumCells(page); numCells > 0 {
+		key = persistence.LeafUtil.GetCellKey(page, numCells-1) + 1
+	}
+	if table.schema.PrimaryKey >= 0 {
+		values[table.schema.PrimaryKey] = core.IntegerValue(int64(key))
+	}
+	return key
+}
+
+// キーの行を削除する。行がなかった場合はfalseを返す
+func (table *Table) DeleteRow(key uint32) (bool, error) {
+	defer table.pager.ReleasePages()
+
+	if len(table.indexes) > 0 {
+		row, found, err := table.GetRow(key)
+		if err != nil || !found {
+			return false, err
+		}
+		if err := table.deleteIndexEntries(row, key); err != nil {
+			return false, err
+		}
+	}
+	return persistence.DeleteKey(table.pager, table.rootPageNum, key), nil
+}
+
+// カーソルが指す行を削除して、カーソルを次の行に進める。
+// 削除でリーフノードが結合されるとカーソルの位置がずれるので、削除したキーより後の最初の行を探し直す
+func (table *Table) DeleteRowAtCursor(cursor *Cursor) error {
+	defer table.pager.ReleasePages()
+
+	key := CursorKey(cursor)
+	if len(table.indexes) > 0 {
+		row, err := table.GetRowByCursor(cursor.PageNum, cursor.CellNum)
+		if err != nil {
+			return err
+		}
+		if err := table.deleteIndexEntries(row, key); err != nil {
+			return err
+		}
+	}
+	persistence.DeleteKey(table.pager, table.rootPageNum, key)
+	*cursor = *TableSeek(table, key)
+	return nil
+}
+
+// キーの行があればtrueを返す
+func (table *Table) ContainsKey(key uint32) bool {
+	defer table.pager.ReleasePages()
+
+	_, found := tableFindKey(table, key)
+	return found
+}
+
+// キーのセルを探す。見つからなかった場合は、挿入する位置のカーソルとfalseを返す
+func tableFindKey(table *Table, key uint32) (*Cursor, bool) {
+	cursor := TableFind(table, key)
+	page := table.pager.GetPage(cursor.PageNum)
+	numCells := persistence.LeafUtil.GetNumCells(page)
+
+	if cursor.CellNum < numCells {
+		return cursor, persistence.LeafUtil.GetCellKey(page, cursor.CellNum) == key
+	}
+
+	// リーフノードの末尾の場合は、右隣のリーフノードの先頭にあるかもしれない
+	nextPageNum := persistence.LeafUtil.GetNextLeaf(page)
+	if nextPageNum == 0 {
+		return cursor, false
+	}
+	next := table.pager.GetPage(nextPageNum)
+	if persistence.LeafUtil.GetNumCells(next) > 0 && persistence.LeafUtil.GetCellKey(next, 0) == key {
+		return &Cursor{table: table, PageNum: nextPageNum, CellNum: 0}, true
+	}
+	return cursor, false
+}
+
+// 行を取得する。値はテーブルのカラムの順番に並ぶ
+func (table *Table) GetRowByCursor(pageNum uint32, cellNum uint32) ([]core.Value, error) {
+	defer table.pager.ReleasePages()
 
 	page := table.pager.GetPage(pageNum)
-	srcBytes := persistence.LeafUtil.GetCellValue(page, cellNum)
-	copy(destinationBytes[:], srcBytes)
+	key := persistence.LeafUtil.GetCellKey(page, cellNum)
+	return decodeRecord(table.schema, key, persistence.LeafUtil.GetCellValue(table.pager, page, cellNum))
+}
 
-	return *row
+// 行数を返す。行をデコードせずに、リーフノードをたどってセルの数を合計する
+func (table *Table) CountRows() uint32 {
+	defer table.pager.ReleasePages()
+
+	count := uint32(0)
+	pageNum := TableFind(table, 0).PageNum
+	for {
+		page := table.pager.GetPage(pageNum)
+		count += persistence.LeafUtil.GetNumCells(page)
+		if pageNum = persistence.LeafUtil.GetNextLeaf(page); pageNum == 0 {
+			return count
+		}
+	}
 }
 
 type Cursor struct {
@@ -87,6 +258,8 @@ type Cursor struct {
 }
 
 func TableStart(table *Table) *Cursor {
+	defer table.pager.ReleasePages()
+
 	cursor := TableFind(table, 0)
 	numCells := persistence.LeafUtil.GetNumCells(table.pager.GetPage(cursor.PageNum))
 	if cursor.CellNum == numCells {
@@ -96,8 +269,100 @@ func TableStart(table *Table) *Cursor {
 	return cursor
 }
 
+// キー以上の最初の行を指すカーソルを返す。
+// TableFindと違い、リーフノードの末尾を指す場合は右隣のリーフノードの先頭に進める
+func TableSeek(table *Table, key uint32) *Cursor {
+	defer table.pager.ReleasePages()
+
+	cursor := TableFind(table, key)
+	page := table.pager.GetPage(cursor.PageNum)
+	if cursor.CellNum >= persistence.LeafUtil.GetNumCells(page) {
+		nextPageNum := persistence.LeafUtil.GetNextLeaf(page)
+		if nextPageNum == 0 {
+			cursor.EndOfTable = true
+		} else {
+			cursor.PageNum = nextPageNum
+			cursor.CellNum = 0
+		}
+	}
+	return cursor
+}
+
+// キー以下の最後の行を指すカーソルを返す。そのような行がない場合はEndOfTableになる
+func TableFindLast(table *Table, key uint32) *Cursor {
+	defer table.pager.ReleasePages()
+
+	cursor, found := findLast(table, table.rootPageNum, key)
+	if !found {
+		cursor.EndOfTable = true
+	}
+	return cursor
+}
+
+// ノード以下から、キー以下の最後の行を探す
+func findLast(table *Table, pageNum uint32, key uint32) (*Cursor, bool) {
+	page := table.pager.GetPage(pageNum)
+
+	if persistence.NodeUtil.GetNodeType(page) == persistence.NODE_LEAF {
+		// キーより大きい最初の行の、1つ前の行
+		cursor := leafNodeFind(table, pageNum, key)
+		numCells := persistence.LeafUtil.GetNumCells(page)
+		if cursor.CellNum < numCells && persistence.LeafUtil.GetCellKey(page, cursor.CellNum) == key {
+			return cursor, true
+		}
+		if cursor.CellNum == 0 {
+			return cursor, false
+		}
+		cursor.CellNum--
+		return cursor, true
+	}
+
+	// キー以上の最初の要素が含まれる子ノードから探し、見つからなければ左隣の子ノードから探す。
+	// 左隣の子ノードのキーは全てkeyより小さい
+	numKeys := persistence.InternalUtil.GetNumKeys(page)
+	index := numKeys
+	for i := uint32(0); i < numKeys; i++ {
+		if persistence.InternalUtil.GetKey(page, i) >= key {
+			index = i
+			break
+		}
+	}
+	for i := int(index); i >= 0; i-- {
+		cursor, found := findLast(table, persistence.InternalUtil.GetChild(page, uint32(i)), key)
+		if found || i == 0 {
+			return cursor, found
+		}
+	}
+	panic("unreachable")
+}
+
+// カーソルを1つ戻す。先頭の行より前に戻るとEndOfTableになる
+func CursorRetreat(cursor *Cursor) {
+	if cursor.CellNum > 0 {
+		cursor.CellNum--
+		return
+	}
+
+	// リーフノードは前のリーフノードを持たないので、1つ小さいキーから探し直す
+	key := CursorKey(cursor)
+	if key == 0 {
+		cursor.EndOfTable = true
+		return
+	}
+	*cursor = *TableFindLast(cursor.table, key-1)
+}
+
+// カーソルが指す行のキーを返す
+func CursorKey(cursor *Cursor) uint32 {
+	defer cursor.table.pager.ReleasePages()
+
+	return persistence.LeafUtil.GetCellKey(cursor.table.pager.GetPage(cursor.PageNum), cursor.CellNum)
+}
+
 // キー以上の最初のカーソルを返す
 func TableFind(table *Table, key uint32) *Cursor {
+	defer table.pager.ReleasePages()
+
 	rootNode := table.pager.GetPage(table.rootPageNum)
 
 	if persistence.NodeUtil.GetNodeType(rootNode) == persistence.NODE_LEAF {
@@ -176,6 +441,8 @@ func leafNodeFind(table *Table, pageNum uint32, key uint32) *Cursor {
 
 // カーソルを1つ進める
 func CursorAdvance(cursor *Cursor) {
+	defer cursor.table.pager.ReleasePages()
+
 	page := cursor.table.pager.GetPage(cursor.PageNum)
 	numCells := persistence.LeafUtil.GetNumCells(page)
 	cursor.CellNum += 1
@@ -198,6 +465,12 @@ func indent(level int) string {
 
 // ノードを表示する
 func PrintTree(table *Table, pageNum uint32, depth int) {
+	defer table.pager.ReleasePages()
+
+	printTree(table, pageNum, depth)
+}
+
+func printTree(table *Table, pageNum uint32, depth int) {
 	node := table.pager.GetPage(pageNum)
 
 	switch persistence.NodeUtil.GetNodeType(node) {
@@ -215,14 +488,14 @@ func PrintTree(table *Table, pageNum uint32, depth int) {
 			for i := uint32(0); i < numKeys; i++ {
 				// 子ノードを表示する
 				childPageNum := persistence.InternalUtil.GetChild(node, i)
-				PrintTree(table, childPageNum, depth+1)
+				printTree(table, childPageNum, depth+1)
 
 				// キーを表示する
 				fmt.Printf("%s- key %d\n", indent(depth+1), persistence.InternalUtil.GetKey(node, i))
 			}
 			// 一番右の子ノードを表示する
 			childPageNum := persistence.InternalUtil.GetRightChild(node)
-			PrintTree(table, childPageNum, depth+1)
+			printTree(table, childPageNum, depth+1)
 		}
 	}
 }
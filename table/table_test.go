@@ -1,23 +1,286 @@
 package table
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"toydb-go/core"
+	"toydb-go/sql"
 )
 
+func createTable(t *testing.T, database *Database, query string) *Table {
+	stmt, err := sql.Parse(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := database.CreateTable(stmt.(*sql.CreateTableStmt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
 func TestInsertAndGetRow(t *testing.T) {
-	table := Table{}
+	database, err := DbOpen(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DbClose(database)
+	table := createTable(t, database, DEFAULT_TABLE_SQL)
 
-	row := Row{
-		Id:       1,
-		Username: [32]byte{'t', 'e', 'k', 'i', 'h', 'e', 'i'},
-		Email:    [256]byte{'e', 'm', 'a', 'i', 'l', '@', 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm'},
+	row := []core.Value{
+		core.IntegerValue(1),
+		core.TextValue("tekihei"),
+		core.TextValue("email@example.com"),
 	}
 
-	table.InsertRow(&row)
+	table.InsertRow(row)
 
-	fetchedRow := table.GetRowByCursor(0, 0)
+	fetchedRow, err := table.GetRowByCursor(table.RootPageNum(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !reflect.DeepEqual(fetchedRow, row) {
 		t.Errorf("invalid row. expected: %v, but got: %v", row, fetchedRow)
 	}
 }
+
+func TestRecordRoundTrip(t *testing.T) {
+	stmt, err := sql.Parse("create table t (a integer, b text, c real, d blob, e integer)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := NewSchema(stmt.(*sql.CreateTableStmt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row := []core.Value{
+		core.IntegerValue(-300),
+		core.TextValue("日本語"),
+		core.RealValue(1.5),
+		core.BlobValue([]byte{0, 1, 2}),
+		core.NullValue(),
+	}
+	decoded, err := decodeRecord(schema, 7, encodeRecord(schema, row))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, row) {
+		t.Errorf("expected %v, but got %v", row, decoded)
+	}
+
+	if _, err := decodeRecord(schema, 7, []byte{5, core.RECORD_TEXT, 10}); err == nil {
+		t.Error("expected an error for a truncated record")
+	}
+}
+
+func TestTablesAreReloaded(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	database, err := DbOpen(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	posts := createTable(t, database, `create table "order" (note text not null, score real)`)
+	createTable(t, database, "create table tags (id int, label varchar(16), primary key (id))")
+
+	// 主キーがないテーブルには連番のキーがつく
+	for _, note := range []string{"first", "second"} {
+		if result := posts.InsertRow([]core.Value{core.TextValue(note), core.RealValue(1)}); result != INSERT_SUCCESS {
+			t.Fatalf("insert failed: %d", result)
+		}
+	}
+	if err := database.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	DbClose(database)
+
+	database, err = DbOpen(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DbClose(database)
+
+	if len(database.Tables()) != 2 {
+		t.Fatalf("expected 2 tables, but got %d", len(database.Tables()))
+	}
+	tags, found := database.GetTable("TAGS")
+	if !found {
+		t.Fatal("table tags was not found")
+	}
+	expected := "CREATE TABLE tags (id INTEGER PRIMARY KEY, label TEXT(16))"
+	if actual := tags.Schema().SQL(); actual != expected {
+		t.Errorf("expected %q, but got %q", expected, actual)
+	}
+
+	posts, _ = database.GetTable("order")
+	cursor := TableStart(posts)
+	var notes []string
+	for !cursor.EndOfTable {
+		row, err := posts.GetRowByCursor(cursor.PageNum, cursor.CellNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notes = append(notes, row[0].Text)
+		CursorAdvance(cursor)
+	}
+	if !reflect.DeepEqual(notes, []string{"first", "second"}) {
+		t.Errorf("unexpected rows: %v", notes)
+	}
+
+	if _, err := database.CreateTable(&sql.CreateTableStmt{Name: "Tags"}); err == nil {
+		t.Error("expected an error for a duplicate table")
+	}
+}
+
+func TestCheckRow(t *testing.T) {
+	schema, err := NewSchema(DefaultTableStmt())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		row      []core.Value
+		expected error
+	}{
+		{[]core.Value{core.IntegerValue(-1), core.TextValue("a"), core.TextValue("b")}, ErrNegativeKey},
+		{[]core.Value{core.IntegerValue(1), core.TextValue(string(make([]byte, 33))), core.TextValue("b")}, ErrStringTooLong},
+		{[]core.Value{core.IntegerValue(1), core.IntegerValue(2), core.TextValue("b")}, ErrTypeMismatch},
+		{[]core.Value{core.IntegerValue(1 << 32), core.TextValue("a"), core.TextValue("b")}, ErrKeyOutOfRange},
+	}
+	for _, test := range tests {
+		if err := schema.CheckRow(test.row); !errors.Is(err, test.expected) {
+			t.Errorf("expected %v, but got %v", test.expected, err)
+		}
+	}
+}
+
+func TestCatalogWithManyTables(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	database, err := DbOpen(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// カタログのリーフノードが分割されるくらいテーブルを作る
+	for i := 0; i < 30; i++ {
+		createTable(t, database, fmt.Sprintf("create table t%d (id integer primary key, v%d text)", i, i))
+	}
+	if err := database.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	DbClose(database)
+
+	database, err = DbOpen(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DbClose(database)
+
+	for i := 0; i < 30; i++ {
+		table, found := database.GetTable(fmt.Sprintf("t%d", i))
+		if !found {
+			t.Fatalf("table t%d was not found", i)
+		}
+		if column := table.Schema().Columns[1].Name; column != fmt.Sprintf("v%d", i) {
+			t.Errorf("unexpected column %s for table t%d", column, i)
+		}
+	}
+	if _, found := database.GetTable(CATALOG_TABLE_NAME); !found {
+		t.Error("catalog was not found")
+	}
+}
+
+func TestDeleteRowAtCursor(t *testing.T) {
+	database, err := DbOpen(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DbClose(database)
+	table := createTable(t, database, "create table t (id integer primary key)")
+
+	for i := 1; i <= 28; i++ {
+		table.InsertRow([]core.Value{core.IntegerValue(int64(i))})
+	}
+
+	// 奇数のキーを削除しながら、リーフノードをたどる
+	for cursor := TableStart(table); !cursor.EndOfTable; {
+		if CursorKey(cursor)%2 == 1 {
+			table.DeleteRowAtCursor(cursor)
+		} else {
+			CursorAdvance(cursor)
+		}
+	}
+
+	var keys []uint32
+	for cursor := TableStart(table); !cursor.EndOfTable; CursorAdvance(cursor) {
+		keys = append(keys, CursorKey(cursor))
+	}
+	expected := []uint32{}
+	for i := uint32(2); i <= 28; i += 2 {
+		expected = append(expected, i)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, but got %v", expected, keys)
+	}
+}
+
+func TestCursorRetreat(t *testing.T) {
+	database, err := DbOpen(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DbClose(database)
+	table := createTable(t, database, "create table t (id integer primary key)")
+
+	if cursor := TableFindLast(table, math.MaxUint32); !cursor.EndOfTable {
+		t.Errorf("expected an empty table")
+	}
+	for i := 2; i <= 56; i += 2 {
+		table.InsertRow([]core.Value{core.IntegerValue(int64(i))})
+	}
+
+	// キー以下の最後の行から、リーフノードをまたいで逆向きにたどる
+	var keys []uint32
+	for cursor := TableFindLast(table, 41); !cursor.EndOfTable; CursorRetreat(cursor) {
+		keys = append(keys, CursorKey(cursor))
+	}
+	expected := []uint32{}
+	for i := uint32(40); i >= 2; i -= 2 {
+		expected = append(expected, i)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, but got %v", expected, keys)
+	}
+
+	if cursor := TableFindLast(table, 1); !cursor.EndOfTable {
+		t.Errorf("expected no row before the first key, but got %d", CursorKey(cursor))
+	}
+	if cursor := TableFindLast(table, math.MaxUint32); CursorKey(cursor) != 56 {
+		t.Errorf("expected the last key 56, but got %d", CursorKey(cursor))
+	}
+}
+
+func TestCountRows(t *testing.T) {
+	database, err := DbOpen(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DbClose(database)
+	table := createTable(t, database, "create table t (id integer primary key)")
+
+	if count := table.CountRows(); count != 0 {
+		t.Errorf("expected 0 rows, but got %d", count)
+	}
+	// 複数のリーフノードにまたがる
+	for i := 1; i <= 28; i++ {
+		table.InsertRow([]core.Value{core.IntegerValue(int64(i))})
+	}
+	table.DeleteRow(3)
+	if count := table.CountRows(); count != 27 {
+		t.Errorf("expected 27 rows, but got %d", count)
+	}
+}
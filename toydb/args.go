@@ -0,0 +1,97 @@
+package toydb
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"toydb-go/core"
+	"toydb-go/execute"
+)
+
+// 名前付きのパラメータ（:name、@name、$name）に渡す値
+type NamedArg struct {
+	Name  string
+	Value interface{}
+}
+
+// 名前付きのパラメータに渡す値を作る。名前の先頭の記号は省略できる
+func Named(name string, value interface{}) NamedArg {
+	return NamedArg{Name: name, Value: value}
+}
+
+// 引数を、ステートメントのパラメータにバインドする値にする。名前のない引数は、順番に1から番号をつける
+func bindArgs(args []interface{}) ([]execute.Param, error) {
+	params := make([]execute.Param, len(args))
+	for i, arg := range args {
+		param := execute.Param{Ordinal: i + 1}
+		if named, ok := arg.(NamedArg); ok {
+			param.Name = strings.TrimLeft(named.Name, ":@$")
+			arg = named.Value
+		}
+		v, err := toValue(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		param.Value = v
+		params[i] = param
+	}
+	return params, nil
+}
+
+// Goの値をデータベースの値にする。時刻は、RFC 3339形式の文字列にする
+func toValue(arg interface{}) (core.Value, error) {
+	switch v := arg.(type) {
+	case nil:
+		return core.NullValue(), nil
+	case core.Value:
+		return v, nil
+	case int:
+		return core.IntegerValue(int64(v)), nil
+	case int8:
+		return core.IntegerValue(int64(v)), nil
+	case int16:
+		return core.IntegerValue(int64(v)), nil
+	case int32:
+		return core.IntegerValue(int64(v)), nil
+	case int64:
+		return core.IntegerValue(v), nil
+	case uint:
+		return unsignedValue(uint64(v))
+	case uint8:
+		return core.IntegerValue(int64(v)), nil
+	case uint16:
+		return core.IntegerValue(int64(v)), nil
+	case uint32:
+		return core.IntegerValue(int64(v)), nil
+	case uint64:
+		return unsignedValue(v)
+	case float32:
+		return core.RealValue(float64(v)), nil
+	case float64:
+		return core.RealValue(v), nil
+	case bool:
+		if v {
+			return core.IntegerValue(1), nil
+		}
+		return core.IntegerValue(0), nil
+	case string:
+		return core.TextValue(v), nil
+	case []byte:
+		if v == nil {
+			return core.NullValue(), nil
+		}
+		return core.BlobValue(append([]byte{}, v...)), nil
+	case time.Time:
+		return core.TextValue(v.Format(time.RFC3339Nano)), nil
+	default:
+		return core.Value{}, fmt.Errorf("unsupported type %T", arg)
+	}
+}
+
+func unsignedValue(v uint64) (core.Value, error) {
+	if v > math.MaxInt64 {
+		return core.Value{}, fmt.Errorf("integer %d is out of range", v)
+	}
+	return core.IntegerValue(int64(v)), nil
+}
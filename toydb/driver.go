@@ -0,0 +1,407 @@
+package toydb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"toydb-go/core"
+	"toydb-go/execute"
+)
+
+// database/sqlのドライバ。sql.Open("toydb", path)で、データベースファイルを開く
+type Driver struct{}
+
+func init() {
+	sql.Register("toydb", Driver{})
+}
+
+func (d Driver) Open(name string) (driver.Conn, error) {
+	connector, err := d.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(context.Background())
+}
+
+func (d Driver) OpenConnector(name string) (driver.Connector, error) {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	return &connector{driver: d, path: path}, nil
+}
+
+type connector struct {
+	driver Driver
+	path   string
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	shared, err := acquireDB(c.path)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{shared: shared}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// 同じファイルを複数のページャで開くと壊れてしまうので、同じファイルへの接続は1つのDBを共有する
+type sharedDB struct {
+	path string
+	db   *DB
+	// 共有している接続の数
+	refs int
+	// ステートメントを実行する間と、トランザクションの間、1つの接続だけが持つ。
+	// トランザクションの途中に、他の接続のステートメントが割り込まないようにする
+	session chan struct{}
+}
+
+var sharedDBs = struct {
+	sync.Mutex
+	m map[string]*sharedDB
+}{m: map[string]*sharedDB{}}
+
+// ファイルのDBを返す。まだ開いていなければ開く
+func acquireDB(path string) (*sharedDB, error) {
+	sharedDBs.Lock()
+	defer sharedDBs.Unlock()
+
+	if s, ok := sharedDBs.m[path]; ok {
+		s.refs++
+		return s, nil
+	}
+	d, err := Open(path, Options{})
+	if err != nil {
+		return nil, err
+	}
+	s := &sharedDB{path: path, db: d, refs: 1, session: make(chan struct{}, 1)}
+	sharedDBs.m[path] = s
+	return s, nil
+}
+
+// 接続を閉じる。最後の接続なら、DBを閉じる
+func (s *sharedDB) release() error {
+	sharedDBs.Lock()
+	defer sharedDBs.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(sharedDBs.m, s.path)
+	return s.db.Close()
+}
+
+type conn struct {
+	shared *sharedDB
+	// トランザクションの途中ならtrue。トランザクションの間は、sessionを持ち続ける
+	inTx   bool
+	closed bool
+}
+
+var (
+	_ driver.ConnPrepareContext = (*conn)(nil)
+	_ driver.ConnBeginTx        = (*conn)(nil)
+	_ driver.ExecerContext      = (*conn)(nil)
+	_ driver.QueryerContext     = (*conn)(nil)
+	_ driver.Pinger             = (*conn)(nil)
+)
+
+// sessionを取得して、解放する関数を返す。トランザクションの途中なら、既に持っている
+func (c *conn) lock(ctx context.Context) (func(), error) {
+	if c.inTx {
+		return func() {}, nil
+	}
+	select {
+	case c.shared.session <- struct{}{}:
+		return func() { <-c.shared.session }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ステートメントを実行する。planがnilなら、queryをパースする。
+// contextは、始める前と、SELECT文の結果の行ごとに確認する
+func (c *conn) run(ctx context.Context, query string, plan *execute.Plan, args []driver.NamedValue) (*collector, error) {
+	var result *collector
+	err := c.withSession(ctx, func() error {
+		result = &collector{check: ctx.Err}
+		return c.shared.db.bind(query, plan, namedArgs(args), func(statement core.Statement) error {
+			if err := checkTxStatement(statement); err != nil {
+				return err
+			}
+			return c.shared.db.execute(statement, result)
+		})
+	})
+	return result, err
+}
+
+// トランザクションを始めるか終えるステートメントなら、ErrTxStatementを返す。
+// ステートメントの後にsessionを解放すると、他の接続の書き込みがトランザクションに混ざるので、BeginTxだけで始める
+func checkTxStatement(statement core.Statement) error {
+	switch statement.Type {
+	case core.STATEMENT_BEGIN, core.STATEMENT_COMMIT, core.STATEMENT_ROLLBACK:
+		return ErrTxStatement
+	}
+	return nil
+}
+
+// sessionを持っている間にfnを呼ぶ。contextは、始める前とsessionを待つ間に確認する
+func (c *conn) withSession(ctx context.Context, fn func() error) error {
+	if c.closed {
+		return driver.ErrBadConn
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
+
+// driver.NamedValueを、DBのパラメータの値にする
+func namedArgs(args []driver.NamedValue) []interface{} {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			values[i] = Named(arg.Name, arg.Value)
+		} else {
+			values[i] = arg.Value
+		}
+	}
+	return values
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// ステートメントを準備する。構文エラーはここで返す。他の接続がsessionを持っていれば、contextが終わるまで待つ
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var prepared *Stmt
+	err := c.withSession(ctx, func() error {
+		var err error
+		prepared, err = c.shared.db.Prepare(query)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{conn: c, query: query, plan: prepared.plan}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.exec(ctx, query, nil, args)
+}
+
+func (c *conn) exec(ctx context.Context, query string, plan *execute.Plan, args []driver.NamedValue) (driver.Result, error) {
+	result, err := c.run(ctx, query, plan, args)
+	if err != nil {
+		return nil, err
+	}
+	return execResult{rowsAffected: result.rowsAffected}, nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.query(ctx, query, nil, args)
+}
+
+// ステートメントを実行して、結果の行を返す。SELECT文の行は、driverRows.Nextで1行ずつ読む。
+// 行を読むときはsessionを持たないので、他の接続の書き込むステートメントは、Rowsを閉じるまでErrBusyになる
+func (c *conn) query(ctx context.Context, query string, plan *execute.Plan, args []driver.NamedValue) (driver.Rows, error) {
+	var rows *Rows
+	err := c.withSession(ctx, func() error {
+		return c.shared.db.bind(query, plan, namedArgs(args), func(statement core.Statement) error {
+			if err := checkTxStatement(statement); err != nil {
+				return err
+			}
+			var err error
+			rows, err = c.shared.db.open(statement, ctx.Err)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &driverRows{rows: rows}, nil
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if c.closed {
+		return driver.ErrBadConn
+	}
+	return ctx.Err()
+}
+
+// 接続を閉じる。トランザクションの途中なら、ロールバックする
+func (c *conn) Close() error {
+	if c.closed {
+		return nil
+	}
+	if c.inTx {
+		c.endTx("ROLLBACK")
+	}
+	c.closed = true
+	return c.shared.release()
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// トランザクションを始める。分離レベルは常にSERIALIZABLEで、読み取り専用のトランザクションはない
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	if c.inTx {
+		return nil, errors.New("cannot start a transaction within a transaction")
+	}
+	level := sql.IsolationLevel(opts.Isolation)
+	if level != sql.LevelDefault && level != sql.LevelSerializable {
+		return nil, errors.New("unsupported isolation level: " + level.String())
+	}
+	if opts.ReadOnly {
+		return nil, errors.New("read-only transactions are not supported")
+	}
+
+	unlock, err := c.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.shared.db.Exec("BEGIN"); err != nil {
+		unlock()
+		return nil, err
+	}
+	// COMMITかROLLBACKまで、sessionを持ち続ける
+	c.inTx = true
+	return &tx{conn: c}, nil
+}
+
+// トランザクションを終えて、sessionを解放する
+func (c *conn) endTx(query string) error {
+	_, err := c.shared.db.Exec(query)
+	if err != nil && query == "COMMIT" {
+		// コミットできなかった変更は取り消す
+		c.shared.db.Exec("ROLLBACK")
+	}
+	c.inTx = false
+	<-c.shared.session
+	return err
+}
+
+type tx struct {
+	conn *conn
+	done bool
+}
+
+func (t *tx) Commit() error {
+	return t.end("COMMIT")
+}
+
+func (t *tx) Rollback() error {
+	return t.end("ROLLBACK")
+}
+
+func (t *tx) end(query string) error {
+	if t.done || !t.conn.inTx {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	return t.conn.endTx(query)
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+	plan  *execute.Plan
+}
+
+var (
+	_ driver.StmtExecContext  = (*stmt)(nil)
+	_ driver.StmtQueryContext = (*stmt)(nil)
+)
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+// 名前つきのパラメータがあると、値の数とパラメータの数は一致しないので、確認しない。
+// 値のないパラメータは、実行するときにエラーになる
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.exec(ctx, s.query, s.plan, args)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.query(ctx, s.query, s.plan, args)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+type execResult struct {
+	rowsAffected int64
+}
+
+func (r execResult) LastInsertId() (int64, error) {
+	return 0, errors.New("LastInsertId is not supported")
+}
+
+func (r execResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type driverRows struct {
+	rows *Rows
+}
+
+func (r *driverRows) Columns() []string {
+	return r.rows.Columns()
+}
+
+func (r *driverRows) Close() error {
+	return r.rows.Close()
+}
+
+func (r *driverRows) Next(dest []driver.Value) error {
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	for i, v := range r.rows.Values() {
+		dest[i] = v
+	}
+	return nil
+}
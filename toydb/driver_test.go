@@ -0,0 +1,315 @@
+package toydb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestSQLDB(t *testing.T) *sql.DB {
+	sqlDB, err := sql.Open("toydb", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if _, err := sqlDB.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, score REAL)"); err != nil {
+		t.Fatal(err)
+	}
+	return sqlDB
+}
+
+func queryNames(t *testing.T, sqlDB *sql.DB, query string, args ...interface{}) []string {
+	rows, err := sqlDB.Query(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestDriverParams(t *testing.T) {
+	sqlDB := openTestSQLDB(t)
+
+	result, err := sqlDB.Exec("INSERT INTO users VALUES (?, ?, ?)", 1, "alice", 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		t.Errorf("expected 1 row affected, but got %d (%v)", n, err)
+	}
+	if _, err := sqlDB.Exec("INSERT INTO users VALUES ($1, $2, $1 * 2)", 2, "bob's"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec("INSERT INTO users VALUES (:id, :name, NULL)", sql.Named("name", "carol"), sql.Named("id", 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 値はテキストとして埋め込まないので、クォートを含んでいてもよい
+	if names := queryNames(t, sqlDB, "SELECT name FROM users WHERE name = ?", "bob's"); !reflect.DeepEqual(names, []string{"bob's"}) {
+		t.Errorf("unexpected rows: %v", names)
+	}
+	if names := queryNames(t, sqlDB, "SELECT name FROM users WHERE id > @min ORDER BY id DESC LIMIT ?", sql.Named("min", 1), 5); !reflect.DeepEqual(names, []string{"carol", "bob's"}) {
+		t.Errorf("unexpected rows: %v", names)
+	}
+
+	var score sql.NullFloat64
+	var id int64
+	if err := sqlDB.QueryRow("SELECT id, score FROM users WHERE id = ?", 3).Scan(&id, &score); err != nil {
+		t.Fatal(err)
+	}
+	if id != 3 || score.Valid {
+		t.Errorf("unexpected row: %d %v", id, score)
+	}
+
+	if _, err := sqlDB.Exec("SELECT * FROM users WHERE id = ?"); !errors.Is(err, ErrMissingParam) {
+		t.Errorf("expected a missing parameter error, but got %v", err)
+	}
+	if _, err := sqlDB.Exec("INSERT INTO users VALUES (?, 'dave', NULL)", 1); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("expected ErrDuplicateKey, but got %v", err)
+	}
+}
+
+func TestDriverPreparedStatement(t *testing.T) {
+	sqlDB := openTestSQLDB(t)
+
+	if _, err := sqlDB.Prepare("SELEC 1"); !errors.Is(err, ErrSyntax) {
+		t.Errorf("expected ErrSyntax, but got %v", err)
+	}
+
+	stmt, err := sqlDB.Prepare("INSERT INTO users VALUES (?, ?, NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	for i, name := range []string{"a", "b", "c"} {
+		if _, err := stmt.Exec(i+1, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := queryNames(t, sqlDB, "SELECT name FROM users"); !reflect.DeepEqual(names, []string{"a", "b", "c"}) {
+		t.Errorf("unexpected rows: %v", names)
+	}
+}
+
+func TestDriverTransactions(t *testing.T) {
+	sqlDB := openTestSQLDB(t)
+
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO users VALUES (1, 'kept', NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err = sqlDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO users VALUES (2, 'rolled back', NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := tx.QueryRow("SELECT count(*) FROM users").Scan(&count); err != nil || count != 2 {
+		t.Errorf("expected 2 rows in the transaction, but got %d (%v)", count, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, sql.ErrTxDone) {
+		t.Errorf("expected ErrTxDone, but got %v", err)
+	}
+
+	if names := queryNames(t, sqlDB, "SELECT name FROM users"); !reflect.DeepEqual(names, []string{"kept"}) {
+		t.Errorf("unexpected rows: %v", names)
+	}
+
+	if _, err := sqlDB.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true}); err == nil {
+		t.Error("expected an error for a read-only transaction")
+	}
+}
+
+// 複数の接続から同時に書き込んでも、トランザクションは混ざらない
+func TestDriverConcurrentTransactions(t *testing.T) {
+	sqlDB := openTestSQLDB(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx, err := sqlDB.Begin()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := tx.Exec("INSERT INTO users VALUES (?, 'user', NULL)", i+1); err != nil {
+				errs <- err
+				tx.Rollback()
+				return
+			}
+			// 偶数のトランザクションは取り消す
+			if i%2 == 0 {
+				errs <- tx.Rollback()
+			} else {
+				errs <- tx.Commit()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	if err := sqlDB.QueryRow("SELECT count(*) FROM users WHERE id % 2 = 0").Scan(&count); err != nil || count != 5 {
+		t.Errorf("expected 5 committed rows, but got %d (%v)", count, err)
+	}
+	if err := sqlDB.QueryRow("SELECT count(*) FROM users").Scan(&count); err != nil || count != 5 {
+		t.Errorf("expected 5 rows, but got %d (%v)", count, err)
+	}
+}
+
+// ExecやQueryでBEGINを実行すると、他の接続の書き込みがトランザクションに混ざるので、拒否する
+func TestDriverRejectsTransactionStatements(t *testing.T) {
+	sqlDB := openTestSQLDB(t)
+	ctx := context.Background()
+	c1, err := sqlDB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := sqlDB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	if _, err := c1.ExecContext(ctx, "BEGIN"); !errors.Is(err, ErrTxStatement) {
+		t.Errorf("expected ErrTxStatement, but got %v", err)
+	}
+	if _, err := c2.ExecContext(ctx, "INSERT INTO users VALUES (1, 'alice', NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{"ROLLBACK", "COMMIT"} {
+		if _, err := c1.ExecContext(ctx, query); !errors.Is(err, ErrTxStatement) {
+			t.Errorf("%s: expected ErrTxStatement, but got %v", query, err)
+		}
+	}
+	if _, err := c1.QueryContext(ctx, "BEGIN"); !errors.Is(err, ErrTxStatement) {
+		t.Errorf("expected ErrTxStatement from QueryContext, but got %v", err)
+	}
+
+	// 書き込んだ行は残っていて、BeginTxでトランザクションを始められる
+	var count int
+	if err := c1.QueryRowContext(ctx, "SELECT count(*) FROM users").Scan(&count); err != nil || count != 1 {
+		t.Errorf("expected 1 row, but got %d (%v)", count, err)
+	}
+	tx, err := c1.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDriverContextCancellation(t *testing.T) {
+	sqlDB := openTestSQLDB(t)
+	for i := 1; i <= 10; i++ {
+		if _, err := sqlDB.Exec("INSERT INTO users VALUES (?, 'user', NULL)", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sqlDB.ExecContext(ctx, "DELETE FROM users"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, but got %v", err)
+	}
+
+	// トランザクションを持っている接続があると、他の接続は待つ
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := sqlDB.ExecContext(ctx, "DELETE FROM users")
+		done <- err
+	}()
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, but got %v", err)
+	}
+
+	// 準備するときも、期限が来たら待つのをやめる
+	deadline, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := sqlDB.PrepareContext(deadline, "SELECT * FROM users"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, but got %v", err)
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT count(*) FROM users").Scan(&count); err != nil || count != 10 {
+		t.Errorf("expected 10 rows, but got %d (%v)", count, err)
+	}
+}
+
+// 同じファイルは、OpenとDriverのどちらか1つのDBだけが開ける
+func TestOpenSameFileTwice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	d, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, Options{}); !errors.Is(err, ErrInUse) {
+		t.Errorf("expected ErrInUse, but got %v", err)
+	}
+	sqlDB, err := sql.Open("toydb", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if err := sqlDB.Ping(); !errors.Is(err, ErrInUse) {
+		t.Errorf("expected ErrInUse from the driver, but got %v", err)
+	}
+
+	// 閉じると、ドライバで開ける。ドライバが開いている間は、Openできない
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlDB.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, Options{}); !errors.Is(err, ErrInUse) {
+		t.Errorf("expected ErrInUse, but got %v", err)
+	}
+}
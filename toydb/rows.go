@@ -0,0 +1,209 @@
+package toydb
+
+import (
+	"errors"
+	"fmt"
+	"toydb-go/core"
+	"toydb-go/execute"
+)
+
+// Queryの結果の行。Nextで1行ずつ進めて、ValuesかScanで値を読む
+type Rows struct {
+	columns []string
+	source  rowSource
+	// 現在の行。Nextを呼ぶ前と、行がなくなった後はnil
+	row    []core.Value
+	err    error
+	closed bool
+}
+
+// Rowsが読む行
+type rowSource interface {
+	// 次の行を返す。行がなくなったらnilを返す
+	next() ([]core.Value, error)
+	close()
+}
+
+// 実行し終えたステートメントの、集めておいた行
+type sliceSource struct {
+	rows [][]core.Value
+}
+
+func (s *sliceSource) next() ([]core.Value, error) {
+	if len(s.rows) == 0 {
+		return nil, nil
+	}
+	row := s.rows[0]
+	s.rows = s.rows[1:]
+	return row, nil
+}
+
+func (s *sliceSource) close() {
+	s.rows = nil
+}
+
+// SELECT文の演算子から、1行ずつ読む
+type querySource struct {
+	db    *DB
+	query *execute.Query
+	// nilでなければ、行を読む前に確認して、エラーを返したら読み込みを止める
+	check func() error
+}
+
+func (s *querySource) next() ([]core.Value, error) {
+	if s.check != nil {
+		if err := s.check(); err != nil {
+			return nil, err
+		}
+	}
+	return s.db.next(s.query)
+}
+
+func (s *querySource) close() {
+	s.db.closeQuery(s.query)
+}
+
+// 結果のカラム名を返す。別名があれば別名、なければ式を文字列に戻したもの
+func (r *Rows) Columns() []string {
+	return r.columns
+}
+
+// 次の行に進む。行がないか、読み込みに失敗したらfalseを返して、Rowsを閉じる。失敗した場合のエラーはErrで返す
+func (r *Rows) Next() bool {
+	if r.closed {
+		return false
+	}
+	r.row, r.err = r.source.next()
+	if r.row == nil {
+		r.Close()
+		return false
+	}
+	return true
+}
+
+func (r *Rows) current() ([]core.Value, error) {
+	if r.closed {
+		return nil, errors.New("rows are closed")
+	}
+	if r.row == nil {
+		return nil, errors.New("no current row; call Next first")
+	}
+	return r.row, nil
+}
+
+// 現在の行の値を返す。INTEGERはint64、REALはfloat64、TEXTはstring、BLOBは[]byte、NULLはnilになる
+func (r *Rows) Values() []interface{} {
+	row, err := r.current()
+	if err != nil {
+		return nil
+	}
+	values := make([]interface{}, len(row))
+	for i, v := range row {
+		values[i] = goValue(v)
+	}
+	return values
+}
+
+// 現在の行の値を、destのポインタに順番に読み込む
+func (r *Rows) Scan(dest ...interface{}) error {
+	row, err := r.current()
+	if err != nil {
+		return err
+	}
+	if len(dest) != len(row) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(row), len(dest))
+	}
+	for i, v := range row {
+		if err := scanValue(v, dest[i]); err != nil {
+			return fmt.Errorf("column %d (%s): %w", i, r.columns[i], err)
+		}
+	}
+	return nil
+}
+
+// 行を読んでいる途中に起きたエラーを返す。Nextがfalseを返した後に確認する
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// 行を読むのをやめる。SELECT文の演算子を閉じて、書き込むステートメントを実行できるようにする
+func (r *Rows) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.row = nil
+	r.source.close()
+	return nil
+}
+
+func goValue(v core.Value) interface{} {
+	switch v.Type {
+	case core.VALUE_INTEGER:
+		return v.Integer
+	case core.VALUE_REAL:
+		return v.Real
+	case core.VALUE_TEXT:
+		return v.Text
+	case core.VALUE_BLOB:
+		return append([]byte{}, v.Blob...)
+	default:
+		return nil
+	}
+}
+
+func scanValue(v core.Value, dest interface{}) error {
+	if d, ok := dest.(*interface{}); ok {
+		*d = goValue(v)
+		return nil
+	}
+	if v.IsNull() {
+		return fmt.Errorf("cannot scan NULL into %T", dest)
+	}
+
+	switch d := dest.(type) {
+	case *int64:
+		if v.Type == core.VALUE_INTEGER {
+			*d = v.Integer
+			return nil
+		}
+	case *int:
+		if v.Type == core.VALUE_INTEGER {
+			*d = int(v.Integer)
+			return nil
+		}
+	case *float64:
+		switch v.Type {
+		case core.VALUE_INTEGER:
+			*d = float64(v.Integer)
+			return nil
+		case core.VALUE_REAL:
+			*d = v.Real
+			return nil
+		}
+	case *bool:
+		if v.Type == core.VALUE_INTEGER {
+			*d = v.Integer != 0
+			return nil
+		}
+	case *string:
+		if v.Type == core.VALUE_BLOB {
+			*d = string(v.Blob)
+		} else {
+			*d = v.String()
+		}
+		return nil
+	case *[]byte:
+		switch v.Type {
+		case core.VALUE_BLOB:
+			*d = append([]byte{}, v.Blob...)
+			return nil
+		case core.VALUE_TEXT:
+			*d = []byte(v.Text)
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported Scan destination %T", dest)
+	}
+	return fmt.Errorf("cannot scan %s into %T", v.Type, dest)
+}
@@ -0,0 +1,393 @@
+// toydbは、データベースをGoのプログラムに組み込むためのパッケージ。
+// プロセスを終了したり、標準出力に表示したりせずに、結果とエラーを返す
+package toydb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"toydb-go/core"
+	"toydb-go/execute"
+	"toydb-go/persistence"
+	db "toydb-go/table"
+)
+
+type Options struct {
+	// キャッシュするページ数の上限（0の場合はデフォルト値）
+	CachePages int
+}
+
+// errors.Isで判定できるエラー
+var (
+	ErrSyntax          = errors.New("syntax error")
+	ErrNoSuchTable     = errors.New("no such table")
+	ErrNoSuchColumn    = errors.New("no such column")
+	ErrDuplicateKey    = errors.New("duplicate key")
+	ErrTableFull       = errors.New("table is full")
+	ErrClosed          = errors.New("database is closed")
+	ErrBusy            = errors.New("database is busy: close the open Rows before writing")
+	ErrInUse           = errors.New("database file is already open")
+	ErrTxStatement     = errors.New("BEGIN, COMMIT and ROLLBACK are not allowed through database/sql: use BeginTx")
+	ErrMissingParam    = execute.ErrMissingParam
+	ErrTypeMismatch    = db.ErrTypeMismatch
+	ErrCorrupt         = persistence.ErrCorrupt
+	ErrUniqueViolation = db.ErrUniqueViolation
+	ErrRowTooLarge     = db.ErrRowTooLarge
+	ErrSchemaTooLong   = db.ErrSchemaTooLong
+)
+
+// 詳細なエラーに、errors.Isで判定できる種類をつける。メッセージは詳細なエラーのものを使う
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// errにkindの種類をつける。errがnilならkindを返す
+func withKind(kind error, err error) error {
+	if err == nil {
+		return kind
+	}
+	if errors.Is(err, kind) {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// 開いているデータベース。複数のゴルーチンから使えるが、ステートメントは1つずつ実行する
+type DB struct {
+	mu sync.Mutex
+	// 開いたファイルの絶対パス。閉じるときに、openPathsから取り除く
+	path     string
+	database *db.Database
+	// PREPARE文で準備したステートメントと、パースしたステートメントのキャッシュ
+	session *execute.Session
+	// ページの読み書きに失敗したときのエラー。失敗した後はキャッシュを信用できないので、このエラーを返し続ける
+	err error
+	// 開いているRowsの数。Rowsの演算子のカーソルが壊れないように、開いている間は書き込むステートメントを実行しない
+	openRows int
+}
+
+// 開いているデータベースファイルの絶対パス。同じファイルを2つのページャで開くと、
+// それぞれのキャッシュとWALが食い違ってファイルが壊れるので、1つのファイルは1つのDBだけが開ける。
+// database/sqlのドライバも、ファイルごとに1つのDBをOpenで開く
+var openPaths = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+// データベースファイルを開く。ファイルがなければ作る。
+// このプロセスで既に開いているファイル（sql.Openで開いたものを含む）は、ErrInUseになる
+func Open(path string, opts Options) (d *DB, err error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	openPaths.Lock()
+	defer openPaths.Unlock()
+	if openPaths.m[abs] {
+		return nil, fmt.Errorf("%w: %s", ErrInUse, abs)
+	}
+
+	defer persistence.RecoverPagerError(&err)
+	database, err := db.DbOpenWithOptions(abs, db.Options{CachePages: opts.CachePages})
+	if err != nil {
+		return nil, err
+	}
+	openPaths.m[abs] = true
+	return &DB{path: abs, database: database, session: execute.NewSession(database)}, nil
+}
+
+// データベースを閉じる。トランザクションの途中なら、コミットせずにロールバックする
+func (d *DB) Close() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.database == nil {
+		return ErrClosed
+	}
+	database := d.database
+	d.database = nil
+	// 閉じられなかった場合も、ページャを捨てるので、同じファイルを開き直せる
+	defer func() {
+		openPaths.Lock()
+		delete(openPaths.m, d.path)
+		openPaths.Unlock()
+	}()
+	if d.err != nil {
+		db.DbAbandon(database)
+		return nil
+	}
+
+	defer func() {
+		if err != nil {
+			db.DbAbandon(database)
+		}
+	}()
+	defer persistence.RecoverPagerError(&err)
+	return db.DbClose(database)
+}
+
+// ステートメントの結果
+type Result struct {
+	// INSERT文、UPDATE文、DELETE文で書き込んだ行数
+	RowsAffected int64
+}
+
+// 結果を返さないステートメントを実行する。SELECT文の結果は捨てる。
+// argsは、ステートメントのパラメータに順番にバインドする。名前付きのパラメータには、Namedで名前をつけて渡す
+func (d *DB) Exec(query string, args ...interface{}) (Result, error) {
+	var c collector
+	if err := d.run(query, nil, args, &c); err != nil {
+		return Result{}, err
+	}
+	return Result{RowsAffected: c.rowsAffected}, nil
+}
+
+// ステートメントを実行して、結果の行を返す。SELECT文は、Rows.Nextを呼ぶたびに1行ずつ実行する。
+// Rowsを開いている間は、書き込むステートメントはErrBusyになる。全ての行を読むか、Closeすると書き込める。
+// argsはExecと同じように、ステートメントのパラメータにバインドする
+func (d *DB) Query(query string, args ...interface{}) (*Rows, error) {
+	return d.query(query, nil, args, nil)
+}
+
+// パースしたステートメント。パラメータに値をバインドして、何度でも実行できる
+type Stmt struct {
+	db    *DB
+	query string
+	plan  *execute.Plan
+}
+
+// ステートメントをパースする。構文エラーはここで返し、パラメータの値の型は実行するときに確認する
+func (d *DB) Prepare(query string) (*Stmt, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.database == nil {
+		return nil, ErrClosed
+	}
+	plan, result, err := d.session.Prepare(query)
+	if result != execute.PREPARE_SUCCESS {
+		return nil, prepareError(result, err, query)
+	}
+	return &Stmt{db: d, query: query, plan: plan}, nil
+}
+
+// パラメータの数（最大の番号）を返す
+func (s *Stmt) NumParams() int {
+	return s.plan.NumParams()
+}
+
+// DB.Execと同じように、ステートメントを実行する
+func (s *Stmt) Exec(args ...interface{}) (Result, error) {
+	var c collector
+	if err := s.db.run(s.query, s.plan, args, &c); err != nil {
+		return Result{}, err
+	}
+	return Result{RowsAffected: c.rowsAffected}, nil
+}
+
+// DB.Queryと同じように、ステートメントを実行して、結果の行を返す
+func (s *Stmt) Query(args ...interface{}) (*Rows, error) {
+	return s.db.query(s.query, s.plan, args, nil)
+}
+
+// 結果を集めるexecute.Output
+type collector struct {
+	// nilでなければ、行を受け取るたびに確認して、エラーを返したら読み込みを止める
+	check        func() error
+	keepRows     bool
+	columns      []string
+	rows         [][]core.Value
+	rowsAffected int64
+}
+
+func (c *collector) Row(values []core.Value) error {
+	if c.check != nil {
+		if err := c.check(); err != nil {
+			return err
+		}
+	}
+	if c.keepRows {
+		c.rows = append(c.rows, append([]core.Value{}, values...))
+	}
+	return nil
+}
+
+func (c *collector) RowsAffected(n int) {
+	c.rowsAffected += int64(n)
+}
+
+// ステートメントを準備して実行する。planがnilなら、queryをパースする（キャッシュがあればキャッシュを使う）
+func (d *DB) run(query string, plan *execute.Plan, args []interface{}, c *collector) error {
+	return d.bind(query, plan, args, func(statement core.Statement) error {
+		return d.execute(statement, c)
+	})
+}
+
+// ステートメントを準備して、結果の行を返す。SELECT文は演算子を開くだけで、行はRows.Nextで1行ずつ読む。
+// それ以外のステートメントは実行して、結果の行を集める。checkがnilでなければ、行を読む前に確認する
+func (d *DB) query(query string, plan *execute.Plan, args []interface{}, check func() error) (rows *Rows, err error) {
+	err = d.bind(query, plan, args, func(statement core.Statement) error {
+		rows, err = d.open(statement, check)
+		return err
+	})
+	return rows, err
+}
+
+// バインドしたステートメントの、結果の行を返す。ロックを取った状態で呼ぶ
+func (d *DB) open(statement core.Statement, check func() error) (*Rows, error) {
+	if statement.Type != core.STATEMENT_SELECT || statement.Explain != 0 {
+		c := collector{check: check, keepRows: true}
+		if err := d.execute(statement, &c); err != nil {
+			return nil, err
+		}
+		return &Rows{columns: c.columns, source: &sliceSource{rows: c.rows}}, nil
+	}
+
+	q, err := execute.OpenQuery(statement, d.database)
+	if err != nil {
+		return nil, err
+	}
+	d.openRows++
+	return &Rows{columns: statement.ColumnNames, source: &querySource{db: d, query: q, check: check}}, nil
+}
+
+// ステートメントを準備して、パラメータをバインドしてから、fnを呼ぶ。fnはロックを取った状態で呼ぶ
+func (d *DB) bind(query string, plan *execute.Plan, args []interface{}, fn func(statement core.Statement) error) (err error) {
+	params, err := bindArgs(args)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.usable(); err != nil {
+		return err
+	}
+	defer d.keepPagerError(&err)
+	defer persistence.RecoverPagerError(&err)
+
+	var prepareResult execute.PrepareResult
+	if plan == nil {
+		if plan, prepareResult, err = d.session.Prepare(query); prepareResult != execute.PREPARE_SUCCESS {
+			return prepareError(prepareResult, err, query)
+		}
+	}
+	var statement core.Statement
+	if prepareResult, err = d.session.Bind(plan, params, &statement); prepareResult != execute.PREPARE_SUCCESS {
+		return prepareError(prepareResult, err, query)
+	}
+	if d.openRows > 0 && !execute.IsReadOnly(statement) {
+		return ErrBusy
+	}
+	return fn(statement)
+}
+
+// ステートメントを実行して、結果をcに集める
+func (d *DB) execute(statement core.Statement, c *collector) error {
+	c.columns = statement.ColumnNames
+	executeResult, err := execute.ExecuteStatement(statement, d.database, c)
+	if executeResult != execute.EXECUTE_SUCCESS {
+		return executeError(executeResult, err)
+	}
+	return nil
+}
+
+// データベースを使えるか確認する。呼び出し側はロックを取っておく
+func (d *DB) usable() error {
+	if d.database == nil {
+		return ErrClosed
+	}
+	return d.err
+}
+
+// deferで呼び出して、ページの読み書きに失敗したエラーを覚えておく
+func (d *DB) keepPagerError(err *error) {
+	var pagerErr *persistence.PagerError
+	if errors.As(*err, &pagerErr) {
+		d.err = *err
+	}
+}
+
+// Rowsの次の行を読む。行がなくなったらnilを返す
+func (d *DB) next(q *execute.Query) (values []core.Value, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.usable(); err != nil {
+		return nil, err
+	}
+	defer d.keepPagerError(&err)
+	defer persistence.RecoverPagerError(&err)
+
+	values, err = q.Next()
+	if values != nil {
+		values = append([]core.Value{}, values...)
+	}
+	return values, err
+}
+
+// Rowsの演算子を閉じて、書き込むステートメントを実行できるようにする
+func (d *DB) closeQuery(q *execute.Query) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	q.Close()
+	d.openRows--
+}
+
+func prepareError(result execute.PrepareResult, err error, query string) error {
+	switch result {
+	case execute.PREPARE_UNRECOGNIZED_STATEMENT:
+		return fmt.Errorf("%w: unrecognized keyword at start of '%s'", ErrSyntax, query)
+	case execute.PREPARE_SYNTAX_ERROR:
+		return fmt.Errorf("%w: %s", ErrSyntax, err.Error())
+	case execute.PREPARE_NO_SUCH_TABLE:
+		return withKind(ErrNoSuchTable, err)
+	case execute.PREPARE_NO_SUCH_COLUMN:
+		return withKind(ErrNoSuchColumn, err)
+	default:
+		if err == nil {
+			return fmt.Errorf("could not prepare statement (result %d)", result)
+		}
+		return err
+	}
+}
+
+func executeError(result execute.ExecuteResult, err error) error {
+	switch result {
+	case execute.EXECUTE_TABLE_FULL:
+		return withKind(ErrTableFull, err)
+	case execute.EXECUTE_DUPLICATE_KEY:
+		return withKind(ErrDuplicateKey, err)
+	case execute.EXECUTE_ROW_TOO_LARGE:
+		return withKind(ErrRowTooLarge, err)
+	case execute.EXECUTE_SCHEMA_TOO_LONG:
+		return withKind(ErrSchemaTooLong, err)
+	case execute.EXECUTE_CORRUPT:
+		return withKind(ErrCorrupt, err)
+	case execute.EXECUTE_UNIQUE_VIOLATION:
+		return withKind(ErrUniqueViolation, err)
+	case execute.EXECUTE_COMMIT_FAILED:
+		return fmt.Errorf("could not commit: %w", err)
+	default:
+		if err == nil {
+			return fmt.Errorf("could not execute statement (result %d)", result)
+		}
+		return err
+	}
+}
@@ -0,0 +1,313 @@
+package toydb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openTestDB(t *testing.T) (*DB, string) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	d, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, path
+}
+
+func mustExec(t *testing.T, d *DB, query string) Result {
+	result, err := d.Exec(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return result
+}
+
+func TestExecAndQuery(t *testing.T) {
+	d, _ := openTestDB(t)
+	defer d.Close()
+
+	mustExec(t, d, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, score REAL)")
+	if result := mustExec(t, d, "INSERT INTO users VALUES (1, 'alice', 1.5)"); result.RowsAffected != 1 {
+		t.Errorf("expected 1 row affected, but got %d", result.RowsAffected)
+	}
+	mustExec(t, d, "INSERT INTO users VALUES (2, 'bob', NULL)")
+	mustExec(t, d, "INSERT INTO users VALUES (3, 'carol', 3)")
+	if result := mustExec(t, d, "UPDATE users SET score = 2 WHERE id >= 2"); result.RowsAffected != 2 {
+		t.Errorf("expected 2 rows affected, but got %d", result.RowsAffected)
+	}
+
+	rows, err := d.Query("SELECT id, name AS n, score * 2 FROM users ORDER BY id DESC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	if columns := rows.Columns(); !reflect.DeepEqual(columns, []string{"id", "n", "score * 2"}) {
+		t.Errorf("unexpected columns: %v", columns)
+	}
+	var got [][]interface{}
+	for rows.Next() {
+		got = append(got, rows.Values())
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]interface{}{
+		{int64(3), "carol", 4.0},
+		{int64(2), "bob", 4.0},
+		{int64(1), "alice", 3.0},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, but got %v", expected, got)
+	}
+}
+
+// SELECT文の行は、Nextを呼ぶたびに1行ずつ読む。途中で起きたエラーは、Errで返す
+func TestQueryStreamsRows(t *testing.T) {
+	d, _ := openTestDB(t)
+	defer d.Close()
+
+	mustExec(t, d, "CREATE TABLE t (id INTEGER PRIMARY KEY, s TEXT)")
+	mustExec(t, d, "INSERT INTO t VALUES (1, NULL)")
+	mustExec(t, d, "INSERT INTO t VALUES (2, NULL)")
+	mustExec(t, d, "INSERT INTO t VALUES (3, 'x')")
+
+	// 3行目で初めて評価に失敗する
+	rows, err := d.Query("SELECT id, -s FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var v interface{}
+		if err := rows.Scan(&id, &v); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if !reflect.DeepEqual(ids, []int64{1, 2}) {
+		t.Errorf("expected [1 2], but got %v", ids)
+	}
+	if err := rows.Err(); err == nil || err.Error() != "datatype mismatch: cannot negate TEXT" {
+		t.Errorf("expected a type mismatch from Err, but got %v", err)
+	}
+
+	// Rowsを開いている間は、読むステートメントだけを実行できる
+	rows, err = d.Query("SELECT id FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatal("expected a row")
+	}
+	if _, err := d.Exec("SELECT count(*) FROM t"); err != nil {
+		t.Errorf("could not read while rows are open: %v", err)
+	}
+	if _, err := d.Exec("DELETE FROM t WHERE id = 1"); !errors.Is(err, ErrBusy) {
+		t.Errorf("expected ErrBusy, but got %v", err)
+	}
+	// 途中でやめると、書き込める
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if result := mustExec(t, d, "DELETE FROM t WHERE id = 1"); result.RowsAffected != 1 {
+		t.Errorf("expected 1 row affected, but got %d", result.RowsAffected)
+	}
+
+	// 全ての行を読むと、Closeを呼ばなくても書き込める
+	rows, err = d.Query("SELECT id FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+	}
+	mustExec(t, d, "DELETE FROM t WHERE id = 2")
+}
+
+func TestScan(t *testing.T) {
+	d, _ := openTestDB(t)
+	defer d.Close()
+
+	mustExec(t, d, "CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT, data BLOB, note TEXT)")
+	mustExec(t, d, "INSERT INTO t VALUES (7, 'x', X'0102', NULL)")
+
+	rows, err := d.Query("SELECT * FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rows.Scan(new(int64)); err == nil {
+		t.Error("expected an error when scanning before Next")
+	}
+	if !rows.Next() {
+		t.Fatal("expected a row")
+	}
+
+	var id int
+	var name string
+	var data []byte
+	var note interface{}
+	if err := rows.Scan(&id, &name, &data, &note); err != nil {
+		t.Fatal(err)
+	}
+	if id != 7 || name != "x" || !reflect.DeepEqual(data, []byte{1, 2}) || note != nil {
+		t.Errorf("unexpected values: %d %q %v %v", id, name, data, note)
+	}
+
+	if err := rows.Scan(&id, &name, &data, &name); err == nil {
+		t.Error("expected an error when scanning NULL into *string")
+	}
+	if err := rows.Scan(&id); err == nil {
+		t.Error("expected an error for the wrong number of destinations")
+	}
+	if rows.Next() {
+		t.Error("expected no more rows")
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	d, _ := openTestDB(t)
+	defer d.Close()
+
+	mustExec(t, d, "CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT)")
+	mustExec(t, d, "CREATE UNIQUE INDEX t_name ON t (name)")
+	mustExec(t, d, "INSERT INTO t VALUES (1, 'a')")
+
+	cases := []struct {
+		query    string
+		expected error
+	}{
+		{"SELEC * FROM t", ErrSyntax},
+		{"SELECT * FROM", ErrSyntax},
+		{"SELECT * FROM missing", ErrNoSuchTable},
+		{"SELECT missing FROM t", ErrNoSuchColumn},
+		{"INSERT INTO t VALUES (1, 'b')", ErrDuplicateKey},
+		{"INSERT INTO t VALUES (2, 'a')", ErrUniqueViolation},
+	}
+	for _, c := range cases {
+		_, err := d.Exec(c.query)
+		if !errors.Is(err, c.expected) {
+			t.Errorf("%s: expected %v, but got %v", c.query, c.expected, err)
+		}
+	}
+
+	// 失敗したステートメントは何も書き込まない
+	rows, err := d.Query("SELECT count(*) FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if !rows.Next() || rows.Scan(&count) != nil || count != 1 {
+		t.Errorf("expected 1 row, but got %d", count)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	d, path := openTestDB(t)
+
+	mustExec(t, d, "CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT)")
+	mustExec(t, d, "BEGIN")
+	mustExec(t, d, "INSERT INTO t VALUES (1, 'kept')")
+	mustExec(t, d, "COMMIT")
+	mustExec(t, d, "BEGIN")
+	mustExec(t, d, "INSERT INTO t VALUES (2, 'rolled back')")
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Exec("SELECT * FROM t"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, but got %v", err)
+	}
+
+	d, err := Open(path, Options{CachePages: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	rows, err := d.Query("SELECT name FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if !reflect.DeepEqual(names, []string{"kept"}) {
+		t.Errorf("unexpected rows: %v", names)
+	}
+}
+
+func TestOpenCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(path, []byte("not a database"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, Options{}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, but got %v", err)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	d, _ := openTestDB(t)
+	defer d.Close()
+	mustExec(t, d, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, score REAL)")
+
+	if _, err := d.Prepare("SELECT * FROM"); !errors.Is(err, ErrSyntax) {
+		t.Errorf("expected ErrSyntax, but got %v", err)
+	}
+
+	insert, err := d.Prepare("INSERT INTO users VALUES ($1, $2, $1 * 1.5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := insert.NumParams(); n != 2 {
+		t.Errorf("expected 2 parameters, but got %d", n)
+	}
+	for i, name := range []string{"alice", "bob", "carol"} {
+		if _, err := insert.Exec(i+1, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := insert.Exec("4", "dave"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected ErrTypeMismatch, but got %v", err)
+	}
+	if _, err := insert.Exec(4, "dave", 5); err == nil {
+		t.Error("expected an error for too many values")
+	}
+
+	query, err := d.Prepare("SELECT name FROM users WHERE id > ? ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := query.Query(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if !reflect.DeepEqual(names, []string{"bob", "carol"}) {
+		t.Errorf("unexpected rows: %v", names)
+	}
+
+	// PREPARE文で準備したステートメントも、同じDBで実行できる
+	mustExec(t, d, "PREPARE remove (INTEGER) AS DELETE FROM users WHERE id = $1")
+	if result, err := d.Exec("EXECUTE remove(?)", 2); err != nil || result.RowsAffected != 1 {
+		t.Errorf("expected 1 row affected, but got %d (%v)", result.RowsAffected, err)
+	}
+	if _, err := d.Exec("EXECUTE remove('x')"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected ErrTypeMismatch, but got %v", err)
+	}
+}